@@ -0,0 +1,355 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const maxAddresses = 20
+
+// Address is a shipping address kept on the user. Orders get a copy, so
+// editing an address never changes where past orders were sent.
+type Address struct {
+	ID         primitive.ObjectID `json:"id" bson:"_id"`
+	Label      string             `json:"label,omitempty" bson:"label,omitempty"`
+	Line1      string             `json:"line1" bson:"line1"`
+	Line2      string             `json:"line2,omitempty" bson:"line2,omitempty"`
+	City       string             `json:"city" bson:"city"`
+	PostalCode string             `json:"postal_code" bson:"postal_code"`
+	// Country is an ISO 3166-1 alpha-2 code such as "DE".
+	Country   string `json:"country" bson:"country"`
+	IsDefault bool   `json:"is_default" bson:"is_default"`
+}
+
+type addressInput struct {
+	Label      string `json:"label"`
+	Line1      string `json:"line1"`
+	Line2      string `json:"line2"`
+	City       string `json:"city"`
+	PostalCode string `json:"postal_code"`
+	Country    string `json:"country"`
+	IsDefault  bool   `json:"is_default"`
+}
+
+func (in *addressInput) validate() []fieldError {
+	in.Label = strings.TrimSpace(in.Label)
+	in.Line1 = strings.TrimSpace(in.Line1)
+	in.Line2 = strings.TrimSpace(in.Line2)
+	in.City = strings.TrimSpace(in.City)
+	in.PostalCode = strings.TrimSpace(in.PostalCode)
+	in.Country = strings.ToUpper(strings.TrimSpace(in.Country))
+
+	var v validator
+	v.required("line1", in.Line1)
+	v.required("city", in.City)
+	v.required("postal_code", in.PostalCode)
+	if v.required("country", in.Country) {
+		ok := len(in.Country) == 2 && strings.Trim(in.Country, "ABCDEFGHIJKLMNOPQRSTUVWXYZ") == ""
+		v.check(ok, "country", ruleFormat, "country must be a two-letter ISO 3166 code")
+	}
+	return v.errs
+}
+
+func (in addressInput) fields() bson.M {
+	return bson.M{
+		"label":       in.Label,
+		"line1":       in.Line1,
+		"line2":       in.Line2,
+		"city":        in.City,
+		"postal_code": in.PostalCode,
+		"country":     in.Country,
+	}
+}
+
+func (user User) address(id primitive.ObjectID) *Address {
+	for i := range user.Addresses {
+		if user.Addresses[i].ID == id {
+			return &user.Addresses[i]
+		}
+	}
+	return nil
+}
+
+// withDefaultAddress returns a copy of addresses in which only id is the
+// default.
+func withDefaultAddress(addresses []Address, id primitive.ObjectID) []Address {
+	updated := make([]Address, len(addresses))
+	for i, address := range addresses {
+		address.IsDefault = address.ID == id
+		updated[i] = address
+	}
+	return updated
+}
+
+// handleAddresses lists (GET), adds (POST), edits (PATCH) and removes
+// (DELETE) the addresses of the user ?id=; PATCH and DELETE name the address
+// with ?address_id=. Edits go through positional updates on the one address,
+// so changes to different addresses never overwrite each other.
+func handleAddresses(w http.ResponseWriter, r *http.Request) {
+	userID, ok := parseObjectID(w, r)
+	if !ok {
+		return
+	}
+	if !authorizeUser(w, r, userID) {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		listAddresses(w, r, userID)
+	case http.MethodPost:
+		addAddress(w, r, userID)
+	case http.MethodPatch:
+		updateAddress(w, r, userID)
+	case http.MethodDelete:
+		deleteAddress(w, r, userID)
+	default:
+		writeJSONError(w, http.StatusMethodNotAllowed, "Method not allowed")
+	}
+}
+
+func addressID(w http.ResponseWriter, r *http.Request) (primitive.ObjectID, bool) {
+	id, err := primitive.ObjectIDFromHex(r.URL.Query().Get("address_id"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidID, "address_id must be a valid ID")
+		return id, false
+	}
+	return id, true
+}
+
+func decodeAddressInput(w http.ResponseWriter, r *http.Request) (addressInput, bool) {
+	var in addressInput
+	if !decodeJSON(w, r, &in) {
+		return in, false
+	}
+	if errs := in.validate(); len(errs) > 0 {
+		writeValidationErrors(w, "Address is invalid", errs)
+		return in, false
+	}
+	return in, true
+}
+
+func writeAddresses(w http.ResponseWriter, status int, addresses []Address) {
+	if addresses == nil {
+		addresses = []Address{}
+	}
+	writeJSON(w, status, addresses)
+}
+
+func listAddresses(w http.ResponseWriter, r *http.Request, userID primitive.ObjectID) {
+	var user User
+	opts := options.FindOne().SetProjection(bson.M{"addresses": 1})
+	err := database.Collection(collectionName).FindOne(r.Context(), activeUserByID(userID), opts).Decode(&user)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		writeJSONError(w, http.StatusNotFound, "User not found")
+		return
+	}
+	if err != nil {
+		fmt.Println("Error loading addresses:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to load addresses")
+		return
+	}
+	writeAddresses(w, http.StatusOK, user.Addresses)
+}
+
+// addAddress appends an address. The user's first address becomes the
+// default whether or not it was asked for.
+func addAddress(w http.ResponseWriter, r *http.Request, userID primitive.ObjectID) {
+	in, ok := decodeAddressInput(w, r)
+	if !ok {
+		return
+	}
+	address := Address{
+		ID:         primitive.NewObjectID(),
+		Label:      in.Label,
+		Line1:      in.Line1,
+		Line2:      in.Line2,
+		City:       in.City,
+		PostalCode: in.PostalCode,
+		Country:    in.Country,
+	}
+
+	filter := activeUserByID(userID)
+	filter["addresses."+fmt.Sprint(maxAddresses-1)] = bson.M{"$exists": false}
+	var before User
+	err := database.Collection(collectionName).FindOneAndUpdate(r.Context(),
+		filter,
+		bson.M{"$push": bson.M{"addresses": address}, "$set": bson.M{"updated_at": time.Now()}},
+	).Decode(&before)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		exists, err := userExists(r.Context(), userID)
+		if err != nil {
+			fmt.Println("Error looking up user:", err)
+			writeJSONError(w, http.StatusInternalServerError, "Failed to add address")
+			return
+		}
+		if !exists {
+			writeJSONError(w, http.StatusNotFound, "User not found")
+			return
+		}
+		writeJSONError(w, http.StatusConflict, fmt.Sprintf("A user can have at most %d addresses", maxAddresses))
+		return
+	}
+	if err != nil {
+		fmt.Println("Error adding address:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to add address")
+		return
+	}
+	after := before
+	after.Addresses = append(append([]Address{}, before.Addresses...), address)
+	recordUserAudit(r, auditUpdate, userID, &before, &after)
+
+	if in.IsDefault || len(before.Addresses) == 0 {
+		setDefaultAddress(w, r, userID, address.ID, http.StatusCreated)
+		return
+	}
+	writeAddresses(w, http.StatusCreated, after.Addresses)
+}
+
+// updateAddress replaces the fields of one address; whether it is the
+// default is changed through /users/addresses/default instead.
+func updateAddress(w http.ResponseWriter, r *http.Request, userID primitive.ObjectID) {
+	id, ok := addressID(w, r)
+	if !ok {
+		return
+	}
+	in, ok := decodeAddressInput(w, r)
+	if !ok {
+		return
+	}
+
+	set := bson.M{"updated_at": time.Now()}
+	for field, value := range in.fields() {
+		set["addresses.$[address]."+field] = value
+	}
+	filter := activeUserByID(userID)
+	filter["addresses._id"] = id
+	var before User
+	err := database.Collection(collectionName).FindOneAndUpdate(r.Context(),
+		filter,
+		bson.M{"$set": set},
+		options.FindOneAndUpdate().SetArrayFilters(options.ArrayFilters{
+			Filters: []interface{}{bson.M{"address._id": id}},
+		}),
+	).Decode(&before)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		writeJSONError(w, http.StatusNotFound, "Address not found")
+		return
+	}
+	if err != nil {
+		fmt.Println("Error updating address:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to update address")
+		return
+	}
+
+	after := before
+	after.Addresses = append([]Address{}, before.Addresses...)
+	if address := after.address(id); address != nil {
+		*address = Address{
+			ID:         id,
+			Label:      in.Label,
+			Line1:      in.Line1,
+			Line2:      in.Line2,
+			City:       in.City,
+			PostalCode: in.PostalCode,
+			Country:    in.Country,
+			IsDefault:  address.IsDefault,
+		}
+	}
+	recordUserAudit(r, auditUpdate, userID, &before, &after)
+	writeAddresses(w, http.StatusOK, after.Addresses)
+}
+
+func deleteAddress(w http.ResponseWriter, r *http.Request, userID primitive.ObjectID) {
+	id, ok := addressID(w, r)
+	if !ok {
+		return
+	}
+
+	filter := activeUserByID(userID)
+	filter["addresses._id"] = id
+	var before User
+	err := database.Collection(collectionName).FindOneAndUpdate(r.Context(),
+		filter,
+		bson.M{"$pull": bson.M{"addresses": bson.M{"_id": id}}, "$set": bson.M{"updated_at": time.Now()}},
+	).Decode(&before)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		writeJSONError(w, http.StatusNotFound, "Address not found")
+		return
+	}
+	if err != nil {
+		fmt.Println("Error deleting address:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to delete address")
+		return
+	}
+
+	after := before
+	after.Addresses = []Address{}
+	for _, address := range before.Addresses {
+		if address.ID != id {
+			after.Addresses = append(after.Addresses, address)
+		}
+	}
+	recordUserAudit(r, auditUpdate, userID, &before, &after)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleDefaultAddress makes ?address_id= the default address of user ?id=.
+func handleDefaultAddress(w http.ResponseWriter, r *http.Request) {
+	userID, ok := parseObjectID(w, r)
+	if !ok {
+		return
+	}
+	if !authorizeUser(w, r, userID) {
+		return
+	}
+	id, ok := addressID(w, r)
+	if !ok {
+		return
+	}
+	setDefaultAddress(w, r, userID, id, http.StatusOK)
+}
+
+// setDefaultAddress flags one address as the default and clears the flag on
+// the others in a single update.
+func setDefaultAddress(w http.ResponseWriter, r *http.Request, userID, id primitive.ObjectID, status int) {
+	filter := activeUserByID(userID)
+	filter["addresses._id"] = id
+	var before User
+	err := database.Collection(collectionName).FindOneAndUpdate(r.Context(),
+		filter,
+		bson.M{"$set": bson.M{
+			"addresses.$[chosen].is_default": true,
+			"addresses.$[other].is_default":  false,
+			"updated_at":                     time.Now(),
+		}},
+		options.FindOneAndUpdate().SetArrayFilters(options.ArrayFilters{
+			Filters: []interface{}{
+				bson.M{"chosen._id": id},
+				bson.M{"other._id": bson.M{"$ne": id}},
+			},
+		}),
+	).Decode(&before)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		writeJSONError(w, http.StatusNotFound, "Address not found")
+		return
+	}
+	if err != nil {
+		fmt.Println("Error setting default address:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to set default address")
+		return
+	}
+
+	after := before
+	after.Addresses = withDefaultAddress(before.Addresses, id)
+	recordUserAudit(r, auditUpdate, userID, &before, &after)
+	writeAddresses(w, status, after.Addresses)
+}
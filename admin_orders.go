@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var adminOrderSortFields = []string{"created_at", "total"}
+
+type adminOrdersResponse struct {
+	Items      []Order `json:"items"`
+	TotalCount int64   `json:"total_count"`
+	Page       int     `json:"page"`
+	TotalPages int64   `json:"total_pages"`
+}
+
+// adminOrderFilter builds the filter for ?status=, ?from=/?to= (RFC3339,
+// inclusive), ?min_total= and ?email=.
+func adminOrderFilter(r *http.Request) (bson.M, error) {
+	query := r.URL.Query()
+	filter := bson.M{}
+
+	if status := query.Get("status"); status != "" {
+		if _, known := orderTransitions[status]; !known {
+			return nil, badRequestf("status must be one of pending, confirmed, shipped, delivered, cancelled")
+		}
+		filter["status"] = status
+	}
+
+	from, hasFrom, err := timeParam(r, "from")
+	if err != nil {
+		return nil, err
+	}
+	to, hasTo, err := timeParam(r, "to")
+	if err != nil {
+		return nil, err
+	}
+	if hasFrom && hasTo && from.After(to) {
+		return nil, badRequestf("from must not be after to")
+	}
+	if hasFrom || hasTo {
+		created := bson.M{}
+		if hasFrom {
+			created["$gte"] = from
+		}
+		if hasTo {
+			created["$lte"] = to
+		}
+		filter["created_at"] = created
+	}
+
+	minTotal, ok, err := floatParam(r, "min_total")
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		filter["total"] = bson.M{"$gte": minTotal}
+	}
+
+	if email := strings.TrimSpace(query.Get("email")); email != "" {
+		filter["customer.email"] = email
+	}
+	return filter, nil
+}
+
+func listAdminOrders(w http.ResponseWriter, r *http.Request) {
+	filter, err := adminOrderFilter(r)
+	if err != nil {
+		writeQueryError(w, err, "Failed to load orders")
+		return
+	}
+	page, err := parsePagination(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	sort := bson.D{{Key: "created_at", Value: -1}, {Key: "_id", Value: -1}}
+	if r.URL.Query().Get("sort") != "" {
+		if sort, err = parseSort(r, adminOrderSortFields); err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+
+	ordersCollection := database.Collection(ordersCollectionName)
+	total, err := ordersCollection.CountDocuments(r.Context(), filter)
+	if err != nil {
+		fmt.Println("Error counting orders:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to load orders")
+		return
+	}
+
+	opts := options.Find().SetSort(sort).SetSkip(page.skip()).SetLimit(int64(page.Limit))
+	cursor, err := ordersCollection.Find(r.Context(), filter, opts)
+	if err != nil {
+		fmt.Println("Error querying orders:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to load orders")
+		return
+	}
+	defer cursor.Close(r.Context())
+
+	orders := []Order{}
+	if err := cursor.All(r.Context(), &orders); err != nil {
+		fmt.Println("Error decoding orders:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to load orders")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, adminOrdersResponse{
+		Items:      orders,
+		TotalCount: total,
+		Page:       page.Page,
+		TotalPages: page.totalPages(total),
+	})
+}
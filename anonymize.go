@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const anonymizedName = "Anonymized user"
+
+// anonymizedEmail is unique per user, so the email index still holds, and
+// on a reserved domain no mail can be delivered to.
+func anonymizedEmail(id primitive.ObjectID) string {
+	return "anonymized-" + id.Hex() + "@anonymized.invalid"
+}
+
+// anonymizedUserFields are removed from an anonymized user: personal data
+// and everything that could be used to log in.
+var anonymizedUserFields = bson.M{
+	"age":                         "",
+	"password_hash":               "",
+	"verification_sent_at":        "",
+	"failed_logins":               "",
+	"locked_until":                "",
+	"totp_enabled":                "",
+	"totp_secret":                 "",
+	"totp_recovery_codes":         "",
+	"totp_last_step":              "",
+	"totp_pending_secret":         "",
+	"totp_pending_recovery_codes": "",
+	"auth_provider":               "",
+	"google_id":                   "",
+	"addresses":                   "",
+	"phone":                       "",
+	"avatar":                      "",
+}
+
+// anonymizeUser replaces a user's personal data with placeholders and
+// removes its credentials, tokens and review authorship. The document and
+// its ID stay, so orders kept for tax purposes still resolve. Anonymizing
+// an anonymized user changes nothing and returns it again.
+func anonymizeUser(w http.ResponseWriter, r *http.Request) {
+	id, ok := parseObjectID(w, r)
+	if !ok {
+		return
+	}
+	if !authorizeUser(w, r, id) {
+		return
+	}
+
+	now := time.Now()
+	set := bson.M{
+		"name":           anonymizedName,
+		"email":          anonymizedEmail(id),
+		"email_verified": false,
+		"anonymized":     true,
+		"anonymized_at":  now,
+		"updated_at":     now,
+	}
+	var before, after User
+	err := withTransaction(r.Context(), func(ctx context.Context) error {
+		usersCollection := database.Collection(collectionName)
+		err := usersCollection.FindOneAndUpdate(ctx,
+			bson.M{"_id": id, "anonymized": bson.M{"$ne": true}},
+			bson.M{"$set": set, "$unset": anonymizedUserFields, "$inc": bson.M{"version": 1}},
+			options.FindOneAndUpdate().SetReturnDocument(options.Before),
+		).Decode(&before)
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			// Already anonymized, or no such user.
+			return usersCollection.FindOne(ctx, bson.M{"_id": id}).Decode(&after)
+		}
+		if err != nil {
+			return err
+		}
+		if err := usersCollection.FindOne(ctx, bson.M{"_id": id}).Decode(&after); err != nil {
+			return err
+		}
+		return removeUserCredentials(ctx, id)
+	})
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		writeJSONError(w, http.StatusNotFound, "User not found")
+		return
+	}
+	if err != nil {
+		fmt.Println("Error anonymizing user:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to anonymize user")
+		return
+	}
+	if !before.ID.IsZero() {
+		recordUserAudit(r, auditAnonymize, id, &before, &after)
+	}
+	if before.Avatar != nil {
+		if bucket, err := imageBucket(); err != nil {
+			fmt.Println("Error opening GridFS bucket:", err)
+		} else {
+			deleteGridFSFiles(r, bucket, before.Avatar.fileIDs())
+		}
+	}
+
+	writeJSON(w, http.StatusOK, after)
+}
+
+// removeUserCredentials deletes every token, pending challenge and login
+// record of a user and detaches it from its reviews.
+func removeUserCredentials(ctx context.Context, id primitive.ObjectID) error {
+	for _, name := range []string{
+		refreshTokensCollectionName,
+		sessionsCollectionName,
+		passwordResetsCollectionName,
+		emailVerificationsCollectionName,
+		twoFactorChallengesCollectionName,
+		loginHistoryCollectionName,
+	} {
+		if _, err := database.Collection(name).DeleteMany(ctx, bson.M{"user_id": id}); err != nil {
+			return err
+		}
+	}
+	_, err := database.Collection(reviewsCollectionName).UpdateMany(ctx,
+		bson.M{"user_id": id},
+		bson.M{"$unset": bson.M{"user_id": ""}},
+	)
+	return err
+}
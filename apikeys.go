@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	scopeCatalogueRead  = "catalogue:read"
+	scopeCatalogueWrite = "catalogue:write"
+	scopeOrdersRead     = "orders:read"
+	scopeOrdersWrite    = "orders:write"
+	scopeDebugRead      = "debug:read"
+
+	apiKeyHeader = "X-API-Key"
+	apiKeyPrefix = "sk_"
+	// apiKeyTouchInterval bounds how often last_used_at is written for a key.
+	apiKeyTouchInterval = time.Minute
+)
+
+var apiKeyScopes = []string{scopeCatalogueRead, scopeCatalogueWrite, scopeOrdersRead, scopeOrdersWrite, scopeDebugRead}
+
+const apiKeyContextKey contextKey = "api_key"
+
+// APIKey only keeps the SHA-256 hash of the key. Hint is the start of the
+// key, so admins can tell keys apart without seeing them.
+type APIKey struct {
+	ID         primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+	Label      string             `json:"label" bson:"label"`
+	Scopes     []string           `json:"scopes" bson:"scopes"`
+	KeyHash    string             `json:"-" bson:"key_hash"`
+	Hint       string             `json:"hint" bson:"hint"`
+	CreatedAt  time.Time          `json:"created_at" bson:"created_at"`
+	LastUsedAt *time.Time         `json:"last_used_at,omitempty" bson:"last_used_at,omitempty"`
+	RevokedAt  *time.Time         `json:"revoked_at,omitempty" bson:"revoked_at,omitempty"`
+}
+
+func createAPIKeyIndexes() error {
+	_, err := database.Collection(apiKeysCollectionName).Indexes().CreateOne(context.TODO(), mongo.IndexModel{
+		Keys:    bson.D{{Key: "key_hash", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	return err
+}
+
+func (k APIKey) allows(scope string) bool {
+	for _, s := range k.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+func (k *APIKey) validate() error {
+	k.Label = strings.TrimSpace(k.Label)
+	if k.Label == "" {
+		return errors.New("label is required")
+	}
+	if len(k.Scopes) == 0 {
+		return errors.New("scopes must name at least one scope")
+	}
+	for _, scope := range k.Scopes {
+		known := false
+		for _, name := range apiKeyScopes {
+			known = known || scope == name
+		}
+		if !known {
+			return fmt.Errorf("unknown scope %q, supported scopes: %s", scope, strings.Join(apiKeyScopes, ", "))
+		}
+	}
+	return nil
+}
+
+// lookupAPIKey returns the active key matching key, noting its use at most
+// once per apiKeyTouchInterval.
+func lookupAPIKey(ctx context.Context, key string) (APIKey, error) {
+	keys := database.Collection(apiKeysCollectionName)
+	var found APIKey
+	err := keys.FindOne(ctx, bson.M{"key_hash": hashToken(key), "revoked_at": bson.M{"$exists": false}}).Decode(&found)
+	if err != nil {
+		return found, err
+	}
+
+	now := time.Now()
+	if found.LastUsedAt == nil || now.Sub(*found.LastUsedAt) >= apiKeyTouchInterval {
+		// The filter repeats the check, so concurrent requests write once.
+		_, err := keys.UpdateOne(ctx, bson.M{
+			"_id": found.ID,
+			"$or": bson.A{
+				bson.M{"last_used_at": bson.M{"$exists": false}},
+				bson.M{"last_used_at": bson.M{"$lte": now.Add(-apiKeyTouchInterval)}},
+			},
+		}, bson.M{"$set": bson.M{"last_used_at": now}})
+		if err != nil {
+			fmt.Println("Error recording API key use:", err)
+		}
+	}
+	return found, nil
+}
+
+// requireAdminOrKey accepts either an admin's access token or an API key
+// carrying scope in the X-API-Key header.
+func requireAdminOrKey(scope string, next http.HandlerFunc) http.HandlerFunc {
+	admin := requireAdmin(next)
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(apiKeyHeader)
+		if key == "" {
+			admin(w, r)
+			return
+		}
+		found, err := lookupAPIKey(r.Context(), key)
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			writeJSONError(w, http.StatusUnauthorized, "Invalid API key")
+			return
+		}
+		if err != nil {
+			fmt.Println("Error looking up API key:", err)
+			writeJSONError(w, http.StatusInternalServerError, "Failed to check API key")
+			return
+		}
+		if !found.allows(scope) {
+			writeJSONError(w, http.StatusForbidden, fmt.Sprintf("API key lacks the %s scope", scope))
+			return
+		}
+		next(w, r.WithContext(context.WithValue(r.Context(), apiKeyContextKey, found)))
+	}
+}
+
+func handleAPIKeys(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		listAPIKeys(w, r)
+	case http.MethodPost:
+		createAPIKey(w, r)
+	case http.MethodDelete:
+		revokeAPIKey(w, r)
+	default:
+		writeJSONError(w, http.StatusMethodNotAllowed, "Method not allowed")
+	}
+}
+
+func listAPIKeys(w http.ResponseWriter, r *http.Request) {
+	opts := options.Find().SetSort(bson.D{{Key: "created_at", Value: -1}})
+	cursor, err := database.Collection(apiKeysCollectionName).Find(r.Context(), bson.M{}, opts)
+	if err != nil {
+		fmt.Println("Error querying API keys:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to load API keys")
+		return
+	}
+	defer cursor.Close(r.Context())
+
+	keys := []APIKey{}
+	if err := cursor.All(r.Context(), &keys); err != nil {
+		fmt.Println("Error decoding API keys:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to load API keys")
+		return
+	}
+	writeJSON(w, http.StatusOK, keys)
+}
+
+// createAPIKey answers with the plaintext key; it cannot be shown again.
+func createAPIKey(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Label  string   `json:"label"`
+		Scopes []string `json:"scopes"`
+	}
+	if !decodeJSON(w, r, &body) {
+		return
+	}
+	apiKey := APIKey{Label: body.Label, Scopes: body.Scopes}
+	if err := apiKey.validate(); err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	secret, err := newSecretToken()
+	if err != nil {
+		fmt.Println("Error generating API key:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to create API key")
+		return
+	}
+	key := apiKeyPrefix + secret
+	apiKey.KeyHash = hashToken(key)
+	apiKey.Hint = key[:len(apiKeyPrefix)+6]
+	apiKey.CreatedAt = time.Now()
+
+	result, err := database.Collection(apiKeysCollectionName).InsertOne(r.Context(), apiKey)
+	if err != nil {
+		fmt.Println("Error inserting API key:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to create API key")
+		return
+	}
+	apiKey.ID = result.InsertedID.(primitive.ObjectID)
+	writeJSON(w, http.StatusCreated, struct {
+		APIKey
+		Key string `json:"key"`
+	}{apiKey, key})
+}
+
+func revokeAPIKey(w http.ResponseWriter, r *http.Request) {
+	id, ok := parseObjectID(w, r)
+	if !ok {
+		return
+	}
+
+	var revoked APIKey
+	err := database.Collection(apiKeysCollectionName).FindOneAndUpdate(
+		r.Context(),
+		bson.M{"_id": id, "revoked_at": bson.M{"$exists": false}},
+		bson.M{"$set": bson.M{"revoked_at": time.Now()}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&revoked)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		writeJSONError(w, http.StatusNotFound, "API key not found or already revoked")
+		return
+	}
+	if err != nil {
+		fmt.Println("Error revoking API key:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to revoke API key")
+		return
+	}
+	writeJSON(w, http.StatusOK, revoked)
+}
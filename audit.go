@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"reflect"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	auditCreate    = "create"
+	auditUpdate    = "update"
+	auditDelete    = "delete"
+	auditRestore   = "restore"
+	auditPurge     = "purge"
+	auditAnonymize = "anonymize"
+)
+
+// auditRedacted replaces the values of secret user fields in audit entries;
+// that they changed is still recorded.
+const auditRedacted = "[redacted]"
+
+var auditSecretFields = map[string]bool{
+	"password_hash":               true,
+	"totp_secret":                 true,
+	"totp_recovery_codes":         true,
+	"totp_pending_secret":         true,
+	"totp_pending_recovery_codes": true,
+	"google_id":                   true,
+}
+
+// AuditEntry records one change to a user document. ActorID is missing when
+// nobody was logged in, as on registration.
+type AuditEntry struct {
+	ID        primitive.ObjectID     `json:"id" bson:"_id,omitempty"`
+	ActorID   *primitive.ObjectID    `json:"actor_id,omitempty" bson:"actor_id,omitempty"`
+	TargetID  primitive.ObjectID     `json:"target_id" bson:"target_id"`
+	Operation string                 `json:"operation" bson:"operation"`
+	Changes   map[string]auditChange `json:"changes,omitempty" bson:"changes,omitempty"`
+	RequestID string                 `json:"request_id,omitempty" bson:"request_id,omitempty"`
+	At        time.Time              `json:"at" bson:"at"`
+}
+
+type auditChange struct {
+	Old interface{} `json:"old" bson:"old"`
+	New interface{} `json:"new" bson:"new"`
+}
+
+func createAuditIndexes() error {
+	_, err := database.Collection(auditLogCollectionName).Indexes().CreateMany(context.TODO(), []mongo.IndexModel{
+		{Keys: bson.D{{Key: "target_id", Value: 1}, {Key: "at", Value: -1}}},
+		{Keys: bson.D{{Key: "at", Value: -1}}},
+	})
+	return err
+}
+
+// userDocument is user the way it is stored.
+func userDocument(user User) (bson.M, error) {
+	data, err := bson.Marshal(user)
+	if err != nil {
+		return nil, err
+	}
+	var doc bson.M
+	return doc, bson.Unmarshal(data, &doc)
+}
+
+// applySet returns user as it is after the $set document set, so a handler
+// can read the old user with FindOneAndUpdate and still know the new one.
+func applySet(user User, set bson.M) (User, error) {
+	doc, err := userDocument(user)
+	if err != nil {
+		return user, err
+	}
+	for field, value := range set {
+		doc[field] = value
+	}
+	data, err := bson.Marshal(doc)
+	if err != nil {
+		return user, err
+	}
+	var updated User
+	return updated, bson.Unmarshal(data, &updated)
+}
+
+// auditChanges lists the fields that differ between before and after, either
+// of which is nil when the user did not exist on that side.
+func auditChanges(before, after *User) (map[string]auditChange, error) {
+	docs := [2]bson.M{{}, {}}
+	for i, user := range []*User{before, after} {
+		if user == nil {
+			continue
+		}
+		doc, err := userDocument(*user)
+		if err != nil {
+			return nil, err
+		}
+		docs[i] = doc
+	}
+
+	changes := map[string]auditChange{}
+	for _, doc := range docs {
+		for field := range doc {
+			oldValue, newValue := docs[0][field], docs[1][field]
+			if field == "_id" || reflect.DeepEqual(oldValue, newValue) {
+				continue
+			}
+			if auditSecretFields[field] {
+				if oldValue != nil {
+					oldValue = auditRedacted
+				}
+				if newValue != nil {
+					newValue = auditRedacted
+				}
+			}
+			changes[field] = auditChange{Old: oldValue, New: newValue}
+		}
+	}
+	return changes, nil
+}
+
+// recordUserAudit writes an audit entry for a change the request made to a
+// user. The change has already happened, so a failure is only logged.
+func recordUserAudit(r *http.Request, operation string, target primitive.ObjectID, before, after *User) {
+	entry := AuditEntry{
+		TargetID:  target,
+		Operation: operation,
+		RequestID: requestIDFrom(r.Context()),
+		At:        time.Now(),
+	}
+	if actor, ok := authenticatedUserID(r.Context()); ok {
+		entry.ActorID = &actor
+	}
+
+	changes, err := auditChanges(before, after)
+	if err == nil {
+		entry.Changes = changes
+		_, err = database.Collection(auditLogCollectionName).InsertOne(r.Context(), entry)
+	}
+	if err != nil {
+		actor := "anonymous"
+		if entry.ActorID != nil {
+			actor = entry.ActorID.Hex()
+		}
+		fmt.Printf("AUDIT LOG WRITE FAILED: %s of user %s by %s (request %q) was not recorded: %v\n",
+			operation, target.Hex(), actor, entry.RequestID, err)
+	}
+}
+
+// listAuditLog pages through the audit log, newest first, optionally for one
+// ?target_id= and between ?from= and ?to= (RFC3339).
+func listAuditLog(w http.ResponseWriter, r *http.Request) {
+	page, err := parsePagination(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	filter := bson.M{}
+	if raw := r.URL.Query().Get("target_id"); raw != "" {
+		target, err := primitive.ObjectIDFromHex(raw)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, codeInvalidID, "target_id must be a valid ID")
+			return
+		}
+		filter["target_id"] = target
+	}
+	at := bson.M{}
+	for param, op := range map[string]string{"from": "$gte", "to": "$lte"} {
+		value, ok, err := timeParam(r, param)
+		if err != nil {
+			writeQueryError(w, err, "Failed to load audit log")
+			return
+		}
+		if ok {
+			at[op] = value
+		}
+	}
+	if len(at) > 0 {
+		filter["at"] = at
+	}
+
+	auditCollection := database.Collection(auditLogCollectionName)
+	total, err := auditCollection.CountDocuments(r.Context(), filter)
+	if err != nil {
+		fmt.Println("Error counting audit log:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to load audit log")
+		return
+	}
+
+	opts := options.Find().
+		SetSort(bson.D{{Key: "at", Value: -1}, {Key: "_id", Value: -1}}).
+		SetSkip(page.skip()).
+		SetLimit(int64(page.Limit))
+	cursor, err := auditCollection.Find(r.Context(), filter, opts)
+	if err != nil {
+		fmt.Println("Error querying audit log:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to load audit log")
+		return
+	}
+	defer cursor.Close(r.Context())
+
+	entries := []AuditEntry{}
+	if err := cursor.All(r.Context(), &entries); err != nil {
+		fmt.Println("Error decoding audit log:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to load audit log")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, pageResponse{
+		Items:      entries,
+		Total:      total,
+		Page:       page.Page,
+		TotalPages: page.totalPages(total),
+	})
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+	"unicode"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	loginModeSession = "session"
+
+	minPasswordLength = 8
+	// bcrypt ignores everything past 72 bytes, so longer passwords would
+	// silently be truncated.
+	maxPasswordBytes = 72
+)
+
+// emailCollation compares emails case-insensitively.
+var emailCollation = &options.Collation{Locale: "en", Strength: 2}
+
+// createAccountIndexes makes emails unique across active users, ignoring
+// case; soft-deleted users do not hold on to their email. Existing emails
+// are lowercased first and surplus copies of the seed user removed; any
+// other duplicates have to be resolved by hand, and are listed in the error.
+func createAccountIndexes() error {
+	ctx := context.TODO()
+	users := database.Collection(collectionName)
+
+	// The index can only select on a null deleted_at, not a missing one.
+	_, err := users.UpdateMany(ctx, bson.M{"deleted_at": bson.M{"$exists": false}}, bson.M{"$set": bson.M{"deleted_at": nil}})
+	if err != nil {
+		return err
+	}
+	_, err = users.UpdateMany(ctx,
+		bson.M{"email": bson.M{"$type": "string"}},
+		mongo.Pipeline{{{Key: "$set", Value: bson.M{"email": bson.M{"$toLower": bson.M{"$trim": bson.M{"input": "$email"}}}}}}},
+	)
+	if err != nil {
+		return err
+	}
+	if err := removeDuplicateSeedUsers(ctx); err != nil {
+		return err
+	}
+
+	cursor, err := users.Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"email": bson.M{"$gt": ""}, "deleted_at": nil}}},
+		{{Key: "$group", Value: bson.M{"_id": "$email", "count": bson.M{"$sum": 1}}}},
+		{{Key: "$match", Value: bson.M{"count": bson.M{"$gt": 1}}}},
+		{{Key: "$limit", Value: 20}},
+	})
+	if err != nil {
+		return err
+	}
+	var duplicates []struct {
+		Email string `bson:"_id"`
+	}
+	if err := cursor.All(ctx, &duplicates); err != nil {
+		return err
+	}
+	if len(duplicates) > 0 {
+		emails := make([]string, len(duplicates))
+		for i, d := range duplicates {
+			emails[i] = d.Email
+		}
+		return fmt.Errorf("users share these emails, merge or change them first: %s", strings.Join(emails, ", "))
+	}
+
+	// Superseded by email_unique_active.
+	for _, name := range []string{"email_account_unique", "email_unique"} {
+		if _, err := users.Indexes().DropOne(ctx, name); err != nil && !isIndexNotFound(err) {
+			return err
+		}
+	}
+	_, err = users.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "email", Value: 1}},
+		Options: options.Index().
+			SetName("email_unique_active").
+			SetUnique(true).
+			SetCollation(emailCollation).
+			SetPartialFilterExpression(bson.M{
+				"email":      bson.M{"$gt": ""},
+				"deleted_at": bson.M{"$type": "null"},
+			}),
+	})
+	return err
+}
+
+// removeDuplicateSeedUsers deletes the extra John Does that earlier
+// versions inserted on every start, keeping the oldest one.
+func removeDuplicateSeedUsers(ctx context.Context) error {
+	users := database.Collection(collectionName)
+	var keep User
+	err := users.FindOne(ctx, bson.M{"email": seedUserEmail},
+		options.FindOne().SetSort(bson.D{{Key: "_id", Value: 1}})).Decode(&keep)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	_, err = users.DeleteMany(ctx, bson.M{
+		"_id":           bson.M{"$ne": keep.ID},
+		"email":         seedUserEmail,
+		"name":          "John Doe",
+		"password_hash": bson.M{"$exists": false},
+	})
+	return err
+}
+
+func validatePassword(password string) string {
+	if len(password) < minPasswordLength {
+		return fmt.Sprintf("password must be at least %d characters", minPasswordLength)
+	}
+	if len(password) > maxPasswordBytes {
+		return fmt.Sprintf("password must be at most %d bytes", maxPasswordBytes)
+	}
+	var letter, digit bool
+	for _, c := range password {
+		letter = letter || unicode.IsLetter(c)
+		digit = digit || unicode.IsDigit(c)
+	}
+	if !letter || !digit {
+		return "password must contain at least one letter and one digit"
+	}
+	return ""
+}
+
+func handleRegister(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Name     string `json:"name"`
+		Email    string `json:"email"`
+		Password string `json:"password"`
+	}
+	if !decodeJSON(w, r, &body) {
+		return
+	}
+	body.Name = strings.TrimSpace(body.Name)
+	body.Email = strings.ToLower(strings.TrimSpace(body.Email))
+
+	var v validator
+	v.required("name", body.Name)
+	v.email("email", body.Email)
+	if message := validatePassword(body.Password); message != "" {
+		v.check(false, "password", rulePassword, message)
+	}
+	if len(v.errs) > 0 {
+		writeValidationErrors(w, "Registration is invalid", v.errs)
+		return
+	}
+
+	usersCollection := database.Collection(collectionName)
+	hash, err := bcrypt.GenerateFromPassword([]byte(body.Password), bcrypt.DefaultCost)
+	if err != nil {
+		fmt.Println("Error hashing password:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to register")
+		return
+	}
+
+	now := time.Now()
+	user := User{
+		Name:               body.Name,
+		Email:              body.Email,
+		PasswordHash:       string(hash),
+		Role:               roleCustomer,
+		EmailVerified:      false,
+		VerificationSentAt: &now,
+		CreatedAt:          now,
+		UpdatedAt:          now,
+		Version:            1,
+	}
+	result, err := usersCollection.InsertOne(r.Context(), user)
+	if mongo.IsDuplicateKeyError(err) {
+		writeError(w, http.StatusConflict, codeDuplicateEmail, "An account with this email already exists")
+		return
+	}
+	if err != nil {
+		fmt.Println("Error inserting user:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to register")
+		return
+	}
+	user.ID = result.InsertedID.(primitive.ObjectID)
+	recordUserAudit(r, auditCreate, user.ID, nil, &user)
+	goBackgroundFor(r.Context(), func(ctx context.Context) { sendVerification(ctx, user) })
+
+	writeJSON(w, http.StatusCreated, user)
+}
+
+// dummyPasswordHash is compared against when the email is unknown, so that
+// response times do not tell which emails have accounts.
+var dummyPasswordHash, _ = bcrypt.GenerateFromPassword([]byte("not-a-real-password-1"), bcrypt.DefaultCost)
+
+// handleLogin exchanges email and password for an access token and a
+// refresh token starting a new token family. Unknown emails and wrong
+// passwords get the same 401; locked accounts get 423 before the password
+// is looked at.
+func handleLogin(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Email    string `json:"email"`
+		Password string `json:"password"`
+		// Mode "session" sets a session cookie instead of returning tokens.
+		Mode string `json:"mode"`
+	}
+	if !decodeJSON(w, r, &body) {
+		return
+	}
+	if body.Mode != "" && body.Mode != loginModeSession {
+		writeJSONError(w, http.StatusBadRequest, `mode must be empty or "session"`)
+		return
+	}
+
+	var user User
+	err := database.Collection(collectionName).FindOne(r.Context(), bson.M{
+		"email":      strings.ToLower(strings.TrimSpace(body.Email)),
+		"deleted_at": nil,
+		"$or": bson.A{
+			bson.M{"password_hash": bson.M{"$exists": true}},
+			bson.M{"auth_provider": authProviderGoogle},
+		},
+	}, options.FindOne().SetSort(bson.D{{Key: "password_hash", Value: -1}})).Decode(&user)
+	if err != nil && !errors.Is(err, mongo.ErrNoDocuments) {
+		fmt.Println("Error looking up account:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to log in")
+		return
+	}
+	if user.PasswordHash == "" && user.AuthProvider == authProviderGoogle {
+		writeJSONError(w, http.StatusBadRequest, "This account signs in with Google and has no password")
+		return
+	}
+
+	known := user.PasswordHash != ""
+	if user.lockedAt(time.Now()) {
+		writeAccountLocked(w, user.LockedUntil)
+		return
+	}
+	hash := []byte(user.PasswordHash)
+	if !known {
+		hash = dummyPasswordHash
+	}
+	if bcrypt.CompareHashAndPassword(hash, []byte(body.Password)) != nil || !known {
+		if known {
+			failed, err := recordFailedLogin(r.Context(), user.ID)
+			if err != nil {
+				fmt.Println("Error recording failed login:", err)
+			} else if failed.lockedAt(time.Now()) {
+				writeAccountLocked(w, failed.LockedUntil)
+				return
+			}
+		}
+		writeUnauthorized(w, "Invalid email or password")
+		return
+	}
+	unlocked, err := clearFailedLogins(r.Context(), user.ID)
+	if err != nil {
+		fmt.Println("Error resetting failed logins:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to log in")
+		return
+	}
+	if !unlocked {
+		writeAccountLocked(w, nil)
+		return
+	}
+
+	if user.TOTPEnabled {
+		startTwoFactorChallenge(w, r, user, body.Mode)
+		return
+	}
+	completeLogin(w, r, user, body.Mode)
+}
+
+// completeLogin answers a successful login with a session cookie or a token
+// pair, depending on mode.
+func completeLogin(w http.ResponseWriter, r *http.Request, user User, mode string) {
+	if mode == loginModeSession {
+		if err := startSession(w, r, user); err != nil {
+			fmt.Println("Error starting session:", err)
+			writeJSONError(w, http.StatusInternalServerError, "Failed to log in")
+			return
+		}
+		recordLogin(r, user, mode)
+		writeJSON(w, http.StatusOK, user)
+		return
+	}
+
+	response, err := issueTokenPair(r.Context(), r, user, primitive.NewObjectID())
+	if err != nil {
+		fmt.Println("Error issuing tokens:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to log in")
+		return
+	}
+	recordLogin(r, user, mode)
+	writeJSON(w, http.StatusOK, response)
+}
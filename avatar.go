@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"net/http"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/gridfs"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	maxAvatarSize = 2 << 20
+	// maxAvatarPixels keeps a small file that decodes to a huge image from
+	// exhausting memory.
+	maxAvatarPixels = 25_000_000
+
+	avatarSize      = 256
+	avatarThumbSize = 64
+
+	avatarCacheControl = "public, max-age=3600"
+)
+
+// Avatar points at the two GridFS files of a user's picture, both square.
+type Avatar struct {
+	ImageID   primitive.ObjectID `json:"image_id" bson:"image_id"`
+	ThumbID   primitive.ObjectID `json:"thumb_id" bson:"thumb_id"`
+	UpdatedAt time.Time          `json:"updated_at" bson:"updated_at"`
+}
+
+func (a Avatar) fileIDs() []primitive.ObjectID {
+	return []primitive.ObjectID{a.ImageID, a.ThumbID}
+}
+
+// handleAvatar serves a user's avatar to anyone (GET) and lets the user or
+// an admin replace it (POST).
+func handleAvatar(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		getAvatar(w, r)
+	case http.MethodPost:
+		requireAuth(uploadAvatar)(w, r)
+	default:
+		writeJSONError(w, http.StatusMethodNotAllowed, "Method not allowed")
+	}
+}
+
+// squareThumbnail crops the middle square out of src and scales it to
+// size×size, averaging the source pixels behind each target pixel.
+func squareThumbnail(src image.Image, size int) *image.RGBA {
+	bounds := src.Bounds()
+	side := bounds.Dx()
+	if bounds.Dy() < side {
+		side = bounds.Dy()
+	}
+	x0 := bounds.Min.X + (bounds.Dx()-side)/2
+	y0 := bounds.Min.Y + (bounds.Dy()-side)/2
+
+	dst := image.NewRGBA(image.Rect(0, 0, size, size))
+	for y := 0; y < size; y++ {
+		sy0, sy1 := y0+y*side/size, y0+(y+1)*side/size
+		if sy1 == sy0 {
+			sy1++
+		}
+		for x := 0; x < size; x++ {
+			sx0, sx1 := x0+x*side/size, x0+(x+1)*side/size
+			if sx1 == sx0 {
+				sx1++
+			}
+			var r, g, b, a, n uint64
+			for sy := sy0; sy < sy1; sy++ {
+				for sx := sx0; sx < sx1; sx++ {
+					cr, cg, cb, ca := src.At(sx, sy).RGBA()
+					r, g, b, a, n = r+uint64(cr), g+uint64(cg), b+uint64(cb), a+uint64(ca), n+1
+				}
+			}
+			dst.SetRGBA64(x, y, color.RGBA64{R: uint16(r / n), G: uint16(g / n), B: uint16(b / n), A: uint16(a / n)})
+		}
+	}
+	return dst
+}
+
+// encodeAvatar writes img in the format the upload came in, so PNGs keep
+// their transparency.
+func encodeAvatar(img image.Image, contentType string) ([]byte, error) {
+	var buf bytes.Buffer
+	var err error
+	if contentType == "image/png" {
+		err = png.Encode(&buf, img)
+	} else {
+		err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: 85})
+	}
+	return buf.Bytes(), err
+}
+
+func uploadAvatar(w http.ResponseWriter, r *http.Request) {
+	userID, ok := parseObjectID(w, r)
+	if !ok {
+		return
+	}
+	if !authorizeUser(w, r, userID) {
+		return
+	}
+
+	// Leave headroom for the multipart envelope around the file itself.
+	r.Body = http.MaxBytesReader(w, r.Body, maxAvatarSize+1<<20)
+	file, header, err := r.FormFile("image")
+	if err != nil {
+		var maxErr *http.MaxBytesError
+		if errors.As(err, &maxErr) {
+			writeJSONError(w, http.StatusRequestEntityTooLarge, "Avatar must be at most 2 MB")
+			return
+		}
+		writeJSONError(w, http.StatusBadRequest, "Expected a multipart form with an image field")
+		return
+	}
+	defer file.Close()
+
+	if header.Size > maxAvatarSize {
+		writeJSONError(w, http.StatusRequestEntityTooLarge, "Avatar must be at most 2 MB")
+		return
+	}
+	data, err := io.ReadAll(io.LimitReader(file, maxAvatarSize))
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "Could not read the uploaded image")
+		return
+	}
+
+	// Trust the bytes rather than the client-declared Content-Type.
+	contentType := http.DetectContentType(data)
+	if !allowedImageTypes[contentType] {
+		writeJSONError(w, http.StatusUnsupportedMediaType, "Only image/jpeg and image/png are supported")
+		return
+	}
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		writeJSONError(w, http.StatusUnprocessableEntity, "The image could not be decoded")
+		return
+	}
+	if config.Width*config.Height > maxAvatarPixels {
+		writeJSONError(w, http.StatusUnprocessableEntity, "The image has too many pixels")
+		return
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		writeJSONError(w, http.StatusUnprocessableEntity, "The image could not be decoded")
+		return
+	}
+
+	exists, err := userExists(r.Context(), userID)
+	if err != nil {
+		fmt.Println("Error looking up user:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to upload avatar")
+		return
+	}
+	if !exists {
+		writeJSONError(w, http.StatusNotFound, "User not found")
+		return
+	}
+
+	bucket, err := imageBucket()
+	if err != nil {
+		fmt.Println("Error opening GridFS bucket:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to upload avatar")
+		return
+	}
+
+	avatar := Avatar{UpdatedAt: time.Now()}
+	for _, version := range []struct {
+		size int
+		id   *primitive.ObjectID
+	}{{avatarSize, &avatar.ImageID}, {avatarThumbSize, &avatar.ThumbID}} {
+		encoded, err := encodeAvatar(squareThumbnail(img, version.size), contentType)
+		if err == nil {
+			metadata := bson.M{"content_type": contentType, "user_id": userID, "size": version.size}
+			*version.id, err = bucket.UploadFromStream(fmt.Sprintf("avatar-%s-%d", userID.Hex(), version.size),
+				bytes.NewReader(encoded), options.GridFSUpload().SetMetadata(metadata))
+		}
+		if err != nil {
+			deleteGridFSFiles(r, bucket, avatar.fileIDs())
+			fmt.Println("Error storing avatar:", err)
+			writeJSONError(w, http.StatusInternalServerError, "Failed to upload avatar")
+			return
+		}
+	}
+
+	var before User
+	err = database.Collection(collectionName).FindOneAndUpdate(
+		r.Context(),
+		activeUserByID(userID),
+		bson.M{"$set": bson.M{"avatar": avatar, "updated_at": avatar.UpdatedAt}},
+		options.FindOneAndUpdate().SetReturnDocument(options.Before),
+	).Decode(&before)
+	if err != nil {
+		deleteGridFSFiles(r, bucket, avatar.fileIDs())
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			writeJSONError(w, http.StatusNotFound, "User not found")
+			return
+		}
+		fmt.Println("Error saving avatar reference:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to upload avatar")
+		return
+	}
+	if before.Avatar != nil {
+		deleteGridFSFiles(r, bucket, before.Avatar.fileIDs())
+	}
+	after := before
+	after.Avatar, after.UpdatedAt = &avatar, avatar.UpdatedAt
+	recordUserAudit(r, auditUpdate, userID, &before, &after)
+
+	writeJSON(w, http.StatusCreated, avatar)
+}
+
+// deleteGridFSFiles removes files that are no longer referenced, logging
+// rather than failing, since the request has already succeeded or failed.
+func deleteGridFSFiles(r *http.Request, bucket *gridfs.Bucket, ids []primitive.ObjectID) {
+	for _, id := range ids {
+		if id.IsZero() {
+			continue
+		}
+		if err := bucket.DeleteContext(r.Context(), id); err != nil && !errors.Is(err, gridfs.ErrFileNotFound) {
+			fmt.Println("Error deleting stored file:", err)
+		}
+	}
+}
+
+// getAvatar streams ?size=256 (the default) or ?size=64. Every upload gets
+// new files, so the file ID is a strong ETag.
+func getAvatar(w http.ResponseWriter, r *http.Request) {
+	userID, ok := parseObjectID(w, r)
+	if !ok {
+		return
+	}
+	size := r.URL.Query().Get("size")
+	if size != "" && size != fmt.Sprint(avatarSize) && size != fmt.Sprint(avatarThumbSize) {
+		writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("size must be %d or %d", avatarSize, avatarThumbSize))
+		return
+	}
+
+	var user User
+	opts := options.FindOne().SetProjection(bson.M{"avatar": 1})
+	err := database.Collection(collectionName).FindOne(r.Context(), activeUserByID(userID), opts).Decode(&user)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		writeJSONError(w, http.StatusNotFound, "User not found")
+		return
+	}
+	if err != nil {
+		fmt.Println("Error looking up user:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to load avatar")
+		return
+	}
+	if user.Avatar == nil {
+		writeJSONError(w, http.StatusNotFound, "User has no avatar")
+		return
+	}
+
+	fileID := user.Avatar.ImageID
+	if size == fmt.Sprint(avatarThumbSize) {
+		fileID = user.Avatar.ThumbID
+	}
+	etag := `"` + fileID.Hex() + `"`
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", avatarCacheControl)
+	w.Header().Set("Last-Modified", user.Avatar.UpdatedAt.UTC().Format(http.TimeFormat))
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	serveGridFSFile(w, fileID)
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	cartCookieName = "cart_id"
+	cartLifetime   = 30 * 24 * time.Hour
+)
+
+// CartItem remembers the unit price the customer saw when adding the item,
+// so checkout can tell them if it has changed since.
+type CartItem struct {
+	FurnitureID int       `json:"furniture_id" bson:"furniture_id"`
+	VariantID   string    `json:"variant_id" bson:"variant_id"`
+	Quantity    int       `json:"quantity" bson:"quantity"`
+	UnitPrice   float64   `json:"unit_price" bson:"unit_price"`
+	AddedAt     time.Time `json:"added_at" bson:"added_at"`
+}
+
+// Cart is keyed by the random ID handed out in the cart_id cookie. Carts not
+// touched for cartLifetime are removed by a TTL index on updated_at.
+type Cart struct {
+	ID        string     `json:"id" bson:"_id"`
+	Items     []CartItem `json:"items" bson:"items"`
+	CreatedAt time.Time  `json:"created_at" bson:"created_at"`
+	UpdatedAt time.Time  `json:"updated_at" bson:"updated_at"`
+}
+
+func (c Cart) orderItems() []OrderItem {
+	items := make([]OrderItem, len(c.Items))
+	for i, line := range c.Items {
+		items[i] = OrderItem{FurnitureID: line.FurnitureID, VariantID: line.VariantID, Quantity: line.Quantity}
+	}
+	return items
+}
+
+func createCartIndexes() error {
+	_, err := database.Collection(cartsCollectionName).Indexes().CreateOne(context.TODO(), mongo.IndexModel{
+		Keys:    bson.D{{Key: "updated_at", Value: 1}},
+		Options: options.Index().SetExpireAfterSeconds(int32(cartLifetime / time.Second)),
+	})
+	return err
+}
+
+// cartID returns the caller's cart ID from the cookie, if it carries a
+// well-formed one.
+func cartID(r *http.Request) (string, bool) {
+	cookie, err := r.Cookie(cartCookieName)
+	if err != nil {
+		return "", false
+	}
+	if raw, err := hex.DecodeString(cookie.Value); err != nil || len(raw) != 16 {
+		return "", false
+	}
+	return cookie.Value, true
+}
+
+// issueCartID returns the caller's cart ID, handing out a new one in the
+// cookie when there is none. The cookie is renewed either way.
+func issueCartID(w http.ResponseWriter, r *http.Request) (string, error) {
+	id, ok := cartID(r)
+	if !ok {
+		var raw [16]byte
+		if _, err := rand.Read(raw[:]); err != nil {
+			return "", err
+		}
+		id = hex.EncodeToString(raw[:])
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     cartCookieName,
+		Value:    id,
+		Path:     "/",
+		MaxAge:   int(cartLifetime / time.Second),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return id, nil
+}
+
+// loadCart returns the cart, or an empty one when it does not exist (yet).
+func loadCart(ctx context.Context, id string) (Cart, error) {
+	cart := Cart{ID: id, Items: []CartItem{}}
+	err := database.Collection(cartsCollectionName).FindOne(ctx, bson.M{"_id": id}).Decode(&cart)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return cart, nil
+	}
+	if cart.Items == nil {
+		cart.Items = []CartItem{}
+	}
+	return cart, err
+}
+
+func (c Cart) line(furnitureID int, variantID string) *CartItem {
+	for i := range c.Items {
+		if c.Items[i].FurnitureID == furnitureID && c.Items[i].VariantID == variantID {
+			return &c.Items[i]
+		}
+	}
+	return nil
+}
+
+func handleCart(w http.ResponseWriter, r *http.Request) {
+	cart := Cart{Items: []CartItem{}}
+	if id, ok := cartID(r); ok {
+		var err error
+		if cart, err = loadCart(r.Context(), id); err != nil {
+			fmt.Println("Error loading cart:", err)
+			writeJSONError(w, http.StatusInternalServerError, "Failed to load cart")
+			return
+		}
+	}
+	writeJSON(w, http.StatusOK, cart)
+}
+
+func handleCartItems(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPost:
+		addCartItem(w, r)
+	case http.MethodDelete:
+		removeCartItem(w, r)
+	default:
+		writeJSONError(w, http.StatusMethodNotAllowed, "Method not allowed")
+	}
+}
+
+// addCartItem adds quantity units of an item, merging with the line already
+// in the cart. The resulting line must still fit the stock that other carts
+// have not reserved.
+func addCartItem(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		FurnitureID int    `json:"furniture_id"`
+		VariantID   string `json:"variant_id"`
+		Quantity    int    `json:"quantity"`
+	}
+	if !decodeJSON(w, r, &body) {
+		return
+	}
+	if body.Quantity < 1 {
+		writeValidationErrors(w, "Cart item is invalid", []fieldError{{Field: "quantity", Message: "quantity must be at least 1"}})
+		return
+	}
+
+	catalogue, err := loadFurniture(r.Context(), []int{body.FurnitureID})
+	if err != nil {
+		fmt.Println("Error loading furniture for cart:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to update cart")
+		return
+	}
+	furniture, ok := catalogue[body.FurnitureID]
+	if !ok || furniture.DeletedAt != nil {
+		writeValidationErrors(w, "Cart item is invalid", []fieldError{{Field: "furniture_id", Message: fmt.Sprintf("unknown furniture ID %d", body.FurnitureID)}})
+		return
+	}
+	if body.VariantID != "" && furniture.variant(body.VariantID) == nil {
+		writeValidationErrors(w, "Cart item is invalid", []fieldError{{Field: "variant_id", Message: "unknown variant for this furniture"}})
+		return
+	}
+
+	id, err := issueCartID(w, r)
+	if err != nil {
+		fmt.Println("Error issuing cart ID:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to update cart")
+		return
+	}
+	cart, err := loadCart(r.Context(), id)
+	if err != nil {
+		fmt.Println("Error loading cart:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to update cart")
+		return
+	}
+
+	quantity := body.Quantity
+	if existing := cart.line(body.FurnitureID, body.VariantID); existing != nil {
+		quantity += existing.Quantity
+	}
+	if quantity > maxLineQuantity {
+		writeValidationErrors(w, "Cart item is invalid", []fieldError{{Field: "quantity", Message: fmt.Sprintf("a cart line may hold at most %d units", maxLineQuantity)}})
+		return
+	}
+	wanted := []OrderItem{{FurnitureID: body.FurnitureID, VariantID: body.VariantID, Quantity: quantity}}
+	shortages, err := checkAvailability(r.Context(), wanted, catalogue, id)
+	if err != nil {
+		fmt.Println("Error checking availability:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to update cart")
+		return
+	}
+	if len(shortages) > 0 {
+		writeStockShortage(w, shortages)
+		return
+	}
+
+	promotions, err := activePromotions(r.Context(), time.Now())
+	if err != nil {
+		fmt.Println("Error loading promotions:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to update cart")
+		return
+	}
+	priceItems(wanted, catalogue, promotions)
+
+	if err := mergeCartLine(r.Context(), id, body.FurnitureID, body.VariantID, body.Quantity, wanted[0].UnitPrice); err != nil {
+		fmt.Println("Error updating cart:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to update cart")
+		return
+	}
+
+	if cart, err = loadCart(r.Context(), id); err != nil {
+		fmt.Println("Error loading cart:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to load cart")
+		return
+	}
+	writeJSON(w, http.StatusOK, cart)
+}
+
+// mergeCartLine increments the line for the item if the cart has one and
+// appends a new line otherwise, creating the cart on first use. Both writes
+// are guarded, so concurrent adds of the same item never produce two lines;
+// the loser of a race simply takes the other branch on its next pass.
+func mergeCartLine(ctx context.Context, id string, furnitureID int, variantID string, quantity int, unitPrice float64) error {
+	carts := database.Collection(cartsCollectionName)
+	key := bson.M{"furniture_id": furnitureID, "variant_id": variantID}
+	now := time.Now()
+
+	for attempt := 0; attempt < 3; attempt++ {
+		result, err := carts.UpdateOne(ctx,
+			bson.M{"_id": id, "items": bson.M{"$elemMatch": key}},
+			bson.M{
+				"$inc": bson.M{"items.$.quantity": quantity},
+				"$set": bson.M{"items.$.unit_price": unitPrice, "updated_at": now},
+			},
+		)
+		if err != nil {
+			return err
+		}
+		if result.MatchedCount > 0 {
+			return nil
+		}
+
+		line := CartItem{FurnitureID: furnitureID, VariantID: variantID, Quantity: quantity, UnitPrice: unitPrice, AddedAt: now}
+		_, err = carts.UpdateOne(ctx,
+			bson.M{"_id": id, "items": bson.M{"$not": bson.M{"$elemMatch": key}}},
+			bson.M{
+				"$push":        bson.M{"items": line},
+				"$set":         bson.M{"updated_at": now},
+				"$setOnInsert": bson.M{"created_at": now},
+			},
+			options.Update().SetUpsert(true),
+		)
+		// A duplicate key means the cart exists and already has the line.
+		if !mongo.IsDuplicateKeyError(err) {
+			return err
+		}
+	}
+	return errors.New("cart kept changing while adding the item")
+}
+
+func removeCartItem(w http.ResponseWriter, r *http.Request) {
+	furnitureID, err := strconv.Atoi(r.URL.Query().Get("furniture_id"))
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "furniture_id must be an integer")
+		return
+	}
+	variantID := r.URL.Query().Get("variant_id")
+
+	id, ok := cartID(r)
+	if !ok {
+		writeJSONError(w, http.StatusNotFound, "Item is not in the cart")
+		return
+	}
+	result, err := database.Collection(cartsCollectionName).UpdateOne(r.Context(),
+		bson.M{"_id": id, "items": bson.M{"$elemMatch": bson.M{"furniture_id": furnitureID, "variant_id": variantID}}},
+		bson.M{
+			"$pull": bson.M{"items": bson.M{"furniture_id": furnitureID, "variant_id": variantID}},
+			"$set":  bson.M{"updated_at": time.Now()},
+		},
+	)
+	if err != nil {
+		fmt.Println("Error removing cart item:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to update cart")
+		return
+	}
+	if result.MatchedCount == 0 {
+		writeJSONError(w, http.StatusNotFound, "Item is not in the cart")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func clearCart(ctx context.Context, id string) error {
+	_, err := database.Collection(cartsCollectionName).UpdateOne(ctx,
+		bson.M{"_id": id},
+		bson.M{"$set": bson.M{"items": []CartItem{}, "updated_at": time.Now()}},
+	)
+	return err
+}
+
+func handleClearCart(w http.ResponseWriter, r *http.Request) {
+	if id, ok := cartID(r); ok {
+		if err := clearCart(r.Context(), id); err != nil {
+			fmt.Println("Error clearing cart:", err)
+			writeJSONError(w, http.StatusInternalServerError, "Failed to clear cart")
+			return
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type Category struct {
+	ID          primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+	Name        string             `json:"name" bson:"name"`
+	Slug        string             `json:"slug" bson:"slug"`
+	Description string             `json:"description" bson:"description"`
+	CreatedAt   time.Time          `json:"created_at" bson:"created_at"`
+}
+
+var (
+	slugPattern   = regexp.MustCompile(`^[a-z0-9]+(-[a-z0-9]+)*$`)
+	slugSeparator = regexp.MustCompile(`[^a-z0-9]+`)
+)
+
+func slugify(name string) string {
+	return strings.Trim(slugSeparator.ReplaceAllString(strings.ToLower(name), "-"), "-")
+}
+
+func createCategoryIndexes() error {
+	_, err := database.Collection(categoriesCollectionName).Indexes().CreateOne(context.TODO(), mongo.IndexModel{
+		Keys:    bson.D{{Key: "slug", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	return err
+}
+
+func findCategoryBySlug(ctx context.Context, slug string) (Category, error) {
+	var category Category
+	err := database.Collection(categoriesCollectionName).FindOne(ctx, bson.M{"slug": slug}).Decode(&category)
+	return category, err
+}
+
+func categoryExists(ctx context.Context, id primitive.ObjectID) (bool, error) {
+	count, err := database.Collection(categoriesCollectionName).CountDocuments(ctx, bson.M{"_id": id})
+	return count > 0, err
+}
+
+func handleCategories(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		listCategories(w, r)
+	case http.MethodPost:
+		createCategory(w, r)
+	case http.MethodDelete:
+		deleteCategory(w, r)
+	default:
+		writeJSONError(w, http.StatusMethodNotAllowed, "Method not allowed")
+	}
+}
+
+func listCategories(w http.ResponseWriter, r *http.Request) {
+	opts := options.Find().SetSort(bson.D{{Key: "name", Value: 1}})
+	cursor, err := database.Collection(categoriesCollectionName).Find(r.Context(), bson.M{}, opts)
+	if err != nil {
+		fmt.Println("Error querying categories:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to load categories")
+		return
+	}
+	defer cursor.Close(r.Context())
+
+	categories := []Category{}
+	if err := cursor.All(r.Context(), &categories); err != nil {
+		fmt.Println("Error decoding categories:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to load categories")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, categories)
+}
+
+func createCategory(w http.ResponseWriter, r *http.Request) {
+	var category Category
+	if !decodeJSON(w, r, &category) {
+		return
+	}
+
+	category.ID = primitive.NilObjectID
+	category.Name = strings.TrimSpace(category.Name)
+	if category.Name == "" {
+		writeJSONError(w, http.StatusBadRequest, "name is required")
+		return
+	}
+	if category.Slug == "" {
+		category.Slug = slugify(category.Name)
+	}
+	if !slugPattern.MatchString(category.Slug) {
+		writeJSONError(w, http.StatusBadRequest, "slug may only contain lowercase letters, digits and dashes")
+		return
+	}
+	category.CreatedAt = time.Now()
+
+	result, err := database.Collection(categoriesCollectionName).InsertOne(r.Context(), category)
+	if mongo.IsDuplicateKeyError(err) {
+		writeJSONError(w, http.StatusConflict, "Category with slug "+category.Slug+" already exists")
+		return
+	}
+	if err != nil {
+		fmt.Println("Error inserting category:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to create category")
+		return
+	}
+	category.ID = result.InsertedID.(primitive.ObjectID)
+
+	writeJSON(w, http.StatusCreated, category)
+}
+
+// deleteCategory refuses to remove a category that furniture still points at,
+// so items never reference a missing category.
+func deleteCategory(w http.ResponseWriter, r *http.Request) {
+	category, err := findCategoryBySlug(r.Context(), r.URL.Query().Get("slug"))
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		writeJSONError(w, http.StatusNotFound, "Category not found")
+		return
+	}
+	if err != nil {
+		fmt.Println("Error finding category:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to delete category")
+		return
+	}
+
+	inUse, err := database.Collection(furnitureCollectionName).CountDocuments(r.Context(), bson.M{"category_id": category.ID})
+	if err != nil {
+		fmt.Println("Error counting furniture in category:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to delete category")
+		return
+	}
+	if inUse > 0 {
+		writeJSONError(w, http.StatusConflict, fmt.Sprintf("Category is still used by %d furniture items", inUse))
+		return
+	}
+
+	if _, err := database.Collection(categoriesCollectionName).DeleteOne(r.Context(), bson.M{"_id": category.ID}); err != nil {
+		fmt.Println("Error deleting category:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to delete category")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
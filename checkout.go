@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type checkoutRequest struct {
+	UserID         *primitive.ObjectID `json:"user_id"`
+	Customer       Customer            `json:"customer"`
+	CouponCode     string              `json:"coupon_code"`
+	UseStoreCredit bool                `json:"use_store_credit"`
+	AddressID      *primitive.ObjectID `json:"address_id"`
+}
+
+type priceChange struct {
+	FurnitureID int     `json:"furniture_id"`
+	VariantID   string  `json:"variant_id,omitempty"`
+	OldPrice    float64 `json:"old_price"`
+	NewPrice    float64 `json:"new_price"`
+}
+
+// handleCheckout turns the caller's cart into an order. Stock, the order and
+// the emptied cart are written together by placeOrder, so a failure leaves
+// the cart as it was. If a price moved since the item was added, nothing is
+// ordered: the cart takes the new prices and the changes come back as 409,
+// so checking out again means the customer accepted them.
+func handleCheckout(w http.ResponseWriter, r *http.Request) {
+	var body checkoutRequest
+	if !decodeJSON(w, r, &body) {
+		return
+	}
+
+	id, ok := cartID(r)
+	if !ok {
+		writeValidationErrors(w, "Cart is empty", []fieldError{{Field: "cart", Message: "the cart has no items"}})
+		return
+	}
+	cart, err := loadCart(r.Context(), id)
+	if err != nil {
+		fmt.Println("Error loading cart:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to check out")
+		return
+	}
+	if len(cart.Items) == 0 {
+		writeValidationErrors(w, "Cart is empty", []fieldError{{Field: "cart", Message: "the cart has no items"}})
+		return
+	}
+
+	req := orderRequest{UserID: body.UserID, Customer: body.Customer, Items: cart.orderItems(), CartID: id, CouponCode: body.CouponCode, UseStoreCredit: body.UseStoreCredit, AddressID: body.AddressID}
+	order, catalogue, ok := prepareOrder(w, r, &req)
+	if !ok {
+		return
+	}
+
+	var changes []priceChange
+	for i, line := range cart.Items {
+		if math.Abs(line.UnitPrice-order.Items[i].UnitPrice) > totalEpsilon {
+			changes = append(changes, priceChange{
+				FurnitureID: line.FurnitureID,
+				VariantID:   line.VariantID,
+				OldPrice:    line.UnitPrice,
+				NewPrice:    order.Items[i].UnitPrice,
+			})
+		}
+	}
+	if len(changes) > 0 {
+		for _, change := range changes {
+			_, err := database.Collection(cartsCollectionName).UpdateOne(r.Context(),
+				bson.M{"_id": id, "items": bson.M{"$elemMatch": bson.M{"furniture_id": change.FurnitureID, "variant_id": change.VariantID}}},
+				bson.M{"$set": bson.M{"items.$.unit_price": change.NewPrice}},
+			)
+			if err != nil {
+				fmt.Println("Error updating cart prices:", err)
+				writeJSONError(w, http.StatusInternalServerError, "Failed to check out")
+				return
+			}
+		}
+		writeErrorDetails(w, http.StatusConflict, "price_changed", "Prices changed since the items were added to the cart", changes)
+		return
+	}
+
+	completeOrder(w, r, &order, catalogue, id)
+}
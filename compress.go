@@ -0,0 +1,171 @@
+package main
+
+import (
+	"compress/gzip"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// compressMinBytes is the smallest response worth compressing; below it the
+// gzip header and trailer eat most of the gain.
+const compressMinBytes = 1024
+
+var gzipWriters = sync.Pool{
+	New: func() interface{} { return gzip.NewWriter(nil) },
+}
+
+// incompressibleTypes are content types that are compressed already.
+var incompressibleTypes = []string{
+	"image/", "video/", "audio/", "font/woff",
+	"application/zip", "application/gzip", "application/x-gzip",
+	"application/pdf", "application/octet-stream",
+}
+
+// compressResponses gzips responses for clients that accept it. The
+// decision waits for compressMinBytes of body, so short answers go out as
+// they are, unless the handler flushes first: streaming exports are
+// compressed from the start and every flush reaches the client.
+func compressResponses(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if r.Method == http.MethodHead || !acceptsGzip(r.Header.Get("Accept-Encoding")) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		gw := &gzipResponseWriter{ResponseWriter: w}
+		// No defer: after a panic the buffered part is dropped and
+		// recoverPanics answers instead.
+		next.ServeHTTP(gw, r)
+		gw.finish()
+	})
+}
+
+// acceptsGzip reports whether an Accept-Encoding header allows gzip, either
+// by name or through "*", with a non-zero quality.
+func acceptsGzip(header string) bool {
+	for _, part := range strings.Split(header, ",") {
+		coding, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		coding = strings.ToLower(strings.TrimSpace(coding))
+		if coding != "gzip" && coding != "*" {
+			continue
+		}
+		if q, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if quality, err := strconv.ParseFloat(q, 64); err == nil && quality == 0 {
+				continue
+			}
+		}
+		return true
+	}
+	return false
+}
+
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	status  int
+	buf     []byte
+	decided bool
+	gz      *gzip.Writer
+}
+
+func (gw *gzipResponseWriter) WriteHeader(status int) {
+	if gw.decided || gw.status != 0 {
+		return
+	}
+	if status == http.StatusNoContent || status == http.StatusNotModified {
+		// No body to compress.
+		gw.decided = true
+		gw.ResponseWriter.WriteHeader(status)
+		return
+	}
+	gw.status = status
+}
+
+func (gw *gzipResponseWriter) Write(b []byte) (int, error) {
+	if !gw.decided {
+		gw.buf = append(gw.buf, b...)
+		if len(gw.buf) < compressMinBytes {
+			return len(b), nil
+		}
+		if err := gw.start(true); err != nil {
+			return 0, err
+		}
+		return len(b), nil
+	}
+	if gw.gz != nil {
+		return gw.gz.Write(b)
+	}
+	return gw.ResponseWriter.Write(b)
+}
+
+// Flush compresses a flushed response even when it is still short, since
+// more is coming.
+func (gw *gzipResponseWriter) Flush() {
+	if !gw.decided {
+		gw.start(true)
+	}
+	if gw.gz != nil {
+		gw.gz.Flush()
+	}
+	if flusher, ok := gw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (gw *gzipResponseWriter) Unwrap() http.ResponseWriter {
+	return gw.ResponseWriter
+}
+
+// start sends the header and the buffered body, compressed if compress is
+// set and the content type and headers allow it.
+func (gw *gzipResponseWriter) start(compress bool) error {
+	header := gw.Header()
+	if header.Get("Content-Type") == "" && len(gw.buf) > 0 {
+		// Sniff the uncompressed bytes; net/http would sniff the gzip ones.
+		header.Set("Content-Type", http.DetectContentType(gw.buf))
+	}
+	compress = compress && header.Get("Content-Encoding") == "" &&
+		header.Get("Content-Range") == "" && compressible(header.Get("Content-Type"))
+	gw.decided = true
+	if compress {
+		header.Set("Content-Encoding", "gzip")
+		header.Del("Content-Length")
+		gw.gz = gzipWriters.Get().(*gzip.Writer)
+		gw.gz.Reset(gw.ResponseWriter)
+	}
+	if gw.status != 0 {
+		gw.ResponseWriter.WriteHeader(gw.status)
+	}
+	buf := gw.buf
+	gw.buf = nil
+	if len(buf) == 0 {
+		return nil
+	}
+	_, err := gw.Write(buf)
+	return err
+}
+
+// finish sends a response that stayed below compressMinBytes as it is and
+// closes the compressor of a longer one.
+func (gw *gzipResponseWriter) finish() {
+	if !gw.decided {
+		gw.start(false)
+	}
+	if gw.gz != nil {
+		gw.gz.Close()
+		gw.gz.Reset(nil)
+		gzipWriters.Put(gw.gz)
+		gw.gz = nil
+	}
+}
+
+func compressible(contentType string) bool {
+	contentType = strings.ToLower(contentType)
+	for _, prefix := range incompressibleTypes {
+		if strings.HasPrefix(contentType, prefix) {
+			return false
+		}
+	}
+	return true
+}
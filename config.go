@@ -0,0 +1,433 @@
+package main
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	envDevelopment = "development"
+	envProduction  = "production"
+
+	// minJWTSecretLength is the shortest JWT_SECRET production accepts; HS256
+	// keys should be at least as long as the hash.
+	minJWTSecretLength = 32
+)
+
+// Config is what the server reads from the environment at startup. The
+// defaults run it against a local MongoDB, as a development setup.
+type Config struct {
+	// Env is APP_ENV, development or production. Production refuses to
+	// start without a proper JWT_SECRET.
+	Env string
+
+	MongoURI             string
+	DBName               string
+	MongoConnectAttempts int
+	MongoConnectTimeout  time.Duration
+
+	HTTPAddr string
+	// PublicBaseURL is where links in emails point.
+	PublicBaseURL string
+
+	// JWTSecret signs access tokens. Outside production it may be empty, and
+	// a random secret is used, which invalidates all tokens on every restart.
+	JWTSecret string
+
+	GoogleClientID     string
+	GoogleClientSecret string
+	GoogleRedirectURL  string
+
+	SMTP mailer
+
+	RequestTimeout  time.Duration
+	ExportTimeout   time.Duration
+	ShutdownTimeout time.Duration
+	// ShutdownDrainDelay may be zero, to stop taking requests right away.
+	ShutdownDrainDelay time.Duration
+
+	LogLevel             slog.Level
+	SlowRequestThreshold time.Duration
+	MaxBodyBytes         int64
+
+	// TrustedProxyHops is how many proxies in front of the server append to
+	// TrustedProxyHeader; zero ignores the header.
+	TrustedProxyHops   int
+	TrustedProxyHeader string
+
+	// CORSAllowedOrigins are origins such as "https://shop.example.com", or
+	// "*". Empty allows same-origin pages only.
+	CORSAllowedOrigins []string
+	CORSAllowedMethods string
+	CORSAllowedHeaders string
+	CORSMaxAge         time.Duration
+
+	RateLimitAuth      rateLimitConfig
+	RateLimitOrders    rateLimitConfig
+	RateLimitCatalogue rateLimitConfig
+
+	DebugEndpoints bool
+	MetricsToken   string
+	// AdminEmail is promoted to admin at startup.
+	AdminEmail string
+
+	OTELServiceName string
+	// OTELTracesEndpoint is where spans are sent; empty keeps them local.
+	OTELTracesEndpoint string
+}
+
+// loadConfig reads the configuration and checks it. The error lists every
+// problem at once, so a broken deploy can be fixed in one go.
+func loadConfig() (Config, error) {
+	env := &envReader{}
+	cfg := Config{
+		Env:                  envOr("APP_ENV", envDevelopment),
+		MongoURI:             envOr("MONGO_URI", "mongodb://localhost:27017"),
+		DBName:               envOr("DB_NAME", "furnitureShopDB"),
+		MongoConnectAttempts: env.positiveInt("MONGO_CONNECT_ATTEMPTS", 10),
+		MongoConnectTimeout:  env.duration("MONGO_CONNECT_TIMEOUT", time.Minute),
+		HTTPAddr:             envOr("HTTP_ADDR", ":8080"),
+		PublicBaseURL:        strings.TrimRight(envOr("PUBLIC_BASE_URL", "http://localhost:8080"), "/"),
+		JWTSecret:            os.Getenv("JWT_SECRET"),
+		GoogleClientID:       os.Getenv("GOOGLE_CLIENT_ID"),
+		GoogleClientSecret:   os.Getenv("GOOGLE_CLIENT_SECRET"),
+		SMTP: mailer{
+			Host:     os.Getenv("SMTP_HOST"),
+			Port:     env.positiveInt("SMTP_PORT", 587),
+			Username: os.Getenv("SMTP_USERNAME"),
+			Password: os.Getenv("SMTP_PASSWORD"),
+			From:     envOr("SMTP_FROM", "orders@furniture-shop.local"),
+		},
+		RequestTimeout:  env.duration("REQUEST_TIMEOUT", 5*time.Second),
+		ExportTimeout:   env.duration("EXPORT_TIMEOUT", 2*time.Minute),
+		ShutdownTimeout: env.duration("SHUTDOWN_TIMEOUT", 30*time.Second),
+
+		ShutdownDrainDelay:   env.nonNegativeDuration("SHUTDOWN_DRAIN_DELAY", 5*time.Second),
+		LogLevel:             env.logLevel("LOG_LEVEL", slog.LevelInfo),
+		SlowRequestThreshold: env.duration("SLOW_REQUEST_THRESHOLD", time.Second),
+		MaxBodyBytes:         int64(env.positiveInt("MAX_BODY_BYTES", 1<<20)),
+		TrustedProxyHops:     env.nonNegativeInt("TRUSTED_PROXY_HOPS", 0),
+		TrustedProxyHeader:   http.CanonicalHeaderKey(strings.TrimSpace(envOr("TRUSTED_PROXY_HEADER", "X-Forwarded-For"))),
+		CORSAllowedOrigins:   splitList(os.Getenv("CORS_ALLOWED_ORIGINS")),
+		CORSAllowedMethods:   joinList(envOr("CORS_ALLOWED_METHODS", defaultCORSMethods)),
+		CORSAllowedHeaders:   joinList(envOr("CORS_ALLOWED_HEADERS", defaultCORSHeaders)),
+		CORSMaxAge:           env.duration("CORS_MAX_AGE", defaultCORSMaxAge),
+		RateLimitAuth:        env.rateLimit("RATE_LIMIT_AUTH", rateLimitConfig{10, time.Minute}),
+		RateLimitOrders:      env.rateLimit("RATE_LIMIT_ORDERS", rateLimitConfig{20, time.Minute}),
+		RateLimitCatalogue:   env.rateLimit("RATE_LIMIT_CATALOGUE", rateLimitConfig{300, time.Minute}),
+		DebugEndpoints:       env.bool("DEBUG_ENDPOINTS", true),
+		MetricsToken:         os.Getenv("METRICS_TOKEN"),
+		AdminEmail:           strings.ToLower(strings.TrimSpace(os.Getenv("ADMIN_EMAIL"))),
+		OTELServiceName:      envOr("OTEL_SERVICE_NAME", "shop"),
+	}
+	cfg.GoogleRedirectURL = envOr("GOOGLE_REDIRECT_URL", cfg.PublicBaseURL+"/auth/google/callback")
+	// Without an SMTP host mail is only logged.
+	cfg.SMTP.DryRun = cfg.SMTP.Host == "" || env.bool("EMAIL_DRY_RUN", false)
+	// As the OpenTelemetry SDKs read them: the traces endpoint, or the traces
+	// path under the general one.
+	cfg.OTELTracesEndpoint = os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT")
+	if base := os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"); cfg.OTELTracesEndpoint == "" && base != "" {
+		cfg.OTELTracesEndpoint = strings.TrimSuffix(base, "/") + "/v1/traces"
+	}
+
+	return cfg, errors.Join(append(env.errs, cfg.validate()...)...)
+}
+
+func (c Config) validate() []error {
+	var errs []error
+	if c.Env != envDevelopment && c.Env != envProduction {
+		errs = append(errs, fmt.Errorf("APP_ENV must be %s or %s", envDevelopment, envProduction))
+	}
+	if !strings.HasPrefix(c.MongoURI, "mongodb://") && !strings.HasPrefix(c.MongoURI, "mongodb+srv://") {
+		errs = append(errs, errors.New("MONGO_URI must start with mongodb:// or mongodb+srv://"))
+	}
+	if c.DBName == "" || strings.ContainsAny(c.DBName, `/\. "$`) {
+		errs = append(errs, errors.New(`DB_NAME must not be empty or contain any of /\. "$`))
+	}
+	if _, port, err := net.SplitHostPort(c.HTTPAddr); err != nil || port == "" {
+		errs = append(errs, errors.New("HTTP_ADDR must be host:port or :port"))
+	}
+	if u, err := url.Parse(c.PublicBaseURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		errs = append(errs, errors.New("PUBLIC_BASE_URL must be an absolute http or https URL"))
+	}
+	if c.Env == envProduction && len(c.JWTSecret) < minJWTSecretLength {
+		errs = append(errs, fmt.Errorf("JWT_SECRET must be set to at least %d bytes in production", minJWTSecretLength))
+	}
+	if c.GoogleClientID != "" && c.GoogleClientSecret == "" {
+		errs = append(errs, errors.New("GOOGLE_CLIENT_SECRET is required with GOOGLE_CLIENT_ID"))
+	}
+	if _, err := mail.ParseAddress(c.SMTP.From); err != nil {
+		errs = append(errs, errors.New("SMTP_FROM must be an email address"))
+	}
+	if c.SMTP.Port > 65535 {
+		errs = append(errs, errors.New("SMTP_PORT must be a port number"))
+	}
+	if !validHeaderName(c.TrustedProxyHeader) {
+		errs = append(errs, errors.New("TRUSTED_PROXY_HEADER must be a header name"))
+	}
+	for _, origin := range c.CORSAllowedOrigins {
+		if origin == "*" {
+			continue
+		}
+		if u, err := url.Parse(origin); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" ||
+			strings.TrimSuffix(u.Path, "/") != "" || u.RawQuery != "" || u.User != nil {
+			errs = append(errs, fmt.Errorf("CORS_ALLOWED_ORIGINS must list \"*\" or origins such as https://shop.example.com, got %q", origin))
+		}
+	}
+	if c.CORSAllowedMethods == "" || c.CORSAllowedHeaders == "" {
+		errs = append(errs, errors.New("CORS_ALLOWED_METHODS and CORS_ALLOWED_HEADERS must not be empty"))
+	}
+	if c.AdminEmail != "" {
+		if _, err := mail.ParseAddress(c.AdminEmail); err != nil {
+			errs = append(errs, errors.New("ADMIN_EMAIL must be an email address"))
+		}
+	}
+	if c.OTELServiceName == "" {
+		errs = append(errs, errors.New("OTEL_SERVICE_NAME must not be empty"))
+	}
+	if c.OTELTracesEndpoint != "" {
+		if u, err := url.Parse(c.OTELTracesEndpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, errors.New("OTEL_EXPORTER_OTLP_ENDPOINT and OTEL_EXPORTER_OTLP_TRACES_ENDPOINT must be absolute http or https URLs"))
+		}
+	}
+	return errs
+}
+
+func validHeaderName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, r := range name {
+		if !(r == '-' || r >= '0' && r <= '9' || r >= 'A' && r <= 'Z' || r >= 'a' && r <= 'z') {
+			return false
+		}
+	}
+	return true
+}
+
+// apply hands the configuration to the parts of the server that use it.
+// main calls it before registering any route.
+func (c Config) apply() {
+	mongoConnectAttempts = c.MongoConnectAttempts
+	mongoConnectTimeout = c.MongoConnectTimeout
+	publicBaseURL = c.PublicBaseURL
+	jwtSecret = jwtSecretFrom(c.JWTSecret)
+	googleOAuth.ClientID = c.GoogleClientID
+	googleOAuth.ClientSecret = c.GoogleClientSecret
+	googleOAuth.RedirectURL = c.GoogleRedirectURL
+	smtp := c.SMTP
+	emailSender = &smtp
+	requestTimeout = c.RequestTimeout
+	exportTimeout = c.ExportTimeout
+	shutdownTimeout = c.ShutdownTimeout
+	readinessDrainDelay = c.ShutdownDrainDelay
+	logLevel.Set(c.LogLevel)
+	slowRequestThreshold = c.SlowRequestThreshold
+	maxBodyBytes = c.MaxBodyBytes
+	trustedProxyHops = c.TrustedProxyHops
+	trustedProxyHeader = c.TrustedProxyHeader
+	cors = newCORSPolicy(c.CORSAllowedOrigins, c.CORSAllowedMethods, c.CORSAllowedHeaders, c.CORSMaxAge)
+	authLimiter = c.RateLimitAuth.limiter()
+	orderLimiter = c.RateLimitOrders.limiter()
+	catalogueLimiter = c.RateLimitCatalogue.limiter()
+	rateLimiters = []*rateLimiter{authLimiter, orderLimiter, catalogueLimiter}
+	debugEndpoints = c.DebugEndpoints
+	metricsToken = c.MetricsToken
+	serviceName = c.OTELServiceName
+	spanExporter = newSpanExporter(c.OTELTracesEndpoint)
+}
+
+func jwtSecretFrom(configured string) []byte {
+	if configured != "" {
+		return []byte(configured)
+	}
+	fmt.Println("JWT_SECRET is not set; using a random secret, tokens will not survive a restart")
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		panic(err)
+	}
+	return secret
+}
+
+// LogValue is the configuration as logged at startup, without secrets.
+func (c Config) LogValue() slog.Value {
+	return slog.GroupValue(
+		slog.String("env", c.Env),
+		slog.String("mongo_uri", redactURL(c.MongoURI)),
+		slog.String("db_name", c.DBName),
+		slog.Int("mongo_connect_attempts", c.MongoConnectAttempts),
+		slog.String("mongo_connect_timeout", c.MongoConnectTimeout.String()),
+		slog.String("http_addr", c.HTTPAddr),
+		slog.String("public_base_url", c.PublicBaseURL),
+		slog.String("jwt_secret", jwtSecretSummary(c.JWTSecret)),
+		slog.String("google_client_id", c.GoogleClientID),
+		slog.String("google_client_secret", redactSecret(c.GoogleClientSecret)),
+		slog.String("google_redirect_url", c.GoogleRedirectURL),
+		slog.String("smtp_host", c.SMTP.Host),
+		slog.Int("smtp_port", c.SMTP.Port),
+		slog.String("smtp_username", c.SMTP.Username),
+		slog.String("smtp_password", redactSecret(c.SMTP.Password)),
+		slog.String("smtp_from", c.SMTP.From),
+		slog.Bool("email_dry_run", c.SMTP.DryRun),
+		slog.String("request_timeout", c.RequestTimeout.String()),
+		slog.String("export_timeout", c.ExportTimeout.String()),
+		slog.String("shutdown_timeout", c.ShutdownTimeout.String()),
+		slog.String("shutdown_drain_delay", c.ShutdownDrainDelay.String()),
+		slog.String("log_level", c.LogLevel.String()),
+		slog.String("slow_request_threshold", c.SlowRequestThreshold.String()),
+		slog.Int64("max_body_bytes", c.MaxBodyBytes),
+		slog.Int("trusted_proxy_hops", c.TrustedProxyHops),
+		slog.String("trusted_proxy_header", c.TrustedProxyHeader),
+		slog.String("cors_allowed_origins", strings.Join(c.CORSAllowedOrigins, ", ")),
+		slog.String("cors_allowed_methods", c.CORSAllowedMethods),
+		slog.String("cors_allowed_headers", c.CORSAllowedHeaders),
+		slog.String("cors_max_age", c.CORSMaxAge.String()),
+		slog.String("rate_limit_auth", c.RateLimitAuth.String()),
+		slog.String("rate_limit_orders", c.RateLimitOrders.String()),
+		slog.String("rate_limit_catalogue", c.RateLimitCatalogue.String()),
+		slog.Bool("debug_endpoints", c.DebugEndpoints),
+		slog.String("metrics_token", redactSecret(c.MetricsToken)),
+		slog.String("admin_email", c.AdminEmail),
+		slog.String("otel_service_name", c.OTELServiceName),
+		slog.String("otel_traces_endpoint", redactURL(c.OTELTracesEndpoint)),
+	)
+}
+
+func jwtSecretSummary(secret string) string {
+	if secret == "" {
+		return "[random]"
+	}
+	return redactSecret(secret)
+}
+
+func redactSecret(secret string) string {
+	if secret == "" {
+		return ""
+	}
+	return "[redacted]"
+}
+
+// redactURL hides the password in a connection string.
+func redactURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "[unparsable]"
+	}
+	return u.Redacted()
+}
+
+func envOr(name, fallback string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return fallback
+}
+
+// envReader parses typed environment variables, collecting what is wrong
+// instead of stopping at the first problem.
+type envReader struct {
+	errs []error
+}
+
+func (e *envReader) duration(name string, fallback time.Duration) time.Duration {
+	raw := os.Getenv(name)
+	if raw == "" {
+		return fallback
+	}
+	value, err := time.ParseDuration(raw)
+	if err != nil || value <= 0 {
+		e.errs = append(e.errs, fmt.Errorf("%s must be a positive duration such as \"10s\", got %q", name, raw))
+		return fallback
+	}
+	return value
+}
+
+// nonNegativeDuration is duration, where zero is allowed too.
+func (e *envReader) nonNegativeDuration(name string, fallback time.Duration) time.Duration {
+	raw := os.Getenv(name)
+	if raw == "" {
+		return fallback
+	}
+	value, err := time.ParseDuration(raw)
+	if err != nil || value < 0 {
+		e.errs = append(e.errs, fmt.Errorf("%s must be a duration of zero or more such as \"5s\", got %q", name, raw))
+		return fallback
+	}
+	return value
+}
+
+func (e *envReader) positiveInt(name string, fallback int) int {
+	raw := os.Getenv(name)
+	if raw == "" {
+		return fallback
+	}
+	value, err := strconv.Atoi(raw)
+	if err != nil || value <= 0 {
+		e.errs = append(e.errs, fmt.Errorf("%s must be a positive integer, got %q", name, raw))
+		return fallback
+	}
+	return value
+}
+
+func (e *envReader) nonNegativeInt(name string, fallback int) int {
+	raw := os.Getenv(name)
+	if raw == "" {
+		return fallback
+	}
+	value, err := strconv.Atoi(raw)
+	if err != nil || value < 0 {
+		e.errs = append(e.errs, fmt.Errorf("%s must be an integer of zero or more, got %q", name, raw))
+		return fallback
+	}
+	return value
+}
+
+func (e *envReader) logLevel(name string, fallback slog.Level) slog.Level {
+	raw := os.Getenv(name)
+	if raw == "" {
+		return fallback
+	}
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(raw)); err != nil {
+		e.errs = append(e.errs, fmt.Errorf("%s must be debug, info, warn or error, got %q", name, raw))
+		return fallback
+	}
+	return level
+}
+
+// rateLimit reads a limit such as "10/m", or "off".
+func (e *envReader) rateLimit(name string, fallback rateLimitConfig) rateLimitConfig {
+	raw := os.Getenv(name)
+	if raw == "" {
+		return fallback
+	}
+	limit, err := parseRate(raw)
+	if err != nil {
+		e.errs = append(e.errs, fmt.Errorf("%s must look like \"10/m\" (per s, m or h) or be \"off\", got %q", name, raw))
+		return fallback
+	}
+	return limit
+}
+
+func (e *envReader) bool(name string, fallback bool) bool {
+	raw := os.Getenv(name)
+	if raw == "" {
+		return fallback
+	}
+	value, err := strconv.ParseBool(raw)
+	if err != nil {
+		e.errs = append(e.errs, fmt.Errorf("%s must be true or false, got %q", name, raw))
+		return fallback
+	}
+	return value
+}
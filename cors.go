@@ -0,0 +1,116 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultCORSMethods = "GET, POST, PUT, PATCH, DELETE"
+	defaultCORSHeaders = "Authorization, Content-Type, If-Match, If-None-Match, Idempotency-Key, " +
+		apiKeyHeader + ", " + requestIDHeader + ", " + traceParentHeader
+	defaultCORSMaxAge = 10 * time.Minute
+)
+
+// corsPolicy says which other origins may call the API from a browser.
+// CORS_ALLOWED_ORIGINS is a comma-separated list of origins such as
+// "https://shop.example.com", or "*" for any origin; it is empty by default,
+// so only same-origin pages work. Credentials (the session and cart cookies)
+// are only allowed for origins that are listed by name.
+type corsPolicy struct {
+	origins    map[string]bool
+	anyOrigin  bool
+	methods    string
+	headers    string
+	expose     string
+	maxAge     string
+	configured bool
+}
+
+var cors = newCORSPolicy(nil, defaultCORSMethods, defaultCORSHeaders, defaultCORSMaxAge)
+
+// newCORSPolicy allows origins, which are origins as splitList returns them
+// or "*", to use methods and headers, comma-separated lists. Preflights are
+// cached for maxAge.
+func newCORSPolicy(origins []string, methods, headers string, maxAge time.Duration) *corsPolicy {
+	p := &corsPolicy{
+		origins: map[string]bool{},
+		methods: joinList(methods),
+		headers: joinList(headers),
+		expose: strings.Join([]string{"ETag", "Deprecation", "Link", "Retry-After",
+			"Idempotent-Replayed", "Content-Disposition", requestIDHeader, traceIDHeader}, ", "),
+		maxAge: strconv.Itoa(int(maxAge.Seconds())),
+	}
+	for _, origin := range origins {
+		if origin == "*" {
+			p.anyOrigin = true
+		} else {
+			p.origins[strings.TrimSuffix(origin, "/")] = true
+		}
+	}
+	p.configured = p.anyOrigin || len(p.origins) > 0
+	return p
+}
+
+// splitList is the non-empty items of a comma-separated list.
+func splitList(raw string) []string {
+	var items []string
+	for _, item := range strings.Split(raw, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func joinList(raw string) string {
+	return strings.Join(splitList(raw), ", ")
+}
+
+// handleCORS adds the CORS headers for allowed origins and answers
+// preflights itself, before the mux, so route's method check never sees
+// them. Requests from other origins get no CORS headers and are left for
+// the browser to block.
+func handleCORS(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+		if origin == "" || !cors.configured {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		header := w.Header()
+		if !cors.anyOrigin {
+			// The answer depends on the origin, so caches must keep them apart.
+			header.Add("Vary", "Origin")
+		}
+		allowed := cors.anyOrigin || cors.origins[origin]
+		if allowed {
+			if cors.origins[origin] {
+				header.Set("Access-Control-Allow-Origin", origin)
+				header.Set("Access-Control-Allow-Credentials", "true")
+			} else {
+				header.Set("Access-Control-Allow-Origin", "*")
+			}
+		}
+
+		if !preflight {
+			if allowed {
+				header.Set("Access-Control-Expose-Headers", cors.expose)
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+		header.Add("Vary", "Access-Control-Request-Method")
+		header.Add("Vary", "Access-Control-Request-Headers")
+		if allowed {
+			header.Set("Access-Control-Allow-Methods", cors.methods)
+			header.Set("Access-Control-Allow-Headers", cors.headers)
+			header.Set("Access-Control-Max-Age", cors.maxAge)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
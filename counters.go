@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"errors"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type counter struct {
+	Name string `bson:"_id"`
+	Seq  int    `bson:"seq"`
+}
+
+// reserveSequence atomically advances the named counter by n and returns the
+// first of the n values reserved. Concurrent callers always get disjoint ranges.
+func reserveSequence(ctx context.Context, name string, n int) (int, error) {
+	var c counter
+	advance := func() error {
+		return database.Collection(countersCollectionName).FindOneAndUpdate(
+			ctx,
+			bson.M{"_id": name},
+			bson.M{"$inc": bson.M{"seq": n}},
+			options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After),
+		).Decode(&c)
+	}
+	err := advance()
+	if mongo.IsDuplicateKeyError(err) {
+		// The first callers of a new counter can race to insert it; the
+		// losers find it on a second try.
+		err = advance()
+	}
+	if err != nil {
+		return 0, err
+	}
+	return c.Seq - n + 1, nil
+}
+
+func nextSequence(ctx context.Context, name string) (int, error) {
+	return reserveSequence(ctx, name, 1)
+}
+
+// raiseSequence makes sure the named counter is at least value, so IDs
+// handed out later never collide with documents that already exist.
+func raiseSequence(ctx context.Context, name string, value int) error {
+	_, err := database.Collection(countersCollectionName).UpdateOne(
+		ctx,
+		bson.M{"_id": name},
+		bson.M{"$max": bson.M{"seq": value}},
+		options.Update().SetUpsert(true),
+	)
+	return err
+}
+
+// syncFurnitureCounter aligns the furniture counter with the highest ID
+// already in the collection, e.g. the seeded inventory.
+func syncFurnitureCounter() error {
+	var last Furniture
+	opts := options.FindOne().SetSort(bson.D{{Key: "_id", Value: -1}})
+	err := database.Collection(furnitureCollectionName).FindOne(context.TODO(), bson.D{}, opts).Decode(&last)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return raiseSequence(context.TODO(), furnitureCollectionName, last.ID)
+}
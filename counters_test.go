@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestReserveSequenceConcurrentRangesAreDisjoint(t *testing.T) {
+	_, _ = testServer(t)
+	const callers, size = 20, 5
+
+	starts := make([]int, callers)
+	errs := make([]error, callers)
+	var wg sync.WaitGroup
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			starts[i], errs[i] = reserveSequence(context.Background(), "test", size)
+		}(i)
+	}
+	wg.Wait()
+
+	seen := map[int]bool{}
+	for i, start := range starts {
+		if errs[i] != nil {
+			t.Fatalf("reserveSequence: %v", errs[i])
+		}
+		for id := start; id < start+size; id++ {
+			if seen[id] {
+				t.Fatalf("%d reserved twice", id)
+			}
+			seen[id] = true
+		}
+	}
+	for id := 1; id <= callers*size; id++ {
+		if !seen[id] {
+			t.Errorf("%d never reserved", id)
+		}
+	}
+}
+
+func TestCreateFurnitureConcurrentIDsAreUniqueAndGapless(t *testing.T) {
+	h, _ := testServer(t)
+	token := testToken(t, User{ID: primitive.NewObjectID(), Role: roleAdmin})
+	const items = 50
+
+	ids := make([]int, items)
+	var wg sync.WaitGroup
+	for i := 0; i < items; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			body := fmt.Sprintf(`{"sku":"TEST-%d","name":"Item %d","price":10}`, i, i)
+			rec := serveTest(h, http.MethodPost, "/furniture", token, body)
+			if rec.Code != http.StatusCreated {
+				t.Errorf("POST /furniture = %d: %s", rec.Code, rec.Body)
+				return
+			}
+			var item Furniture
+			if err := json.Unmarshal(rec.Body.Bytes(), &item); err != nil {
+				t.Errorf("decode: %v", err)
+				return
+			}
+			ids[i] = item.ID
+		}(i)
+	}
+	wg.Wait()
+	if t.Failed() {
+		return
+	}
+
+	sort.Ints(ids)
+	for i, id := range ids {
+		if id != i+1 {
+			t.Fatalf("ids = %v, want 1 to %d without duplicates or gaps", ids, items)
+		}
+	}
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	couponTypePercent = "percent"
+	couponTypeFixed   = "fixed"
+)
+
+// Coupon is a discount code. UsageLimit 0 means unlimited; Used counts the
+// orders that redeemed it.
+type Coupon struct {
+	ID            primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+	Code          string             `json:"code" bson:"code"`
+	Type          string             `json:"type" bson:"type"`
+	Value         float64            `json:"value" bson:"value"`
+	MinOrderValue float64            `json:"min_order_value" bson:"min_order_value"`
+	UsageLimit    int                `json:"usage_limit" bson:"usage_limit"`
+	Used          int                `json:"used" bson:"used"`
+	ExpiresAt     *time.Time         `json:"expires_at,omitempty" bson:"expires_at,omitempty"`
+	CreatedAt     time.Time          `json:"created_at" bson:"created_at"`
+}
+
+// couponError says why a coupon cannot be applied. Reason is meant for
+// programs, Message for people.
+type couponError struct {
+	Reason  string
+	Message string
+}
+
+func (e *couponError) Error() string {
+	return e.Message
+}
+
+var (
+	errCouponNotFound  = &couponError{Reason: "coupon_not_found", Message: "coupon code does not exist"}
+	errCouponExpired   = &couponError{Reason: "coupon_expired", Message: "coupon has expired"}
+	errCouponExhausted = &couponError{Reason: "coupon_exhausted", Message: "coupon has no uses left"}
+)
+
+func writeCouponError(w http.ResponseWriter, err *couponError) {
+	writeErrorDetails(w, http.StatusUnprocessableEntity, err.Reason, err.Message,
+		[]fieldError{{Field: "coupon_code", Rule: err.Reason, Message: err.Message}})
+}
+
+func normalizeCouponCode(code string) string {
+	return strings.ToUpper(strings.TrimSpace(code))
+}
+
+func createCouponIndexes() error {
+	_, err := database.Collection(couponsCollectionName).Indexes().CreateOne(context.TODO(), mongo.IndexModel{
+		Keys:    bson.D{{Key: "code", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	return err
+}
+
+func (c *Coupon) validate() error {
+	c.Code = normalizeCouponCode(c.Code)
+	if c.Code == "" {
+		return errors.New("code is required")
+	}
+	switch c.Type {
+	case couponTypePercent:
+		if c.Value <= 0 || c.Value > 100 {
+			return errors.New("a percent coupon needs a value greater than 0 and at most 100")
+		}
+	case couponTypeFixed:
+		if c.Value <= 0 {
+			return errors.New("a fixed coupon needs a value greater than 0")
+		}
+	default:
+		return errors.New("type must be percent or fixed")
+	}
+	if c.MinOrderValue < 0 {
+		return errors.New("min_order_value must not be negative")
+	}
+	if c.UsageLimit < 0 {
+		return errors.New("usage_limit must not be negative")
+	}
+	return nil
+}
+
+// discountOn returns the amount taken off subtotal, rounded to whole cents
+// and never more than the subtotal itself.
+func (c Coupon) discountOn(subtotal float64) float64 {
+	discount := c.Value
+	if c.Type == couponTypePercent {
+		discount = subtotal * c.Value / 100
+	}
+	return math.Min(math.Round(discount*100)/100, subtotal)
+}
+
+// findApplicableCoupon loads the coupon for code and checks that it may be
+// used on an order worth subtotal right now. Remaining uses are checked here
+// for a clear answer up front; redeemCoupon checks them again atomically.
+func findApplicableCoupon(ctx context.Context, code string, subtotal float64) (Coupon, error) {
+	var coupon Coupon
+	err := database.Collection(couponsCollectionName).FindOne(ctx, bson.M{"code": normalizeCouponCode(code)}).Decode(&coupon)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return coupon, errCouponNotFound
+	}
+	if err != nil {
+		return coupon, err
+	}
+	if coupon.ExpiresAt != nil && !time.Now().Before(*coupon.ExpiresAt) {
+		return coupon, errCouponExpired
+	}
+	if subtotal < coupon.MinOrderValue {
+		return coupon, &couponError{
+			Reason:  "coupon_min_order_not_met",
+			Message: fmt.Sprintf("coupon needs an order of at least %.2f", coupon.MinOrderValue),
+		}
+	}
+	if coupon.UsageLimit > 0 && coupon.Used >= coupon.UsageLimit {
+		return coupon, errCouponExhausted
+	}
+	return coupon, nil
+}
+
+// redeemCoupon uses up one redemption. The limit is part of the update
+// filter, so with one use left only one of several concurrent orders wins.
+func redeemCoupon(ctx context.Context, id primitive.ObjectID) error {
+	result, err := database.Collection(couponsCollectionName).UpdateOne(ctx,
+		bson.M{"_id": id, "$or": bson.A{
+			bson.M{"usage_limit": 0},
+			bson.M{"$expr": bson.M{"$lt": bson.A{"$used", "$usage_limit"}}},
+		}},
+		bson.M{"$inc": bson.M{"used": 1}},
+	)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return errCouponExhausted
+	}
+	return nil
+}
+
+func unredeemCoupon(ctx context.Context, id primitive.ObjectID) error {
+	_, err := database.Collection(couponsCollectionName).UpdateOne(ctx,
+		bson.M{"_id": id, "used": bson.M{"$gt": 0}},
+		bson.M{"$inc": bson.M{"used": -1}},
+	)
+	return err
+}
+
+func handleCoupons(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		listCoupons(w, r)
+	case http.MethodPost:
+		createCoupon(w, r)
+	case http.MethodPut:
+		updateCoupon(w, r)
+	case http.MethodDelete:
+		deleteCoupon(w, r)
+	default:
+		writeJSONError(w, http.StatusMethodNotAllowed, "Method not allowed")
+	}
+}
+
+func listCoupons(w http.ResponseWriter, r *http.Request) {
+	opts := options.Find().SetSort(bson.D{{Key: "created_at", Value: -1}})
+	cursor, err := database.Collection(couponsCollectionName).Find(r.Context(), bson.M{}, opts)
+	if err != nil {
+		fmt.Println("Error querying coupons:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to load coupons")
+		return
+	}
+	defer cursor.Close(r.Context())
+
+	coupons := []Coupon{}
+	if err := cursor.All(r.Context(), &coupons); err != nil {
+		fmt.Println("Error decoding coupons:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to load coupons")
+		return
+	}
+	writeJSON(w, http.StatusOK, coupons)
+}
+
+func createCoupon(w http.ResponseWriter, r *http.Request) {
+	var coupon Coupon
+	if !decodeJSON(w, r, &coupon) {
+		return
+	}
+	if err := coupon.validate(); err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	coupon.ID = primitive.NilObjectID
+	coupon.Used = 0
+	coupon.CreatedAt = time.Now()
+	result, err := database.Collection(couponsCollectionName).InsertOne(r.Context(), coupon)
+	if mongo.IsDuplicateKeyError(err) {
+		writeJSONError(w, http.StatusConflict, "A coupon with this code already exists")
+		return
+	}
+	if err != nil {
+		fmt.Println("Error inserting coupon:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to create coupon")
+		return
+	}
+	coupon.ID = result.InsertedID.(primitive.ObjectID)
+	writeJSON(w, http.StatusCreated, coupon)
+}
+
+// updateCoupon replaces the coupon's settings; the redemption count is kept.
+func updateCoupon(w http.ResponseWriter, r *http.Request) {
+	id, ok := parseObjectID(w, r)
+	if !ok {
+		return
+	}
+
+	var coupon Coupon
+	if !decodeJSON(w, r, &coupon) {
+		return
+	}
+	if err := coupon.validate(); err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	update := bson.M{"$set": bson.M{
+		"code":            coupon.Code,
+		"type":            coupon.Type,
+		"value":           coupon.Value,
+		"min_order_value": coupon.MinOrderValue,
+		"usage_limit":     coupon.UsageLimit,
+	}}
+	if coupon.ExpiresAt != nil {
+		update["$set"].(bson.M)["expires_at"] = *coupon.ExpiresAt
+	} else {
+		update["$unset"] = bson.M{"expires_at": ""}
+	}
+
+	var updated Coupon
+	err := database.Collection(couponsCollectionName).FindOneAndUpdate(
+		r.Context(),
+		bson.M{"_id": id},
+		update,
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&updated)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		writeJSONError(w, http.StatusNotFound, "Coupon not found")
+		return
+	}
+	if mongo.IsDuplicateKeyError(err) {
+		writeJSONError(w, http.StatusConflict, "A coupon with this code already exists")
+		return
+	}
+	if err != nil {
+		fmt.Println("Error updating coupon:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to update coupon")
+		return
+	}
+	writeJSON(w, http.StatusOK, updated)
+}
+
+func deleteCoupon(w http.ResponseWriter, r *http.Request) {
+	id, ok := parseObjectID(w, r)
+	if !ok {
+		return
+	}
+
+	result, err := database.Collection(couponsCollectionName).DeleteOne(r.Context(), bson.M{"_id": id})
+	if err != nil {
+		fmt.Println("Error deleting coupon:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to delete coupon")
+		return
+	}
+	if result.DeletedCount == 0 {
+		writeJSONError(w, http.StatusNotFound, "Coupon not found")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
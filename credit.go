@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	creditReasonGrant          = "grant"
+	creditReasonOrder          = "order"
+	creditReasonOrderCanceled  = "order_cancelled"
+	creditReasonReturnRefunded = "return_refunded"
+
+	recentLedgerEntries = 20
+)
+
+var errCreditChanged = errors.New("store credit balance changed")
+
+// CreditMovement is one line of the credit ledger. Amount is positive for
+// credit given and negative for credit spent.
+type CreditMovement struct {
+	ID           primitive.ObjectID  `json:"id" bson:"_id,omitempty"`
+	UserID       primitive.ObjectID  `json:"user_id" bson:"user_id"`
+	Amount       float64             `json:"amount" bson:"amount"`
+	BalanceAfter float64             `json:"balance_after" bson:"balance_after"`
+	Reason       string              `json:"reason" bson:"reason"`
+	Note         string              `json:"note,omitempty" bson:"note,omitempty"`
+	OrderID      *primitive.ObjectID `json:"order_id,omitempty" bson:"order_id,omitempty"`
+	CreatedAt    time.Time           `json:"created_at" bson:"created_at"`
+}
+
+func createCreditIndexes() error {
+	_, err := database.Collection(creditLedgerCollectionName).Indexes().CreateOne(context.TODO(), mongo.IndexModel{
+		Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "created_at", Value: -1}},
+	})
+	return err
+}
+
+func roundCents(amount float64) float64 {
+	return math.Round(amount*100) / 100
+}
+
+func creditBalance(ctx context.Context, userID primitive.ObjectID) (float64, error) {
+	var user User
+	opts := options.FindOne().SetProjection(bson.M{"store_credit": 1})
+	err := database.Collection(collectionName).FindOne(ctx, activeUserByID(userID), opts).Decode(&user)
+	return user.StoreCredit, err
+}
+
+// moveCredit changes a user's balance by amount and writes the ledger entry.
+// Spending is guarded with $gte in the same update, so two checkouts can
+// never both spend the same credit; the loser gets errCreditChanged. Deleted
+// accounts are left alone. Callers run it in withTransaction; on a standalone
+// server the balance change is undone if the ledger entry cannot be written.
+func moveCredit(ctx context.Context, movement CreditMovement) error {
+	filter := activeUserByID(movement.UserID)
+	if movement.Amount < 0 {
+		filter["store_credit"] = bson.M{"$gte": -movement.Amount}
+	}
+
+	var user User
+	err := database.Collection(collectionName).FindOneAndUpdate(ctx, filter,
+		bson.M{"$inc": bson.M{"store_credit": movement.Amount}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After).SetProjection(bson.M{"store_credit": 1}),
+	).Decode(&user)
+	if errors.Is(err, mongo.ErrNoDocuments) && movement.Amount < 0 {
+		return errCreditChanged
+	}
+	if err != nil {
+		return err
+	}
+
+	movement.BalanceAfter = roundCents(user.StoreCredit)
+	movement.CreatedAt = time.Now()
+	if _, err := database.Collection(creditLedgerCollectionName).InsertOne(ctx, movement); err != nil {
+		undoSteps("credit movement", []func() error{func() error {
+			_, err := database.Collection(collectionName).UpdateOne(ctx,
+				bson.M{"_id": movement.UserID},
+				bson.M{"$inc": bson.M{"store_credit": -movement.Amount}},
+			)
+			return err
+		}})
+		return err
+	}
+	return nil
+}
+
+// grantCredit adds credit to ?id= with {"amount", "note"}. It is for admins
+// only.
+func grantCredit(w http.ResponseWriter, r *http.Request) {
+	userID, ok := parseObjectID(w, r)
+	if !ok {
+		return
+	}
+
+	var body struct {
+		Amount float64 `json:"amount"`
+		Note   string  `json:"note"`
+	}
+	if !decodeJSON(w, r, &body) {
+		return
+	}
+	amount := roundCents(body.Amount)
+	if amount <= 0 {
+		writeValidationErrors(w, "Credit grant is invalid", []fieldError{{Field: "amount", Message: "amount must be at least 0.01"}})
+		return
+	}
+
+	movement := CreditMovement{UserID: userID, Amount: amount, Reason: creditReasonGrant, Note: strings.TrimSpace(body.Note)}
+	err := withTransaction(r.Context(), func(ctx context.Context) error {
+		return moveCredit(ctx, movement)
+	})
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		writeJSONError(w, http.StatusNotFound, "User not found")
+		return
+	}
+	if err != nil {
+		fmt.Println("Error granting store credit:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to grant store credit")
+		return
+	}
+	getCredit(w, r)
+}
+
+// getCredit returns the balance of ?id= and the latest ledger entries, to
+// that user or an admin.
+func getCredit(w http.ResponseWriter, r *http.Request) {
+	userID, ok := parseObjectID(w, r)
+	if !ok || !authorizeUser(w, r, userID) {
+		return
+	}
+
+	balance, err := creditBalance(r.Context(), userID)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		writeJSONError(w, http.StatusNotFound, "User not found")
+		return
+	}
+	if err != nil {
+		fmt.Println("Error loading store credit:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to load store credit")
+		return
+	}
+
+	opts := options.Find().SetSort(bson.D{{Key: "created_at", Value: -1}, {Key: "_id", Value: -1}}).SetLimit(recentLedgerEntries)
+	cursor, err := database.Collection(creditLedgerCollectionName).Find(r.Context(), bson.M{"user_id": userID}, opts)
+	if err != nil {
+		fmt.Println("Error querying credit ledger:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to load store credit")
+		return
+	}
+	defer cursor.Close(r.Context())
+
+	entries := []CreditMovement{}
+	if err := cursor.All(r.Context(), &entries); err != nil {
+		fmt.Println("Error decoding credit ledger:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to load store credit")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"balance": roundCents(balance),
+		"entries": entries,
+	})
+}
+
+func handleUserCredit(w http.ResponseWriter, r *http.Request) {
+	getCredit(w, r)
+}
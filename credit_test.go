@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+func insertCreditUser(t *testing.T, user User) {
+	t.Helper()
+	if _, err := database.Collection(collectionName).InsertOne(context.Background(), user); err != nil {
+		t.Fatalf("insert user: %v", err)
+	}
+}
+
+func storedCredit(t *testing.T, id primitive.ObjectID) float64 {
+	t.Helper()
+	var user User
+	if err := database.Collection(collectionName).FindOne(context.Background(), bson.M{"_id": id}).Decode(&user); err != nil {
+		t.Fatalf("load user: %v", err)
+	}
+	return user.StoreCredit
+}
+
+func TestMoveCreditLeavesDeletedAccountsAlone(t *testing.T) {
+	testServer(t)
+	ctx := context.Background()
+	deletedAt := time.Now()
+	user := User{ID: primitive.NewObjectID(), Name: "Gone", Email: "gone@example.com", StoreCredit: 20, DeletedAt: &deletedAt}
+	insertCreditUser(t, user)
+
+	if err := moveCredit(ctx, CreditMovement{UserID: user.ID, Amount: 5, Reason: creditReasonGrant}); !errors.Is(err, mongo.ErrNoDocuments) {
+		t.Errorf("credit = %v, want %v", err, mongo.ErrNoDocuments)
+	}
+	if err := moveCredit(ctx, CreditMovement{UserID: user.ID, Amount: -5, Reason: creditReasonOrder}); !errors.Is(err, errCreditChanged) {
+		t.Errorf("debit = %v, want %v", err, errCreditChanged)
+	}
+	if credit := storedCredit(t, user.ID); credit != 20 {
+		t.Errorf("balance = %.2f, want it left at 20.00", credit)
+	}
+	if n, err := database.Collection(creditLedgerCollectionName).CountDocuments(ctx, bson.M{"user_id": user.ID}); err != nil || n != 0 {
+		t.Errorf("%d ledger entries (err %v), want none", n, err)
+	}
+}
+
+func TestMoveCreditUndoesBalanceWhenLedgerWriteFails(t *testing.T) {
+	testServer(t)
+	supported := transactionsSupported
+	transactionsSupported = false
+	t.Cleanup(func() { transactionsSupported = supported })
+	ctx := context.Background()
+	user := User{ID: primitive.NewObjectID(), Name: "Jane", Email: "jane@example.com", StoreCredit: 20}
+	insertCreditUser(t, user)
+
+	first := CreditMovement{ID: primitive.NewObjectID(), UserID: user.ID, Amount: 5, Reason: creditReasonGrant}
+	if err := moveCredit(ctx, first); err != nil {
+		t.Fatalf("moveCredit: %v", err)
+	}
+	// Reusing the ledger entry's _id makes the second insert fail.
+	if err := moveCredit(ctx, first); !mongo.IsDuplicateKeyError(err) {
+		t.Fatalf("moveCredit with a taken ledger ID = %v, want a duplicate key error", err)
+	}
+	if credit := storedCredit(t, user.ID); credit != 25 {
+		t.Errorf("balance = %.2f, want 25.00 with only the recorded movement applied", credit)
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// dataExportTimeout bounds all the queries of one data export together.
+const dataExportTimeout = 30 * time.Second
+
+// dataExportSection is one collection of a user's data export. newItem
+// returns a pointer to decode each document into.
+type dataExportSection struct {
+	name       string
+	collection string
+	filter     bson.M
+	newItem    func() interface{}
+}
+
+func dataExportSections(id primitive.ObjectID) []dataExportSection {
+	return []dataExportSection{
+		{"user", collectionName, bson.M{"_id": id}, func() interface{} { return &User{} }},
+		{"orders", ordersCollectionName, bson.M{"user_id": id}, func() interface{} { return &Order{} }},
+		{"reviews", reviewsCollectionName, bson.M{"user_id": id}, func() interface{} { return &Review{} }},
+		{"wishlist", wishlistsCollectionName, bson.M{"user_id": id}, func() interface{} { return &wishlistEntry{} }},
+		{"store_credit", creditLedgerCollectionName, bson.M{"user_id": id}, func() interface{} { return &CreditMovement{} }},
+		{"logins", loginHistoryCollectionName, bson.M{"user_id": id}, func() interface{} { return &LoginEvent{} }},
+		{"audit_log", auditLogCollectionName, bson.M{"target_id": id}, func() interface{} { return &AuditEntry{} }},
+	}
+}
+
+// exportUserData streams everything held about a user as one JSON file. Each
+// section holds its items and whether they were all loaded; a section that
+// failed part way keeps what was read and says so in "error", so nothing is
+// left out silently.
+func exportUserData(w http.ResponseWriter, r *http.Request) {
+	id, ok := parseObjectID(w, r)
+	if !ok {
+		return
+	}
+	if !authorizeUser(w, r, id) {
+		return
+	}
+
+	count, err := database.Collection(collectionName).CountDocuments(r.Context(), bson.M{"_id": id})
+	if err != nil {
+		fmt.Println("Error looking up user for export:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to export user data")
+		return
+	}
+	if count == 0 {
+		writeJSONError(w, http.StatusNotFound, "User not found")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), dataExportTimeout)
+	defer cancel()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", `attachment; filename="user-`+id.Hex()+`-export.json"`)
+
+	exportedAt, _ := json.Marshal(time.Now().UTC())
+	fmt.Fprintf(w, `{"user_id":%q,"exported_at":%s,"sections":{`, id.Hex(), exportedAt)
+	for i, section := range dataExportSections(id) {
+		if i > 0 {
+			fmt.Fprint(w, ",")
+		}
+		fmt.Fprintf(w, `%q:`, section.name)
+		writeDataExportSection(ctx, w, section)
+	}
+	fmt.Fprint(w, "}}\n")
+}
+
+// writeDataExportSection writes section as {"items":[...],"complete":bool}
+// with an "error" when it could not be read completely.
+func writeDataExportSection(ctx context.Context, w http.ResponseWriter, section dataExportSection) {
+	fmt.Fprint(w, `{"items":[`)
+	written := 0
+	err := func() error {
+		opts := options.Find().SetSort(bson.D{{Key: "_id", Value: 1}})
+		cursor, err := database.Collection(section.collection).Find(ctx, section.filter, opts)
+		if err != nil {
+			return err
+		}
+		defer cursor.Close(ctx)
+
+		for cursor.Next(ctx) {
+			item := section.newItem()
+			if err := cursor.Decode(item); err != nil {
+				return err
+			}
+			data, err := json.Marshal(item)
+			if err != nil {
+				return err
+			}
+			if written > 0 {
+				fmt.Fprint(w, ",")
+			}
+			w.Write(data)
+			written++
+		}
+		return cursor.Err()
+	}()
+	fmt.Fprint(w, `]`)
+
+	if err != nil {
+		fmt.Printf("Error exporting %s: %v\n", section.name, err)
+		message := "could not be loaded"
+		if ctx.Err() != nil {
+			message = "timed out"
+		}
+		fmt.Fprintf(w, `,"complete":false,"error":%q}`, section.name+" "+message)
+		return
+	}
+	fmt.Fprint(w, `,"complete":true}`)
+}
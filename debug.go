@@ -0,0 +1,85 @@
+package main
+
+import (
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"sync/atomic"
+	"time"
+
+	"go.mongodb.org/mongo-driver/event"
+)
+
+// debugEndpoints turns the /debug routes on or off, from DEBUG_ENDPOINTS.
+// Off leaves them out altogether; when on, they need an admin or an API key
+// with the debug:read scope.
+var debugEndpoints = true
+
+var startedAt = time.Now()
+
+// registerDebugRoutes mounts the pprof handlers and /debug/vars. They get
+// exportTimeout, since CPU profiles and traces take 30 seconds by default.
+func registerDebugRoutes(mux router) {
+	if !debugEndpoints {
+		return
+	}
+	guard := func(h http.HandlerFunc) http.HandlerFunc { return requireAdminOrKey(scopeDebugRead, h) }
+	mux.exportRoute("/debug/pprof/", guard(pprof.Index), http.MethodGet)
+	mux.exportRoute("/debug/pprof/cmdline", guard(pprof.Cmdline), http.MethodGet)
+	mux.exportRoute("/debug/pprof/profile", guard(pprof.Profile), http.MethodGet)
+	mux.exportRoute("/debug/pprof/symbol", guard(pprof.Symbol), http.MethodGet, http.MethodPost)
+	mux.exportRoute("/debug/pprof/trace", guard(pprof.Trace), http.MethodGet)
+	mux.route("/debug/vars", guard(handleDebugVars), http.MethodGet)
+}
+
+// mongoPool counts the connections of the MongoDB clients, which the driver
+// does not report otherwise.
+var mongoPool struct {
+	open, inUse, created, closed, checkoutFailed atomic.Int64
+}
+
+var mongoPoolMonitor = &event.PoolMonitor{
+	Event: func(e *event.PoolEvent) {
+		switch e.Type {
+		case event.ConnectionCreated:
+			mongoPool.created.Add(1)
+			mongoPool.open.Add(1)
+		case event.ConnectionClosed:
+			mongoPool.closed.Add(1)
+			mongoPool.open.Add(-1)
+		case event.GetSucceeded:
+			mongoPool.inUse.Add(1)
+		case event.ConnectionReturned:
+			mongoPool.inUse.Add(-1)
+		case event.GetFailed:
+			mongoPool.checkoutFailed.Add(1)
+		}
+	},
+}
+
+func handleDebugVars(w http.ResponseWriter, r *http.Request) {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"go_version":     runtime.Version(),
+		"uptime_seconds": int64(time.Since(startedAt).Seconds()),
+		"goroutines":     runtime.NumGoroutine(),
+		"heap": map[string]uint64{
+			"alloc_bytes":       mem.HeapAlloc,
+			"in_use_bytes":      mem.HeapInuse,
+			"sys_bytes":         mem.HeapSys,
+			"objects":           mem.HeapObjects,
+			"next_gc_bytes":     mem.NextGC,
+			"gc_runs":           uint64(mem.NumGC),
+			"gc_pause_total_ns": mem.PauseTotalNs,
+		},
+		"mongo_pool": map[string]int64{
+			"open":            mongoPool.open.Load(),
+			"in_use":          mongoPool.inUse.Load(),
+			"created":         mongoPool.created.Load(),
+			"closed":          mongoPool.closed.Load(),
+			"checkout_failed": mongoPool.checkoutFailed.Load(),
+		},
+	})
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestDebugEndpointsNeedAdminOrDebugKey(t *testing.T) {
+	enabled := debugEndpoints
+	debugEndpoints = true
+	t.Cleanup(func() { debugEndpoints = enabled })
+	h, db := testServer(t)
+
+	keys := map[string][]string{
+		"shop_debugkey":     {scopeDebugRead},
+		"shop_cataloguekey": {scopeCatalogueRead},
+	}
+	for key, scopes := range keys {
+		apiKey := APIKey{Label: key, Scopes: scopes, KeyHash: hashToken(key), CreatedAt: time.Now()}
+		if _, err := db.Collection(apiKeysCollectionName).InsertOne(context.Background(), apiKey); err != nil {
+			t.Fatalf("insert API key: %v", err)
+		}
+	}
+	customer := testToken(t, User{ID: primitive.NewObjectID()})
+	admin := testToken(t, User{ID: primitive.NewObjectID(), Role: roleAdmin})
+
+	for _, path := range []string{"/debug/vars", "/debug/pprof/", "/debug/pprof/cmdline"} {
+		t.Run(path, func(t *testing.T) {
+			tests := []struct {
+				name, token, key string
+				want             int
+			}{
+				{"anonymous", "", "", http.StatusUnauthorized},
+				{"invalid token", "not-a-token", "", http.StatusUnauthorized},
+				{"customer", customer, "", http.StatusForbidden},
+				{"unknown key", "", "shop_nosuchkey", http.StatusUnauthorized},
+				{"key without debug:read", "", "shop_cataloguekey", http.StatusForbidden},
+				{"admin", admin, "", http.StatusOK},
+				{"debug key", "", "shop_debugkey", http.StatusOK},
+			}
+			for _, tt := range tests {
+				req := newTestRequest(http.MethodGet, path, tt.token, "")
+				if tt.key != "" {
+					req.Header.Set(apiKeyHeader, tt.key)
+				}
+				rec := serveRequest(h, req)
+				if rec.Code != tt.want {
+					t.Errorf("%s: status = %d, want %d", tt.name, rec.Code, tt.want)
+					continue
+				}
+				if tt.want != http.StatusOK {
+					if apiErr := decodeAPIError(t, rec); apiErr.Code != statusCodes[tt.want] {
+						t.Errorf("%s: code = %q, want %q", tt.name, apiErr.Code, statusCodes[tt.want])
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestDebugEndpointsCanBeTurnedOff(t *testing.T) {
+	enabled := debugEndpoints
+	debugEndpoints = false
+	t.Cleanup(func() { debugEndpoints = enabled })
+	h := newHandler(nil)
+
+	admin := testToken(t, User{ID: primitive.NewObjectID(), Role: roleAdmin})
+	if rec := serveTest(h, http.MethodGet, "/debug/vars", admin, ""); rec.Code != http.StatusNotFound {
+		t.Errorf("GET /debug/vars = %d, want 404 with the debug endpoints off", rec.Code)
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	htmltemplate "html/template"
+	"mime"
+	"mime/quotedprintable"
+	"net/smtp"
+	"strconv"
+	"strings"
+	texttemplate "text/template"
+	"time"
+)
+
+// mailer sends mail through an SMTP relay. In dry-run mode messages are only
+// logged, which is the default when no SMTP host is configured.
+type mailer struct {
+	Host     string
+	Port     int
+	Username string
+	Password string
+	From     string
+	DryRun   bool
+}
+
+// emailSender is Config.SMTP, set by Config.apply.
+var emailSender = &mailer{DryRun: true}
+
+type emailMessage struct {
+	To      string `bson:"to"`
+	Subject string `bson:"subject"`
+	Text    string `bson:"text"`
+	HTML    string `bson:"html"`
+	// RequestID is sent as X-Request-ID, to trace a message back to the
+	// request that caused it.
+	RequestID string `bson:"request_id,omitempty"`
+}
+
+func (m *mailer) send(msg emailMessage) error {
+	if m.DryRun {
+		fmt.Printf("Email (dry run) to %s: %s\n%s\n", msg.To, msg.Subject, msg.Text)
+		return nil
+	}
+
+	var auth smtp.Auth
+	if m.Username != "" {
+		auth = smtp.PlainAuth("", m.Username, m.Password, m.Host)
+	}
+	addr := m.Host + ":" + strconv.Itoa(m.Port)
+	return smtp.SendMail(addr, auth, m.From, []string{msg.To}, m.build(msg))
+}
+
+// build renders msg as a multipart/alternative message carrying both the
+// plain-text and the HTML body.
+func (m *mailer) build(msg emailMessage) []byte {
+	var boundary [12]byte
+	rand.Read(boundary[:])
+	sep := "shop-" + hex.EncodeToString(boundary[:])
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: %s\r\n", m.From)
+	fmt.Fprintf(&b, "To: %s\r\n", msg.To)
+	fmt.Fprintf(&b, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", msg.Subject))
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	if msg.RequestID != "" {
+		fmt.Fprintf(&b, "%s: %s\r\n", requestIDHeader, msg.RequestID)
+	}
+	b.WriteString("MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&b, "Content-Type: multipart/alternative; boundary=%q\r\n\r\n", sep)
+
+	for _, part := range []struct{ contentType, body string }{
+		{"text/plain", msg.Text},
+		{"text/html", msg.HTML},
+	} {
+		fmt.Fprintf(&b, "--%s\r\n", sep)
+		fmt.Fprintf(&b, "Content-Type: %s; charset=utf-8\r\n", part.contentType)
+		b.WriteString("Content-Transfer-Encoding: quoted-printable\r\n\r\n")
+		qp := quotedprintable.NewWriter(&b)
+		qp.Write([]byte(strings.ReplaceAll(part.body, "\n", "\r\n")))
+		qp.Close()
+		b.WriteString("\r\n")
+	}
+	fmt.Fprintf(&b, "--%s--\r\n", sep)
+	return b.Bytes()
+}
+
+type confirmationLine struct {
+	Name      string
+	Quantity  int
+	UnitPrice float64
+	Amount    float64
+}
+
+type confirmationData struct {
+	Order Order
+	Lines []confirmationLine
+}
+
+var orderConfirmationText = texttemplate.Must(texttemplate.New("text").Parse(`Hello {{.Order.Customer.Name}},
+
+thank you for your order {{.Order.Number}}. We have received it and will let you know when it ships.
+
+{{range .Lines}}{{.Quantity}} x {{.Name}} @ {{printf "%.2f" .UnitPrice}} = {{printf "%.2f" .Amount}}
+{{end}}{{if .Order.Discount}}
+Coupon {{.Order.CouponCode}}: -{{printf "%.2f" .Order.Discount}}{{end}}
+Total: {{printf "%.2f" .Order.Total}}
+
+Online Furniture Shop
+`))
+
+var orderConfirmationHTML = htmltemplate.Must(htmltemplate.New("html").Parse(`<!DOCTYPE html>
+<html>
+<body>
+<p>Hello {{.Order.Customer.Name}},</p>
+<p>thank you for your order <strong>{{.Order.Number}}</strong>. We have received it and will let you know when it ships.</p>
+<table cellpadding="4" cellspacing="0" border="1">
+<tr><th align="left">Item</th><th align="right">Qty</th><th align="right">Unit price</th><th align="right">Amount</th></tr>
+{{range .Lines}}<tr><td>{{.Name}}</td><td align="right">{{.Quantity}}</td><td align="right">{{printf "%.2f" .UnitPrice}}</td><td align="right">{{printf "%.2f" .Amount}}</td></tr>
+{{end}}{{if .Order.Discount}}<tr><td colspan="3" align="right">Coupon {{.Order.CouponCode}}</td><td align="right">-{{printf "%.2f" .Order.Discount}}</td></tr>
+{{end}}<tr><td colspan="3" align="right"><strong>Total</strong></td><td align="right"><strong>{{printf "%.2f" .Order.Total}}</strong></td></tr>
+</table>
+<p>Online Furniture Shop</p>
+</body>
+</html>
+`))
+
+func orderConfirmationEmail(order Order, catalogue map[int]Furniture) (emailMessage, error) {
+	data := confirmationData{Order: order}
+	for _, item := range order.Items {
+		name := fmt.Sprintf("Furniture #%d", item.FurnitureID)
+		if furniture, ok := catalogue[item.FurnitureID]; ok {
+			name = furniture.Name
+			if item.VariantID != "" {
+				name += " (" + item.VariantID + ")"
+			}
+		}
+		data.Lines = append(data.Lines, confirmationLine{
+			Name:      name,
+			Quantity:  item.Quantity,
+			UnitPrice: item.UnitPrice,
+			Amount:    item.UnitPrice * float64(item.Quantity),
+		})
+	}
+
+	var text, html bytes.Buffer
+	if err := orderConfirmationText.Execute(&text, data); err != nil {
+		return emailMessage{}, err
+	}
+	if err := orderConfirmationHTML.Execute(&html, data); err != nil {
+		return emailMessage{}, err
+	}
+	return emailMessage{
+		To:      order.Customer.Email,
+		Subject: "Your order " + order.Number,
+		Text:    text.String(),
+		HTML:    html.String(),
+	}, nil
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// fakeSMTP is an SMTP server that accepts every message and keeps it.
+type fakeSMTP struct {
+	listener net.Listener
+	mu       sync.Mutex
+	conns    int
+	messages []string
+}
+
+func startFakeSMTP(t *testing.T) *fakeSMTP {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	s := &fakeSMTP{listener: listener}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			s.mu.Lock()
+			s.conns++
+			s.mu.Unlock()
+			go s.serve(conn)
+		}
+	}()
+	t.Cleanup(func() { listener.Close() })
+	return s
+}
+
+func (s *fakeSMTP) serve(conn net.Conn) {
+	defer conn.Close()
+	text := textproto.NewConn(conn)
+	text.PrintfLine("220 fake ESMTP")
+	for {
+		line, err := text.ReadLine()
+		if err != nil {
+			return
+		}
+		switch verb := strings.ToUpper(strings.Fields(line + " ")[0]); verb {
+		case "EHLO", "HELO", "MAIL", "RCPT", "RSET", "NOOP":
+			text.PrintfLine("250 OK")
+		case "DATA":
+			text.PrintfLine("354 go ahead")
+			body, err := text.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			s.mu.Lock()
+			s.messages = append(s.messages, string(body))
+			s.mu.Unlock()
+			text.PrintfLine("250 queued")
+		case "QUIT":
+			text.PrintfLine("221 bye")
+			return
+		default:
+			text.PrintfLine("502 not implemented")
+		}
+	}
+}
+
+func (s *fakeSMTP) mailer(dryRun bool) *mailer {
+	host, port, _ := net.SplitHostPort(s.listener.Addr().String())
+	n, _ := strconv.Atoi(port)
+	return &mailer{Host: host, Port: n, From: "orders@example.com", DryRun: dryRun}
+}
+
+func (s *fakeSMTP) counts() (conns, messages int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.conns, len(s.messages)
+}
+
+var testEmail = emailMessage{
+	To:      "jane@example.com",
+	Subject: "Your order ORD-2024-000001",
+	Text:    "Thank you for your order.",
+	HTML:    "<p>Thank you for your order.</p>",
+}
+
+func TestMailerDryRunSendsNothingAndReportsLikeARealSend(t *testing.T) {
+	live := startFakeSMTP(t)
+	if err := live.mailer(false).send(testEmail); err != nil {
+		t.Fatalf("real send: %v", err)
+	}
+	if _, messages := live.counts(); messages != 1 {
+		t.Fatalf("real send delivered %d messages, want 1", messages)
+	}
+
+	dry := startFakeSMTP(t)
+	if err := dry.mailer(true).send(testEmail); err != nil {
+		t.Errorf("dry run = %v, want nil like the real send", err)
+	}
+	if conns, messages := dry.counts(); conns != 0 || messages != 0 {
+		t.Errorf("dry run made %d connections and sent %d messages, want none", conns, messages)
+	}
+}
+
+func TestMailerBuildsMultipartMessage(t *testing.T) {
+	s := startFakeSMTP(t)
+	msg := testEmail
+	msg.RequestID = "req-123"
+	if err := s.mailer(false).send(msg); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	s.mu.Lock()
+	body := s.messages[0]
+	s.mu.Unlock()
+	for _, want := range []string{
+		"To: jane@example.com", "X-Request-ID: req-123", "multipart/alternative",
+		"text/plain; charset=utf-8", "text/html; charset=utf-8", testEmail.Text,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("message lacks %q:\n%s", want, body)
+		}
+	}
+}
+
+// In the outbox a dry run leaves the same record as a delivered message, so
+// nothing is retried later.
+func TestEnqueueEmailDryRunRecordsLikeARealSend(t *testing.T) {
+	_, db := testServer(t)
+	sender := emailSender
+	t.Cleanup(func() { emailSender = sender })
+	s := startFakeSMTP(t)
+
+	outcome := func(dryRun bool, to string) outboxEmail {
+		t.Helper()
+		emailSender = s.mailer(dryRun)
+		msg := testEmail
+		msg.To = to
+		if err := enqueueEmail(context.Background(), msg); err != nil {
+			t.Fatalf("enqueueEmail: %v", err)
+		}
+		var entry outboxEmail
+		if err := db.Collection(emailOutboxCollectionName).FindOne(context.Background(), bson.M{"message.to": to}).Decode(&entry); err != nil {
+			t.Fatalf("load outbox entry: %v", err)
+		}
+		return entry
+	}
+
+	sent := outcome(false, "real@example.com")
+	dry := outcome(true, "dry@example.com")
+	if dry.Status != sent.Status || dry.Attempts != sent.Attempts || dry.LastError != sent.LastError {
+		t.Errorf("dry run recorded status %q, %d attempts, error %q; a real send recorded %q, %d, %q",
+			dry.Status, dry.Attempts, dry.LastError, sent.Status, sent.Attempts, sent.LastError)
+	}
+	if sent.Status != outboxStatusSent {
+		t.Errorf("status = %q, want %q", sent.Status, outboxStatusSent)
+	}
+	if _, messages := s.counts(); messages != 1 {
+		t.Errorf("SMTP server got %d messages, want only the real one", messages)
+	}
+}
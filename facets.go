@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+var defaultPriceBuckets = []float64{0, 50, 100, 250, 500, 1000}
+
+type categoryFacet struct {
+	CategoryID *primitive.ObjectID `json:"category_id" bson:"_id"`
+	Slug       string              `json:"slug,omitempty" bson:"slug"`
+	Name       string              `json:"name,omitempty" bson:"name"`
+	Count      int64               `json:"count" bson:"count"`
+}
+
+// priceFacet covers prices from Min (inclusive) up to Max (exclusive). The
+// last facet has no Max and holds everything at or above the top boundary.
+type priceFacet struct {
+	Min   float64  `json:"min"`
+	Max   *float64 `json:"max"`
+	Count int64    `json:"count"`
+}
+
+type facetsResponse struct {
+	Categories []categoryFacet `json:"categories"`
+	Prices     []priceFacet    `json:"prices"`
+}
+
+// parsePriceBuckets reads ?price_buckets=0,50,100 as strictly increasing
+// bucket boundaries.
+func parsePriceBuckets(r *http.Request) ([]float64, error) {
+	raw := r.URL.Query().Get("price_buckets")
+	if raw == "" {
+		return defaultPriceBuckets, nil
+	}
+
+	parts := strings.Split(raw, ",")
+	boundaries := make([]float64, len(parts))
+	for i, part := range parts {
+		value, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+		if err != nil || value < 0 {
+			return nil, badRequestf("price_buckets must be a comma-separated list of non-negative numbers")
+		}
+		boundaries[i] = value
+	}
+	if len(boundaries) < 2 {
+		return nil, badRequestf("price_buckets needs at least two boundaries")
+	}
+	if !sort.SliceIsSorted(boundaries, func(i, j int) bool { return boundaries[i] < boundaries[j] }) {
+		return nil, badRequestf("price_buckets must be in increasing order")
+	}
+	for i := 1; i < len(boundaries); i++ {
+		if boundaries[i] == boundaries[i-1] {
+			return nil, badRequestf("price_buckets must not repeat a boundary")
+		}
+	}
+	return boundaries, nil
+}
+
+func handleFurnitureFacets(w http.ResponseWriter, r *http.Request) {
+	filter, err := furnitureFilter(r)
+	if err != nil {
+		writeQueryError(w, err, "Failed to compute facets")
+		return
+	}
+	boundaries, err := parsePriceBuckets(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// Prices below the first boundary are filed with the first bucket's
+	// lower bound so that nothing is silently dropped.
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: filter}},
+		{{Key: "$facet", Value: bson.M{
+			"categories": bson.A{
+				bson.M{"$group": bson.M{"_id": "$category_id", "count": bson.M{"$sum": 1}}},
+				bson.M{"$lookup": bson.M{
+					"from":         categoriesCollectionName,
+					"localField":   "_id",
+					"foreignField": "_id",
+					"as":           "category",
+				}},
+				bson.M{"$set": bson.M{
+					"slug": bson.M{"$first": "$category.slug"},
+					"name": bson.M{"$first": "$category.name"},
+				}},
+				bson.M{"$sort": bson.D{{Key: "count", Value: -1}, {Key: "name", Value: 1}}},
+			},
+			"prices": bson.A{
+				bson.M{"$bucket": bson.M{
+					"groupBy":    bson.M{"$max": bson.A{"$price", boundaries[0]}},
+					"boundaries": boundaries,
+					"default":    "above",
+					"output":     bson.M{"count": bson.M{"$sum": 1}},
+				}},
+			},
+		}}},
+	}
+
+	cursor, err := database.Collection(furnitureCollectionName).Aggregate(r.Context(), pipeline)
+	if err != nil {
+		fmt.Println("Error aggregating furniture facets:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to compute facets")
+		return
+	}
+	defer cursor.Close(r.Context())
+
+	var results []struct {
+		Categories []categoryFacet `bson:"categories"`
+		Prices     []struct {
+			Lower interface{} `bson:"_id"`
+			Count int64       `bson:"count"`
+		} `bson:"prices"`
+	}
+	if err := cursor.All(r.Context(), &results); err != nil || len(results) != 1 {
+		fmt.Println("Error decoding furniture facets:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to compute facets")
+		return
+	}
+
+	counts := map[float64]int64{}
+	var above int64
+	for _, bucket := range results[0].Prices {
+		switch lower := bucket.Lower.(type) {
+		case string:
+			above = bucket.Count
+		case float64:
+			counts[lower] = bucket.Count
+		}
+	}
+
+	// Report every bucket, including empty ones, so the storefront can render
+	// a stable list.
+	response := facetsResponse{Categories: results[0].Categories, Prices: []priceFacet{}}
+	if response.Categories == nil {
+		response.Categories = []categoryFacet{}
+	}
+	for i := 0; i < len(boundaries)-1; i++ {
+		upper := boundaries[i+1]
+		response.Prices = append(response.Prices, priceFacet{Min: boundaries[i], Max: &upper, Count: counts[boundaries[i]]})
+	}
+	response.Prices = append(response.Prices, priceFacet{Min: boundaries[len(boundaries)-1], Count: above})
+
+	writeJSON(w, http.StatusOK, response)
+}
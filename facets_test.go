@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestParsePriceBuckets(t *testing.T) {
+	tests := []struct {
+		query   string
+		want    []float64
+		wantErr bool
+	}{
+		{"", defaultPriceBuckets, false},
+		{"price_buckets=0,50,100", []float64{0, 50, 100}, false},
+		{"price_buckets=10.5,%2020", []float64{10.5, 20}, false},
+		{"price_buckets=50", nil, true},
+		{"price_buckets=100,50", nil, true},
+		{"price_buckets=0,50,50", nil, true},
+		{"price_buckets=-1,50", nil, true},
+		{"price_buckets=0,cheap", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			got, err := parsePriceBuckets(httptest.NewRequest(http.MethodGet, "/furniture/facets?"+tt.query, nil))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("boundaries = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// Each bucket includes its lower boundary and excludes its upper one; prices
+// below the first boundary count in the first bucket and prices at or above
+// the last in the open-ended one.
+func TestFurnitureFacetsPriceBucketBoundaries(t *testing.T) {
+	h, db := testServer(t)
+	var docs []interface{}
+	for id, price := range []float64{10, 50, 99.99, 100, 249.99, 250, 1000} {
+		docs = append(docs, Furniture{ID: id + 1, Name: "Item", Price: price})
+	}
+	if _, err := db.Collection(furnitureCollectionName).InsertMany(context.Background(), docs); err != nil {
+		t.Fatalf("insert: %v", err)
+	}
+
+	rec := serveTest(h, http.MethodGet, "/furniture/facets?price_buckets=50,100,250", "", "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", rec.Code, rec.Body)
+	}
+	var got facetsResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	hundred, twoFifty := 100.0, 250.0
+	want := []priceFacet{
+		{Min: 50, Max: &hundred, Count: 3},
+		{Min: 100, Max: &twoFifty, Count: 2},
+		{Min: 250, Count: 2},
+	}
+	if !reflect.DeepEqual(got.Prices, want) {
+		gotJSON, _ := json.Marshal(got.Prices)
+		wantJSON, _ := json.Marshal(want)
+		t.Errorf("prices = %s, want %s", gotJSON, wantJSON)
+	}
+}
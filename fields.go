@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// userFields maps the fields ?fields= may select on users to their key in
+// the JSON response.
+var userFields = map[string]string{
+	"name":           "name",
+	"email":          "email",
+	"phone":          "phone",
+	"age":            "age",
+	"role":           "role",
+	"email_verified": "email_verified",
+	"created_at":     "created_at",
+	"updated_at":     "updated_at",
+}
+
+var furnitureFields = map[string]string{
+	"sku":          "sku",
+	"name":         "name",
+	"description":  "description",
+	"price":        "price",
+	"category_id":  "category_id",
+	"stock":        "stock",
+	"width_cm":     "width_cm",
+	"depth_cm":     "depth_cm",
+	"height_cm":    "height_cm",
+	"image_id":     "image_id",
+	"variants":     "variants",
+	"rating_avg":   "rating_avg",
+	"rating_count": "rating_count",
+	"created_at":   "created_at",
+	"updated_at":   "updated_at",
+}
+
+// fieldSelection is what ?fields= asked for: the projection sent to MongoDB
+// and the keys kept in the JSON response. The zero value selects everything.
+type fieldSelection struct {
+	projection bson.M
+	keys       []string
+}
+
+// parseFields reads ?fields=a,b, accepting only the fields in allowed. _id is
+// always fetched and kept under idKey.
+func parseFields(r *http.Request, allowed map[string]string, idKey string) (fieldSelection, error) {
+	raw := r.URL.Query().Get("fields")
+	if raw == "" {
+		return fieldSelection{}, nil
+	}
+
+	selection := fieldSelection{projection: bson.M{"_id": 1}, keys: []string{idKey}}
+	for _, field := range strings.Split(raw, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" || field == "_id" {
+			continue
+		}
+		key, ok := allowed[field]
+		if !ok {
+			names := make([]string, 0, len(allowed))
+			for name := range allowed {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			return fieldSelection{}, badRequestf("unknown field %q, allowed fields: %s", field, strings.Join(names, ", "))
+		}
+		selection.projection[field] = 1
+		selection.keys = append(selection.keys, key)
+	}
+	return selection, nil
+}
+
+// pick trims the JSON form of v down to the selected keys. Without a
+// selection v is returned as it is.
+func (s fieldSelection) pick(v interface{}) (interface{}, error) {
+	if s.projection == nil {
+		return v, nil
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var all map[string]json.RawMessage
+	if err := json.Unmarshal(data, &all); err != nil {
+		return nil, err
+	}
+	picked := make(map[string]json.RawMessage, len(s.keys))
+	for _, key := range s.keys {
+		if value, ok := all[key]; ok {
+			picked[key] = value
+		}
+	}
+	return picked, nil
+}
@@ -0,0 +1,670 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type Furniture struct {
+	ID          int                 `json:"id" bson:"_id,omitempty"`
+	SKU         string              `json:"sku,omitempty" bson:"sku,omitempty"`
+	Name        string              `json:"name" bson:"name"`
+	Description string              `json:"description" bson:"description"`
+	Price       float64             `json:"price" bson:"price"`
+	CategoryID  *primitive.ObjectID `json:"category_id,omitempty" bson:"category_id,omitempty"`
+	Stock       int                 `json:"stock" bson:"stock"`
+	WidthCM     float64             `json:"width_cm,omitempty" bson:"width_cm,omitempty"`
+	DepthCM     float64             `json:"depth_cm,omitempty" bson:"depth_cm,omitempty"`
+	HeightCM    float64             `json:"height_cm,omitempty" bson:"height_cm,omitempty"`
+	ImageID     *primitive.ObjectID `json:"image_id,omitempty" bson:"image_id,omitempty"`
+	Variants    []Variant           `json:"variants,omitempty" bson:"variants,omitempty"`
+	CreatedAt   time.Time           `json:"created_at" bson:"created_at,omitempty"`
+	UpdatedAt   time.Time           `json:"updated_at" bson:"updated_at,omitempty"`
+	DeletedAt   *time.Time          `json:"deleted_at,omitempty" bson:"deleted_at,omitempty"`
+
+	// Kept in step with the approved reviews; see adjustRating.
+	RatingAvg   float64 `json:"rating_avg" bson:"rating_avg,omitempty"`
+	RatingCount int     `json:"rating_count" bson:"rating_count,omitempty"`
+	RatingSum   int     `json:"-" bson:"rating_sum,omitempty"`
+
+	// Computed from the active promotions when the item is served.
+	SalePrice   *float64            `json:"sale_price,omitempty" bson:"-"`
+	PromotionID *primitive.ObjectID `json:"promotion_id,omitempty" bson:"-"`
+}
+
+// activeFurnitureByID matches an item unless it has been soft-deleted.
+func activeFurnitureByID(id int) bson.M {
+	return bson.M{"_id": id, "deleted_at": bson.M{"$exists": false}}
+}
+
+// furnitureInput is the client-supplied part of a furniture item on create and update.
+type furnitureInput struct {
+	SKU         string  `json:"sku"`
+	Name        string  `json:"name"`
+	Description string  `json:"description"`
+	Price       float64 `json:"price"`
+	CategoryID  string  `json:"category_id"`
+	// Stock is the starting stock of a new item. A PUT only sets it when it
+	// is sent; stock moves with orders, so adjusting it belongs to
+	// /furniture/stock.
+	Stock    *int    `json:"stock"`
+	WidthCM  float64 `json:"width_cm"`
+	DepthCM  float64 `json:"depth_cm"`
+	HeightCM float64 `json:"height_cm"`
+
+	categoryID *primitive.ObjectID
+}
+
+var skuPattern = regexp.MustCompile(`^[A-Za-z0-9]+(-[A-Za-z0-9]+)*$`)
+
+func (in *furnitureInput) validate() []fieldError {
+	var v validator
+	in.SKU = strings.TrimSpace(in.SKU)
+	if v.required("sku", in.SKU) {
+		v.check(skuPattern.MatchString(in.SKU), "sku", ruleFormat, "sku may only contain letters, digits and dashes")
+	}
+	in.Name = strings.TrimSpace(in.Name)
+	v.required("name", in.Name)
+	v.positive("price", in.Price)
+	if in.Stock != nil {
+		v.nonNegative("stock", float64(*in.Stock))
+	}
+	v.nonNegative("width_cm", in.WidthCM)
+	v.nonNegative("depth_cm", in.DepthCM)
+	v.nonNegative("height_cm", in.HeightCM)
+	if in.CategoryID != "" {
+		id, err := primitive.ObjectIDFromHex(in.CategoryID)
+		if v.check(err == nil, "category_id", ruleFormat, "category_id must be a valid ID") {
+			in.categoryID = &id
+		}
+	}
+	return v.errs
+}
+
+func (in furnitureInput) newFurniture(id int, now time.Time) Furniture {
+	var stock int
+	if in.Stock != nil {
+		stock = *in.Stock
+	}
+	return Furniture{
+		ID:          id,
+		SKU:         in.SKU,
+		Name:        in.Name,
+		Description: in.Description,
+		Price:       in.Price,
+		CategoryID:  in.categoryID,
+		Stock:       stock,
+		WidthCM:     in.WidthCM,
+		DepthCM:     in.DepthCM,
+		HeightCM:    in.HeightCM,
+		CreatedAt:   now,
+		UpdatedAt:   now,
+	}
+}
+
+// checkCategory writes a 400 and returns false if the input references a
+// category that does not exist.
+func (in *furnitureInput) checkCategory(w http.ResponseWriter, ctx context.Context) bool {
+	if in.categoryID == nil {
+		return true
+	}
+	exists, err := categoryExists(ctx, *in.categoryID)
+	if err != nil {
+		fmt.Println("Error looking up category:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to look up category")
+		return false
+	}
+	if !exists {
+		writeJSONError(w, http.StatusBadRequest, "category_id does not reference an existing category")
+		return false
+	}
+	return true
+}
+
+var furnitureSortFields = []string{"price", "name", "created_at"}
+
+// inventory is the initial catalogue written to an empty furniture collection.
+var inventory = []Furniture{
+	{ID: 1, SKU: "CHAIR-001", Name: "Chair", Description: "Comfortable chair", Price: 49.99, Stock: 10},
+	{ID: 2, SKU: "TABLE-001", Name: "Table", Description: "Sturdy table", Price: 99.99, Stock: 10},
+}
+
+func seedFurniture() error {
+	furnitureCollection := database.Collection(furnitureCollectionName)
+
+	count, err := furnitureCollection.CountDocuments(context.TODO(), bson.D{})
+	if err != nil {
+		return err
+	}
+	if count > 0 {
+		return nil
+	}
+
+	now := time.Now()
+	docs := make([]interface{}, len(inventory))
+	for i, item := range inventory {
+		item.CreatedAt = now
+		item.UpdatedAt = now
+		docs[i] = item
+	}
+
+	_, err = furnitureCollection.InsertMany(context.TODO(), docs)
+	return err
+}
+
+var furnitureDimensionFilters = map[string]string{
+	"max_width":  "width_cm",
+	"max_depth":  "depth_cm",
+	"max_height": "height_cm",
+}
+
+// furnitureFilter builds the listing filter from the request query.
+// ?q= matches every whitespace-separated term, case-insensitively, against
+// name or description; ?min_price= and ?max_price= are inclusive bounds;
+// ?category= restricts to the category with that slug; ?max_width=,
+// ?max_depth= and ?max_height= cap the dimensions in centimetres. Soft-deleted
+// items are left out unless an admin asks for ?include_deleted=true; for
+// anyone else the flag is ignored.
+func furnitureFilter(r *http.Request) (bson.M, error) {
+	query := r.URL.Query()
+	var conditions []bson.M
+
+	if query.Get("include_deleted") != "true" || !callerIsAdmin(r.Context()) {
+		conditions = append(conditions, bson.M{"deleted_at": bson.M{"$exists": false}})
+	}
+
+	for _, term := range strings.Fields(query.Get("q")) {
+		pattern := primitive.Regex{Pattern: regexp.QuoteMeta(term), Options: "i"}
+		conditions = append(conditions, bson.M{"$or": []bson.M{
+			{"name": pattern},
+			{"description": pattern},
+		}})
+	}
+
+	minPrice, hasMin, err := floatParam(r, "min_price")
+	if err != nil {
+		return nil, err
+	}
+	maxPrice, hasMax, err := floatParam(r, "max_price")
+	if err != nil {
+		return nil, err
+	}
+	if hasMin && hasMax && minPrice > maxPrice {
+		return nil, badRequestf("min_price must not be greater than max_price")
+	}
+	if hasMin || hasMax {
+		price := bson.M{}
+		if hasMin {
+			price["$gte"] = minPrice
+		}
+		if hasMax {
+			price["$lte"] = maxPrice
+		}
+		conditions = append(conditions, bson.M{"price": price})
+	}
+
+	for param, field := range furnitureDimensionFilters {
+		limit, ok, err := floatParam(r, param)
+		if err != nil {
+			return nil, badRequestf("%s must be a non-negative number of centimetres; items without that dimension are excluded when it is filtered on", param)
+		}
+		if ok {
+			// $lte never matches a missing field, so items without this
+			// dimension drop out of the result.
+			conditions = append(conditions, bson.M{field: bson.M{"$lte": limit}})
+		}
+	}
+
+	if slug := query.Get("category"); slug != "" {
+		category, err := findCategoryBySlug(r.Context(), slug)
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, badRequestf("unknown category %q", slug)
+		}
+		if err != nil {
+			return nil, err
+		}
+		conditions = append(conditions, bson.M{"category_id": category.ID})
+	}
+
+	if len(conditions) == 0 {
+		return bson.M{}, nil
+	}
+	return bson.M{"$and": conditions}, nil
+}
+
+// createFurnitureIndexes makes SKUs unique and sets up full-text search. Items
+// created before SKUs existed have none, so the SKU index only covers
+// documents that carry one.
+func createFurnitureIndexes() error {
+	_, err := database.Collection(furnitureCollectionName).Indexes().CreateOne(context.TODO(), mongo.IndexModel{
+		Keys: bson.D{{Key: "sku", Value: 1}},
+		Options: options.Index().
+			SetUnique(true).
+			SetPartialFilterExpression(bson.M{"sku": bson.M{"$type": "string"}}),
+	})
+	if err != nil {
+		return err
+	}
+	return createFurnitureTextIndex(context.TODO())
+}
+
+func handleGetFurniture(w http.ResponseWriter, r *http.Request) {
+	page, err := parsePagination(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	filter, err := furnitureFilter(r)
+	if err != nil {
+		writeQueryError(w, err, "Failed to load furniture")
+		return
+	}
+
+	sort, err := parseSort(r, furnitureSortFields)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	fields, err := parseFields(r, furnitureFields, "id")
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if _, ok := fields.projection["price"]; ok {
+		// The sale price goes with the price, and promotions can apply by
+		// category.
+		fields.projection["category_id"] = 1
+		fields.keys = append(fields.keys, "sale_price", "promotion_id")
+	}
+
+	furnitureCollection := database.Collection(furnitureCollectionName)
+	total, err := furnitureCollection.CountDocuments(r.Context(), filter)
+	if err != nil {
+		fmt.Println("Error counting furniture:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to load furniture")
+		return
+	}
+
+	opts := options.Find().SetSort(sort).SetSkip(page.skip()).SetLimit(int64(page.Limit))
+	if fields.projection != nil {
+		opts.SetProjection(fields.projection)
+	}
+	cursor, err := furnitureCollection.Find(r.Context(), filter, opts)
+	if err != nil {
+		fmt.Println("Error querying furniture:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to load furniture")
+		return
+	}
+	defer cursor.Close(r.Context())
+
+	items := []Furniture{}
+	if err := cursor.All(r.Context(), &items); err != nil {
+		fmt.Println("Error decoding furniture:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to load furniture")
+		return
+	}
+	if err := applySalePrices(r.Context(), items); err != nil {
+		fmt.Println("Error applying promotions:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to load furniture")
+		return
+	}
+	picked := make([]interface{}, len(items))
+	for i, item := range items {
+		if picked[i], err = fields.pick(item); err != nil {
+			fmt.Println("Error selecting furniture fields:", err)
+			writeJSONError(w, http.StatusInternalServerError, "Failed to load furniture")
+			return
+		}
+	}
+
+	writeJSON(w, http.StatusOK, pageResponse{
+		Items:      picked,
+		Total:      total,
+		Page:       page.Page,
+		TotalPages: page.totalPages(total),
+	})
+}
+
+func handleFurniture(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		handleGetFurniture(w, r)
+	case http.MethodPost:
+		createFurniture(w, r)
+	case http.MethodPut:
+		updateFurniture(w, r)
+	case http.MethodDelete:
+		deleteFurniture(w, r)
+	default:
+		writeJSONError(w, http.StatusMethodNotAllowed, "Method not allowed")
+	}
+}
+
+func parseFurnitureID(r *http.Request) (int, error) {
+	id, err := strconv.Atoi(idParam(r))
+	if err != nil || id <= 0 {
+		return 0, errors.New("id must be a positive integer")
+	}
+	return id, nil
+}
+
+func nextFurnitureID(ctx context.Context) (int, error) {
+	return nextSequence(ctx, furnitureCollectionName)
+}
+
+func createFurniture(w http.ResponseWriter, r *http.Request) {
+	var input furnitureInput
+	if !decodeJSON(w, r, &input) {
+		return
+	}
+	if errs := input.validate(); len(errs) > 0 {
+		writeValidationErrors(w, "Furniture is invalid", errs)
+		return
+	}
+
+	if !input.checkCategory(w, r.Context()) {
+		return
+	}
+
+	id, err := nextFurnitureID(r.Context())
+	if err != nil {
+		fmt.Println("Error generating furniture ID:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to create furniture")
+		return
+	}
+
+	item := input.newFurniture(id, time.Now())
+
+	furnitureCollection := database.Collection(furnitureCollectionName)
+	_, err = furnitureCollection.InsertOne(r.Context(), item)
+	if mongo.IsDuplicateKeyError(err) {
+		writeSKUConflict(w, input.SKU)
+		return
+	}
+	if err != nil {
+		fmt.Println("Error inserting furniture:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to create furniture")
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, item)
+}
+
+func writeSKUConflict(w http.ResponseWriter, sku string) {
+	writeErrorDetails(w, http.StatusConflict, codeDuplicateSKU, "Another furniture item already uses this SKU",
+		[]map[string]string{{"sku": sku}})
+}
+
+func getFurnitureBySKU(w http.ResponseWriter, r *http.Request) {
+	sku := strings.TrimSpace(r.URL.Query().Get("sku"))
+	if sku == "" {
+		writeJSONError(w, http.StatusBadRequest, "sku is required")
+		return
+	}
+
+	var item Furniture
+	err := database.Collection(furnitureCollectionName).FindOne(
+		r.Context(),
+		bson.M{"sku": sku, "deleted_at": bson.M{"$exists": false}},
+	).Decode(&item)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		writeJSONError(w, http.StatusNotFound, "Furniture not found")
+		return
+	}
+	if err != nil {
+		fmt.Println("Error looking up furniture by SKU:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to load furniture")
+		return
+	}
+	items := []Furniture{item}
+	if err := applySalePrices(r.Context(), items); err != nil {
+		fmt.Println("Error applying promotions:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to load furniture")
+		return
+	}
+	item = items[0]
+
+	writeJSON(w, http.StatusOK, item)
+}
+
+func getFurnitureByID(w http.ResponseWriter, r *http.Request) {
+	id, err := parseFurnitureID(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidID, err.Error())
+		return
+	}
+
+	var item Furniture
+	err = database.Collection(furnitureCollectionName).FindOne(
+		r.Context(),
+		bson.M{"_id": id, "deleted_at": bson.M{"$exists": false}},
+	).Decode(&item)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		writeJSONError(w, http.StatusNotFound, "Furniture not found")
+		return
+	}
+	if err != nil {
+		fmt.Println("Error loading furniture:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to load furniture")
+		return
+	}
+	items := []Furniture{item}
+	if err := applySalePrices(r.Context(), items); err != nil {
+		fmt.Println("Error applying promotions:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to load furniture")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, items[0])
+}
+
+// updateFurniture replaces an item's details. Stock is left alone unless the
+// body sends it, so a PUT cannot undo sales placed since the client read it.
+func updateFurniture(w http.ResponseWriter, r *http.Request) {
+	id, err := parseFurnitureID(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidID, err.Error())
+		return
+	}
+
+	var input furnitureInput
+	if !decodeJSON(w, r, &input) {
+		return
+	}
+	if errs := input.validate(); len(errs) > 0 {
+		writeValidationErrors(w, "Furniture is invalid", errs)
+		return
+	}
+
+	if !input.checkCategory(w, r.Context()) {
+		return
+	}
+
+	update := bson.M{"$set": bson.M{
+		"sku":         input.SKU,
+		"name":        input.Name,
+		"description": input.Description,
+		"price":       input.Price,
+		"updated_at":  time.Now(),
+	}}
+	set, unset := update["$set"].(bson.M), bson.M{}
+	if input.Stock != nil {
+		set["stock"] = *input.Stock
+	}
+	if input.categoryID != nil {
+		set["category_id"] = *input.categoryID
+	} else {
+		unset["category_id"] = ""
+	}
+	for field, value := range map[string]float64{
+		"width_cm":  input.WidthCM,
+		"depth_cm":  input.DepthCM,
+		"height_cm": input.HeightCM,
+	} {
+		if value > 0 {
+			set[field] = value
+		} else {
+			unset[field] = ""
+		}
+	}
+	if len(unset) > 0 {
+		update["$unset"] = unset
+	}
+
+	// The update and its price history entry commit together, so the
+	// history cannot miss a price change.
+	furnitureCollection := database.Collection(furnitureCollectionName)
+	err = withTransaction(r.Context(), func(ctx context.Context) error {
+		var previous Furniture
+		err := furnitureCollection.FindOneAndUpdate(
+			ctx,
+			activeFurnitureByID(id),
+			update,
+			options.FindOneAndUpdate().SetReturnDocument(options.Before),
+		).Decode(&previous)
+		if err != nil || previous.Price == input.Price {
+			return err
+		}
+
+		err = recordPriceChange(ctx, PriceChange{FurnitureID: id, OldPrice: previous.Price, NewPrice: input.Price})
+		if err != nil && !transactionsSupported {
+			// No transaction to roll back, so put the old price back by hand
+			// unless someone has changed it again in the meantime.
+			furnitureCollection.UpdateOne(ctx, bson.M{"_id": id, "price": input.Price}, bson.M{"$set": bson.M{"price": previous.Price}})
+		}
+		return err
+	})
+	if mongo.IsDuplicateKeyError(err) {
+		writeSKUConflict(w, input.SKU)
+		return
+	}
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		writeJSONError(w, http.StatusNotFound, "Furniture not found")
+		return
+	}
+	if err != nil {
+		fmt.Println("Error updating furniture:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to update furniture")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// deleteFurniture only marks the item as deleted so that orders referencing
+// it keep resolving; purgeFurniture removes it for good later.
+func deleteFurniture(w http.ResponseWriter, r *http.Request) {
+	id, err := parseFurnitureID(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidID, err.Error())
+		return
+	}
+
+	furnitureCollection := database.Collection(furnitureCollectionName)
+	now := time.Now()
+	result, err := furnitureCollection.UpdateOne(
+		r.Context(),
+		activeFurnitureByID(id),
+		bson.M{"$set": bson.M{"deleted_at": now, "updated_at": now}},
+	)
+	if err != nil {
+		fmt.Println("Error deleting furniture:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to delete furniture")
+		return
+	}
+	if result.MatchedCount == 0 {
+		writeJSONError(w, http.StatusNotFound, "Furniture not found")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func restoreFurniture(w http.ResponseWriter, r *http.Request) {
+	id, err := parseFurnitureID(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidID, err.Error())
+		return
+	}
+
+	var item Furniture
+	err = database.Collection(furnitureCollectionName).FindOneAndUpdate(
+		r.Context(),
+		bson.M{"_id": id, "deleted_at": bson.M{"$exists": true}},
+		bson.M{"$unset": bson.M{"deleted_at": ""}, "$set": bson.M{"updated_at": time.Now()}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&item)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		writeJSONError(w, http.StatusNotFound, "No deleted furniture with this ID")
+		return
+	}
+	if err != nil {
+		fmt.Println("Error restoring furniture:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to restore furniture")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, item)
+}
+
+const defaultPurgeAfterDays = 30
+
+// purgeFurniture permanently removes items soft-deleted more than
+// ?older_than_days= days ago, along with their images.
+func purgeFurniture(w http.ResponseWriter, r *http.Request) {
+	days := defaultPurgeAfterDays
+	if raw := r.URL.Query().Get("older_than_days"); raw != "" {
+		parsed, err := strconv.Atoi(raw)
+		if err != nil || parsed < 0 {
+			writeJSONError(w, http.StatusBadRequest, "older_than_days must be a non-negative integer")
+			return
+		}
+		days = parsed
+	}
+
+	filter := bson.M{"deleted_at": bson.M{"$lt": time.Now().AddDate(0, 0, -days)}}
+	furnitureCollection := database.Collection(furnitureCollectionName)
+
+	var purged []Furniture
+	cursor, err := furnitureCollection.Find(r.Context(), filter, options.Find().SetProjection(bson.M{"image_id": 1}))
+	if err == nil {
+		err = cursor.All(r.Context(), &purged)
+	}
+	if err != nil {
+		fmt.Println("Error finding furniture to purge:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to purge furniture")
+		return
+	}
+
+	result, err := furnitureCollection.DeleteMany(r.Context(), filter)
+	if err != nil {
+		fmt.Println("Error purging furniture:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to purge furniture")
+		return
+	}
+
+	if bucket, err := imageBucket(); err == nil {
+		for _, item := range purged {
+			if item.ImageID != nil {
+				if err := bucket.DeleteContext(r.Context(), *item.ImageID); err != nil {
+					fmt.Println("Error deleting image of purged furniture:", err)
+				}
+			}
+		}
+	}
+
+	writeJSON(w, http.StatusOK, map[string]int64{"purged": result.DeletedCount})
+}
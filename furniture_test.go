@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestFurnitureFilterRejectsBadPrices(t *testing.T) {
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{"min_price=-1", "min_price must be a non-negative number"},
+		{"max_price=abc", "max_price must be a non-negative number"},
+		{"min_price=NaN", "min_price must be a non-negative number"},
+		{"max_price=Inf", "max_price must be a non-negative number"},
+		{"min_price=200.01&max_price=200", "min_price must not be greater than max_price"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			_, err := furnitureFilter(httptest.NewRequest(http.MethodGet, "/getFurniture?"+tt.query, nil))
+			var reqErr requestError
+			if !errors.As(err, &reqErr) || reqErr.message != tt.want {
+				t.Errorf("err = %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetFurniturePriceBoundsAreInclusive(t *testing.T) {
+	h, db := testServer(t)
+	var docs []interface{}
+	for id, price := range map[int]float64{1: 99.99, 2: 100, 3: 150, 4: 200, 5: 200.01} {
+		docs = append(docs, Furniture{ID: id, Name: "Item", Price: price})
+	}
+	if _, err := db.Collection(furnitureCollectionName).InsertMany(context.Background(), docs); err != nil {
+		t.Fatalf("insert: %v", err)
+	}
+
+	tests := []struct {
+		query string
+		want  []int
+	}{
+		{"min_price=100", []int{2, 3, 4, 5}},
+		{"max_price=200", []int{1, 2, 3, 4}},
+		{"min_price=100&max_price=200", []int{2, 3, 4}},
+		{"min_price=200&max_price=200", []int{4}},
+		{"min_price=100.001&max_price=199.999", []int{3}},
+		{"min_price=0&max_price=0", []int{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			rec := serveTest(h, http.MethodGet, "/getFurniture?"+tt.query, "", "")
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status = %d: %s", rec.Code, rec.Body)
+			}
+			var page struct {
+				Items []Furniture `json:"items"`
+			}
+			if err := json.Unmarshal(rec.Body.Bytes(), &page); err != nil {
+				t.Fatalf("decode: %v", err)
+			}
+			got := []int{}
+			for _, item := range page.Items {
+				got = append(got, item.ID)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ids = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIncludeDeletedIsForAdminsOnly(t *testing.T) {
+	h, db := testServer(t)
+	deletedAt := time.Now()
+	docs := []interface{}{
+		Furniture{ID: 1, Name: "Chair", Price: 50},
+		Furniture{ID: 2, Name: "Old chair", Price: 40, DeletedAt: &deletedAt},
+	}
+	if _, err := db.Collection(furnitureCollectionName).InsertMany(context.Background(), docs); err != nil {
+		t.Fatalf("insert: %v", err)
+	}
+	customer := testToken(t, User{ID: primitive.NewObjectID()})
+	admin := testToken(t, User{ID: primitive.NewObjectID(), Role: roleAdmin})
+
+	tests := []struct {
+		name, target, token string
+		want                []int
+	}{
+		{"anonymous", "/getFurniture?include_deleted=true", "", []int{1}},
+		{"customer", "/getFurniture?include_deleted=true", customer, []int{1}},
+		{"admin without the flag", "/getFurniture", admin, []int{1}},
+		{"admin", "/getFurniture?include_deleted=true", admin, []int{1, 2}},
+		{"anonymous on /furniture", "/furniture?include_deleted=true", "", []int{1}},
+		{"admin on /furniture", "/furniture?include_deleted=true", admin, []int{1, 2}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := serveTest(h, http.MethodGet, tt.target, tt.token, "")
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status = %d: %s", rec.Code, rec.Body)
+			}
+			var page struct {
+				Items []Furniture `json:"items"`
+			}
+			if err := json.Unmarshal(rec.Body.Bytes(), &page); err != nil {
+				t.Fatalf("decode: %v", err)
+			}
+			got := []int{}
+			for _, item := range page.Items {
+				got = append(got, item.ID)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ids = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -1,8 +1,14 @@
 module shop
 
-go 1.21.5
+go 1.22
 
-require go.mongodb.org/mongo-driver v1.13.1
+require (
+	github.com/go-pdf/fpdf v0.9.0
+	github.com/golang-jwt/jwt/v5 v5.2.1
+	go.mongodb.org/mongo-driver v1.13.1
+	golang.org/x/crypto v0.0.0-20220622213112-05595931fe9d
+	golang.org/x/sync v0.0.0-20220722155255-886fb9371eb4
+)
 
 require (
 	github.com/golang/snappy v0.0.1 // indirect
@@ -14,8 +20,6 @@ require (
 	github.com/xdg-go/scram v1.1.2 // indirect
 	github.com/xdg-go/stringprep v1.0.4 // indirect
 	github.com/youmark/pkcs8 v0.0.0-20181117223130-1be2e3e5546d // indirect
-	golang.org/x/crypto v0.0.0-20220622213112-05595931fe9d // indirect
-	golang.org/x/sync v0.0.0-20220722155255-886fb9371eb4 // indirect
 	golang.org/x/text v0.7.0 // indirect
 	gorm.io/gorm v1.25.5 // indirect
 )
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+)
+
+const (
+	mongoPingTimeout = time.Second
+	// readinessCacheTTL keeps a burst of probes down to one ping.
+	readinessCacheTTL = 2 * time.Second
+)
+
+// readinessDrainDelay is how long /readyz answers 503 after a shutdown
+// signal before the server stops accepting requests, so load balancers
+// notice and send traffic elsewhere first. It is SHUTDOWN_DRAIN_DELAY; zero
+// stops right away.
+var readinessDrainDelay = 5 * time.Second
+
+// shuttingDown is set once a shutdown signal has arrived.
+var shuttingDown atomic.Bool
+
+type dependencyCheck struct {
+	Status    string  `json:"status"`
+	LatencyMS float64 `json:"latency_ms"`
+	Error     string  `json:"error,omitempty"`
+}
+
+type mongoReadiness struct {
+	mu        sync.Mutex
+	checked   time.Time
+	lastCheck dependencyCheck
+}
+
+var mongoHealth mongoReadiness
+
+// check pings MongoDB unless the last ping is recent enough. Probes that
+// arrive during a ping wait for it instead of starting their own.
+func (m *mongoReadiness) check(ctx context.Context) dependencyCheck {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if time.Since(m.checked) < readinessCacheTTL {
+		return m.lastCheck
+	}
+
+	if database == nil {
+		m.checked, m.lastCheck = time.Now(), dependencyCheck{Status: "unavailable", Error: "not connected"}
+		return m.lastCheck
+	}
+	ctx, cancel := context.WithTimeout(ctx, mongoPingTimeout)
+	defer cancel()
+	start := time.Now()
+	err := database.Client().Ping(ctx, readpref.Primary())
+	result := dependencyCheck{Status: "ok", LatencyMS: float64(time.Since(start).Microseconds()) / 1000}
+	if err != nil {
+		fmt.Println("Error pinging MongoDB:", err)
+		result.Status = "unavailable"
+		result.Error = "ping failed"
+	}
+	m.checked, m.lastCheck = time.Now(), result
+	return result
+}
+
+// handleLiveness answers 200 as long as the process serves requests at all;
+// it checks nothing else, so a database outage does not get it restarted.
+func handleLiveness(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// handleReadiness answers 200 when the server can do useful work and 503
+// while it is shutting down or a dependency is unavailable.
+func handleReadiness(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	if shuttingDown.Load() {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"status": "shutting_down"})
+		return
+	}
+
+	checks := map[string]dependencyCheck{"mongo": mongoHealth.check(r.Context())}
+	status, code := "ok", http.StatusOK
+	for _, check := range checks {
+		if check.Status != "ok" {
+			status, code = "unavailable", http.StatusServiceUnavailable
+		}
+	}
+	writeJSON(w, code, map[string]interface{}{"status": status, "checks": checks})
+}
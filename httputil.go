@@ -0,0 +1,398 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	defaultPageLimit = 20
+	maxPageLimit     = 100
+)
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// Error codes clients can branch on. Messages are for people and may change.
+const (
+	codeBadRequest           = "bad_request"
+	codeInvalidID            = "invalid_id"
+	codeUnauthorized         = "unauthorized"
+	codeForbidden            = "forbidden"
+	codeNotFound             = "not_found"
+	codeMethodNotAllowed     = "method_not_allowed"
+	codeConflict             = "conflict"
+	codeDuplicateEmail       = "duplicate_email"
+	codeDuplicateSKU         = "duplicate_sku"
+	codeVersionConflict      = "version_conflict"
+	codeValidationFailed     = "validation_failed"
+	codePreconditionRequired = "precondition_required"
+	codePayloadTooLarge      = "payload_too_large"
+	codeUnsupportedMedia     = "unsupported_media_type"
+	codeRateLimited          = "rate_limited"
+	codeInternal             = "internal_error"
+	codeUnavailable          = "unavailable"
+	codeTimeout              = "timeout"
+)
+
+// statusCodes is the code writeJSONError uses for each status.
+var statusCodes = map[int]string{
+	http.StatusBadRequest:            codeBadRequest,
+	http.StatusUnauthorized:          codeUnauthorized,
+	http.StatusForbidden:             codeForbidden,
+	http.StatusNotFound:              codeNotFound,
+	http.StatusMethodNotAllowed:      codeMethodNotAllowed,
+	http.StatusConflict:              codeConflict,
+	http.StatusPreconditionRequired:  codePreconditionRequired,
+	http.StatusRequestEntityTooLarge: codePayloadTooLarge,
+	http.StatusUnsupportedMediaType:  codeUnsupportedMedia,
+	http.StatusUnprocessableEntity:   codeValidationFailed,
+	http.StatusTooManyRequests:       codeRateLimited,
+	http.StatusServiceUnavailable:    codeUnavailable,
+	http.StatusGatewayTimeout:        codeTimeout,
+}
+
+// apiError is the body of every error response, inside {"error": ...}.
+// Details, when set, is a list of whatever the client needs to act on the
+// error, such as the invalid fields.
+type apiError struct {
+	Code    string      `json:"code"`
+	Message string      `json:"message"`
+	Details interface{} `json:"details,omitempty"`
+	// RequestID and TraceID are the IDs to quote when reporting the error.
+	RequestID string `json:"request_id,omitempty"`
+	TraceID   string `json:"trace_id,omitempty"`
+}
+
+// writeError answers with the error envelope. message is shown to clients,
+// so database and other internal errors must be logged instead of passed in.
+func writeError(w http.ResponseWriter, status int, code, message string) {
+	writeErrorDetails(w, status, code, message, nil)
+}
+
+func writeErrorDetails(w http.ResponseWriter, status int, code, message string, details interface{}) {
+	writeJSON(w, status, map[string]apiError{"error": {
+		Code:      code,
+		Message:   message,
+		Details:   details,
+		RequestID: w.Header().Get(requestIDHeader),
+		TraceID:   w.Header().Get(traceIDHeader),
+	}})
+}
+
+// writeJSONError is writeError with the usual code for status.
+func writeJSONError(w http.ResponseWriter, status int, message string) {
+	code, ok := statusCodes[status]
+	if !ok {
+		code = codeInternal
+	}
+	writeError(w, status, code, message)
+}
+
+// router is the server's mux. It is not http.DefaultServeMux, on which
+// net/http/pprof registers its handlers without any authentication.
+type router struct {
+	*http.ServeMux
+}
+
+func newRouter() router {
+	return router{http.NewServeMux()}
+}
+
+// route registers h for pattern and answers any method not in methods with
+// 405 and an Allow header, before authentication or anything else in h runs.
+// h gets requestTimeout to finish. Requests are counted and timed under
+// pattern on /metrics.
+func (mux router) route(pattern string, h http.HandlerFunc, methods ...string) {
+	mux.HandleFunc(pattern, instrument(pattern, allowMethods(withTimeout(requireDatabase(h), requestTimeout), methods...)))
+}
+
+// exportRoute is route for exports and imports, which get exportTimeout.
+func (mux router) exportRoute(pattern string, h http.HandlerFunc, methods ...string) {
+	mux.HandleFunc(pattern, instrument(pattern, allowMethods(withTimeout(requireDatabase(h), exportTimeout), methods...)))
+}
+
+// probeRoute is route for the probes and metrics, which have to answer
+// whether or not the database is there.
+func (mux router) probeRoute(pattern string, h http.HandlerFunc, methods ...string) {
+	mux.HandleFunc(pattern, instrument(pattern, allowMethods(withTimeout(h, requestTimeout), methods...)))
+}
+
+// idParam is the {id} path segment, or the id query parameter on the older
+// routes that take ?id=.
+func idParam(r *http.Request) string {
+	if id := r.PathValue("id"); id != "" {
+		return id
+	}
+	return r.URL.Query().Get("id")
+}
+
+// parseObjectID reads the ID from idParam, answering 400 with invalid_id
+// when it is missing or not an ObjectID.
+func parseObjectID(w http.ResponseWriter, r *http.Request) (primitive.ObjectID, bool) {
+	raw := idParam(r)
+	if raw == "" {
+		writeError(w, http.StatusBadRequest, codeInvalidID, "id is required")
+		return primitive.NilObjectID, false
+	}
+	id, err := primitive.ObjectIDFromHex(raw)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidID, "id must be a valid ID")
+		return primitive.NilObjectID, false
+	}
+	return id, true
+}
+
+// deprecated marks responses of an old route with the route that replaces
+// it, so clients can move before the old one is removed.
+func deprecated(h http.HandlerFunc, successor string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Deprecation", "true")
+		w.Header().Set("Link", "<"+successor+">; rel=\"successor-version\"")
+		h(w, r)
+	}
+}
+
+func allowMethods(h http.HandlerFunc, methods ...string) http.HandlerFunc {
+	allow := strings.Join(methods, ", ")
+	return func(w http.ResponseWriter, r *http.Request) {
+		for _, method := range methods {
+			if r.Method == method {
+				h(w, r)
+				return
+			}
+		}
+		w.Header().Set("Allow", allow)
+		writeJSONError(w, http.StatusMethodNotAllowed, "Method not allowed")
+	}
+}
+
+// maxBodyBytes caps JSON request bodies; MAX_BODY_BYTES overrides the 1 MB
+// default.
+var maxBodyBytes int64 = 1 << 20
+
+// decodeJSON reads exactly one JSON value from the body into dst, rejecting
+// fields dst does not have, and answers 400 (413 for a body over
+// maxBodyBytes) saying what was wrong when it cannot.
+func decodeJSON(w http.ResponseWriter, r *http.Request, dst interface{}) bool {
+	r.Body = http.MaxBytesReader(w, r.Body, maxBodyBytes)
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	err := dec.Decode(dst)
+	if err == nil && dec.Decode(&struct{}{}) != io.EOF {
+		err = errTrailingJSON
+	}
+	if err == nil {
+		return true
+	}
+
+	var maxErr *http.MaxBytesError
+	if errors.As(err, &maxErr) {
+		writeError(w, http.StatusRequestEntityTooLarge, codePayloadTooLarge,
+			fmt.Sprintf("Request body must be at most %d bytes", maxErr.Limit))
+		return false
+	}
+	writeJSONError(w, http.StatusBadRequest, jsonErrorMessage(err))
+	return false
+}
+
+var errTrailingJSON = errors.New("data after the JSON value")
+
+func jsonErrorMessage(err error) string {
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.Is(err, errTrailingJSON):
+		return "Request body must hold a single JSON value"
+	case errors.Is(err, io.EOF):
+		return "Request body must not be empty"
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		return "Request body is not valid JSON: it ends too early"
+	case errors.As(err, &syntaxErr):
+		return fmt.Sprintf("Request body is not valid JSON at byte %d", syntaxErr.Offset)
+	case errors.As(err, &typeErr):
+		if typeErr.Field == "" {
+			return "Request body must be " + jsonTypeName(typeErr.Type)
+		}
+		return fmt.Sprintf("%s must be %s, not %s", typeErr.Field, jsonTypeName(typeErr.Type), typeErr.Value)
+	case strings.HasPrefix(err.Error(), "json: unknown field "):
+		return "Unknown field " + strings.TrimPrefix(err.Error(), "json: unknown field ")
+	}
+	return "Invalid JSON-message"
+}
+
+// jsonTypeName describes t the way a JSON client would see it.
+func jsonTypeName(t reflect.Type) string {
+	if t == reflect.TypeOf(primitive.ObjectID{}) {
+		return "an ID string"
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		return "a boolean"
+	case reflect.String:
+		return "a string"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "a whole number"
+	case reflect.Float32, reflect.Float64:
+		return "a number"
+	case reflect.Slice, reflect.Array:
+		return "an array"
+	case reflect.Ptr:
+		return jsonTypeName(t.Elem())
+	}
+	return "an object"
+}
+
+// requestError marks a problem with the client's input, as opposed to a
+// database or server failure.
+type requestError struct {
+	message string
+}
+
+func (e requestError) Error() string {
+	return e.message
+}
+
+func badRequestf(format string, args ...interface{}) error {
+	return requestError{message: fmt.Sprintf(format, args...)}
+}
+
+// writeQueryError responds 400 with the message of a requestError, and logs
+// anything else before responding 500 with failureMessage.
+func writeQueryError(w http.ResponseWriter, err error, failureMessage string) {
+	var reqErr requestError
+	if errors.As(err, &reqErr) {
+		writeJSONError(w, http.StatusBadRequest, reqErr.message)
+		return
+	}
+	fmt.Println(failureMessage+":", err)
+	writeJSONError(w, http.StatusInternalServerError, failureMessage)
+}
+
+// fieldError describes one invalid field of a request body.
+type fieldError struct {
+	Field   string `json:"field"`
+	Rule    string `json:"rule,omitempty"`
+	Message string `json:"message"`
+}
+
+// writeValidationErrors responds 422 listing every invalid field at once.
+func writeValidationErrors(w http.ResponseWriter, message string, errs []fieldError) {
+	writeErrorDetails(w, http.StatusUnprocessableEntity, codeValidationFailed, message, errs)
+}
+
+type pagination struct {
+	Page  int
+	Limit int
+}
+
+func (p pagination) skip() int64 {
+	return int64(p.Page-1) * int64(p.Limit)
+}
+
+func (p pagination) totalPages(total int64) int64 {
+	return (total + int64(p.Limit) - 1) / int64(p.Limit)
+}
+
+// parsePagination reads ?page= and ?limit=, defaulting to the first page and
+// capping the limit at maxPageLimit. A page so far out that its offset would
+// overflow is rejected rather than handed to the driver as a negative skip.
+func parsePagination(r *http.Request) (pagination, error) {
+	p := pagination{Page: 1, Limit: defaultPageLimit}
+	query := r.URL.Query()
+
+	if raw := query.Get("page"); raw != "" {
+		page, err := strconv.Atoi(raw)
+		if err != nil || page < 1 {
+			return p, badRequestf("page must be a positive integer")
+		}
+		p.Page = page
+	}
+
+	if raw := query.Get("limit"); raw != "" {
+		limit, err := strconv.Atoi(raw)
+		if err != nil || limit < 1 {
+			return p, badRequestf("limit must be a positive integer")
+		}
+		if limit > maxPageLimit {
+			limit = maxPageLimit
+		}
+		p.Limit = limit
+	}
+
+	if int64(p.Page-1) > math.MaxInt64/int64(p.Limit) {
+		return p, badRequestf("page is too large")
+	}
+	return p, nil
+}
+
+// floatParam parses an optional non-negative number from the query string.
+// ok is false when the parameter is absent.
+func floatParam(r *http.Request, name string) (value float64, ok bool, err error) {
+	raw := r.URL.Query().Get(name)
+	if raw == "" {
+		return 0, false, nil
+	}
+	value, err = strconv.ParseFloat(raw, 64)
+	if err != nil || math.IsNaN(value) || math.IsInf(value, 0) || value < 0 {
+		return 0, false, badRequestf("%s must be a non-negative number", name)
+	}
+	return value, true, nil
+}
+
+// timeParam parses an optional RFC3339 timestamp from the query string. Only
+// full timestamps with a zone are accepted, so "01/02/2024" or a bare date
+// cannot be read two ways.
+func timeParam(r *http.Request, name string) (value time.Time, ok bool, err error) {
+	raw := r.URL.Query().Get(name)
+	if raw == "" {
+		return time.Time{}, false, nil
+	}
+	value, err = time.Parse(time.RFC3339, raw)
+	if err != nil {
+		return time.Time{}, false, badRequestf("%s must be an RFC3339 timestamp such as 2024-01-31T00:00:00Z", name)
+	}
+	return value, true, nil
+}
+
+// parseSort turns ?sort=field or ?sort=-field into a sort document, accepting
+// only the listed fields. Ties are broken by _id so pages stay stable.
+func parseSort(r *http.Request, allowed []string) (bson.D, error) {
+	raw := r.URL.Query().Get("sort")
+	if raw == "" {
+		return bson.D{{Key: "_id", Value: 1}}, nil
+	}
+
+	field, order := raw, 1
+	if strings.HasPrefix(raw, "-") {
+		field, order = raw[1:], -1
+	}
+	for _, name := range allowed {
+		if name == field {
+			return bson.D{{Key: field, Value: order}, {Key: "_id", Value: 1}}, nil
+		}
+	}
+	return nil, badRequestf("unsupported sort %q, allowed values: %s (prefix with - for descending)", raw, strings.Join(allowed, ", "))
+}
+
+type pageResponse struct {
+	Items      interface{} `json:"items"`
+	Total      int64       `json:"total"`
+	Page       int         `json:"page"`
+	TotalPages int64       `json:"total_pages"`
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestAllowMethods(t *testing.T) {
+	called := false
+	h := allowMethods(func(w http.ResponseWriter, r *http.Request) { called = true }, http.MethodGet, http.MethodPost)
+
+	rec := httptest.NewRecorder()
+	h(rec, httptest.NewRequest(http.MethodPost, "/", nil))
+	if !called || rec.Code != http.StatusOK {
+		t.Errorf("POST: called = %v, status = %d; want the handler to run", called, rec.Code)
+	}
+
+	called = false
+	rec = httptest.NewRecorder()
+	h(rec, httptest.NewRequest(http.MethodDelete, "/", nil))
+	if called {
+		t.Error("DELETE reached the handler")
+	}
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("DELETE = %d, want 405", rec.Code)
+	}
+	if allow := rec.Header().Get("Allow"); allow != "GET, POST" {
+		t.Errorf("Allow = %q, want %q", allow, "GET, POST")
+	}
+	if apiErr := decodeAPIError(t, rec); apiErr.Code != codeMethodNotAllowed {
+		t.Errorf("code = %q, want %q", apiErr.Code, codeMethodNotAllowed)
+	}
+}
+
+// Wrong methods are turned away before authentication and before the
+// database is needed, so no database is set up here.
+func TestRoutesRejectWrongMethods(t *testing.T) {
+	h := newHandler(nil)
+	tests := []struct {
+		method, path, allow string
+	}{
+		{http.MethodPost, "/getFurniture", "GET"},
+		{http.MethodGet, "/submitOrder", "POST"},
+		{http.MethodDelete, "/orders/cancel", "POST"},
+		{http.MethodPatch, "/wishlist", "GET, POST, DELETE"},
+		{http.MethodPut, "/users/0123456789abcdef01234567", "GET, PATCH, DELETE"},
+		{http.MethodPost, "/admin/orders", "GET"},
+		{http.MethodPut, "/healthz", "GET"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.path, func(t *testing.T) {
+			rec := serveTest(h, tt.method, tt.path, "", "")
+			if rec.Code != http.StatusMethodNotAllowed {
+				t.Fatalf("status = %d, want 405: %s", rec.Code, rec.Body)
+			}
+			if allow := rec.Header().Get("Allow"); allow != tt.allow {
+				t.Errorf("Allow = %q, want %q", allow, tt.allow)
+			}
+			if apiErr := decodeAPIError(t, rec); apiErr.Code != codeMethodNotAllowed || apiErr.RequestID == "" {
+				t.Errorf("error = %+v, want %s with a request ID", apiErr, codeMethodNotAllowed)
+			}
+		})
+	}
+}
+
+func TestParseObjectIDRejectsBadIDs(t *testing.T) {
+	h := assignRequestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := parseObjectID(w, r); ok {
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+	tests := []struct {
+		name, query, message string
+	}{
+		{"empty", "", "id is required"},
+		{"blank", "?id=", "id is required"},
+		{"too short", "?id=0123456789abcdef0123456", "id must be a valid ID"},
+		{"too long", "?id=0123456789abcdef012345678", "id must be a valid ID"},
+		{"not hex", "?id=0123456789abcdef0123456z", "id must be a valid ID"},
+		{"not an ObjectID", "?id=42", "id must be a valid ID"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/users"+tt.query, nil))
+			if rec.Code != http.StatusBadRequest {
+				t.Fatalf("status = %d, want 400", rec.Code)
+			}
+			apiErr := decodeAPIError(t, rec)
+			if apiErr.Code != codeInvalidID || apiErr.Message != tt.message {
+				t.Errorf("error = %q %q, want %q %q", apiErr.Code, apiErr.Message, codeInvalidID, tt.message)
+			}
+			if apiErr.RequestID == "" || apiErr.RequestID != rec.Header().Get(requestIDHeader) {
+				t.Errorf("request_id = %q, want the %s header", apiErr.RequestID, requestIDHeader)
+			}
+		})
+	}
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/users?id=0123456789abcdef01234567", nil))
+	if rec.Code != http.StatusNoContent {
+		t.Errorf("valid ID: status = %d, want it accepted", rec.Code)
+	}
+}
+
+func TestUserRouteRejectsBadIDs(t *testing.T) {
+	h, _ := testServer(t)
+	token := testToken(t, User{ID: primitive.NewObjectID(), Role: roleAdmin})
+	for _, id := range []string{"abc", "0123456789abcdef0123456", "0123456789abcdef0123456z"} {
+		rec := serveTest(h, http.MethodGet, "/users/"+id, token, "")
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("GET /users/%s = %d, want 400", id, rec.Code)
+			continue
+		}
+		if apiErr := decodeAPIError(t, rec); apiErr.Code != codeInvalidID {
+			t.Errorf("GET /users/%s: code = %q, want %q", id, apiErr.Code, codeInvalidID)
+		}
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	idempotencyKeyTTL      = 24 * time.Hour
+	idempotencyWaitTimeout = 5 * time.Second
+	idempotencyPollPeriod  = 100 * time.Millisecond
+)
+
+// idempotencyRecord stores the outcome of the first request made with a key.
+// While that request is still running Completed is false. A key belongs to
+// the caller who sent it on the route it was sent to; the _id combines all
+// three, so nobody else, and no other route, ever sees the stored response.
+type idempotencyRecord struct {
+	ID          string    `bson:"_id"`
+	Key         string    `bson:"key"`
+	Route       string    `bson:"route"`
+	Caller      string    `bson:"caller"`
+	RequestHash string    `bson:"request_hash"`
+	Completed   bool      `bson:"completed"`
+	StatusCode  int       `bson:"status_code,omitempty"`
+	ContentType string    `bson:"content_type,omitempty"`
+	Body        []byte    `bson:"body,omitempty"`
+	CreatedAt   time.Time `bson:"created_at"`
+}
+
+func createIdempotencyIndexes() error {
+	_, err := database.Collection(idempotencyKeysCollectionName).Indexes().CreateOne(context.TODO(), mongo.IndexModel{
+		Keys:    bson.D{{Key: "created_at", Value: 1}},
+		Options: options.Index().SetExpireAfterSeconds(int32(idempotencyKeyTTL.Seconds())),
+	})
+	return err
+}
+
+// responseRecorder passes a response through while keeping a copy of it.
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (rec *responseRecorder) WriteHeader(status int) {
+	rec.status = status
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *responseRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	rec.body.Write(b)
+	return rec.ResponseWriter.Write(b)
+}
+
+// idempotencyCaller identifies who sent r: the signed-in user, else the cart
+// in the cookie, else the client address.
+func idempotencyCaller(r *http.Request) string {
+	if id, ok := authenticatedUserID(r.Context()); ok && !id.IsZero() {
+		return "user:" + id.Hex()
+	}
+	if id, ok := cartID(r); ok {
+		return "cart:" + id
+	}
+	return "ip:" + clientIP(r)
+}
+
+// withIdempotency makes a handler honour the Idempotency-Key header: the first
+// request with a key runs normally and its response is stored, and any repeat
+// by the same caller on the same route gets that stored response back instead
+// of running the handler again. The record _id is unique, so of two concurrent
+// requests only one can claim it; the other waits for the winner's result. It
+// goes inside optionalAuth, so that the caller is known.
+func withIdempotency(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Idempotency-Key")
+		if key == "" {
+			next(w, r)
+			return
+		}
+
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxBodyBytes))
+		var maxErr *http.MaxBytesError
+		if errors.As(err, &maxErr) {
+			writeError(w, http.StatusRequestEntityTooLarge, codePayloadTooLarge,
+				fmt.Sprintf("Request body must be at most %d bytes", maxErr.Limit))
+			return
+		}
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "Could not read request body")
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		sum := sha256.Sum256(body)
+		requestHash := hex.EncodeToString(sum[:])
+
+		record := idempotencyRecord{
+			Key:         key,
+			Route:       r.URL.Path,
+			Caller:      idempotencyCaller(r),
+			RequestHash: requestHash,
+			CreatedAt:   time.Now(),
+		}
+		record.ID = record.Route + " " + record.Caller + " " + key
+		keys := database.Collection(idempotencyKeysCollectionName)
+		_, err = keys.InsertOne(r.Context(), record)
+		if mongo.IsDuplicateKeyError(err) {
+			replayIdempotentResponse(w, r, record)
+			return
+		}
+		if err != nil {
+			fmt.Println("Error storing idempotency key:", err)
+			writeJSONError(w, http.StatusInternalServerError, "Failed to process request")
+			return
+		}
+
+		rec := &responseRecorder{ResponseWriter: w}
+		next(rec, r)
+
+		// Server failures are not worth replaying; free the key so the
+		// client's retry gets a fresh attempt.
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if rec.status >= http.StatusInternalServerError {
+			if _, err := keys.DeleteOne(ctx, bson.M{"_id": record.ID}); err != nil {
+				fmt.Println("Error releasing idempotency key:", err)
+			}
+			return
+		}
+		_, err = keys.UpdateOne(ctx, bson.M{"_id": record.ID}, bson.M{"$set": bson.M{
+			"completed":    true,
+			"status_code":  rec.status,
+			"content_type": rec.Header().Get("Content-Type"),
+			"body":         rec.body.Bytes(),
+		}})
+		if err != nil {
+			fmt.Println("Error storing idempotent response:", err)
+		}
+	}
+}
+
+// replayIdempotentResponse answers a repeat of want with the stored response,
+// once the first request has one.
+func replayIdempotentResponse(w http.ResponseWriter, r *http.Request, want idempotencyRecord) {
+	deadline := time.Now().Add(idempotencyWaitTimeout)
+	for {
+		var record idempotencyRecord
+		err := database.Collection(idempotencyKeysCollectionName).FindOne(r.Context(), bson.M{"_id": want.ID}).Decode(&record)
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			// The first attempt failed and released the key.
+			writeJSONError(w, http.StatusConflict, "The original request with this Idempotency-Key failed; retry it")
+			return
+		}
+		if err != nil {
+			fmt.Println("Error loading idempotency key:", err)
+			writeJSONError(w, http.StatusInternalServerError, "Failed to process request")
+			return
+		}
+
+		if record.Key != want.Key || record.Route != want.Route || record.Caller != want.Caller {
+			fmt.Println("Error replaying idempotency key: stored record belongs to another request")
+			writeJSONError(w, http.StatusInternalServerError, "Failed to process request")
+			return
+		}
+		if record.RequestHash != want.RequestHash {
+			writeJSONError(w, http.StatusUnprocessableEntity, "Idempotency-Key was already used with a different request body")
+			return
+		}
+		if record.Completed {
+			w.Header().Set("Content-Type", record.ContentType)
+			w.Header().Set("Idempotent-Replayed", "true")
+			w.WriteHeader(record.StatusCode)
+			w.Write(record.Body)
+			return
+		}
+
+		if time.Now().After(deadline) {
+			writeJSONError(w, http.StatusConflict, "A request with this Idempotency-Key is still being processed")
+			return
+		}
+		select {
+		case <-r.Context().Done():
+			return
+		case <-time.After(idempotencyPollPeriod):
+		}
+	}
+}
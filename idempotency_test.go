@@ -0,0 +1,55 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestIdempotencyKeyIsScopedToCallerAndRoute(t *testing.T) {
+	testServer(t)
+	calls := 0
+	h := optionalAuth(withIdempotency(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		writeJSON(w, http.StatusCreated, map[string]string{"call": strconv.Itoa(calls)})
+	}))
+
+	jane := testToken(t, User{ID: primitive.NewObjectID()})
+	john := testToken(t, User{ID: primitive.NewObjectID()})
+	send := func(target, token string, cookie *http.Cookie) (string, bool) {
+		t.Helper()
+		req := newTestRequest(http.MethodPost, target, token, `{"items":[]}`)
+		req.Header.Set("Idempotency-Key", "shared-key")
+		if cookie != nil {
+			req.AddCookie(cookie)
+		}
+		rec := serveRequest(h, req)
+		if rec.Code != http.StatusCreated {
+			t.Fatalf("POST %s = %d: %s", target, rec.Code, rec.Body)
+		}
+		return rec.Body.String(), rec.Header().Get("Idempotent-Replayed") == "true"
+	}
+
+	first, _ := send("/submitOrder", jane, nil)
+	if again, replayed := send("/submitOrder", jane, nil); !replayed || again != first {
+		t.Errorf("repeat by the same user = %s (replayed %v), want %s replayed", again, replayed, first)
+	}
+	if _, replayed := send("/submitOrder", john, nil); replayed {
+		t.Error("another user got the first user's response")
+	}
+	if _, replayed := send("/checkout", jane, nil); replayed {
+		t.Error("the same key on /checkout replayed the /submitOrder response")
+	}
+	cart := &http.Cookie{Name: cartCookieName, Value: "0123456789abcdef0123456789abcdef"}
+	if _, replayed := send("/submitOrder", "", cart); replayed {
+		t.Error("a guest got a signed-in user's response")
+	}
+	if _, replayed := send("/submitOrder", "", cart); !replayed {
+		t.Error("a repeat from the same cart was not replayed")
+	}
+	if calls != 4 {
+		t.Errorf("handler ran %d times, want 4", calls)
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/gridfs"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const maxImageSize = 5 << 20
+
+var allowedImageTypes = map[string]bool{
+	"image/jpeg": true,
+	"image/png":  true,
+}
+
+func imageBucket() (*gridfs.Bucket, error) {
+	return gridfs.NewBucket(database)
+}
+
+func handleFurnitureImage(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		getFurnitureImage(w, r)
+	case http.MethodPost:
+		uploadFurnitureImage(w, r)
+	default:
+		writeJSONError(w, http.StatusMethodNotAllowed, "Method not allowed")
+	}
+}
+
+func uploadFurnitureImage(w http.ResponseWriter, r *http.Request) {
+	id, err := parseFurnitureID(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidID, err.Error())
+		return
+	}
+
+	// Leave headroom for the multipart envelope around the file itself.
+	r.Body = http.MaxBytesReader(w, r.Body, maxImageSize+1<<20)
+	file, header, err := r.FormFile("image")
+	if err != nil {
+		var maxErr *http.MaxBytesError
+		if errors.As(err, &maxErr) {
+			writeJSONError(w, http.StatusRequestEntityTooLarge, "Image must be at most 5 MB")
+			return
+		}
+		writeJSONError(w, http.StatusBadRequest, "Expected a multipart form with an image field")
+		return
+	}
+	defer file.Close()
+
+	if header.Size > maxImageSize {
+		writeJSONError(w, http.StatusRequestEntityTooLarge, "Image must be at most 5 MB")
+		return
+	}
+
+	// Trust the bytes rather than the client-declared Content-Type.
+	reader := bufio.NewReader(file)
+	head, _ := reader.Peek(512)
+	contentType := http.DetectContentType(head)
+	if !allowedImageTypes[contentType] {
+		writeJSONError(w, http.StatusUnsupportedMediaType, "Only image/jpeg and image/png are supported")
+		return
+	}
+
+	furnitureCollection := database.Collection(furnitureCollectionName)
+	if count, err := furnitureCollection.CountDocuments(r.Context(), activeFurnitureByID(id)); err != nil {
+		fmt.Println("Error looking up furniture:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to upload image")
+		return
+	} else if count == 0 {
+		writeJSONError(w, http.StatusNotFound, "Furniture not found")
+		return
+	}
+
+	bucket, err := imageBucket()
+	if err != nil {
+		fmt.Println("Error opening GridFS bucket:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to upload image")
+		return
+	}
+
+	uploadOpts := options.GridFSUpload().SetMetadata(bson.M{"content_type": contentType, "furniture_id": id})
+	fileID, err := bucket.UploadFromStream(header.Filename, reader, uploadOpts)
+	if err != nil {
+		fmt.Println("Error uploading image:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to upload image")
+		return
+	}
+
+	var previous Furniture
+	err = furnitureCollection.FindOneAndUpdate(
+		r.Context(),
+		activeFurnitureByID(id),
+		bson.M{"$set": bson.M{"image_id": fileID, "updated_at": time.Now()}},
+		options.FindOneAndUpdate().SetReturnDocument(options.Before),
+	).Decode(&previous)
+	if err != nil {
+		bucket.DeleteContext(r.Context(), fileID)
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			writeJSONError(w, http.StatusNotFound, "Furniture not found")
+			return
+		}
+		fmt.Println("Error saving image reference:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to upload image")
+		return
+	}
+
+	if previous.ImageID != nil {
+		if err := bucket.DeleteContext(r.Context(), *previous.ImageID); err != nil {
+			fmt.Println("Error deleting previous image:", err)
+		}
+	}
+
+	writeJSON(w, http.StatusCreated, map[string]string{"image_id": fileID.Hex()})
+}
+
+func getFurnitureImage(w http.ResponseWriter, r *http.Request) {
+	id, err := parseFurnitureID(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidID, err.Error())
+		return
+	}
+
+	var item Furniture
+	err = database.Collection(furnitureCollectionName).FindOne(r.Context(), activeFurnitureByID(id)).Decode(&item)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		writeJSONError(w, http.StatusNotFound, "Furniture not found")
+		return
+	}
+	if err != nil {
+		fmt.Println("Error looking up furniture:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to load image")
+		return
+	}
+	if item.ImageID == nil {
+		writeJSONError(w, http.StatusNotFound, "Furniture has no image")
+		return
+	}
+
+	serveGridFSFile(w, *item.ImageID)
+}
+
+// serveGridFSFile streams a stored file using the content type recorded in
+// its metadata at upload time.
+func serveGridFSFile(w http.ResponseWriter, fileID primitive.ObjectID) {
+	bucket, err := imageBucket()
+	if err != nil {
+		fmt.Println("Error opening GridFS bucket:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to load image")
+		return
+	}
+
+	stream, err := bucket.OpenDownloadStream(fileID)
+	if errors.Is(err, gridfs.ErrFileNotFound) {
+		writeJSONError(w, http.StatusNotFound, "Image not found")
+		return
+	}
+	if err != nil {
+		fmt.Println("Error opening image:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to load image")
+		return
+	}
+	defer stream.Close()
+
+	file := stream.GetFile()
+	contentType := "application/octet-stream"
+	if value, err := file.Metadata.LookupErr("content_type"); err == nil {
+		if s, ok := value.StringValueOK(); ok {
+			contentType = s
+		}
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Length", strconv.FormatInt(file.Length, 10))
+	if _, err := io.Copy(w, stream); err != nil {
+		fmt.Println("Error streaming image:", err)
+	}
+}
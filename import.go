@@ -0,0 +1,217 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const maxImportSize = 10 << 20
+
+// importRow is one record of an import together with the line (CSV) or
+// array position (JSON, 1-based) it came from.
+type importRow struct {
+	Line  int
+	Input furnitureInput
+	Err   error
+}
+
+type importedItem struct {
+	Line int `json:"line"`
+	ID   int `json:"id"`
+}
+
+type importFailure struct {
+	Line  int    `json:"line"`
+	Error string `json:"error"`
+}
+
+type importReport struct {
+	Inserted []importedItem  `json:"inserted"`
+	Failed   []importFailure `json:"failed"`
+}
+
+func handleFurnitureImport(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxImportSize)
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+
+	var rows []importRow
+	var err error
+	switch mediaType {
+	case "application/json":
+		rows, err = readJSONImport(r.Body)
+	case "text/csv":
+		rows, err = readCSVImport(r.Body)
+	default:
+		writeJSONError(w, http.StatusUnsupportedMediaType, "Content-Type must be application/json or text/csv")
+		return
+	}
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	report := importReport{Inserted: []importedItem{}, Failed: []importFailure{}}
+	var valid []importRow
+	for _, row := range rows {
+		if row.Err == nil {
+			row.Err = fieldErrorsErr(row.Input.validate())
+		}
+		if row.Err == nil && row.Input.categoryID != nil {
+			exists, err := categoryExists(r.Context(), *row.Input.categoryID)
+			if err != nil {
+				fmt.Println("Error looking up category:", err)
+				writeJSONError(w, http.StatusInternalServerError, "Failed to import furniture")
+				return
+			}
+			if !exists {
+				row.Err = errors.New("category_id does not reference an existing category")
+			}
+		}
+		if row.Err != nil {
+			report.Failed = append(report.Failed, importFailure{Line: row.Line, Error: row.Err.Error()})
+			continue
+		}
+		valid = append(valid, row)
+	}
+
+	if len(valid) == 0 {
+		writeJSON(w, http.StatusOK, report)
+		return
+	}
+
+	firstID, err := reserveSequence(r.Context(), furnitureCollectionName, len(valid))
+	if err != nil {
+		fmt.Println("Error generating furniture ID:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to import furniture")
+		return
+	}
+
+	now := time.Now()
+	docs := make([]interface{}, len(valid))
+	for i, row := range valid {
+		docs[i] = row.Input.newFurniture(firstID+i, now)
+	}
+
+	// Unordered so one bad document does not stop the rest; the write errors
+	// then say exactly which documents were not written.
+	furnitureCollection := database.Collection(furnitureCollectionName)
+	_, err = furnitureCollection.InsertMany(r.Context(), docs, options.InsertMany().SetOrdered(false))
+	writeFailed := map[int]string{}
+	if err != nil {
+		var bulkErr mongo.BulkWriteException
+		if !errors.As(err, &bulkErr) || bulkErr.WriteConcernError != nil {
+			fmt.Println("Error inserting imported furniture:", err)
+			writeJSONError(w, http.StatusInternalServerError, "Failed to import furniture")
+			return
+		}
+		for _, writeErr := range bulkErr.WriteErrors {
+			if writeErr.Code == 11000 {
+				writeFailed[writeErr.Index] = "sku " + valid[writeErr.Index].Input.SKU + " already exists"
+			} else {
+				writeFailed[writeErr.Index] = "could not be written"
+			}
+		}
+	}
+
+	for i, row := range valid {
+		if message, failed := writeFailed[i]; failed {
+			report.Failed = append(report.Failed, importFailure{Line: row.Line, Error: message})
+			continue
+		}
+		report.Inserted = append(report.Inserted, importedItem{Line: row.Line, ID: firstID + i})
+	}
+
+	writeJSON(w, http.StatusOK, report)
+}
+
+func readJSONImport(body io.Reader) ([]importRow, error) {
+	var raw []json.RawMessage
+	if err := json.NewDecoder(body).Decode(&raw); err != nil {
+		return nil, errors.New("body must be a JSON array of furniture items")
+	}
+
+	rows := make([]importRow, len(raw))
+	for i, item := range raw {
+		rows[i].Line = i + 1
+		if err := json.Unmarshal(item, &rows[i].Input); err != nil {
+			rows[i].Err = errors.New("invalid furniture object")
+		}
+	}
+	return rows, nil
+}
+
+// readCSVImport expects a header row naming the columns; sku, name and price
+// are required, description, stock and category_id are optional.
+func readCSVImport(body io.Reader) ([]importRow, error) {
+	reader := csv.NewReader(body)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, errors.New("CSV must start with a header row")
+	}
+	columns := map[string]int{}
+	for i, name := range header {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	for _, required := range []string{"sku", "name", "price"} {
+		if _, ok := columns[required]; !ok {
+			return nil, fmt.Errorf("CSV header is missing the %s column", required)
+		}
+	}
+
+	var rows []importRow
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		var row importRow
+		if err != nil {
+			var parseErr *csv.ParseError
+			if !errors.As(err, &parseErr) {
+				return nil, errors.New("could not read CSV body")
+			}
+			row.Line = parseErr.StartLine
+			row.Err = errors.New(parseErr.Err.Error())
+			rows = append(rows, row)
+			continue
+		}
+		row.Line, _ = reader.FieldPos(0)
+
+		field := func(name string) string {
+			if i, ok := columns[name]; ok && i < len(record) {
+				return strings.TrimSpace(record[i])
+			}
+			return ""
+		}
+
+		row.Input.SKU = field("sku")
+		row.Input.Name = field("name")
+		row.Input.Description = field("description")
+		row.Input.CategoryID = field("category_id")
+		if row.Input.Price, err = strconv.ParseFloat(field("price"), 64); err != nil {
+			row.Err = errors.New("price must be a number")
+		} else if raw := field("stock"); raw != "" {
+			stock, err := strconv.Atoi(raw)
+			if err != nil {
+				row.Err = errors.New("stock must be an integer")
+			}
+			row.Input.Stock = &stock
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
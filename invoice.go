@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/go-pdf/fpdf"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// invoiceColumns are the line-item table columns and their widths in mm; they
+// add up to the printable width of an A4 page with 15 mm margins.
+var invoiceColumns = []struct {
+	Title string
+	Width float64
+	Align string
+}{
+	{"Item", 95, "L"},
+	{"Qty", 20, "R"},
+	{"Unit price", 32.5, "R"},
+	{"Amount", 32.5, "R"},
+}
+
+func handleOrderInvoice(w http.ResponseWriter, r *http.Request) {
+	id, ok := parseObjectID(w, r)
+	if !ok {
+		return
+	}
+
+	order, ok := findOrder(w, r, bson.M{"_id": id})
+	if !ok {
+		return
+	}
+	if order.Status == orderStatusPending {
+		writeJSONError(w, http.StatusConflict, "Order has not been paid yet")
+		return
+	}
+
+	ids := make([]int, len(order.Items))
+	for i, item := range order.Items {
+		ids[i] = item.FurnitureID
+	}
+	catalogue, err := loadFurniture(r.Context(), ids)
+	if err != nil {
+		fmt.Println("Error loading furniture for invoice:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to render invoice")
+		return
+	}
+
+	var buf bytes.Buffer
+	if err := renderInvoice(&buf, order, catalogue); err != nil {
+		fmt.Println("Error rendering invoice:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to render invoice")
+		return
+	}
+
+	name := order.Number
+	if name == "" {
+		name = order.ID.Hex()
+	}
+	w.Header().Set("Content-Type", "application/pdf")
+	w.Header().Set("Content-Disposition", `attachment; filename="invoice-`+name+`.pdf"`)
+	w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+	w.Write(buf.Bytes())
+}
+
+// renderInvoice lays the order out on as many A4 pages as its items need,
+// repeating the table header at the top of every continuation page.
+func renderInvoice(buf *bytes.Buffer, order Order, catalogue map[int]Furniture) error {
+	pdf := fpdf.New("P", "mm", "A4", "")
+	pdf.SetMargins(15, 15, 15)
+	pdf.SetAutoPageBreak(true, 20)
+	tr := pdf.UnicodeTranslatorFromDescriptor("")
+
+	tableHeader := func() {
+		pdf.SetFont("Helvetica", "B", 10)
+		pdf.SetFillColor(230, 230, 230)
+		for _, col := range invoiceColumns {
+			pdf.CellFormat(col.Width, 7, col.Title, "1", 0, col.Align, true, 0, "")
+		}
+		pdf.Ln(-1)
+		pdf.SetFont("Helvetica", "", 10)
+	}
+	inTable := false
+	pdf.SetHeaderFunc(func() {
+		if inTable {
+			tableHeader()
+		}
+	})
+	pdf.SetFooterFunc(func() {
+		pdf.SetY(-15)
+		pdf.SetFont("Helvetica", "I", 8)
+		pdf.CellFormat(0, 10, fmt.Sprintf("Page %d of {nb}", pdf.PageNo()), "", 0, "C", false, 0, "")
+	})
+	pdf.AliasNbPages("{nb}")
+	pdf.AddPage()
+
+	pdf.SetFont("Helvetica", "B", 18)
+	pdf.CellFormat(0, 10, "Invoice", "", 1, "L", false, 0, "")
+	pdf.SetFont("Helvetica", "", 10)
+	if order.Number != "" {
+		pdf.CellFormat(0, 6, "Order number: "+order.Number, "", 1, "L", false, 0, "")
+	}
+	pdf.CellFormat(0, 6, "Order date: "+order.CreatedAt.Format("2 January 2006"), "", 1, "L", false, 0, "")
+	pdf.Ln(4)
+
+	pdf.SetFont("Helvetica", "B", 10)
+	pdf.CellFormat(0, 6, "Bill to", "", 1, "L", false, 0, "")
+	pdf.SetFont("Helvetica", "", 10)
+	pdf.CellFormat(0, 6, tr(order.Customer.Name), "", 1, "L", false, 0, "")
+	if order.Customer.Email != "" {
+		pdf.CellFormat(0, 6, tr(order.Customer.Email), "", 1, "L", false, 0, "")
+	}
+	pdf.Ln(6)
+
+	tableHeader()
+	inTable = true
+	for _, item := range order.Items {
+		description := fmt.Sprintf("Furniture #%d", item.FurnitureID)
+		if furniture, ok := catalogue[item.FurnitureID]; ok {
+			description = furniture.Name
+			if item.VariantID != "" {
+				description += " (" + item.VariantID + ")"
+			}
+		}
+		cells := []string{
+			tr(description),
+			strconv.Itoa(item.Quantity),
+			fmt.Sprintf("%.2f", item.UnitPrice),
+			fmt.Sprintf("%.2f", item.UnitPrice*float64(item.Quantity)),
+		}
+		for i, col := range invoiceColumns {
+			pdf.CellFormat(col.Width, 7, cells[i], "1", 0, col.Align, false, 0, "")
+		}
+		pdf.Ln(-1)
+	}
+	inTable = false
+
+	labelWidth := invoiceColumns[0].Width + invoiceColumns[1].Width + invoiceColumns[2].Width
+	if order.Discount > 0 || order.StoreCredit > 0 {
+		pdf.CellFormat(labelWidth, 7, "Subtotal", "1", 0, "R", false, 0, "")
+		pdf.CellFormat(invoiceColumns[3].Width, 7, fmt.Sprintf("%.2f", order.Subtotal), "1", 1, "R", false, 0, "")
+	}
+	if order.Discount > 0 {
+		pdf.CellFormat(labelWidth, 7, "Coupon "+order.CouponCode, "1", 0, "R", false, 0, "")
+		pdf.CellFormat(invoiceColumns[3].Width, 7, fmt.Sprintf("-%.2f", order.Discount), "1", 1, "R", false, 0, "")
+	}
+	if order.StoreCredit > 0 {
+		pdf.CellFormat(labelWidth, 7, "Store credit", "1", 0, "R", false, 0, "")
+		pdf.CellFormat(invoiceColumns[3].Width, 7, fmt.Sprintf("-%.2f", order.StoreCredit), "1", 1, "R", false, 0, "")
+	}
+	pdf.SetFont("Helvetica", "B", 10)
+	pdf.CellFormat(labelWidth, 8, "Total", "1", 0, "R", false, 0, "")
+	pdf.CellFormat(invoiceColumns[3].Width, 8, fmt.Sprintf("%.2f", order.Total), "1", 1, "R", false, 0, "")
+
+	return pdf.Output(buf)
+}
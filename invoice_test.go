@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"io"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+var pdfStream = regexp.MustCompile(`(?s)stream\r?\n(.*?)\r?\nendstream`)
+
+// invoiceText is the page content of a rendered invoice, inflated.
+func invoiceText(t *testing.T, order Order) string {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := renderInvoice(&buf, order, map[int]Furniture{1: {ID: 1, Name: "Chair"}}); err != nil {
+		t.Fatalf("renderInvoice: %v", err)
+	}
+	var text strings.Builder
+	for _, m := range pdfStream.FindAllSubmatch(buf.Bytes(), -1) {
+		r, err := zlib.NewReader(bytes.NewReader(m[1]))
+		if err != nil {
+			continue
+		}
+		io.Copy(&text, r)
+	}
+	return text.String()
+}
+
+func TestInvoiceShowsStoreCredit(t *testing.T) {
+	items := []OrderItem{{FurnitureID: 1, Quantity: 2, UnitPrice: 50}}
+	tests := []struct {
+		name    string
+		order   Order
+		want    []string
+		missing []string
+	}{
+		{
+			"full price",
+			Order{Items: items, Subtotal: 100, Total: 100},
+			[]string{"(Total)", "(100.00)"},
+			[]string{"(Subtotal)", "(Store credit)"},
+		},
+		{
+			"store credit only",
+			Order{Items: items, Subtotal: 100, StoreCredit: 30, Total: 70},
+			[]string{"(Subtotal)", "(Store credit)", "(-30.00)", "(70.00)"},
+			[]string{"(Coupon"},
+		},
+		{
+			"coupon and store credit",
+			Order{Items: items, Subtotal: 100, Discount: 10, CouponCode: "SAVE10", StoreCredit: 30, Total: 60},
+			[]string{"(Subtotal)", "(Coupon SAVE10)", "(-10.00)", "(Store credit)", "(-30.00)", "(60.00)"},
+			nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.order.CreatedAt = time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+			text := invoiceText(t, tt.order)
+			for _, want := range tt.want {
+				if !strings.Contains(text, want) {
+					t.Errorf("invoice lacks %s", want)
+				}
+			}
+			for _, missing := range tt.missing {
+				if strings.Contains(text, missing) {
+					t.Errorf("invoice has %s", missing)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const accessTokenTTL = 15 * time.Minute
+
+// jwtSecret signs access tokens; Config.apply sets it from JWT_SECRET.
+var jwtSecret []byte
+
+type contextKey string
+
+const principalContextKey contextKey = "principal"
+
+// principal is the caller an access token was issued to. The role is
+// copied into the token, so a role change takes effect once the caller's
+// current access token expires.
+type principal struct {
+	UserID primitive.ObjectID
+	Role   string
+	// SessionID is set when the caller came in with a session cookie.
+	SessionID primitive.ObjectID
+}
+
+type accessClaims struct {
+	Role string `json:"role"`
+	jwt.RegisteredClaims
+}
+
+// issueAccessToken signs a short-lived HS256 token whose subject is the user.
+func issueAccessToken(user User, now time.Time) (string, time.Time, error) {
+	expiresAt := now.Add(accessTokenTTL)
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, accessClaims{
+		Role: user.role(),
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   user.ID.Hex(),
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(expiresAt),
+		},
+	})
+	signed, err := token.SignedString(jwtSecret)
+	return signed, expiresAt, err
+}
+
+// parseAccessToken checks the signature, the algorithm and the expiry and
+// returns the caller the token was issued to.
+func parseAccessToken(raw string) (principal, error) {
+	var claims accessClaims
+	_, err := jwt.ParseWithClaims(raw, &claims, func(*jwt.Token) (interface{}, error) {
+		return jwtSecret, nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}), jwt.WithExpirationRequired())
+	if err != nil {
+		return principal{}, err
+	}
+	id, err := primitive.ObjectIDFromHex(claims.Subject)
+	return principal{UserID: id, Role: claims.Role}, err
+}
+
+func writeUnauthorized(w http.ResponseWriter, message string) {
+	w.Header().Set("WWW-Authenticate", `Bearer realm="shop"`)
+	writeJSONError(w, http.StatusUnauthorized, message)
+}
+
+func bearerToken(r *http.Request) (string, bool) {
+	header := r.Header.Get("Authorization")
+	scheme, token, ok := strings.Cut(header, " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") || strings.TrimSpace(token) == "" {
+		return "", false
+	}
+	return strings.TrimSpace(token), true
+}
+
+// requireAuth lets the request through only with a valid access token in the
+// Authorization header or a session cookie, and makes the caller available
+// to next through authenticatedUserID and callerIsAdmin. A bearer token wins
+// when both are sent.
+func requireAuth(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r, ok := authenticate(w, r); ok {
+			next(w, r)
+		}
+	}
+}
+
+// optionalAuth is requireAuth for endpoints guests may use too: a request
+// without credentials goes through anonymously, but credentials that are
+// sent must be valid.
+func optionalAuth(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := bearerToken(r); !ok {
+			if _, err := r.Cookie(sessionCookieName); err != nil {
+				next(w, r)
+				return
+			}
+		}
+		if r, ok := authenticate(w, r); ok {
+			next(w, r)
+		}
+	}
+}
+
+// authenticate returns r with the caller in its context, or answers 401 and
+// returns false.
+func authenticate(w http.ResponseWriter, r *http.Request) (*http.Request, bool) {
+	raw, ok := bearerToken(r)
+	if !ok {
+		cookie, err := r.Cookie(sessionCookieName)
+		if err != nil {
+			writeUnauthorized(w, "Authentication required")
+			return r, false
+		}
+		caller, err := authenticateSession(r.Context(), cookie.Value)
+		if errors.Is(err, errSessionInvalid) {
+			writeUnauthorized(w, "Session has expired")
+			return r, false
+		}
+		if err != nil {
+			fmt.Println("Error looking up session:", err)
+			writeJSONError(w, http.StatusInternalServerError, "Failed to check session")
+			return r, false
+		}
+		return r.WithContext(context.WithValue(r.Context(), principalContextKey, caller)), true
+	}
+	caller, err := parseAccessToken(raw)
+	if err != nil {
+		message := "Invalid access token"
+		if errors.Is(err, jwt.ErrTokenExpired) {
+			message = "Access token has expired"
+		}
+		writeUnauthorized(w, message)
+		return r, false
+	}
+	return r.WithContext(context.WithValue(r.Context(), principalContextKey, caller)), true
+}
+
+func authenticatedCaller(ctx context.Context) (principal, bool) {
+	caller, ok := ctx.Value(principalContextKey).(principal)
+	return caller, ok
+}
+
+func authenticatedUserID(ctx context.Context) (primitive.ObjectID, bool) {
+	caller, ok := authenticatedCaller(ctx)
+	return caller.UserID, ok
+}
+
+func callerIsAdmin(ctx context.Context) bool {
+	caller, ok := authenticatedCaller(ctx)
+	return ok && caller.Role == roleAdmin
+}
+
+// authorizeUser lets the caller act on the user document id only if it is
+// their own or they are an admin, answering 403 otherwise.
+func authorizeUser(w http.ResponseWriter, r *http.Request, id primitive.ObjectID) bool {
+	if caller, ok := authenticatedUserID(r.Context()); ok && (caller == id || callerIsAdmin(r.Context())) {
+		return true
+	}
+	writeJSONError(w, http.StatusForbidden, "You may only access your own account")
+	return false
+}
+
+// authorizeOrder lets the caller see or act on order only if they placed it
+// or are an admin. Anyone else is told it does not exist; order numbers are
+// sequential, so a 403 would confirm which ones are taken.
+func authorizeOrder(w http.ResponseWriter, r *http.Request, order Order) bool {
+	if callerIsAdmin(r.Context()) {
+		return true
+	}
+	if caller, ok := authenticatedUserID(r.Context()); ok && order.UserID != nil && *order.UserID == caller {
+		return true
+	}
+	writeJSONError(w, http.StatusNotFound, "Order not found")
+	return false
+}
+
+func tokenResponse(accessToken string, expiresAt time.Time) map[string]interface{} {
+	return map[string]interface{}{
+		"access_token": accessToken,
+		"token_type":   "Bearer",
+		"expires_in":   int(time.Until(expiresAt).Round(time.Second).Seconds()),
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	maxFailedLogins = 5
+	lockoutDuration = 15 * time.Minute
+)
+
+func (u User) lockedAt(now time.Time) bool {
+	return u.LockedUntil != nil && u.LockedUntil.After(now)
+}
+
+// recordFailedLogin counts a wrong password against the account and locks
+// it once maxFailedLogins is reached. Counting and locking are one pipeline
+// update, so parallel attempts are all counted and lock exactly once.
+// Failures while the account is locked are not counted. It returns the
+// account as it is afterwards.
+func recordFailedLogin(ctx context.Context, id primitive.ObjectID) (User, error) {
+	now := time.Now()
+	locked := bson.M{"$gt": bson.A{bson.M{"$ifNull": bson.A{"$locked_until", time.Time{}}}, now}}
+	reached := bson.M{"$gte": bson.A{"$failed_logins", maxFailedLogins}}
+	update := mongo.Pipeline{
+		{{Key: "$set", Value: bson.M{
+			"failed_logins": bson.M{"$cond": bson.A{
+				locked,
+				"$failed_logins",
+				bson.M{"$add": bson.A{bson.M{"$ifNull": bson.A{"$failed_logins", 0}}, 1}},
+			}},
+		}}},
+		{{Key: "$set", Value: bson.M{
+			"locked_until":  bson.M{"$cond": bson.A{reached, now.Add(lockoutDuration), "$locked_until"}},
+			"failed_logins": bson.M{"$cond": bson.A{reached, 0, "$failed_logins"}},
+		}}},
+	}
+
+	var user User
+	err := database.Collection(collectionName).FindOneAndUpdate(ctx, bson.M{"_id": id}, update,
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&user)
+	return user, err
+}
+
+// clearFailedLogins resets the counter after a correct password. It only
+// succeeds while the account is not locked, so a lock set by a parallel
+// attempt cannot be slipped past; ok is false in that case.
+func clearFailedLogins(ctx context.Context, id primitive.ObjectID) (ok bool, err error) {
+	result, err := database.Collection(collectionName).UpdateOne(ctx,
+		bson.M{"_id": id, "$or": bson.A{
+			bson.M{"locked_until": bson.M{"$exists": false}},
+			bson.M{"locked_until": bson.M{"$lte": time.Now()}},
+		}},
+		bson.M{"$set": bson.M{"failed_logins": 0}, "$unset": bson.M{"locked_until": ""}},
+	)
+	if err != nil {
+		return false, err
+	}
+	return result.MatchedCount > 0, nil
+}
+
+func writeAccountLocked(w http.ResponseWriter, until *time.Time) {
+	if until != nil {
+		w.Header().Set("Retry-After", strconv.Itoa(int(time.Until(*until).Seconds())+1))
+	}
+	writeJSONError(w, http.StatusLocked, "Account is temporarily locked after too many failed logins")
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"os"
+	"time"
+)
+
+// logger writes JSON lines to stdout, at logLevel and above. Records logged
+// with a request context carry its request and trace IDs.
+var logger = slog.New(contextHandler{slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{Level: logLevel})})
+
+// logLevel is LOG_LEVEL: debug, info, warn or error. Until the server has
+// read its configuration it is info.
+var logLevel = new(slog.LevelVar)
+
+// slowRequestThreshold marks requests that took longer with "slow": true.
+// SLOW_REQUEST_THRESHOLD takes a Go duration such as "500ms".
+var slowRequestThreshold = time.Second
+
+// quietPaths are polled by load balancers and scrapers; they are logged at
+// debug level so they do not drown out real traffic.
+var quietPaths = map[string]bool{
+	"/healthz": true,
+	"/readyz":  true,
+	"/metrics": true,
+}
+
+// logRequests logs one line per request once it is done, panics included:
+// recoverPanics, outside this, answers those with a 500.
+func logRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: w}
+		completed := false
+		defer func() {
+			status := sw.status
+			if !completed {
+				status = http.StatusInternalServerError
+			} else if status == 0 {
+				status = http.StatusOK
+			}
+			duration := time.Since(start)
+
+			level := slog.LevelInfo
+			switch {
+			case status >= http.StatusInternalServerError:
+				level = slog.LevelError
+			case quietPaths[r.URL.Path]:
+				level = slog.LevelDebug
+			}
+			attrs := []slog.Attr{
+				slog.String("method", r.Method),
+				slog.String("path", r.URL.Path),
+				slog.Int("status", status),
+				slog.Int64("bytes", sw.bytes),
+				slog.Float64("duration_ms", float64(duration.Microseconds())/1000),
+				slog.String("remote_ip", clientIP(r)),
+			}
+			if duration > slowRequestThreshold {
+				attrs = append(attrs, slog.Bool("slow", true))
+				if level < slog.LevelWarn {
+					level = slog.LevelWarn
+				}
+			}
+			if !completed {
+				attrs = append(attrs, slog.Bool("panic", true))
+			}
+			logger.LogAttrs(r.Context(), level, "request", attrs...)
+		}()
+		next.ServeHTTP(sw, r)
+		completed = true
+	})
+}
+
+// statusWriter records the status and size of a response for the
+// middleware around the handlers.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (sw *statusWriter) WriteHeader(status int) {
+	if sw.status == 0 {
+		sw.status = status
+	}
+	sw.ResponseWriter.WriteHeader(status)
+}
+
+func (sw *statusWriter) Write(b []byte) (int, error) {
+	if sw.status == 0 {
+		sw.status = http.StatusOK
+	}
+	n, err := sw.ResponseWriter.Write(b)
+	sw.bytes += int64(n)
+	return n, err
+}
+
+func (sw *statusWriter) Flush() {
+	if flusher, ok := sw.ResponseWriter.(http.Flusher); ok {
+		if sw.status == 0 {
+			sw.status = http.StatusOK
+		}
+		flusher.Flush()
+	}
+}
+
+func (sw *statusWriter) Unwrap() http.ResponseWriter {
+	return sw.ResponseWriter
+}
+
+// started reports whether any of the response has been sent.
+func (sw *statusWriter) started() bool {
+	return sw.status != 0
+}
+
+// contextHandler adds the request and trace IDs of the context to every
+// record logged with one.
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, record slog.Record) error {
+	if id := requestIDFrom(ctx); id != "" {
+		record.AddAttrs(slog.String("request_id", id))
+	}
+	if id := traceIDFrom(ctx); id != "" {
+		record.AddAttrs(slog.String("trace_id", id))
+	}
+	return h.Handler.Handle(ctx, record)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	// maxLoginHistory is how many logins are kept per user; older ones are
+	// dropped as new ones come in.
+	maxLoginHistory    = 100
+	maxLoginUserAgent  = 512
+	loginRecordTimeout = 5 * time.Second
+)
+
+type LoginEvent struct {
+	ID        primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+	UserID    primitive.ObjectID `json:"-" bson:"user_id"`
+	At        time.Time          `json:"at" bson:"at"`
+	IP        string             `json:"ip" bson:"ip"`
+	UserAgent string             `json:"user_agent" bson:"user_agent"`
+	// Mode is loginModeSession for cookie logins and "token" otherwise.
+	Mode string `json:"mode" bson:"mode"`
+}
+
+func createLoginHistoryIndexes() error {
+	_, err := database.Collection(loginHistoryCollectionName).Indexes().CreateOne(context.TODO(), mongo.IndexModel{
+		Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "at", Value: -1}},
+	})
+	return err
+}
+
+// recordLogin sets last_login_at and appends to the login history in the
+// background, so a slow write never holds up the login itself.
+func recordLogin(r *http.Request, user User, mode string) {
+	if mode != loginModeSession {
+		mode = "token"
+	}
+	userAgent := r.UserAgent()
+	if len(userAgent) > maxLoginUserAgent {
+		userAgent = userAgent[:maxLoginUserAgent]
+	}
+	event := LoginEvent{UserID: user.ID, At: time.Now(), IP: clientIP(r), UserAgent: userAgent, Mode: mode}
+
+	goBackground(func(context.Context) {
+		ctx, cancel := context.WithTimeout(context.Background(), loginRecordTimeout)
+		defer cancel()
+		if err := storeLogin(ctx, event); err != nil {
+			fmt.Println("Error recording login:", err)
+		}
+	})
+}
+
+func storeLogin(ctx context.Context, event LoginEvent) error {
+	_, err := database.Collection(collectionName).UpdateOne(ctx,
+		bson.M{"_id": event.UserID},
+		bson.M{"$max": bson.M{"last_login_at": event.At}},
+	)
+	if err != nil {
+		return err
+	}
+	history := database.Collection(loginHistoryCollectionName)
+	if _, err := history.InsertOne(ctx, event); err != nil {
+		return err
+	}
+
+	// Everything older than the oldest entry worth keeping goes.
+	var oldest LoginEvent
+	opts := options.FindOne().SetSort(bson.D{{Key: "at", Value: -1}, {Key: "_id", Value: -1}}).SetSkip(maxLoginHistory - 1)
+	err = history.FindOne(ctx, bson.M{"user_id": event.UserID}, opts).Decode(&oldest)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	_, err = history.DeleteMany(ctx, bson.M{"user_id": event.UserID, "at": bson.M{"$lt": oldest.At}})
+	return err
+}
+
+// listLogins pages through the logins of user ?id=, newest first.
+func listLogins(w http.ResponseWriter, r *http.Request) {
+	userID, ok := parseObjectID(w, r)
+	if !ok {
+		return
+	}
+	if !authorizeUser(w, r, userID) {
+		return
+	}
+	page, err := parsePagination(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	filter := bson.M{"user_id": userID}
+	history := database.Collection(loginHistoryCollectionName)
+	total, err := history.CountDocuments(r.Context(), filter)
+	if err != nil {
+		fmt.Println("Error counting logins:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to load logins")
+		return
+	}
+
+	opts := options.Find().
+		SetSort(bson.D{{Key: "at", Value: -1}, {Key: "_id", Value: -1}}).
+		SetSkip(page.skip()).
+		SetLimit(int64(page.Limit))
+	cursor, err := history.Find(r.Context(), filter, opts)
+	if err != nil {
+		fmt.Println("Error querying logins:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to load logins")
+		return
+	}
+	defer cursor.Close(r.Context())
+
+	events := []LoginEvent{}
+	if err := cursor.All(r.Context(), &events); err != nil {
+		fmt.Println("Error decoding logins:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to load logins")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, pageResponse{
+		Items:      events,
+		Total:      total,
+		Page:       page.Page,
+		TotalPages: page.totalPages(total),
+	})
+}
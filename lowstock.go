@@ -0,0 +1,174 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const (
+	defaultLowStockThreshold = 5
+	lowStockSalesWindow      = 30 * 24 * time.Hour
+)
+
+// lowStockItem is one stock pool at or below the threshold: an item without
+// variants, or a single variant of an item that has them.
+type lowStockItem struct {
+	FurnitureID int    `json:"furniture_id" bson:"furniture_id"`
+	VariantID   string `json:"variant_id,omitempty" bson:"variant_id"`
+	SKU         string `json:"sku" bson:"sku"`
+	Name        string `json:"name" bson:"name"`
+	Stock       int    `json:"stock" bson:"stock"`
+	Reserved    int    `json:"reserved" bson:"reserved"`
+	Available   int    `json:"available" bson:"available"`
+	SoldLast30  int    `json:"sold_last_30_days" bson:"sold_last_30_days"`
+}
+
+// lowStockPipeline expands every active item into its stock pools, subtracts
+// live reservations, keeps the pools at or below threshold and attaches the
+// units sold since salesSince. Cancelled orders do not count as sales.
+func lowStockPipeline(threshold int, now, salesSince time.Time, page pagination) mongo.Pipeline {
+	poolKey := bson.M{"$and": bson.A{
+		bson.M{"$eq": bson.A{"$furniture_id", "$$furniture_id"}},
+		bson.M{"$eq": bson.A{bson.M{"$ifNull": bson.A{"$variant_id", ""}}, "$$variant_id"}},
+	}}
+
+	return mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"deleted_at": bson.M{"$exists": false}}}},
+		{{Key: "$project", Value: bson.M{
+			"sku":  1,
+			"name": 1,
+			"pools": bson.M{"$cond": bson.A{
+				bson.M{"$gt": bson.A{bson.M{"$size": bson.M{"$ifNull": bson.A{"$variants", bson.A{}}}}, 0}},
+				bson.M{"$map": bson.M{
+					"input": "$variants",
+					"as":    "v",
+					"in":    bson.M{"variant_id": "$$v.id", "stock": "$$v.stock"},
+				}},
+				bson.A{bson.M{"variant_id": "", "stock": "$stock"}},
+			}},
+		}}},
+		{{Key: "$unwind", Value: "$pools"}},
+		{{Key: "$project", Value: bson.M{
+			"_id":          0,
+			"furniture_id": "$_id",
+			"variant_id":   "$pools.variant_id",
+			"sku":          1,
+			"name":         1,
+			"stock":        "$pools.stock",
+		}}},
+		{{Key: "$lookup", Value: bson.M{
+			"from": reservationsCollectionName,
+			"let":  bson.M{"furniture_id": "$furniture_id", "variant_id": "$variant_id"},
+			"pipeline": bson.A{
+				bson.M{"$match": bson.M{"$expr": bson.M{"$and": bson.A{
+					poolKey,
+					bson.M{"$gt": bson.A{"$expires_at", now}},
+				}}}},
+				bson.M{"$group": bson.M{"_id": nil, "quantity": bson.M{"$sum": "$quantity"}}},
+			},
+			"as": "reservations",
+		}}},
+		{{Key: "$addFields", Value: bson.M{
+			"reserved": bson.M{"$ifNull": bson.A{bson.M{"$arrayElemAt": bson.A{"$reservations.quantity", 0}}, 0}},
+		}}},
+		{{Key: "$addFields", Value: bson.M{
+			"available": bson.M{"$max": bson.A{bson.M{"$subtract": bson.A{"$stock", "$reserved"}}, 0}},
+		}}},
+		{{Key: "$match", Value: bson.M{"available": bson.M{"$lte": threshold}}}},
+		{{Key: "$lookup", Value: bson.M{
+			"from": ordersCollectionName,
+			"let":  bson.M{"furniture_id": "$furniture_id", "variant_id": "$variant_id"},
+			"pipeline": bson.A{
+				bson.M{"$match": bson.M{
+					"created_at": bson.M{"$gte": salesSince},
+					"status":     bson.M{"$ne": orderStatusCancelled},
+					"$expr":      bson.M{"$in": bson.A{"$$furniture_id", "$items.furniture_id"}},
+				}},
+				bson.M{"$unwind": "$items"},
+				bson.M{"$replaceRoot": bson.M{"newRoot": "$items"}},
+				bson.M{"$match": bson.M{"$expr": poolKey}},
+				bson.M{"$group": bson.M{"_id": nil, "quantity": bson.M{"$sum": "$quantity"}}},
+			},
+			"as": "sales",
+		}}},
+		{{Key: "$addFields", Value: bson.M{
+			"sold_last_30_days": bson.M{"$ifNull": bson.A{bson.M{"$arrayElemAt": bson.A{"$sales.quantity", 0}}, 0}},
+		}}},
+		{{Key: "$project", Value: bson.M{"reservations": 0, "sales": 0}}},
+		{{Key: "$sort", Value: bson.D{
+			{Key: "available", Value: 1},
+			{Key: "sold_last_30_days", Value: -1},
+			{Key: "furniture_id", Value: 1},
+			{Key: "variant_id", Value: 1},
+		}}},
+		{{Key: "$facet", Value: bson.M{
+			"items": bson.A{
+				bson.M{"$skip": page.skip()},
+				bson.M{"$limit": page.Limit},
+			},
+			"total": bson.A{bson.M{"$count": "count"}},
+		}}},
+	}
+}
+
+func handleLowStock(w http.ResponseWriter, r *http.Request) {
+	threshold := defaultLowStockThreshold
+	if raw := r.URL.Query().Get("threshold"); raw != "" {
+		parsed, err := strconv.Atoi(raw)
+		if err != nil || parsed < 0 {
+			writeJSONError(w, http.StatusBadRequest, "threshold must be a non-negative integer")
+			return
+		}
+		threshold = parsed
+	}
+	page, err := parsePagination(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	now := time.Now()
+	pipeline := lowStockPipeline(threshold, now, now.Add(-lowStockSalesWindow), page)
+	cursor, err := database.Collection(furnitureCollectionName).Aggregate(r.Context(), pipeline)
+	if err != nil {
+		fmt.Println("Error aggregating low stock:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to load low-stock report")
+		return
+	}
+	defer cursor.Close(r.Context())
+
+	var result []struct {
+		Items []lowStockItem `bson:"items"`
+		Total []struct {
+			Count int64 `bson:"count"`
+		} `bson:"total"`
+	}
+	if err := cursor.All(r.Context(), &result); err != nil {
+		fmt.Println("Error decoding low stock:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to load low-stock report")
+		return
+	}
+
+	items := []lowStockItem{}
+	var total int64
+	if len(result) > 0 {
+		if result[0].Items != nil {
+			items = result[0].Items
+		}
+		if len(result[0].Total) > 0 {
+			total = result[0].Total[0].Count
+		}
+	}
+
+	writeJSON(w, http.StatusOK, pageResponse{
+		Items:      items,
+		Total:      total,
+		Page:       page.Page,
+		TotalPages: page.totalPages(total),
+	})
+}
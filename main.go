@@ -3,8 +3,16 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"os"
+	"os/signal"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
 	"time"
 
 	"go.mongodb.org/mongo-driver/bson"
@@ -14,20 +22,40 @@ import (
 )
 
 const (
-	mongoURI       = "mongodb://localhost:27017"
-	databaseName   = "furnitureShopDB"
 	collectionName = "users"
+
+	furnitureCollectionName           = "furniture"
+	categoriesCollectionName          = "categories"
+	countersCollectionName            = "counters"
+	ordersCollectionName              = "orders"
+	priceHistoryCollectionName        = "price_history"
+	promotionsCollectionName          = "promotions"
+	idempotencyKeysCollectionName     = "idempotency_keys"
+	reservationsCollectionName        = "reservations"
+	emailOutboxCollectionName         = "email_outbox"
+	webhooksCollectionName            = "webhooks"
+	webhookDeliveriesCollectionName   = "webhook_deliveries"
+	cartsCollectionName               = "carts"
+	couponsCollectionName             = "coupons"
+	wishlistsCollectionName           = "wishlists"
+	reviewsCollectionName             = "reviews"
+	returnsCollectionName             = "returns"
+	creditLedgerCollectionName        = "credit_ledger"
+	refreshTokensCollectionName       = "refresh_tokens"
+	apiKeysCollectionName             = "api_keys"
+	passwordResetsCollectionName      = "password_resets"
+	emailVerificationsCollectionName  = "email_verifications"
+	sessionsCollectionName            = "sessions"
+	twoFactorChallengesCollectionName = "two_factor_challenges"
+	auditLogCollectionName            = "audit_log"
+	loginHistoryCollectionName        = "login_history"
 )
 
-var client *mongo.Client
-var database *mongo.Database
+var userSortFields = []string{"name", "email", "age", "created_at"}
 
-type Furniture struct {
-	ID          int     `json:"id" bson:"_id,omitempty"`
-	Name        string  `json:"name" bson:"name"`
-	Description string  `json:"description" bson:"description"`
-	Price       float64 `json:"price" bson:"price"`
-}
+// database is the handle the handlers and migrations use. Only newHandler
+// sets it, with the database main connected to or one a test set up.
+var database *mongo.Database
 
 type User struct {
 	ID        primitive.ObjectID `bson:"_id,omitempty"`
@@ -37,258 +65,1100 @@ type User struct {
 	CreatedAt time.Time          `bson:"created_at"`
 	UpdatedAt time.Time          `bson:"updated_at"`
 	Version   int                `bson:"version"`
+	// StoreCredit only changes through moveCredit, which keeps the ledger.
+	StoreCredit float64 `bson:"store_credit"`
+	// PasswordHash is the bcrypt hash; it is never serialised to JSON.
+	PasswordHash string `json:"-" bson:"password_hash,omitempty"`
+	// Role is roleCustomer or roleAdmin; see User.role for older users.
+	Role               string     `bson:"role,omitempty"`
+	EmailVerified      bool       `bson:"email_verified"`
+	VerificationSentAt *time.Time `json:"-" bson:"verification_sent_at,omitempty"`
+	FailedLogins       int        `json:"-" bson:"failed_logins,omitempty"`
+	LockedUntil        *time.Time `json:"-" bson:"locked_until,omitempty"`
+	TOTPEnabled        bool       `bson:"totp_enabled,omitempty"`
+	TOTPSecret         string     `json:"-" bson:"totp_secret,omitempty"`
+	TOTPRecoveryCodes  []string   `json:"-" bson:"totp_recovery_codes,omitempty"`
+	// The pending fields hold a setup until it is confirmed with a code.
+	TOTPPendingSecret        string   `json:"-" bson:"totp_pending_secret,omitempty"`
+	TOTPPendingRecoveryCodes []string `json:"-" bson:"totp_pending_recovery_codes,omitempty"`
+	// AuthProvider is authProviderGoogle for users created by Google login;
+	// they have no password.
+	AuthProvider string `bson:"auth_provider,omitempty"`
+	GoogleID     string `json:"-" bson:"google_id,omitempty"`
+	// DeletedAt is stored as null rather than left out on active users, so
+	// the partial email index can skip deleted ones; see activeUserByID.
+	DeletedAt *time.Time `bson:"deleted_at"`
+	// Anonymized users keep their ID for orders but no personal data and no
+	// way to log in; see anonymizeUser.
+	Anonymized   bool       `bson:"anonymized,omitempty"`
+	AnonymizedAt *time.Time `bson:"anonymized_at,omitempty"`
+	Addresses    []Address  `bson:"addresses,omitempty"`
+	// Phone is in E.164 form, as in +49301234567; see normalizePhone.
+	Phone  string  `bson:"phone,omitempty"`
+	Avatar *Avatar `bson:"avatar,omitempty"`
+	// LastLoginAt is kept up to date by recordLogin.
+	LastLoginAt *time.Time `bson:"last_login_at,omitempty"`
 }
 
-var inventory = []Furniture{
-	{ID: 1, Name: "Chair", Description: "Comfortable chair", Price: 49.99},
-	{ID: 2, Name: "Table", Description: "Sturdy table", Price: 99.99},
+// userResponse is how a user is shown to API clients. Secrets and the
+// version stay on the server; clients get the version as the ETag.
+type userResponse struct {
+	ID            string    `json:"id"`
+	Name          string    `json:"name"`
+	Email         string    `json:"email"`
+	Age           int       `json:"age,omitempty"`
+	Phone         string    `json:"phone,omitempty"`
+	Role          string    `json:"role"`
+	EmailVerified bool      `json:"email_verified"`
+	TOTPEnabled   bool      `json:"totp_enabled"`
+	AuthProvider  string    `json:"auth_provider,omitempty"`
+	StoreCredit   float64   `json:"store_credit"`
+	Addresses     []Address `json:"addresses,omitempty"`
+	Avatar        *Avatar   `json:"avatar,omitempty"`
+	Anonymized    bool      `json:"anonymized,omitempty"`
+	CreatedAt     string    `json:"created_at"`
+	UpdatedAt     string    `json:"updated_at"`
+	LastLoginAt   *string   `json:"last_login_at,omitempty"`
+	AnonymizedAt  *string   `json:"anonymized_at,omitempty"`
+	DeletedAt     *string   `json:"deleted_at,omitempty"`
 }
 
-func init() {
-
-	var err error
-	client, err = mongo.NewClient(options.Client().ApplyURI(mongoURI))
-	if err != nil {
-		fmt.Println("Error creating MongoDB client:", err)
-		return
-	}
-
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
-
-	err = client.Connect(ctx)
-	if err != nil {
-		fmt.Println("Error connecting to MongoDB:", err)
-		return
+func newUserResponse(user User) userResponse {
+	return userResponse{
+		ID:            user.ID.Hex(),
+		Name:          user.Name,
+		Email:         user.Email,
+		Age:           user.Age,
+		Phone:         user.Phone,
+		Role:          user.role(),
+		EmailVerified: user.EmailVerified,
+		TOTPEnabled:   user.TOTPEnabled,
+		AuthProvider:  user.AuthProvider,
+		StoreCredit:   user.StoreCredit,
+		Addresses:     user.Addresses,
+		Avatar:        user.Avatar,
+		Anonymized:    user.Anonymized,
+		CreatedAt:     rfc3339(user.CreatedAt),
+		UpdatedAt:     rfc3339(user.UpdatedAt),
+		LastLoginAt:   optionalRFC3339(user.LastLoginAt),
+		AnonymizedAt:  optionalRFC3339(user.AnonymizedAt),
+		DeletedAt:     optionalRFC3339(user.DeletedAt),
 	}
+}
 
-	err = client.Ping(ctx, nil)
-	if err != nil {
-		fmt.Println("Error pinging MongoDB:", err)
-		return
-	}
-
-	fmt.Println("Connected to MongoDB successfully!")
-
-	database = client.Database(databaseName)
+// MarshalJSON renders every user through userResponse, so no handler can
+// leak the stored document by encoding a User directly.
+func (u User) MarshalJSON() ([]byte, error) {
+	return json.Marshal(newUserResponse(u))
 }
 
-func handleGetFurniture(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(inventory)
+func rfc3339(t time.Time) string {
+	return t.UTC().Format(time.RFC3339)
 }
 
-func handlePostOrder(w http.ResponseWriter, r *http.Request) {
-	var order map[string]interface{}
-	err := json.NewDecoder(r.Body).Decode(&order)
-	if err != nil {
-		response := map[string]string{"status": "400", "message": "Invalid JSON-message"}
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(response)
-		return
+func optionalRFC3339(t *time.Time) *string {
+	if t == nil {
+		return nil
 	}
-
-	fmt.Printf("Received order data: %+v\n", order)
-
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	response := map[string]string{"status": "200", "message": "Order received successfully"}
-	json.NewEncoder(w).Encode(response)
+	formatted := rfc3339(*t)
+	return &formatted
 }
 
 func handleHTML(w http.ResponseWriter, r *http.Request) {
 	http.ServeFile(w, r, "index.html")
 }
 
+const seedUserEmail = "john.doe@example.com"
+
+// createUsersCollection makes sure the example user exists; restarts leave
+// it alone.
 func createUsersCollection() error {
 	usersCollection := database.Collection(collectionName)
 
-	_, err := usersCollection.InsertOne(context.TODO(), User{
-		Name:      "John Doe",
-		Email:     "john.doe@example.com",
-		CreatedAt: time.Now(),
-		UpdatedAt: time.Now(),
-		Version:   1,
-	})
+	now := time.Now()
+	_, err := usersCollection.UpdateOne(
+		context.TODO(),
+		bson.M{"email": seedUserEmail},
+		bson.M{"$setOnInsert": User{
+			Name:      "John Doe",
+			Email:     seedUserEmail,
+			Role:      roleCustomer,
+			CreatedAt: now,
+			UpdatedAt: now,
+			Version:   1,
+		}},
+		options.Update().SetUpsert(true),
+	)
 
 	return err
 }
 
+// addAgeField gives users without an age the 0 that stands for unknown.
+// Users that have an age keep it.
 func addAgeField() error {
 	usersCollection := database.Collection(collectionName)
 
 	_, err := usersCollection.UpdateMany(
 		context.TODO(),
-		bson.D{},
+		bson.M{"age": bson.M{"$exists": false}},
 		bson.M{"$set": bson.M{"age": 0}},
 	)
 
 	return err
 }
 
-func main() {
-	client, err := mongo.NewClient(options.Client().ApplyURI(mongoURI))
-	if err != nil {
-		fmt.Println("Error creating MongoDB client:", err)
-		return
-	}
+// addVersionField gives users stored before versions were enforced the
+// version new users start at.
+func addVersionField() error {
+	usersCollection := database.Collection(collectionName)
 
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
+	_, err := usersCollection.UpdateMany(
+		context.TODO(),
+		bson.M{"version": bson.M{"$not": bson.M{"$gte": 1}}},
+		bson.M{"$set": bson.M{"version": 1}},
+	)
 
-	err = client.Connect(ctx)
+	return err
+}
+
+func main() {
+	cfg, err := loadConfig()
 	if err != nil {
-		fmt.Println("Error connecting to MongoDB:", err)
-		return
+		fmt.Println("Invalid configuration:")
+		fmt.Println(err)
+		os.Exit(1)
 	}
+	cfg.apply()
+	logger.Info("Effective configuration", "config", cfg)
 
-	err = client.Ping(ctx, nil)
+	// A signal while MongoDB is still coming up stops the retries.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	client, err := connectMongo(ctx, cfg.MongoURI)
+	stop()
 	if err != nil {
-		fmt.Println("Error pinging MongoDB:", err)
-		return
+		fmt.Println("Error connecting to MongoDB:", err)
+		os.Exit(1)
 	}
-
 	fmt.Println("Connected to MongoDB successfully!")
+	defer disconnectMongo(client)
+	handler := newHandler(client.Database(cfg.DBName))
 
-	defer client.Disconnect(ctx)
-
-	database := client.Database(databaseName)
+	// exit stops a server that cannot start with status 1, so supervisors
+	// restart it and alerts fire; os.Exit skips the deferred disconnect.
+	exit := func() {
+		disconnectMongo(client)
+		os.Exit(1)
+	}
 
 	if err := createUsersCollection(); err != nil {
 		fmt.Println("Error creating users collection:", err)
-		return
+		exit()
 	}
 
 	if err := addAgeField(); err != nil {
 		fmt.Println("Error adding age field:", err)
-		return
+		exit()
 	}
-	exampleUser := User{
-		Name:      "John Doe",
-		Email:     "john.doe@example.com",
-		CreatedAt: time.Now(),
-		UpdatedAt: time.Now(),
+
+	if err := addVersionField(); err != nil {
+		fmt.Println("Error adding version field:", err)
+		exit()
 	}
 
-	usersCollection := database.Collection(collectionName)
-	insertResult, err := usersCollection.InsertOne(ctx, exampleUser)
-	if err != nil {
-		fmt.Println("Error inserting user:", err)
-		return
+	if err := seedFurniture(); err != nil {
+		fmt.Println("Error seeding furniture collection:", err)
+		exit()
 	}
 
-	fmt.Println("Inserted user with ID:", insertResult.InsertedID)
+	if err := syncFurnitureCounter(); err != nil {
+		fmt.Println("Error initializing furniture counter:", err)
+		exit()
+	}
 
-	http.Handle("/", http.FileServer(http.Dir(".")))
+	if err := createFurnitureIndexes(); err != nil {
+		fmt.Println("Error creating furniture indexes:", err)
+		exit()
+	}
 
-	http.HandleFunc("/getFurniture", handleGetFurniture)
-	http.HandleFunc("/submitOrder", handlePostOrder)
+	if err := createOrderIndexes(); err != nil {
+		fmt.Println("Error creating order indexes:", err)
+		exit()
+	}
 
-	// routes and handlers for CRUD operations
-	http.HandleFunc("/createUser", createUser)
-	http.HandleFunc("/getUser", getUserByID)
-	http.HandleFunc("/updateUser", updateUser)
-	http.HandleFunc("/deleteUser", deleteUser)
-	http.HandleFunc("/getAllUsers", getAllUsers)
-
-	fmt.Println("Server is running on :8080...")
-	err = http.ListenAndServe(":8080", nil)
-	if err != nil {
-		fmt.Println("Error starting the server:", err)
+	if err := createIdempotencyIndexes(); err != nil {
+		fmt.Println("Error creating idempotency key indexes:", err)
+		exit()
+	}
+
+	if err := createReservationIndexes(); err != nil {
+		fmt.Println("Error creating reservation indexes:", err)
+		exit()
+	}
+
+	if err := createOutboxIndexes(); err != nil {
+		fmt.Println("Error creating email outbox indexes:", err)
+		exit()
+	}
+
+	if err := createWebhookIndexes(); err != nil {
+		fmt.Println("Error creating webhook indexes:", err)
+		exit()
+	}
+
+	if err := createCartIndexes(); err != nil {
+		fmt.Println("Error creating cart indexes:", err)
+		exit()
+	}
+
+	if err := createCouponIndexes(); err != nil {
+		fmt.Println("Error creating coupon indexes:", err)
+		exit()
+	}
+
+	if err := createWishlistIndexes(); err != nil {
+		fmt.Println("Error creating wishlist indexes:", err)
+		exit()
+	}
+
+	if err := createReviewIndexes(); err != nil {
+		fmt.Println("Error creating review indexes:", err)
+		exit()
+	}
+
+	if err := createReturnIndexes(); err != nil {
+		fmt.Println("Error creating return indexes:", err)
+		exit()
+	}
+
+	if err := createCreditIndexes(); err != nil {
+		fmt.Println("Error creating credit ledger indexes:", err)
+		exit()
+	}
+
+	if err := createAccountIndexes(); err != nil {
+		fmt.Println("Error creating account indexes:", err)
+		exit()
+	}
+
+	if err := createRefreshTokenIndexes(); err != nil {
+		fmt.Println("Error creating refresh token indexes:", err)
+		exit()
+	}
+
+	if err := createOAuthIndexes(); err != nil {
+		fmt.Println("Error creating OAuth indexes:", err)
+		exit()
+	}
+
+	if err := createTwoFactorIndexes(); err != nil {
+		fmt.Println("Error creating two-factor challenge indexes:", err)
+		exit()
+	}
+
+	if err := createSessionIndexes(); err != nil {
+		fmt.Println("Error creating session indexes:", err)
+		exit()
+	}
+
+	if err := createVerificationIndexes(); err != nil {
+		fmt.Println("Error creating email verification indexes:", err)
+		exit()
+	}
+
+	if err := createPasswordResetIndexes(); err != nil {
+		fmt.Println("Error creating password reset indexes:", err)
+		exit()
+	}
+
+	if err := createLoginHistoryIndexes(); err != nil {
+		fmt.Println("Error creating login history indexes:", err)
+		exit()
+	}
+
+	if err := createPhoneIndexes(); err != nil {
+		fmt.Println("Error creating phone indexes:", err)
+		exit()
+	}
+
+	if err := createUserSearchIndexes(); err != nil {
+		fmt.Println("Error creating user search indexes:", err)
+		exit()
+	}
+
+	if err := createAuditIndexes(); err != nil {
+		fmt.Println("Error creating audit log indexes:", err)
+		exit()
 	}
+
+	if err := createAPIKeyIndexes(); err != nil {
+		fmt.Println("Error creating API key indexes:", err)
+		exit()
+	}
+
+	if err := bootstrapAdmin(cfg.AdminEmail); err != nil {
+		fmt.Println("Error promoting bootstrap admin:", err)
+		exit()
+	}
+
+	if err := createPriceHistoryIndexes(); err != nil {
+		fmt.Println("Error creating price history indexes:", err)
+		exit()
+	}
+
+	if err := detectTransactionSupport(); err != nil {
+		fmt.Println("Error checking MongoDB deployment:", err)
+		exit()
+	}
+
+	if err := createCategoryIndexes(); err != nil {
+		fmt.Println("Error creating category indexes:", err)
+		exit()
+	}
+
+	goBackground(refreshSuggestionsPeriodically)
+	goBackground(retryOutboxPeriodically)
+	goBackground(sweepRateLimitersPeriodically)
+	goBackground(exportSpansPeriodically)
+
+	fmt.Printf("Server is running on %s...\n", cfg.HTTPAddr)
+	if err := serve(&http.Server{Addr: cfg.HTTPAddr, Handler: handler}); err != nil {
+		exit()
+	}
+}
+
+// newHandler wires db into the handlers and returns the server's handler:
+// every route on a mux of its own, behind the middleware. A nil db leaves
+// the routes that need MongoDB answering 503, as requireDatabase does.
+func newHandler(db *mongo.Database) http.Handler {
+	database = db
+	mux := newRouter()
+
+	mux.Handle("/", http.FileServer(http.Dir(".")))
+
+	mux.probeRoute("/healthz", handleLiveness, http.MethodGet)
+	mux.probeRoute("/readyz", handleReadiness, http.MethodGet)
+	mux.probeRoute("/metrics", handleMetrics, http.MethodGet)
+	registerDebugRoutes(mux)
+	mux.route("/getFurniture", rateLimit(catalogueLimiter, optionalAuth(handleGetFurniture)), http.MethodGet)
+	mux.route("/submitOrder", rateLimit(orderLimiter, optionalAuth(withIdempotency(handlePostOrder))), http.MethodPost)
+	mux.route("/orders/{id}", requireAuth(handleOrders), http.MethodGet)
+	mux.route("/orders", deprecated(requireAuth(handleOrders), "/orders/{id}"), http.MethodGet)
+	mux.route("/orders/status", requireAdminOrKey(scopeOrdersWrite, updateOrderStatus), http.MethodPatch)
+	mux.route("/orders/cancel", requireAuth(handleCancelOrder), http.MethodPost)
+	mux.route("/orders/by-number", requireAuth(getOrderByNumber), http.MethodGet)
+	mux.route("/orders/invoice", requireAuth(handleOrderInvoice), http.MethodGet)
+	mux.route("/orders/return", requireAuth(handleOrderReturn), http.MethodPost)
+	mux.route("/orders/returns", requireAuth(handleOrderReturns), http.MethodGet)
+	mux.route("/admin/returns", requireAdmin(updateReturnStatus), http.MethodPatch)
+	mux.route("/admin/orders", requireAdminOrKey(scopeOrdersRead, listAdminOrders), http.MethodGet)
+	mux.exportRoute("/admin/orders/export", requireAdminOrKey(scopeOrdersRead, exportOrders), http.MethodGet)
+	mux.route("/admin/lowStock", requireAdminOrKey(scopeCatalogueRead, handleLowStock), http.MethodGet)
+	mux.route("/admin/coupons", requireAdmin(handleCoupons), http.MethodGet, http.MethodPost, http.MethodPut, http.MethodDelete)
+	mux.route("/admin/apiKeys", requireAdmin(handleAPIKeys), http.MethodGet, http.MethodPost, http.MethodDelete)
+	mux.route("/admin/webhooks", requireAdmin(handleWebhooks), http.MethodGet, http.MethodPost, http.MethodPut, http.MethodDelete)
+	mux.route("/admin/webhooks/deliveries", requireAdmin(listWebhookDeliveries), http.MethodGet)
+	mux.route("/admin/stats/sales", requireAdmin(handleSalesStats), http.MethodGet)
+	mux.route("/admin/stats/topProducts", requireAdmin(handleTopProducts), http.MethodGet)
+	mux.route("/admin/stats/overview", requireAdmin(handleStatsOverview), http.MethodGet)
+	mux.route("/admin/stats/users", requireAdmin(handleUserStats), http.MethodGet)
+	mux.route("/admin/stats/inventoryValue", requireAdminOrKey(scopeCatalogueRead, handleInventoryValue), http.MethodGet)
+	mux.route("/reservations", rateLimit(orderLimiter, handleReservations), http.MethodPost, http.MethodDelete)
+	mux.route("/cart", handleCart, http.MethodGet)
+	mux.route("/cart/items", handleCartItems, http.MethodPost, http.MethodDelete)
+	mux.route("/cart/clear", handleClearCart, http.MethodPost)
+	mux.route("/checkout", rateLimit(orderLimiter, optionalAuth(withIdempotency(handleCheckout))), http.MethodPost)
+	mux.route("/wishlist", requireAuth(handleWishlist), http.MethodGet, http.MethodPost, http.MethodDelete)
+	mux.route("/reviews", handleReviews, http.MethodGet, http.MethodPost)
+	mux.route("/admin/reviews", requireAdmin(handleAdminReviews), http.MethodGet, http.MethodPatch, http.MethodDelete)
+	mux.exportRoute("/admin/ratings/recompute", requireAdmin(recomputeRatings), http.MethodPost)
+	mux.route("/furniture/{id}", rateLimit(catalogueLimiter, getFurnitureByID), http.MethodGet)
+	mux.route("/furniture", adminWrites(scopeCatalogueWrite, handleFurniture), http.MethodGet, http.MethodPost, http.MethodPut, http.MethodDelete)
+	mux.route("/furniture/stock", requireAdminOrKey(scopeCatalogueWrite, handleFurnitureStock), http.MethodPatch)
+	mux.route("/furniture/variants", requireAdminOrKey(scopeCatalogueWrite, handleFurnitureVariants), http.MethodPost, http.MethodPut, http.MethodDelete)
+	mux.route("/furniture/image", adminWrites(scopeCatalogueWrite, handleFurnitureImage), http.MethodGet, http.MethodPost)
+	mux.exportRoute("/furniture/import", requireAdminOrKey(scopeCatalogueWrite, handleFurnitureImport), http.MethodPost)
+	mux.route("/furniture/restore", requireAdmin(restoreFurniture), http.MethodPost)
+	mux.route("/furniture/by-sku", rateLimit(catalogueLimiter, getFurnitureBySKU), http.MethodGet)
+	mux.route("/furniture/search", rateLimit(catalogueLimiter, searchFurniture), http.MethodGet)
+	mux.route("/furniture/related", rateLimit(catalogueLimiter, getRelatedFurniture), http.MethodGet)
+	mux.route("/furniture/suggest", rateLimit(catalogueLimiter, suggestFurniture), http.MethodGet)
+	mux.route("/furniture/facets", rateLimit(catalogueLimiter, optionalAuth(handleFurnitureFacets)), http.MethodGet)
+	mux.route("/furniture/priceHistory", rateLimit(catalogueLimiter, getPriceHistory), http.MethodGet)
+	mux.route("/furniture/purge", requireAdmin(purgeFurniture), http.MethodPost)
+	mux.route("/categories", adminWrites(scopeCatalogueWrite, handleCategories), http.MethodGet, http.MethodPost, http.MethodDelete)
+	mux.route("/promotions", adminWrites(scopeCatalogueWrite, handlePromotions), http.MethodGet, http.MethodPost, http.MethodPut, http.MethodDelete)
+
+	// routes and handlers for CRUD operations
+	mux.route("/createUser", rateLimit(authLimiter, createUser), http.MethodPost)
+	mux.route("/users/{id}", requireAuth(handleUser), http.MethodGet, http.MethodPatch, http.MethodDelete)
+	mux.route("/getUser", deprecated(requireAuth(getUserByID), "/users/{id}"), http.MethodGet)
+	mux.route("/updateUser", deprecated(requireAuth(updateUser), "/users/{id}"), http.MethodPatch)
+	mux.route("/deleteUser", deprecated(requireAuth(deleteUser), "/users/{id}"), http.MethodDelete)
+	mux.exportRoute("/users/export", requireAuth(exportUserData), http.MethodGet)
+	mux.route("/users/anonymize", requireAuth(anonymizeUser), http.MethodPost)
+	mux.route("/users/addresses", requireAuth(handleAddresses), http.MethodGet, http.MethodPost, http.MethodPatch, http.MethodDelete)
+	mux.route("/users/addresses/default", requireAuth(handleDefaultAddress), http.MethodPost)
+	mux.route("/users/avatar", handleAvatar, http.MethodGet, http.MethodPost)
+	mux.route("/users/logins", requireAuth(listLogins), http.MethodGet)
+	mux.route("/users/restore", requireAdmin(restoreUser), http.MethodPost)
+	mux.route("/users/purge", requireAdmin(purgeUser), http.MethodDelete)
+	mux.route("/getAllUsers", requireAdmin(getAllUsers), http.MethodGet)
+	mux.route("/users/batchGet", requireAdmin(batchGetUsers), http.MethodPost)
+	mux.exportRoute("/admin/users/export", requireAdmin(exportUsers), http.MethodGet)
+	mux.exportRoute("/admin/users/import", requireAdmin(importUsers), http.MethodPost)
+	mux.route("/admin/users/search", requireAdmin(searchUsers), http.MethodGet)
+	mux.route("/admin/users/distinct", requireAdmin(distinctUserValues), http.MethodGet)
+	mux.route("/admin/audit", requireAdmin(listAuditLog), http.MethodGet)
+	mux.route("/register", rateLimit(authLimiter, handleRegister), http.MethodPost)
+	mux.route("/login", rateLimit(authLimiter, handleLogin), http.MethodPost)
+	mux.route("/token/refresh", rateLimit(authLimiter, handleTokenRefresh), http.MethodPost)
+	mux.route("/logout", handleLogout, http.MethodPost)
+	mux.route("/sessions", requireAuth(handleSessions), http.MethodGet, http.MethodDelete)
+	mux.route("/2fa/setup", requireAuth(handleTwoFactorSetup), http.MethodPost)
+	mux.route("/2fa/confirm", requireAuth(handleTwoFactorConfirm), http.MethodPost)
+	mux.route("/2fa/verify", rateLimit(authLimiter, handleTwoFactorVerify), http.MethodPost)
+	mux.route("/auth/google", handleGoogleLogin, http.MethodGet)
+	mux.route("/auth/google/callback", handleGoogleCallback, http.MethodGet)
+	mux.route("/password/forgot", rateLimit(authLimiter, handleForgotPassword), http.MethodPost)
+	mux.route("/password/reset", rateLimit(authLimiter, handleResetPassword), http.MethodPost)
+	mux.route("/verify", handleVerifyEmail, http.MethodGet)
+	mux.route("/verify/resend", requireAuth(resendVerification), http.MethodPost)
+	mux.route("/users/orders", requireAuth(getUserOrders), http.MethodGet)
+	mux.route("/users/credit", requireAuth(handleUserCredit), http.MethodGet)
+	mux.route("/admin/users/credit", requireAdmin(grantCredit), http.MethodPost)
+
+	return withMiddleware(mux)
+}
+
+// withMiddleware wraps h in the middleware every request goes through,
+// recoverPanics outermost.
+func withMiddleware(h http.Handler) http.Handler {
+	return recoverPanics(assignRequestID(traceRequests(logRequests(handleCORS(compressResponses(h))))))
+}
+
+// newUserRequest is the body of /createUser; everything else about a new
+// user is set by the server.
+type newUserRequest struct {
+	Name  string `json:"name"`
+	Email string `json:"email"`
+	Age   int    `json:"age"`
+	Phone string `json:"phone"`
 }
 
 // CRUD
 func createUser(w http.ResponseWriter, r *http.Request) {
-	var newUser User
-	err := json.NewDecoder(r.Body).Decode(&newUser)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+	var input newUserRequest
+	if !decodeJSON(w, r, &input) {
 		return
 	}
 
+	newUser := User{
+		Name:  strings.TrimSpace(input.Name),
+		Email: strings.ToLower(strings.TrimSpace(input.Email)),
+		Age:   input.Age,
+		Phone: input.Phone,
+	}
+	if errs := validateNewUser(&newUser); len(errs) > 0 {
+		writeValidationErrors(w, "User is invalid", errs)
+		return
+	}
 	newUser.CreatedAt = time.Now()
 	newUser.UpdatedAt = newUser.CreatedAt
+	newUser.StoreCredit = 0
+	newUser.Role = roleCustomer
+	newUser.Version = 1
 
 	usersCollection := database.Collection(collectionName)
-	insertResult, err := usersCollection.InsertOne(context.Background(), newUser)
+	insertResult, err := usersCollection.InsertOne(r.Context(), newUser)
+	if mongo.IsDuplicateKeyError(err) {
+		writeError(w, http.StatusConflict, codeDuplicateEmail, "A user with this email already exists")
+		return
+	}
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		fmt.Println("Error creating user:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to create user")
 		return
 	}
+	newUser.ID = insertResult.InsertedID.(primitive.ObjectID)
+	recordUserAudit(r, auditCreate, newUser.ID, nil, &newUser)
+
+	w.Header().Set("ETag", userETag(newUser))
+	writeJSON(w, http.StatusCreated, newUser)
+}
 
-	json.NewEncoder(w).Encode(insertResult)
+// activeUserByID matches a user unless it has been soft-deleted. A null
+// filter value also matches users stored before deleted_at existed.
+func activeUserByID(id primitive.ObjectID) bson.M {
+	return bson.M{"_id": id, "deleted_at": nil}
 }
+
+// handleUser serves /users/{id}; /getUser, /updateUser and /deleteUser are
+// the older ?id= forms of the same handlers.
+func handleUser(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		getUserByID(w, r)
+	case http.MethodPatch:
+		updateUser(w, r)
+	case http.MethodDelete:
+		deleteUser(w, r)
+	default:
+		writeJSONError(w, http.StatusMethodNotAllowed, "Method not allowed")
+	}
+}
+
 func getUserByID(w http.ResponseWriter, r *http.Request) {
-	userID := r.URL.Query().Get("id")
-	objID, _ := primitive.ObjectIDFromHex(userID)
+	objID, ok := parseObjectID(w, r)
+	if !ok {
+		return
+	}
+	if !authorizeUser(w, r, objID) {
+		return
+	}
+
+	fields, err := parseFields(r, userFields, "id")
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
 
 	var user User
 	usersCollection := database.Collection(collectionName)
-	err := usersCollection.FindOne(context.Background(), bson.M{"_id": objID}).Decode(&user)
+	opts := options.FindOne()
+	if fields.projection != nil {
+		opts.SetProjection(fields.projection)
+	}
+	err = usersCollection.FindOne(r.Context(), activeUserByID(objID), opts).Decode(&user)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		writeJSONError(w, http.StatusNotFound, "User not found")
+		return
+	}
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusNotFound)
+		fmt.Println("Error loading user:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to load user")
 		return
 	}
 
-	json.NewEncoder(w).Encode(user)
+	picked, err := fields.pick(user)
+	if err != nil {
+		fmt.Println("Error selecting user fields:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to load user")
+		return
+	}
+	if fields.projection == nil {
+		w.Header().Set("ETag", userETag(user))
+	}
+	writeJSON(w, http.StatusOK, picked)
+}
+
+// userETag is the version of user as an entity tag, for If-Match.
+func userETag(user User) string {
+	return strconv.Quote(strconv.Itoa(user.Version))
 }
+
+// expectedVersion reads the version the caller last saw from the If-Match
+// header or the version field of patch, taking it out of the patch. Both may
+// be sent if they agree.
+func expectedVersion(r *http.Request, patch map[string]json.RawMessage) (int, error) {
+	version, fromHeader := 0, false
+	if raw := strings.TrimSpace(r.Header.Get("If-Match")); raw != "" {
+		parsed, err := strconv.Atoi(strings.Trim(strings.TrimPrefix(raw, "W/"), `"`))
+		if err != nil {
+			return 0, badRequestf("If-Match must be the user's version, as in its ETag")
+		}
+		version, fromHeader = parsed, true
+	}
+	fromBody := false
+	for _, key := range []string{"version", "Version"} {
+		raw, ok := patch[key]
+		if !ok {
+			continue
+		}
+		delete(patch, key)
+		var parsed int
+		if err := json.Unmarshal(raw, &parsed); err != nil {
+			return 0, badRequestf("version must be a whole number")
+		}
+		if (fromHeader || fromBody) && parsed != version {
+			return 0, badRequestf("the versions sent disagree")
+		}
+		version, fromBody = parsed, true
+	}
+	if !fromHeader && !fromBody {
+		return 0, errVersionRequired
+	}
+	return version, nil
+}
+
+var errVersionRequired = errors.New("version required")
+
+// updateUser applies a partial update of name, email and age and returns
+// the updated user. The caller has to send the version it last saw; if the
+// user has changed since, nothing is written and the response is 409 with
+// the current user. Changing an account's email means it has to be verified
+// again.
 func updateUser(w http.ResponseWriter, r *http.Request) {
-	userID := r.URL.Query().Get("id")
-	objID, _ := primitive.ObjectIDFromHex(userID)
+	objID, ok := parseObjectID(w, r)
+	if !ok {
+		return
+	}
+	if !authorizeUser(w, r, objID) {
+		return
+	}
 
-	var updateData struct {
-		Name string `json:"name"`
+	var patch map[string]json.RawMessage
+	if !decodeJSON(w, r, &patch) {
+		return
+	}
+	version, err := expectedVersion(r, patch)
+	if errors.Is(err, errVersionRequired) {
+		writeJSONError(w, http.StatusPreconditionRequired, "Send the user's version in the body or an If-Match header")
+		return
 	}
-	err := json.NewDecoder(r.Body).Decode(&updateData)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		writeQueryError(w, err, "Failed to update user")
+		return
+	}
+	if len(patch) == 0 {
+		writeJSONError(w, http.StatusBadRequest, "Patch must change at least one field")
+		return
+	}
+	set, errs := userPatch(patch)
+	if len(errs) > 0 {
+		writeValidationErrors(w, "User update is invalid", errs)
 		return
 	}
+	set["updated_at"] = time.Now()
+	if _, ok := set["email"]; ok {
+		set["email_verified"] = false
+	}
 
+	filter := activeUserByID(objID)
+	filter["version"] = version
+	var before User
 	usersCollection := database.Collection(collectionName)
-	_, err = usersCollection.UpdateOne(
-		context.Background(),
-		bson.M{"_id": objID},
-		bson.M{"$set": bson.M{"name": updateData.Name, "updated_at": time.Now()}},
-	)
+	err = usersCollection.FindOneAndUpdate(
+		r.Context(),
+		filter,
+		bson.M{"$set": set, "$inc": bson.M{"version": 1}},
+		options.FindOneAndUpdate().SetReturnDocument(options.Before),
+	).Decode(&before)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		var current User
+		err = usersCollection.FindOne(r.Context(), activeUserByID(objID)).Decode(&current)
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			writeJSONError(w, http.StatusNotFound, "User not found")
+			return
+		}
+		if err != nil {
+			fmt.Println("Error loading user:", err)
+			writeJSONError(w, http.StatusInternalServerError, "Failed to update user")
+			return
+		}
+		w.Header().Set("ETag", userETag(current))
+		writeErrorDetails(w, http.StatusConflict, codeVersionConflict,
+			fmt.Sprintf("User has changed since version %d", version),
+			[]map[string]interface{}{{"current": current}})
+		return
+	}
+	if mongo.IsDuplicateKeyError(err) {
+		writeError(w, http.StatusConflict, codeDuplicateEmail, "An account with this email already exists")
+		return
+	}
+	if err != nil {
+		fmt.Println("Error updating user:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to update user")
+		return
+	}
+	user, err := applySet(before, set)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		fmt.Println("Error applying user update:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to update user")
 		return
 	}
+	user.Version++
+	recordUserAudit(r, auditUpdate, objID, &before, &user)
+	w.Header().Set("ETag", userETag(user))
+	writeJSON(w, http.StatusOK, user)
+}
 
-	w.WriteHeader(http.StatusNoContent)
+const maxUserAge = 150
+
+// maxBatchGetUsers caps the IDs one /users/batchGet request may resolve.
+const maxBatchGetUsers = 100
+
+// validateNewUser checks user and normalizes its phone number.
+func validateNewUser(user *User) []fieldError {
+	var v validator
+	v.required("name", user.Name)
+	if user.Email != "" {
+		v.email("email", user.Email)
+	}
+	v.intRange("age", user.Age, 0, maxUserAge)
+	if user.Phone != "" {
+		user.Phone, _ = v.phone("phone", user.Phone)
+	}
+	return v.errs
+}
+
+// userPatch validates every field of patch and turns it into a $set
+// document. Fields that exist but may not be changed are reported as such,
+// unknown ones as unknown.
+func userPatch(patch map[string]json.RawMessage) (bson.M, []fieldError) {
+	set := bson.M{}
+	var v validator
+	for field, raw := range patch {
+		switch field {
+		case "name":
+			var name string
+			if v.check(json.Unmarshal(raw, &name) == nil, field, ruleType, "name must be a string") &&
+				v.required(field, strings.TrimSpace(name)) {
+				set["name"] = strings.TrimSpace(name)
+			}
+		case "email":
+			var email string
+			if !v.check(json.Unmarshal(raw, &email) == nil, field, ruleType, "email must be a string") {
+				continue
+			}
+			email = strings.ToLower(strings.TrimSpace(email))
+			if v.email(field, email) {
+				set["email"] = email
+			}
+		case "phone":
+			// null or an empty string removes the number.
+			var phone *string
+			if !v.check(json.Unmarshal(raw, &phone) == nil, field, ruleType, "phone must be a string") {
+				continue
+			}
+			if phone == nil || strings.TrimSpace(*phone) == "" {
+				set["phone"] = nil
+			} else if normalized, ok := v.phone(field, *phone); ok {
+				set["phone"] = normalized
+			}
+		case "age":
+			var age int
+			if v.check(json.Unmarshal(raw, &age) == nil, field, ruleType, "age must be a whole number") &&
+				v.intRange(field, age, 0, maxUserAge) {
+				set["age"] = age
+			}
+		case "_id", "id", "ID", "created_at", "CreatedAt", "updated_at", "UpdatedAt":
+			v.check(false, field, ruleImmutable, field+" cannot be changed")
+		default:
+			v.check(false, field, ruleUnknown, "unknown field "+field)
+		}
+	}
+	// Map iteration order is random; keep the response stable.
+	sort.Slice(v.errs, func(i, j int) bool { return v.errs[i].Field < v.errs[j].Field })
+	return set, v.errs
 }
+
+// deleteUser only marks the user as deleted so orders keep their
+// attribution; the user is logged out everywhere. purgeUser removes it for
+// good.
 func deleteUser(w http.ResponseWriter, r *http.Request) {
-	userID := r.URL.Query().Get("id")
-	objID, _ := primitive.ObjectIDFromHex(userID)
+	objID, ok := parseObjectID(w, r)
+	if !ok {
+		return
+	}
+	if !authorizeUser(w, r, objID) {
+		return
+	}
 
-	usersCollection := database.Collection(collectionName)
-	_, err := usersCollection.DeleteOne(context.Background(), bson.M{"_id": objID})
+	now := time.Now()
+	var before User
+	err := withTransaction(r.Context(), func(ctx context.Context) error {
+		err := database.Collection(collectionName).FindOneAndUpdate(ctx,
+			activeUserByID(objID),
+			bson.M{"$set": bson.M{"deleted_at": now, "updated_at": now}, "$inc": bson.M{"version": 1}},
+		).Decode(&before)
+		if err != nil {
+			return err
+		}
+		if err := revokeUserRefreshTokens(ctx, objID); err != nil {
+			return err
+		}
+		return deleteUserSessions(ctx, objID)
+	})
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		writeJSONError(w, http.StatusNotFound, "User not found")
+		return
+	}
+	if err != nil {
+		fmt.Println("Error deleting user:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to delete user")
+		return
+	}
+	after := before
+	after.DeletedAt, after.UpdatedAt = &now, now
+	after.Version++
+	recordUserAudit(r, auditDelete, objID, &before, &after)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func restoreUser(w http.ResponseWriter, r *http.Request) {
+	id, ok := parseObjectID(w, r)
+	if !ok {
+		return
+	}
+
+	now := time.Now()
+	var before User
+	err := database.Collection(collectionName).FindOneAndUpdate(
+		r.Context(),
+		bson.M{"_id": id, "deleted_at": bson.M{"$type": "date"}},
+		bson.M{"$set": bson.M{"deleted_at": nil, "updated_at": now}, "$inc": bson.M{"version": 1}},
+	).Decode(&before)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		writeJSONError(w, http.StatusNotFound, "No deleted user with this ID")
+		return
+	}
+	if mongo.IsDuplicateKeyError(err) {
+		writeJSONError(w, http.StatusConflict, "The email of this user has been registered again since it was deleted")
+		return
+	}
+	if err != nil {
+		fmt.Println("Error restoring user:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to restore user")
+		return
+	}
+	user := before
+	user.DeletedAt, user.UpdatedAt = nil, now
+	user.Version++
+	recordUserAudit(r, auditRestore, id, &before, &user)
+
+	writeJSON(w, http.StatusOK, user)
+}
+
+// purgeUser permanently removes a user that has already been soft-deleted.
+func purgeUser(w http.ResponseWriter, r *http.Request) {
+	id, ok := parseObjectID(w, r)
+	if !ok {
+		return
+	}
+
+	var before User
+	err := database.Collection(collectionName).FindOneAndDelete(r.Context(),
+		bson.M{"_id": id, "deleted_at": bson.M{"$type": "date"}},
+	).Decode(&before)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		writeJSONError(w, http.StatusNotFound, "No deleted user with this ID")
+		return
+	}
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		fmt.Println("Error purging user:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to purge user")
 		return
 	}
+	recordUserAudit(r, auditPurge, id, &before, nil)
 
 	w.WriteHeader(http.StatusNoContent)
 }
+
+// userFilter builds the filter for ?name= (prefix, any case), ?email=,
+// ?phone= (any notation normalizePhone accepts), ?min_age=/?max_age= and
+// ?created_after= (RFC3339).
+func userFilter(r *http.Request) (bson.M, error) {
+	query := r.URL.Query()
+	filter := bson.M{"deleted_at": nil}
+
+	if name := strings.TrimSpace(query.Get("name")); name != "" {
+		filter["name"] = primitive.Regex{Pattern: "^" + regexp.QuoteMeta(name), Options: "i"}
+	}
+	if email := strings.ToLower(strings.TrimSpace(query.Get("email"))); email != "" {
+		filter["email"] = email
+	}
+	if raw := query.Get("phone"); strings.TrimSpace(raw) != "" {
+		phone, err := normalizePhone(raw)
+		if err != nil {
+			return nil, badRequestf("%s", err.Error())
+		}
+		filter["phone"] = phone
+	}
+
+	age := bson.M{}
+	for param, op := range map[string]string{"min_age": "$gte", "max_age": "$lte"} {
+		raw := query.Get(param)
+		if raw == "" {
+			continue
+		}
+		value, err := strconv.Atoi(raw)
+		if err != nil || value < 0 {
+			return nil, badRequestf("%s must be a non-negative integer", param)
+		}
+		age[op] = value
+	}
+	if min, ok := age["$gte"].(int); ok {
+		if max, ok := age["$lte"].(int); ok && min > max {
+			return nil, badRequestf("min_age must not be greater than max_age")
+		}
+	}
+	if len(age) > 0 {
+		filter["age"] = age
+	}
+
+	createdAfter, ok, err := timeParam(r, "created_after")
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		filter["created_at"] = bson.M{"$gt": createdAfter}
+	}
+	return filter, nil
+}
+
 func getAllUsers(w http.ResponseWriter, r *http.Request) {
-	var users []User
+	sort, err := parseSort(r, userSortFields)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	filter, err := userFilter(r)
+	if err != nil {
+		writeQueryError(w, err, "Failed to load users")
+		return
+	}
+	page, err := parsePagination(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	fields, err := parseFields(r, userFields, "id")
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
 	usersCollection := database.Collection(collectionName)
-	cursor, err := usersCollection.Find(context.Background(), bson.M{})
+	total, err := usersCollection.CountDocuments(r.Context(), filter)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		fmt.Println("Error counting users:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to load users")
 		return
 	}
-	defer cursor.Close(context.Background())
 
-	for cursor.Next(context.Background()) {
+	opts := options.Find().SetSort(sort).SetSkip(page.skip()).SetLimit(int64(page.Limit))
+	if fields.projection != nil {
+		opts.SetProjection(fields.projection)
+	}
+	cursor, err := usersCollection.Find(r.Context(), filter, opts)
+	if err != nil {
+		fmt.Println("Error querying users:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to load users")
+		return
+	}
+	defer cursor.Close(r.Context())
+
+	users := make([]interface{}, 0, page.Limit)
+	for cursor.Next(r.Context()) {
+		// Next only notices cancellation when it has to fetch a batch.
+		if err := r.Context().Err(); err != nil {
+			fmt.Println("Error iterating users:", err)
+			writeJSONError(w, http.StatusInternalServerError, "Failed to load users")
+			return
+		}
 		var user User
-		cursor.Decode(&user)
-		users = append(users, user)
+		if err := cursor.Decode(&user); err != nil {
+			fmt.Println("Error decoding user:", err)
+			writeJSONError(w, http.StatusInternalServerError, "Failed to load users")
+			return
+		}
+		picked, err := fields.pick(user)
+		if err != nil {
+			fmt.Println("Error selecting user fields:", err)
+			writeJSONError(w, http.StatusInternalServerError, "Failed to load users")
+			return
+		}
+		users = append(users, picked)
+	}
+	if err := cursor.Err(); err != nil {
+		fmt.Println("Error iterating users:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to load users")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, pageResponse{
+		Items:      users,
+		Total:      total,
+		Page:       page.Page,
+		TotalPages: page.totalPages(total),
+	})
+}
+
+// batchGetUsers resolves a JSON array of user IDs in one query. Every
+// requested ID appears in the response, mapped to null when there is no
+// active user with it. ?fields= works as on getAllUsers.
+func batchGetUsers(w http.ResponseWriter, r *http.Request) {
+	fields, err := parseFields(r, userFields, "id")
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	var raw []string
+	if !decodeJSON(w, r, &raw) {
+		return
+	}
+	if len(raw) > maxBatchGetUsers {
+		writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("at most %d IDs may be requested at once", maxBatchGetUsers))
+		return
+	}
+
+	var v validator
+	ids := make([]primitive.ObjectID, 0, len(raw))
+	result := make(map[string]interface{}, len(raw))
+	for i, hex := range raw {
+		id, err := primitive.ObjectIDFromHex(hex)
+		if !v.check(err == nil, fmt.Sprintf("[%d]", i), ruleFormat, fmt.Sprintf("%q is not a valid ID", hex)) {
+			continue
+		}
+		if _, seen := result[id.Hex()]; !seen {
+			result[id.Hex()] = nil
+			ids = append(ids, id)
+		}
+	}
+	if len(v.errs) > 0 {
+		writeValidationErrors(w, "Some IDs are invalid", v.errs)
+		return
+	}
+	if len(ids) == 0 {
+		writeJSON(w, http.StatusOK, result)
+		return
+	}
+
+	opts := options.Find()
+	if fields.projection != nil {
+		opts.SetProjection(fields.projection)
+	}
+	cursor, err := database.Collection(collectionName).Find(r.Context(),
+		bson.M{"_id": bson.M{"$in": ids}, "deleted_at": nil}, opts)
+	if err != nil {
+		fmt.Println("Error querying users:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to load users")
+		return
+	}
+	defer cursor.Close(r.Context())
+
+	for cursor.Next(r.Context()) {
+		var user User
+		if err := cursor.Decode(&user); err != nil {
+			fmt.Println("Error decoding user:", err)
+			writeJSONError(w, http.StatusInternalServerError, "Failed to load users")
+			return
+		}
+		picked, err := fields.pick(user)
+		if err != nil {
+			fmt.Println("Error selecting user fields:", err)
+			writeJSONError(w, http.StatusInternalServerError, "Failed to load users")
+			return
+		}
+		result[user.ID.Hex()] = picked
+	}
+	if err := cursor.Err(); err != nil {
+		fmt.Println("Error iterating users:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to load users")
+		return
 	}
 
-	json.NewEncoder(w).Encode(users)
+	writeJSON(w, http.StatusOK, result)
 }
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+func TestMain(m *testing.M) {
+	jwtSecret = []byte("test secret, at least thirty-two bytes long")
+	os.Exit(m.Run())
+}
+
+// testDatabase is a database of the test's own on MONGO_TEST_URI, dropped
+// when the test ends. Tests that need MongoDB are skipped without it.
+func testDatabase(t *testing.T) *mongo.Database {
+	t.Helper()
+	uri := os.Getenv("MONGO_TEST_URI")
+	if uri == "" {
+		t.Skip("MONGO_TEST_URI is not set")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(uri))
+	if err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	if err := client.Ping(ctx, nil); err != nil {
+		t.Fatalf("ping: %v", err)
+	}
+	db := client.Database(fmt.Sprintf("shop_test_%s", primitive.NewObjectID().Hex()))
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := db.Drop(ctx); err != nil {
+			t.Errorf("drop %s: %v", db.Name(), err)
+		}
+		client.Disconnect(ctx)
+	})
+	return db
+}
+
+// testServer is the server's handler on a fresh test database. The work
+// requests started in the background finishes before the database goes.
+func testServer(t *testing.T) (http.Handler, *mongo.Database) {
+	t.Helper()
+	db := testDatabase(t)
+	h := newHandler(db)
+	t.Cleanup(func() {
+		backgroundWork.Wait()
+		database = nil
+	})
+	return h, db
+}
+
+// testToken is an access token for user, who need not exist.
+func testToken(t *testing.T, user User) string {
+	t.Helper()
+	token, _, err := issueAccessToken(user, time.Now())
+	if err != nil {
+		t.Fatalf("issue token: %v", err)
+	}
+	return token
+}
+
+// newTestRequest is a request with token, when set, as the bearer token
+// and body as JSON.
+func newTestRequest(method, target, token, body string) *http.Request {
+	var reader io.Reader
+	if body != "" {
+		reader = strings.NewReader(body)
+	}
+	req := httptest.NewRequest(method, target, reader)
+	if body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return req
+}
+
+func serveRequest(h http.Handler, req *http.Request) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+// serveTest sends newTestRequest to h.
+func serveTest(h http.Handler, method, target, token, body string) *httptest.ResponseRecorder {
+	return serveRequest(h, newTestRequest(method, target, token, body))
+}
+
+// decodeAPIError is the envelope of an error response.
+func decodeAPIError(t *testing.T, rec *httptest.ResponseRecorder) apiError {
+	t.Helper()
+	var body struct {
+		Error apiError `json:"error"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatalf("error body %q: %v", rec.Body.String(), err)
+	}
+	return body.Error
+}
+
+func TestNewHandlerWithoutDatabase(t *testing.T) {
+	h := newHandler(nil)
+
+	if rec := serveTest(h, http.MethodGet, "/healthz", "", ""); rec.Code != http.StatusOK {
+		t.Errorf("GET /healthz = %d, want 200", rec.Code)
+	}
+	rec := serveTest(h, http.MethodGet, "/getFurniture", "", "")
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("GET /getFurniture = %d, want 503", rec.Code)
+	}
+	if apiErr := decodeAPIError(t, rec); apiErr.Code != codeUnavailable {
+		t.Errorf("code = %q, want %q", apiErr.Code, codeUnavailable)
+	}
+}
+
+func TestNewHandlerUsesInjectedDatabase(t *testing.T) {
+	h, db := testServer(t)
+	item := Furniture{ID: 42, Name: "Test chair", Price: 99, Stock: 3, CreatedAt: time.Now()}
+	if _, err := db.Collection(furnitureCollectionName).InsertOne(context.Background(), item); err != nil {
+		t.Fatalf("insert: %v", err)
+	}
+
+	rec := serveTest(h, http.MethodGet, "/furniture/42", "", "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET /furniture/42 = %d: %s", rec.Code, rec.Body)
+	}
+	var got Furniture
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if got.ID != item.ID || got.Name != item.Name || got.Stock != item.Stock {
+		t.Errorf("got %+v, want %+v", got, item)
+	}
+}
+
+func TestConnectMongoGivesUp(t *testing.T) {
+	attempts, timeout := mongoConnectAttempts, mongoConnectTimeout
+	mongoConnectAttempts, mongoConnectTimeout = 1, 2*time.Second
+	t.Cleanup(func() { mongoConnectAttempts, mongoConnectTimeout = attempts, timeout })
+
+	client, err := connectMongo(context.Background(), "mongodb://127.0.0.1:1/?serverSelectionTimeoutMS=200")
+	if err == nil {
+		disconnectMongo(client)
+		t.Fatal("connectMongo succeeded against a closed port")
+	}
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.mongodb.org/mongo-driver/event"
+)
+
+// The metrics served on /metrics in the Prometheus text format. Labels only
+// ever take values from small fixed sets, route patterns rather than paths
+// among them, so the number of series stays bounded.
+var (
+	httpRequests = newCounterVec("http_requests_total",
+		"HTTP requests served, by route pattern, method and status.", "route", "method", "status")
+	httpDuration = newHistogramVec("http_request_duration_seconds",
+		"Time to serve HTTP requests, by route pattern and method.", defaultBuckets, "route", "method")
+	httpInFlight atomic.Int64
+
+	mongoDuration = newHistogramVec("mongodb_command_duration_seconds",
+		"Time MongoDB commands took, by command, collection and outcome.", defaultBuckets, "command", "collection", "outcome")
+
+	ordersCreated = newCounterVec("shop_orders_created_total", "Orders placed.")
+	orderValue    = newCounterVec("shop_order_value_total", "Sum of the totals of the orders placed.")
+)
+
+var defaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// metricsToken, from METRICS_TOKEN, must come as a bearer token when set;
+// the metrics include business figures.
+var metricsToken string
+
+type counterVec struct {
+	name, help string
+	labels     []string
+
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	return &counterVec{name: name, help: help, labels: labels, values: map[string]float64{}}
+}
+
+func (c *counterVec) add(value float64, labelValues ...string) {
+	key := labelKey(c.labels, labelValues)
+	c.mu.Lock()
+	c.values[key] += value
+	c.mu.Unlock()
+}
+
+func (c *counterVec) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.labels) == 0 && len(c.values) == 0 {
+		fmt.Fprintf(w, "%s 0\n", c.name)
+	}
+	for _, key := range sortedKeys(c.values) {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, key, formatFloat(c.values[key]))
+	}
+}
+
+type histogram struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+type histogramVec struct {
+	name, help string
+	labels     []string
+	buckets    []float64
+
+	mu     sync.Mutex
+	series map[string]*histogram
+}
+
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *histogramVec {
+	return &histogramVec{name: name, help: help, labels: labels, buckets: buckets, series: map[string]*histogram{}}
+}
+
+func (h *histogramVec) observe(value float64, labelValues ...string) {
+	key := labelKey(h.labels, labelValues)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s, ok := h.series[key]
+	if !ok {
+		s = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.series[key] = s
+	}
+	for i, bound := range h.buckets {
+		if value <= bound {
+			s.counts[i]++
+		}
+	}
+	s.sum += value
+	s.count++
+}
+
+func (h *histogramVec) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	keys := make([]string, 0, len(h.series))
+	for key := range h.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		s := h.series[key]
+		for i, bound := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, withLabel(key, "le", formatFloat(bound)), s.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, withLabel(key, "le", "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, key, formatFloat(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, key, s.count)
+	}
+}
+
+// labelKey renders label pairs as they appear in the output, {a="x",b="y"},
+// and doubles as the series key.
+func labelKey(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, name := range names {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		value := ""
+		if i < len(values) {
+			value = values[i]
+		}
+		b.WriteString(name)
+		b.WriteString(`="`)
+		b.WriteString(escapeLabel(value))
+		b.WriteByte('"')
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+func withLabel(key, name, value string) string {
+	pair := name + `="` + value + `"`
+	if key == "" {
+		return "{" + pair + "}"
+	}
+	return key[:len(key)-1] + "," + pair + "}"
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(value string) string {
+	return labelEscaper.Replace(value)
+}
+
+func formatFloat(value float64) string {
+	if math.IsInf(value, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+func sortedKeys(values map[string]float64) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// instrument counts and times the requests of one route and names its
+// span; route and exportRoute wrap every handler in it.
+func instrument(pattern string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		httpInFlight.Add(1)
+		defer httpInFlight.Add(-1)
+		start := time.Now()
+		if s := currentSpan(r.Context()); s != nil {
+			s.name = r.Method + " " + pattern
+			s.setAttr("http.route", pattern)
+		}
+		sw := &statusWriter{ResponseWriter: w}
+		h(sw, r)
+		status := sw.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		method := r.Method
+		if !knownMethods[method] {
+			method = "other"
+		}
+		httpRequests.add(1, pattern, method, strconv.Itoa(status))
+		httpDuration.observe(time.Since(start).Seconds(), pattern, method)
+	}
+}
+
+var knownMethods = map[string]bool{
+	http.MethodGet: true, http.MethodHead: true, http.MethodPost: true, http.MethodPut: true,
+	http.MethodPatch: true, http.MethodDelete: true, http.MethodOptions: true,
+}
+
+// recordOrderCreated counts a freshly placed order and its value.
+func recordOrderCreated(order Order) {
+	ordersCreated.add(1)
+	orderValue.add(order.Total)
+}
+
+// mongoMonitor times every command the MongoDB clients run and traces those
+// run as part of a trace. The collection is only known when a command
+// starts, so it is kept until it ends.
+var mongoMonitor = &event.CommandMonitor{
+	Started: func(ctx context.Context, e *event.CommandStartedEvent) {
+		command := mongoCommand{collection: "-"}
+		if value, err := e.Command.LookupErr(e.CommandName); err == nil {
+			if name, ok := value.StringValueOK(); ok {
+				command.collection = name
+			}
+		}
+		if _, traced := spanContextFrom(ctx); traced {
+			_, command.span = startSpan(ctx, e.CommandName+" "+command.collection, spanKindClient)
+			command.span.setAttr("db.system", "mongodb")
+			command.span.setAttr("db.namespace", e.DatabaseName)
+			command.span.setAttr("db.operation.name", e.CommandName)
+			command.span.setAttr("db.collection.name", command.collection)
+		}
+		mongoCommands.Store(e.RequestID, command)
+	},
+	Succeeded: func(ctx context.Context, e *event.CommandSucceededEvent) {
+		observeMongoCommand(e.CommandFinishedEvent, "ok", "")
+	},
+	Failed: func(ctx context.Context, e *event.CommandFailedEvent) {
+		observeMongoCommand(e.CommandFinishedEvent, "error", e.Failure)
+	},
+}
+
+type mongoCommand struct {
+	collection string
+	span       *span
+}
+
+// mongoCommands holds the commands in flight by driver request ID.
+var mongoCommands sync.Map
+
+func observeMongoCommand(e event.CommandFinishedEvent, outcome, failure string) {
+	command := mongoCommand{collection: "-"}
+	if value, ok := mongoCommands.LoadAndDelete(e.RequestID); ok {
+		command = value.(mongoCommand)
+	}
+	mongoDuration.observe(e.Duration.Seconds(), e.CommandName, command.collection, outcome)
+	if command.span != nil {
+		if failure != "" {
+			command.span.fail(failure)
+		}
+		command.span.end()
+	}
+}
+
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	if metricsToken != "" {
+		token, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(metricsToken)) != 1 {
+			writeJSONError(w, http.StatusUnauthorized, "A valid metrics token is required")
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	httpRequests.write(w)
+	httpDuration.write(w)
+	fmt.Fprintf(w, "# HELP http_requests_in_flight HTTP requests being served.\n# TYPE http_requests_in_flight gauge\nhttp_requests_in_flight %d\n", httpInFlight.Load())
+	mongoDuration.write(w)
+	ordersCreated.write(w)
+	orderValue.write(w)
+}
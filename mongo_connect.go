@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	mongoRetryInitialDelay = 500 * time.Millisecond
+	mongoRetryMaxDelay     = 10 * time.Second
+	mongoAttemptTimeout    = 5 * time.Second
+)
+
+// MongoDB often comes up after the server, under docker-compose or in a pod
+// started alongside it, so the first connection is retried.
+// MONGO_CONNECT_ATTEMPTS (default 10) and MONGO_CONNECT_TIMEOUT (a Go
+// duration, default 1m) bound the retries; whichever runs out first ends
+// them.
+var (
+	mongoConnectAttempts = 10
+	mongoConnectTimeout  = time.Minute
+)
+
+// connectMongo connects to uri and pings the server until it answers,
+// waiting twice as long after each failure, with jitter so that several
+// replicas do not retry in lockstep. Cancelling ctx gives up early.
+func connectMongo(ctx context.Context, uri string) (*mongo.Client, error) {
+	c, err := mongo.NewClient(options.Client().ApplyURI(uri).SetMonitor(mongoMonitor).SetPoolMonitor(mongoPoolMonitor))
+	if err != nil {
+		return nil, err
+	}
+	deadline := time.Now().Add(mongoConnectTimeout)
+	ctx, cancel := context.WithDeadline(ctx, deadline)
+	defer cancel()
+	if err := c.Connect(ctx); err != nil {
+		return nil, err
+	}
+
+	delay := mongoRetryInitialDelay
+	for attempt := 1; ; attempt++ {
+		attemptCtx, cancelAttempt := context.WithTimeout(ctx, mongoAttemptTimeout)
+		err = c.Ping(attemptCtx, nil)
+		cancelAttempt()
+		if err == nil {
+			return c, nil
+		}
+
+		wait := delay/2 + time.Duration(rand.Int63n(int64(delay)))
+		if attempt == mongoConnectAttempts || ctx.Err() != nil || time.Now().Add(wait).After(deadline) {
+			fmt.Printf("MongoDB not reachable (attempt %d/%d): %v; giving up\n", attempt, mongoConnectAttempts, err)
+			disconnectMongo(c)
+			return nil, err
+		}
+		fmt.Printf("MongoDB not reachable (attempt %d/%d): %v; retrying in %s\n", attempt, mongoConnectAttempts, err, wait.Round(time.Millisecond))
+		select {
+		case <-ctx.Done():
+			disconnectMongo(c)
+			return nil, ctx.Err()
+		case <-time.After(wait):
+		}
+		if delay *= 2; delay > mongoRetryMaxDelay {
+			delay = mongoRetryMaxDelay
+		}
+	}
+}
+
+// requireDatabase answers 503 if the database handle is missing, which
+// should not happen once startup has succeeded, rather than let h panic.
+func requireDatabase(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if database == nil {
+			writeJSONError(w, http.StatusServiceUnavailable, "Database unavailable, please try again later")
+			return
+		}
+		h(w, r)
+	}
+}
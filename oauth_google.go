@@ -0,0 +1,261 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	authProviderGoogle = "google"
+
+	googleAuthURL     = "https://accounts.google.com/o/oauth2/v2/auth"
+	googleTokenURL    = "https://oauth2.googleapis.com/token"
+	googleUserInfoURL = "https://openidconnect.googleapis.com/v1/userinfo"
+
+	oauthStateCookieName = "oauth_state"
+	oauthStateLifetime   = 10 * time.Minute
+)
+
+// googleOAuth is set by Config.apply from GOOGLE_CLIENT_ID,
+// GOOGLE_CLIENT_SECRET and GOOGLE_REDIRECT_URL; Google login answers 503
+// while the ID is unset.
+var googleOAuth struct {
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+}
+
+var oauthClient = &http.Client{Timeout: 10 * time.Second}
+
+type googleProfile struct {
+	Subject       string `json:"sub"`
+	Email         string `json:"email"`
+	EmailVerified bool   `json:"email_verified"`
+	Name          string `json:"name"`
+}
+
+// createOAuthIndexes keeps one active user per Google account.
+func createOAuthIndexes() error {
+	indexes := database.Collection(collectionName).Indexes()
+	// Superseded by google_id_active_unique.
+	if _, err := indexes.DropOne(context.TODO(), "google_id_1"); err != nil && !isIndexNotFound(err) {
+		return err
+	}
+	_, err := indexes.CreateOne(context.TODO(), mongo.IndexModel{
+		Keys: bson.D{{Key: "google_id", Value: 1}},
+		Options: options.Index().
+			SetName("google_id_active_unique").
+			SetUnique(true).
+			SetPartialFilterExpression(bson.M{
+				"google_id":  bson.M{"$exists": true},
+				"deleted_at": bson.M{"$type": "null"},
+			}),
+	})
+	return err
+}
+
+func setOAuthStateCookie(w http.ResponseWriter, value string, maxAge int) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     oauthStateCookieName,
+		Value:    value,
+		Path:     "/auth/google",
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// handleGoogleLogin sends the browser to Google's consent screen. The state
+// is kept in a cookie and checked on the way back, so a callback cannot be
+// forged from another site. ?mode=session logs in with a session cookie.
+func handleGoogleLogin(w http.ResponseWriter, r *http.Request) {
+	if googleOAuth.ClientID == "" {
+		writeJSONError(w, http.StatusServiceUnavailable, "Google login is not configured")
+		return
+	}
+	mode := r.URL.Query().Get("mode")
+	if mode != "" && mode != loginModeSession {
+		writeJSONError(w, http.StatusBadRequest, `mode must be empty or "session"`)
+		return
+	}
+
+	state, err := newSecretToken()
+	if err != nil {
+		fmt.Println("Error generating OAuth state:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to start Google login")
+		return
+	}
+	setOAuthStateCookie(w, state+"."+mode, int(oauthStateLifetime/time.Second))
+
+	query := url.Values{
+		"client_id":     {googleOAuth.ClientID},
+		"redirect_uri":  {googleOAuth.RedirectURL},
+		"response_type": {"code"},
+		"scope":         {"openid email profile"},
+		"state":         {state},
+		"prompt":        {"select_account"},
+	}
+	http.Redirect(w, r, googleAuthURL+"?"+query.Encode(), http.StatusFound)
+}
+
+// exchangeGoogleCode trades an authorization code for the user's profile.
+func exchangeGoogleCode(ctx context.Context, code string) (googleProfile, error) {
+	var profile googleProfile
+	form := url.Values{
+		"code":          {code},
+		"client_id":     {googleOAuth.ClientID},
+		"client_secret": {googleOAuth.ClientSecret},
+		"redirect_uri":  {googleOAuth.RedirectURL},
+		"grant_type":    {"authorization_code"},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, googleTokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return profile, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := oauthClient.Do(req)
+	if err != nil {
+		return profile, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return profile, fmt.Errorf("token endpoint answered %d", resp.StatusCode)
+	}
+	var token struct {
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return profile, err
+	}
+
+	req, err = http.NewRequestWithContext(ctx, http.MethodGet, googleUserInfoURL, nil)
+	if err != nil {
+		return profile, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token.AccessToken)
+	resp, err = oauthClient.Do(req)
+	if err != nil {
+		return profile, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return profile, fmt.Errorf("userinfo endpoint answered %d", resp.StatusCode)
+	}
+	err = json.NewDecoder(resp.Body).Decode(&profile)
+	return profile, err
+}
+
+// googleUser returns the user signed in through profile: the one already
+// linked to the Google account, else the one with the same email, which is
+// linked now, else a new user.
+func googleUser(ctx context.Context, profile googleProfile) (User, error) {
+	users := database.Collection(collectionName)
+	now := time.Now()
+	email := strings.ToLower(profile.Email)
+
+	var user User
+	err := users.FindOne(ctx, bson.M{"google_id": profile.Subject, "deleted_at": nil}).Decode(&user)
+	if !errors.Is(err, mongo.ErrNoDocuments) {
+		return user, err
+	}
+
+	// Google has verified the email, which proves ownership of the
+	// matching user as well.
+	err = users.FindOneAndUpdate(ctx,
+		bson.M{"email": email, "deleted_at": nil, "google_id": bson.M{"$exists": false}},
+		bson.M{"$set": bson.M{"google_id": profile.Subject, "email_verified": true, "updated_at": now}},
+		options.FindOneAndUpdate().
+			SetSort(bson.D{{Key: "password_hash", Value: -1}, {Key: "created_at", Value: 1}}).
+			SetReturnDocument(options.After),
+	).Decode(&user)
+	if !errors.Is(err, mongo.ErrNoDocuments) {
+		return user, err
+	}
+
+	user = User{
+		Name:          profile.Name,
+		Email:         email,
+		Role:          roleCustomer,
+		EmailVerified: true,
+		AuthProvider:  authProviderGoogle,
+		GoogleID:      profile.Subject,
+		CreatedAt:     now,
+		UpdatedAt:     now,
+		Version:       1,
+	}
+	result, err := users.InsertOne(ctx, user)
+	if mongo.IsDuplicateKeyError(err) {
+		// A parallel callback for the same Google account won.
+		err = users.FindOne(ctx, bson.M{"google_id": profile.Subject, "deleted_at": nil}).Decode(&user)
+		return user, err
+	}
+	if err != nil {
+		return user, err
+	}
+	user.ID = result.InsertedID.(primitive.ObjectID)
+	return user, nil
+}
+
+func handleGoogleCallback(w http.ResponseWriter, r *http.Request) {
+	if googleOAuth.ClientID == "" {
+		writeJSONError(w, http.StatusServiceUnavailable, "Google login is not configured")
+		return
+	}
+
+	cookie, err := r.Cookie(oauthStateCookieName)
+	setOAuthStateCookie(w, "", -1)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "Google login has expired, start again")
+		return
+	}
+	state, mode, _ := strings.Cut(cookie.Value, ".")
+	query := r.URL.Query()
+	if state == "" || subtle.ConstantTimeCompare([]byte(state), []byte(query.Get("state"))) != 1 {
+		writeJSONError(w, http.StatusBadRequest, "Invalid OAuth state")
+		return
+	}
+	if query.Get("error") != "" {
+		writeJSONError(w, http.StatusUnauthorized, "Google login was not completed: "+query.Get("error"))
+		return
+	}
+	if query.Get("code") == "" {
+		writeJSONError(w, http.StatusBadRequest, "code is required")
+		return
+	}
+
+	profile, err := exchangeGoogleCode(r.Context(), query.Get("code"))
+	if err != nil {
+		fmt.Println("Error exchanging Google code:", err)
+		writeJSONError(w, http.StatusBadGateway, "Failed to complete Google login")
+		return
+	}
+	if profile.Subject == "" || profile.Email == "" || !profile.EmailVerified {
+		writeJSONError(w, http.StatusForbidden, "Google account has no verified email address")
+		return
+	}
+
+	user, err := googleUser(r.Context(), profile)
+	if err != nil {
+		fmt.Println("Error signing in Google user:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to complete Google login")
+		return
+	}
+	if user.TOTPEnabled {
+		startTwoFactorChallenge(w, r, user, mode)
+		return
+	}
+	completeLogin(w, r, user, mode)
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// exportFlushEvery is how many rows are buffered before they are pushed to
+// the client.
+const exportFlushEvery = 500
+
+var orderExportHeader = []string{"order_number", "date", "customer_email", "item", "quantity", "unit_price", "line_total", "status"}
+
+// furnitureNames maps every furniture ID, deleted ones included, to its name.
+func furnitureNames(r *http.Request) (map[int]string, error) {
+	opts := options.Find().SetProjection(bson.M{"name": 1})
+	cursor, err := database.Collection(furnitureCollectionName).Find(r.Context(), bson.M{}, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(r.Context())
+
+	names := map[int]string{}
+	for cursor.Next(r.Context()) {
+		var item struct {
+			ID   int    `bson:"_id"`
+			Name string `bson:"name"`
+		}
+		if err := cursor.Decode(&item); err != nil {
+			return nil, err
+		}
+		names[item.ID] = item.Name
+	}
+	return names, cursor.Err()
+}
+
+// exportOrders streams one CSV row per order line in [from, to]. Orders are
+// read from the cursor one at a time, so memory use does not grow with the
+// size of the export. Once the first row is out the status is fixed, so a
+// failure part way is only logged and the response ends early.
+func exportOrders(w http.ResponseWriter, r *http.Request) {
+	if format := r.URL.Query().Get("format"); format != "" && format != "csv" {
+		writeJSONError(w, http.StatusBadRequest, "format must be csv")
+		return
+	}
+	from, to, err := statsRange(r)
+	if err != nil {
+		writeQueryError(w, err, "Failed to export orders")
+		return
+	}
+
+	names, err := furnitureNames(r)
+	if err != nil {
+		fmt.Println("Error loading furniture names:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to export orders")
+		return
+	}
+
+	filter := bson.M{"created_at": bson.M{"$gte": from, "$lte": to}}
+	opts := options.Find().SetSort(bson.D{{Key: "created_at", Value: 1}, {Key: "_id", Value: 1}}).SetBatchSize(1000)
+	cursor, err := database.Collection(ordersCollectionName).Find(r.Context(), filter, opts)
+	if err != nil {
+		fmt.Println("Error querying orders for export:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to export orders")
+		return
+	}
+	defer cursor.Close(r.Context())
+
+	filename := fmt.Sprintf("orders-%s-%s.csv", from.Format("20060102"), to.Format("20060102"))
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+filename+`"`)
+
+	flusher, _ := w.(http.Flusher)
+	out := csv.NewWriter(w)
+	out.Write(orderExportHeader)
+
+	rows := 0
+	for cursor.Next(r.Context()) {
+		var order Order
+		if err := cursor.Decode(&order); err != nil {
+			fmt.Println("Error decoding order for export:", err)
+			break
+		}
+		for _, item := range order.Items {
+			name := names[item.FurnitureID]
+			if item.VariantID != "" {
+				name += " (" + item.VariantID + ")"
+			}
+			out.Write([]string{
+				order.Number,
+				order.CreatedAt.UTC().Format(time.RFC3339),
+				order.Customer.Email,
+				name,
+				strconv.Itoa(item.Quantity),
+				strconv.FormatFloat(item.UnitPrice, 'f', 2, 64),
+				strconv.FormatFloat(item.UnitPrice*float64(item.Quantity), 'f', 2, 64),
+				order.Status,
+			})
+			rows++
+			if rows%exportFlushEvery == 0 {
+				out.Flush()
+				if flusher != nil {
+					flusher.Flush()
+				}
+				if err := r.Context().Err(); err != nil {
+					fmt.Println("Export stopped:", err)
+					break
+				}
+			}
+		}
+	}
+	if err := cursor.Err(); err != nil {
+		fmt.Println("Error reading orders for export:", err)
+	}
+
+	out.Flush()
+	if err := out.Error(); err != nil {
+		fmt.Println("Error writing order export:", err)
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	orderStatusConfirmed = "confirmed"
+	orderStatusShipped   = "shipped"
+	orderStatusDelivered = "delivered"
+	orderStatusCancelled = "cancelled"
+)
+
+// orderTransitions lists, for each status, the statuses an order may move to
+// next. Delivered and cancelled orders are final.
+var orderTransitions = map[string][]string{
+	orderStatusPending:   {orderStatusConfirmed, orderStatusCancelled},
+	orderStatusConfirmed: {orderStatusShipped, orderStatusCancelled},
+	orderStatusShipped:   {orderStatusDelivered},
+	orderStatusDelivered: {},
+	orderStatusCancelled: {},
+}
+
+type StatusChange struct {
+	Status    string    `json:"status" bson:"status"`
+	ChangedAt time.Time `json:"changed_at" bson:"changed_at"`
+}
+
+var errIllegalTransition = errors.New("illegal status transition")
+
+// statusesLeadingTo returns every status from which target can be reached in
+// one step.
+func statusesLeadingTo(target string) []string {
+	from := []string{}
+	for status, next := range orderTransitions {
+		for _, candidate := range next {
+			if candidate == target {
+				from = append(from, status)
+			}
+		}
+	}
+	return from
+}
+
+// transitionOrder moves an order to status if its current status allows it.
+// The check and the write are one atomic update, so two concurrent requests
+// cannot both win. On errIllegalTransition the current order is returned.
+func transitionOrder(ctx context.Context, id primitive.ObjectID, status string) (Order, error) {
+	now := time.Now()
+	var order Order
+	ordersCollection := database.Collection(ordersCollectionName)
+	err := ordersCollection.FindOneAndUpdate(
+		ctx,
+		bson.M{"_id": id, "status": bson.M{"$in": statusesLeadingTo(status)}},
+		bson.M{
+			"$set":  bson.M{"status": status, "updated_at": now},
+			"$push": bson.M{"status_history": StatusChange{Status: status, ChangedAt: now}},
+		},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&order)
+	if !errors.Is(err, mongo.ErrNoDocuments) {
+		return order, err
+	}
+
+	if err := ordersCollection.FindOne(ctx, bson.M{"_id": id}).Decode(&order); err != nil {
+		return order, err
+	}
+	return order, errIllegalTransition
+}
+
+// revertTransition moves an order that is still in status back to previous,
+// dropping the history entry the transition added.
+func revertTransition(ctx context.Context, id primitive.ObjectID, status, previous string) error {
+	_, err := database.Collection(ordersCollectionName).UpdateOne(ctx,
+		bson.M{"_id": id, "status": status},
+		bson.M{
+			"$set": bson.M{"status": previous, "updated_at": time.Now()},
+			"$pop": bson.M{"status_history": 1},
+		},
+	)
+	return err
+}
+
+func writeTransitionConflict(w http.ResponseWriter, order Order, requested string) {
+	writeErrorDetails(w, http.StatusConflict, "illegal_transition",
+		fmt.Sprintf("Cannot move an order from %s to %s", order.Status, requested),
+		[]map[string]string{{"current_status": order.Status}})
+}
+
+func updateOrderStatus(w http.ResponseWriter, r *http.Request) {
+	id, ok := parseObjectID(w, r)
+	if !ok {
+		return
+	}
+
+	var body struct {
+		Status string `json:"status"`
+	}
+	if !decodeJSON(w, r, &body) {
+		return
+	}
+	if _, known := orderTransitions[body.Status]; !known {
+		writeJSONError(w, http.StatusBadRequest, "status must be one of pending, confirmed, shipped, delivered, cancelled")
+		return
+	}
+
+	var order Order
+	var err error
+	if body.Status == orderStatusCancelled {
+		order, err = cancelOrder(r.Context(), id)
+	} else if order, err = transitionOrder(r.Context(), id, body.Status); err == nil {
+		notifyStatusChange(r.Context(), order)
+	}
+	switch {
+	case errors.Is(err, errIllegalTransition):
+		writeTransitionConflict(w, order, body.Status)
+	case errors.Is(err, mongo.ErrNoDocuments):
+		writeJSONError(w, http.StatusNotFound, "Order not found")
+	case err != nil:
+		fmt.Println("Error updating order status:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to update order status")
+	default:
+		writeJSON(w, http.StatusOK, order)
+	}
+}
+
+// cancelOrder cancels a pending or confirmed order and puts any stock it
+// reserved and store credit it spent back. Cancelling an already cancelled
+// order changes nothing and returns it without an error, so retries never
+// credit anything twice. Without a transaction a failed release or refund
+// undoes what was already given back and restores the previous status, so
+// the order is never left cancelled with its stock still held.
+func cancelOrder(ctx context.Context, id primitive.ObjectID) (Order, error) {
+	var order Order
+	err := withTransaction(ctx, func(ctx context.Context) error {
+		var undo []func() error
+		fail := func(err error) error {
+			undoSteps("cancellation", undo)
+			return err
+		}
+
+		var err error
+		order, err = transitionOrder(ctx, id, orderStatusCancelled)
+		if err != nil {
+			return err
+		}
+		// Orders from before the status history was kept count as pending.
+		previous := orderStatusPending
+		if n := len(order.StatusHistory); n >= 2 {
+			previous = order.StatusHistory[n-2].Status
+		}
+		undo = append(undo, func() error { return revertTransition(ctx, order.ID, orderStatusCancelled, previous) })
+
+		// Only the request that flipped the status gets here, so stock and
+		// credit are given back exactly once. Lines are released one at a
+		// time so an undo takes back exactly what was released.
+		if order.StockReserved {
+			for i := range order.Items {
+				line := order.Items[i : i+1]
+				if err := releaseStock(ctx, line); err != nil {
+					return fail(err)
+				}
+				undo = append(undo, func() error { return reserveStock(ctx, line) })
+			}
+		}
+		if order.StoreCredit > 0 && order.UserID != nil {
+			refund := CreditMovement{UserID: *order.UserID, Amount: order.StoreCredit, Reason: creditReasonOrderCanceled, OrderID: &order.ID}
+			if err := moveCredit(ctx, refund); err != nil {
+				return fail(err)
+			}
+		}
+		return nil
+	})
+	if err == nil {
+		notifyStatusChange(ctx, order)
+	}
+	if errors.Is(err, errIllegalTransition) && order.Status == orderStatusCancelled {
+		return order, nil
+	}
+	return order, err
+}
+
+// handleCancelOrder cancels ?id= for the customer who placed it or an admin.
+func handleCancelOrder(w http.ResponseWriter, r *http.Request) {
+	id, ok := parseObjectID(w, r)
+	if !ok {
+		return
+	}
+	if _, ok := findOrder(w, r, bson.M{"_id": id}); !ok {
+		return
+	}
+
+	order, err := cancelOrder(r.Context(), id)
+	switch {
+	case errors.Is(err, errIllegalTransition):
+		writeTransitionConflict(w, order, orderStatusCancelled)
+	case errors.Is(err, mongo.ErrNoDocuments):
+		writeJSONError(w, http.StatusNotFound, "Order not found")
+	case err != nil:
+		fmt.Println("Error cancelling order:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to cancel order")
+	default:
+		writeJSON(w, http.StatusOK, order)
+	}
+}
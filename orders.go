@@ -0,0 +1,551 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const orderStatusPending = "pending"
+
+type Customer struct {
+	Name  string `json:"name" bson:"name"`
+	Email string `json:"email,omitempty" bson:"email,omitempty"`
+	Age   int    `json:"age,omitempty" bson:"age,omitempty"`
+}
+
+type OrderItem struct {
+	FurnitureID int                 `json:"furniture_id" bson:"furniture_id"`
+	VariantID   string              `json:"variant_id,omitempty" bson:"variant_id,omitempty"`
+	Quantity    int                 `json:"quantity" bson:"quantity"`
+	UnitPrice   float64             `json:"unit_price" bson:"unit_price"`
+	PromotionID *primitive.ObjectID `json:"promotion_id,omitempty" bson:"promotion_id,omitempty"`
+}
+
+type Order struct {
+	ID       primitive.ObjectID  `json:"id" bson:"_id,omitempty"`
+	Number   string              `json:"number" bson:"number"`
+	UserID   *primitive.ObjectID `json:"user_id,omitempty" bson:"user_id,omitempty"`
+	Customer Customer            `json:"customer" bson:"customer"`
+	// ShippingAddress is a copy of the user's address as it was when the
+	// order was placed.
+	ShippingAddress *Address            `json:"shipping_address,omitempty" bson:"shipping_address,omitempty"`
+	Items           []OrderItem         `json:"items" bson:"items"`
+	Subtotal        float64             `json:"subtotal" bson:"subtotal"`
+	CouponID        *primitive.ObjectID `json:"coupon_id,omitempty" bson:"coupon_id,omitempty"`
+	CouponCode      string              `json:"coupon_code,omitempty" bson:"coupon_code,omitempty"`
+	Discount        float64             `json:"discount,omitempty" bson:"discount,omitempty"`
+	StoreCredit     float64             `json:"store_credit,omitempty" bson:"store_credit,omitempty"`
+	Total           float64             `json:"total" bson:"total"`
+	Status          string              `json:"status" bson:"status"`
+	StatusHistory   []StatusChange      `json:"status_history" bson:"status_history"`
+	CreatedAt       time.Time           `json:"created_at" bson:"created_at"`
+	UpdatedAt       time.Time           `json:"updated_at" bson:"updated_at"`
+
+	// StockReserved records whether stock was taken for the items, so that
+	// cancelling only gives back what was actually taken.
+	StockReserved bool `json:"-" bson:"stock_reserved"`
+	// ReturnsVersion is bumped with every return recorded against the order.
+	ReturnsVersion int `json:"-" bson:"returns_version"`
+}
+
+// maxLineQuantity caps how many units of one item a single order line may
+// request.
+var maxLineQuantity = 50
+
+// totalEpsilon is how far a client-supplied total may drift from the server's
+// own calculation before the order is refused.
+const totalEpsilon = 0.005
+
+type orderRequest struct {
+	// UserID may only name the caller; an authenticated caller's orders are
+	// theirs whether or not it is sent.
+	UserID   *primitive.ObjectID `json:"user_id"`
+	Customer Customer            `json:"customer"`
+	Items    []OrderItem         `json:"items"`
+	Total    *float64            `json:"total"`
+	// AddressID picks one of the user's addresses to ship to.
+	AddressID *primitive.ObjectID `json:"address_id"`
+	// CartID names the reservation to turn into this order, if any.
+	CartID         string `json:"cart_id"`
+	CouponCode     string `json:"coupon_code"`
+	UseStoreCredit bool   `json:"use_store_credit"`
+}
+
+func (req *orderRequest) furnitureIDs() []int {
+	ids := make([]int, len(req.Items))
+	for i, item := range req.Items {
+		ids[i] = item.FurnitureID
+	}
+	return ids
+}
+
+func createOrderIndexes() error {
+	_, err := database.Collection(ordersCollectionName).Indexes().CreateMany(context.TODO(), []mongo.IndexModel{
+		{Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "created_at", Value: -1}}},
+		{
+			Keys: bson.D{{Key: "number", Value: 1}},
+			Options: options.Index().
+				SetUnique(true).
+				SetPartialFilterExpression(bson.M{"number": bson.M{"$type": "string"}}),
+		},
+	})
+	return err
+}
+
+// nextOrderNumber returns a number like ORD-2024-000123. Each year has its own
+// counter, advanced atomically, so concurrent orders never share a number.
+func nextOrderNumber(ctx context.Context, now time.Time) (string, error) {
+	year := now.Year()
+	seq, err := nextSequence(ctx, fmt.Sprintf("order_number_%d", year))
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("ORD-%d-%06d", year, seq), nil
+}
+
+func userExists(ctx context.Context, id primitive.ObjectID) (bool, error) {
+	count, err := database.Collection(collectionName).CountDocuments(ctx, activeUserByID(id))
+	return count > 0, err
+}
+
+// loadFurniture fetches the items with the given IDs, keyed by ID. Soft-deleted
+// items are included so callers can tell them apart from unknown IDs.
+func loadFurniture(ctx context.Context, ids []int) (map[int]Furniture, error) {
+	cursor, err := database.Collection(furnitureCollectionName).Find(ctx, bson.M{"_id": bson.M{"$in": ids}})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var items []Furniture
+	if err := cursor.All(ctx, &items); err != nil {
+		return nil, err
+	}
+	byID := make(map[int]Furniture, len(items))
+	for _, item := range items {
+		byID[item.ID] = item
+	}
+	return byID, nil
+}
+
+// validate checks the order against the catalogue and reports every problem
+// as a field error.
+func (req *orderRequest) validate(catalogue map[int]Furniture) []fieldError {
+	var v validator
+
+	req.Customer.Name = strings.TrimSpace(req.Customer.Name)
+	req.Customer.Email = strings.TrimSpace(req.Customer.Email)
+	v.required("customer.name", req.Customer.Name)
+	if req.Customer.Email != "" {
+		v.email("customer.email", req.Customer.Email)
+	}
+	v.intRange("customer.age", req.Customer.Age, 0, maxUserAge)
+	v.check(len(req.Items) > 0, "items", ruleRequired, "an order needs at least one item")
+
+	for i, item := range req.Items {
+		prefix := "items[" + strconv.Itoa(i) + "]."
+		furniture, ok := catalogue[item.FurnitureID]
+		switch {
+		case !ok:
+			v.check(false, prefix+"furniture_id", ruleReference, fmt.Sprintf("unknown furniture ID %d", item.FurnitureID))
+		case furniture.DeletedAt != nil:
+			v.check(false, prefix+"furniture_id", ruleReference, fmt.Sprintf("furniture %d is no longer available", item.FurnitureID))
+		case item.VariantID != "" && furniture.variant(item.VariantID) == nil:
+			v.check(false, prefix+"variant_id", ruleReference, "unknown variant for this furniture")
+		}
+		if v.check(item.Quantity >= 1, prefix+"quantity", ruleMin, "quantity must be at least 1") {
+			v.check(item.Quantity <= maxLineQuantity, prefix+"quantity", ruleMax, fmt.Sprintf("quantity must be at most %d", maxLineQuantity))
+		}
+	}
+	return v.errs
+}
+
+// priceItems sets each line's unit price from the catalogue, applying the
+// best active promotion, and returns the order total. Client-supplied prices
+// are never trusted.
+func priceItems(items []OrderItem, catalogue map[int]Furniture, promotions []Promotion) float64 {
+	var totalCents float64
+	for i := range items {
+		furniture := catalogue[items[i].FurnitureID]
+		price := furniture.Price
+		if variant := furniture.variant(items[i].VariantID); variant != nil {
+			price += variant.PriceDelta
+		}
+		items[i].PromotionID = nil
+		if promotion := bestPromotion(promotions, furniture); promotion != nil {
+			price = promotion.discount(price)
+			items[i].PromotionID = &promotion.ID
+		}
+		items[i].UnitPrice = math.Round(price*100) / 100
+		totalCents += math.Round(items[i].UnitPrice*100) * float64(items[i].Quantity)
+	}
+	return totalCents / 100
+}
+
+func handlePostOrder(w http.ResponseWriter, r *http.Request) {
+	var req orderRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+
+	order, catalogue, ok := prepareOrder(w, r, &req)
+	if !ok {
+		return
+	}
+
+	if req.Total != nil && math.Abs(*req.Total-order.Total) > totalEpsilon {
+		writeErrorDetails(w, http.StatusConflict, "total_mismatch", "Order total does not match current prices",
+			[]map[string]float64{{"client_total": *req.Total, "computed_total": order.Total}})
+		return
+	}
+
+	completeOrder(w, r, &order, catalogue, req.CartID)
+}
+
+// prepareOrder validates req and builds the priced, not yet stored order. On
+// failure the response has been written and ok is false.
+func prepareOrder(w http.ResponseWriter, r *http.Request, req *orderRequest) (order Order, catalogue map[int]Furniture, ok bool) {
+	if callerID, authenticated := authenticatedUserID(r.Context()); authenticated {
+		if req.UserID != nil && *req.UserID != callerID {
+			writeJSONError(w, http.StatusForbidden, "You may only place orders for your own account")
+			return order, nil, false
+		}
+		req.UserID = &callerID
+	} else if req.UserID != nil {
+		writeUnauthorized(w, "Authentication required to order for an account")
+		return order, nil, false
+	}
+
+	catalogue, err := loadFurniture(r.Context(), req.furnitureIDs())
+	if err != nil {
+		fmt.Println("Error loading order furniture:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to submit order")
+		return order, nil, false
+	}
+	errs := req.validate(catalogue)
+	var shippingAddress *Address
+	if req.UserID != nil {
+		var user User
+		err := database.Collection(collectionName).FindOne(r.Context(), activeUserByID(*req.UserID)).Decode(&user)
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			errs = append(errs, fieldError{Field: "user_id", Rule: ruleReference, Message: "unknown user"})
+		} else if err != nil {
+			fmt.Println("Error looking up order user:", err)
+			writeJSONError(w, http.StatusInternalServerError, "Failed to submit order")
+			return order, nil, false
+		} else if user.needsVerification() {
+			writeJSONError(w, http.StatusForbidden, "Verify your email address before placing orders")
+			return order, nil, false
+		} else if req.AddressID != nil {
+			if address := user.address(*req.AddressID); address != nil {
+				snapshot := *address
+				shippingAddress = &snapshot
+			} else {
+				errs = append(errs, fieldError{Field: "address_id", Rule: ruleReference, Message: "unknown address for this user"})
+			}
+		}
+	} else if req.AddressID != nil {
+		errs = append(errs, fieldError{Field: "address_id", Rule: ruleReference, Message: "address_id needs a signed-in user"})
+	}
+	if len(errs) > 0 {
+		writeValidationErrors(w, "Order is invalid", errs)
+		return order, nil, false
+	}
+
+	promotions, err := activePromotions(r.Context(), time.Now())
+	if err != nil {
+		fmt.Println("Error loading promotions:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to submit order")
+		return order, nil, false
+	}
+
+	order = Order{
+		UserID:          req.UserID,
+		Customer:        req.Customer,
+		ShippingAddress: shippingAddress,
+		Items:           req.Items,
+		Status:          orderStatusPending,
+		CreatedAt:       time.Now(),
+	}
+	order.UpdatedAt = order.CreatedAt
+	order.StatusHistory = []StatusChange{{Status: order.Status, ChangedAt: order.CreatedAt}}
+	order.Subtotal = priceItems(order.Items, catalogue, promotions)
+	order.Total = order.Subtotal
+
+	if strings.TrimSpace(req.CouponCode) != "" {
+		coupon, err := findApplicableCoupon(r.Context(), req.CouponCode, order.Subtotal)
+		var couponErr *couponError
+		if errors.As(err, &couponErr) {
+			writeCouponError(w, couponErr)
+			return order, nil, false
+		}
+		if err != nil {
+			fmt.Println("Error loading coupon:", err)
+			writeJSONError(w, http.StatusInternalServerError, "Failed to submit order")
+			return order, nil, false
+		}
+		order.CouponID = &coupon.ID
+		order.CouponCode = coupon.Code
+		order.Discount = coupon.discountOn(order.Subtotal)
+		order.Total = math.Round((order.Subtotal-order.Discount)*100) / 100
+	}
+
+	if req.UseStoreCredit {
+		// req.UserID is the caller by now, so only they can spend it.
+		if req.UserID == nil {
+			writeUnauthorized(w, "Authentication required to use store credit")
+			return order, nil, false
+		}
+		balance, err := creditBalance(r.Context(), *req.UserID)
+		if err != nil {
+			fmt.Println("Error loading store credit:", err)
+			writeJSONError(w, http.StatusInternalServerError, "Failed to submit order")
+			return order, nil, false
+		}
+		order.StoreCredit = roundCents(math.Min(balance, order.Total))
+		order.Total = roundCents(order.Total - order.StoreCredit)
+	}
+	return order, catalogue, true
+}
+
+// completeOrder places a prepared order, then announces it and answers 201.
+func completeOrder(w http.ResponseWriter, r *http.Request, order *Order, catalogue map[int]Furniture, cartID string) {
+	// Stock held by other carts is not for sale; this cart's own hold is.
+	shortages, err := checkAvailability(r.Context(), order.Items, catalogue, cartID)
+	if err != nil {
+		fmt.Println("Error checking availability:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to submit order")
+		return
+	}
+	if len(shortages) > 0 {
+		writeStockShortage(w, shortages)
+		return
+	}
+
+	err = placeOrder(r.Context(), order, cartID)
+	var shortage *stockShortageError
+	if errors.As(err, &shortage) {
+		writeStockShortage(w, shortage.Shortages)
+		return
+	}
+	var couponErr *couponError
+	if errors.As(err, &couponErr) {
+		writeCouponError(w, couponErr)
+		return
+	}
+	if errors.Is(err, errCreditChanged) {
+		writeJSONError(w, http.StatusConflict, "Store credit balance changed, please review the order and try again")
+		return
+	}
+	if err != nil {
+		fmt.Println("Error placing order:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to submit order")
+		return
+	}
+
+	recordOrderCreated(*order)
+	confirmed := *order
+	goBackgroundFor(r.Context(), func(ctx context.Context) { sendOrderConfirmation(ctx, confirmed, catalogue) })
+	publishOrderEvent(r.Context(), webhookEventOrderCreated, *order)
+
+	writeJSON(w, http.StatusCreated, map[string]interface{}{
+		"status":       strconv.Itoa(http.StatusCreated),
+		"message":      "Order received successfully",
+		"order_id":     order.ID.Hex(),
+		"order_number": order.Number,
+		"total":        order.Total,
+	})
+}
+
+// placeOrder takes stock for every line, redeems the coupon and store credit,
+// numbers the order and inserts it as one unit. The number is taken last, so
+// an order turned away for stock, coupon or credit does not use one up. With a replica set all of it happens in
+// a transaction. On a standalone server each step is guarded on its own and
+// the steps already taken are undone when a later one fails, so an order is
+// never half-written either way. The cart's reservation, if any, is consumed
+// by the permanent decrement, and the cart itself is emptied.
+func placeOrder(ctx context.Context, order *Order, cartID string) error {
+	order.ID = primitive.NewObjectID()
+	order.StockReserved = true
+	return withTransaction(ctx, func(ctx context.Context) error {
+		var undo []func() error
+		fail := func(err error) error {
+			undoSteps("order", undo)
+			return err
+		}
+
+		if err := reserveStock(ctx, order.Items); err != nil {
+			return err
+		}
+		undo = append(undo, func() error { return releaseStock(ctx, order.Items) })
+
+		if order.CouponID != nil {
+			if err := redeemCoupon(ctx, *order.CouponID); err != nil {
+				return fail(err)
+			}
+			undo = append(undo, func() error { return unredeemCoupon(ctx, *order.CouponID) })
+		}
+
+		if order.StoreCredit > 0 {
+			spend := CreditMovement{UserID: *order.UserID, Amount: -order.StoreCredit, Reason: creditReasonOrder, OrderID: &order.ID}
+			if err := moveCredit(ctx, spend); err != nil {
+				return fail(err)
+			}
+			undo = append(undo, func() error {
+				refund := CreditMovement{UserID: *order.UserID, Amount: order.StoreCredit, Reason: creditReasonOrderCanceled, OrderID: &order.ID}
+				return moveCredit(ctx, refund)
+			})
+		}
+
+		number, err := nextOrderNumber(ctx, order.CreatedAt)
+		if err != nil {
+			return fail(err)
+		}
+		order.Number = number
+
+		if _, err := database.Collection(ordersCollectionName).InsertOne(ctx, order); err != nil {
+			return fail(err)
+		}
+		if cartID == "" {
+			return nil
+		}
+		// Without a transaction the order is already written; a hold or cart
+		// left behind must not make it look as if the order failed.
+		err = releaseReservations(ctx, cartID)
+		if err == nil {
+			err = clearCart(ctx, cartID)
+		}
+		if err != nil && !transactionsSupported {
+			fmt.Println("Error releasing cart of placed order:", err)
+			return nil
+		}
+		return err
+	})
+}
+
+// findOrder loads the order matching filter if the caller may see it (see
+// authorizeOrder). Otherwise it answers and ok is false.
+func findOrder(w http.ResponseWriter, r *http.Request, filter bson.M) (order Order, ok bool) {
+	err := database.Collection(ordersCollectionName).FindOne(r.Context(), filter).Decode(&order)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		writeJSONError(w, http.StatusNotFound, "Order not found")
+		return order, false
+	}
+	if err != nil {
+		fmt.Println("Error loading order:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to load order")
+		return order, false
+	}
+	return order, authorizeOrder(w, r, order)
+}
+
+// handleOrders returns one order to the customer who placed it or an admin.
+// Listing orders is /users/orders for customers and /admin/orders for
+// staff.
+func handleOrders(w http.ResponseWriter, r *http.Request) {
+	id, ok := parseObjectID(w, r)
+	if !ok {
+		return
+	}
+	order, ok := findOrder(w, r, bson.M{"_id": id})
+	if !ok {
+		return
+	}
+
+	writeJSON(w, http.StatusOK, order)
+}
+
+// getOrderByNumber is handleOrders by ?number=. The numbers are sequential,
+// so the same owner-or-admin check matters even more here.
+func getOrderByNumber(w http.ResponseWriter, r *http.Request) {
+	number := strings.ToUpper(strings.TrimSpace(r.URL.Query().Get("number")))
+	if number == "" {
+		writeJSONError(w, http.StatusBadRequest, "number is required")
+		return
+	}
+	order, ok := findOrder(w, r, bson.M{"number": number})
+	if !ok {
+		return
+	}
+
+	writeJSON(w, http.StatusOK, order)
+}
+
+// getUserOrders lists a user's orders, newest first. Orders placed without a
+// user never show up here.
+func getUserOrders(w http.ResponseWriter, r *http.Request) {
+	userID, ok := parseObjectID(w, r)
+	if !ok || !authorizeUser(w, r, userID) {
+		return
+	}
+	page, err := parsePagination(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	filter := bson.M{"user_id": userID}
+	if status := r.URL.Query().Get("status"); status != "" {
+		if _, known := orderTransitions[status]; !known {
+			writeJSONError(w, http.StatusBadRequest, "status must be one of pending, confirmed, shipped, delivered, cancelled")
+			return
+		}
+		filter["status"] = status
+	}
+
+	exists, err := userExists(r.Context(), userID)
+	if err != nil {
+		fmt.Println("Error looking up user:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to load orders")
+		return
+	}
+	if !exists {
+		writeJSONError(w, http.StatusNotFound, "User not found")
+		return
+	}
+
+	ordersCollection := database.Collection(ordersCollectionName)
+	total, err := ordersCollection.CountDocuments(r.Context(), filter)
+	if err != nil {
+		fmt.Println("Error counting orders:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to load orders")
+		return
+	}
+
+	opts := options.Find().
+		SetSort(bson.D{{Key: "created_at", Value: -1}, {Key: "_id", Value: -1}}).
+		SetSkip(page.skip()).
+		SetLimit(int64(page.Limit))
+	cursor, err := ordersCollection.Find(r.Context(), filter, opts)
+	if err != nil {
+		fmt.Println("Error querying orders:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to load orders")
+		return
+	}
+	defer cursor.Close(r.Context())
+
+	orders := []Order{}
+	if err := cursor.All(r.Context(), &orders); err != nil {
+		fmt.Println("Error decoding orders:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to load orders")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, pageResponse{
+		Items:      orders,
+		Total:      total,
+		Page:       page.Page,
+		TotalPages: page.totalPages(total),
+	})
+}
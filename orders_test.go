@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestConcurrentOrdersGetUniqueGaplessNumbers(t *testing.T) {
+	limiter := orderLimiter
+	orderLimiter = nil
+	t.Cleanup(func() { orderLimiter = limiter })
+	h, db := testServer(t)
+	const orders = 100
+	item := Furniture{ID: 1, Name: "Chair", Price: 25, Stock: orders}
+	if _, err := db.Collection(furnitureCollectionName).InsertOne(context.Background(), item); err != nil {
+		t.Fatalf("insert: %v", err)
+	}
+
+	numbers := make([]string, orders)
+	var wg sync.WaitGroup
+	for i := 0; i < orders; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			body := fmt.Sprintf(`{"customer":{"name":"Guest %d"},"items":[{"furniture_id":1,"quantity":1}]}`, i)
+			rec := serveTest(h, http.MethodPost, "/submitOrder", "", body)
+			if rec.Code != http.StatusCreated {
+				t.Errorf("POST /submitOrder = %d: %s", rec.Code, rec.Body)
+				return
+			}
+			var placed struct {
+				Number string `json:"order_number"`
+			}
+			if err := json.Unmarshal(rec.Body.Bytes(), &placed); err != nil {
+				t.Errorf("decode: %v", err)
+				return
+			}
+			numbers[i] = placed.Number
+		}(i)
+	}
+	wg.Wait()
+	if t.Failed() {
+		return
+	}
+
+	sort.Strings(numbers)
+	year := time.Now().Year()
+	for i, number := range numbers {
+		if want := fmt.Sprintf("ORD-%d-%06d", year, i+1); number != want {
+			t.Fatalf("numbers[%d] = %q, want %q; numbers must be unique and gapless", i, number, want)
+		}
+	}
+
+	var left Furniture
+	if err := db.Collection(furnitureCollectionName).FindOne(context.Background(), bson.M{"_id": 1}).Decode(&left); err != nil {
+		t.Fatalf("load furniture: %v", err)
+	}
+	if left.Stock != 0 {
+		t.Errorf("stock = %d after %d orders of one, want 0", left.Stock, orders)
+	}
+}
+
+func TestNextOrderNumberRestartsEachYear(t *testing.T) {
+	_, _ = testServer(t)
+	ctx := context.Background()
+	for _, tt := range []struct {
+		year int
+		want string
+	}{
+		{2024, "ORD-2024-000001"},
+		{2024, "ORD-2024-000002"},
+		{2025, "ORD-2025-000001"},
+		{2024, "ORD-2024-000003"},
+	} {
+		got, err := nextOrderNumber(ctx, time.Date(tt.year, 6, 1, 0, 0, 0, 0, time.UTC))
+		if err != nil {
+			t.Fatalf("nextOrderNumber: %v", err)
+		}
+		if got != tt.want {
+			t.Errorf("nextOrderNumber(%d) = %q, want %q", tt.year, got, tt.want)
+		}
+	}
+}
+
+func TestRejectedOrdersDoNotUseUpNumbers(t *testing.T) {
+	h, db := testServer(t)
+	item := Furniture{ID: 1, Name: "Chair", Price: 25, Stock: 1}
+	if _, err := db.Collection(furnitureCollectionName).InsertOne(context.Background(), item); err != nil {
+		t.Fatalf("insert: %v", err)
+	}
+
+	order := func(quantity int) *httptest.ResponseRecorder {
+		body := fmt.Sprintf(`{"customer":{"name":"Guest"},"items":[{"furniture_id":1,"quantity":%d}]}`, quantity)
+		return serveTest(h, http.MethodPost, "/submitOrder", "", body)
+	}
+	for i := 0; i < 3; i++ {
+		if rec := order(2); rec.Code != http.StatusConflict {
+			t.Fatalf("order of 2 with 1 in stock = %d, want 409: %s", rec.Code, rec.Body)
+		}
+	}
+	rec := order(1)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("POST /submitOrder = %d: %s", rec.Code, rec.Body)
+	}
+	var placed struct {
+		Number string `json:"order_number"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &placed); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if want := fmt.Sprintf("ORD-%d-000001", time.Now().Year()); placed.Number != want {
+		t.Errorf("number = %q, want %q after only rejected orders", placed.Number, want)
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	outboxStatusPending = "pending"
+	outboxStatusSent    = "sent"
+	outboxStatusFailed  = "failed"
+
+	maxEmailAttempts   = 6
+	outboxPollInterval = time.Minute
+	// outboxLease keeps a message claimed while one worker is sending it.
+	outboxLease = 2 * time.Minute
+)
+
+// outboxEmail is a rendered message together with its delivery state. Every
+// message goes through the outbox, so a crash or a mail server outage delays
+// it instead of losing it.
+type outboxEmail struct {
+	ID            primitive.ObjectID `bson:"_id"`
+	Message       emailMessage       `bson:"message"`
+	Status        string             `bson:"status"`
+	Attempts      int                `bson:"attempts"`
+	LastError     string             `bson:"last_error,omitempty"`
+	NextAttemptAt time.Time          `bson:"next_attempt_at"`
+	CreatedAt     time.Time          `bson:"created_at"`
+	SentAt        *time.Time         `bson:"sent_at,omitempty"`
+}
+
+func createOutboxIndexes() error {
+	_, err := database.Collection(emailOutboxCollectionName).Indexes().CreateOne(context.TODO(), mongo.IndexModel{
+		Keys: bson.D{{Key: "status", Value: 1}, {Key: "next_attempt_at", Value: 1}},
+	})
+	return err
+}
+
+// emailRetryDelay backs off exponentially from one minute, capped at an hour.
+func emailRetryDelay(attempts int) time.Duration {
+	delay := time.Minute << (attempts - 1)
+	if delay > time.Hour || delay <= 0 {
+		delay = time.Hour
+	}
+	return delay
+}
+
+// enqueueEmail stores msg and makes a first delivery attempt right away. The
+// message is tagged with the request ID in ctx, if any.
+func enqueueEmail(ctx context.Context, msg emailMessage) error {
+	if msg.RequestID == "" {
+		msg.RequestID = requestIDFrom(ctx)
+	}
+	now := time.Now()
+	entry := outboxEmail{
+		ID:            primitive.NewObjectID(),
+		Message:       msg,
+		Status:        outboxStatusPending,
+		NextAttemptAt: now.Add(outboxLease),
+		CreatedAt:     now,
+	}
+	if _, err := database.Collection(emailOutboxCollectionName).InsertOne(ctx, entry); err != nil {
+		return err
+	}
+	deliverEmail(ctx, entry)
+	return nil
+}
+
+// deliverEmail sends a claimed message and records the outcome.
+func deliverEmail(ctx context.Context, entry outboxEmail) {
+	now := time.Now()
+	entry.Attempts++
+	set := bson.M{"attempts": entry.Attempts}
+
+	_, send := startSpan(ctx, "smtp send", spanKindClient)
+	send.setAttr("email.attempt", entry.Attempts)
+	if err := emailSender.send(entry.Message); err != nil {
+		send.fail(err.Error())
+		fmt.Println("Error sending email to", entry.Message.To+":", err)
+		set["last_error"] = err.Error()
+		if entry.Attempts >= maxEmailAttempts {
+			set["status"] = outboxStatusFailed
+		} else {
+			set["next_attempt_at"] = now.Add(emailRetryDelay(entry.Attempts))
+		}
+	} else {
+		set["status"] = outboxStatusSent
+		set["sent_at"] = now
+	}
+	send.end()
+
+	_, err := database.Collection(emailOutboxCollectionName).UpdateByID(ctx, entry.ID, bson.M{"$set": set})
+	if err != nil {
+		fmt.Println("Error updating email outbox:", err)
+	}
+}
+
+// claimDueEmail takes the next pending message whose retry time has come and
+// pushes its retry time out by the lease, so overlapping workers never send
+// the same message twice.
+func claimDueEmail(ctx context.Context) (outboxEmail, bool, error) {
+	now := time.Now()
+	var entry outboxEmail
+	err := database.Collection(emailOutboxCollectionName).FindOneAndUpdate(ctx,
+		bson.M{"status": outboxStatusPending, "next_attempt_at": bson.M{"$lte": now}},
+		bson.M{"$set": bson.M{"next_attempt_at": now.Add(outboxLease)}},
+		options.FindOneAndUpdate().SetSort(bson.D{{Key: "next_attempt_at", Value: 1}}).SetReturnDocument(options.After),
+	).Decode(&entry)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return outboxEmail{}, false, nil
+	}
+	if err != nil {
+		return outboxEmail{}, false, err
+	}
+	return entry, true, nil
+}
+
+// retryOutboxPeriodically works through due messages until ctx is cancelled.
+func retryOutboxPeriodically(ctx context.Context) {
+	ticker := time.NewTicker(outboxPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		for {
+			entry, ok, err := claimDueEmail(ctx)
+			if err != nil {
+				fmt.Println("Error reading email outbox:", err)
+				break
+			}
+			if !ok {
+				break
+			}
+			deliverEmail(ctx, entry)
+		}
+	}
+}
+
+// sendOrderConfirmation queues the confirmation email of a freshly placed
+// order. It runs outside the request, so it only takes the request ID from
+// ctx and is not cut short by a shutdown.
+func sendOrderConfirmation(ctx context.Context, order Order, catalogue map[int]Furniture) {
+	if order.Customer.Email == "" {
+		return
+	}
+	msg, err := orderConfirmationEmail(order, catalogue)
+	if err != nil {
+		fmt.Println("Error rendering order confirmation:", err)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), time.Minute)
+	defer cancel()
+	if err := enqueueEmail(ctx, msg); err != nil {
+		fmt.Println("Error queueing order confirmation:", err)
+	}
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	htmltemplate "html/template"
+	"net/http"
+	"strings"
+	texttemplate "text/template"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const passwordResetTTL = time.Hour
+
+// publicBaseURL is where links in emails point, from PUBLIC_BASE_URL.
+var publicBaseURL = "http://localhost:8080"
+
+type passwordReset struct {
+	ID        primitive.ObjectID `bson:"_id,omitempty"`
+	UserID    primitive.ObjectID `bson:"user_id"`
+	TokenHash string             `bson:"token_hash"`
+	ExpiresAt time.Time          `bson:"expires_at"`
+	CreatedAt time.Time          `bson:"created_at"`
+	UsedAt    *time.Time         `bson:"used_at,omitempty"`
+}
+
+func createPasswordResetIndexes() error {
+	_, err := database.Collection(passwordResetsCollectionName).Indexes().CreateMany(context.TODO(), []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "token_hash", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+		{Keys: bson.D{{Key: "user_id", Value: 1}}},
+		{
+			Keys:    bson.D{{Key: "expires_at", Value: 1}},
+			Options: options.Index().SetExpireAfterSeconds(0),
+		},
+	})
+	return err
+}
+
+// linkEmailData fills emails whose point is a single link.
+type linkEmailData struct {
+	Name string
+	Link string
+}
+
+var passwordResetText = texttemplate.Must(texttemplate.New("text").Parse(`Hello {{.Name}},
+
+someone asked to reset the password of your Online Furniture Shop account. Follow this link within an hour to choose a new one:
+
+{{.Link}}
+
+If that was not you, ignore this email; your password stays as it is.
+
+Online Furniture Shop
+`))
+
+var passwordResetHTML = htmltemplate.Must(htmltemplate.New("html").Parse(`<!DOCTYPE html>
+<html>
+<body>
+<p>Hello {{.Name}},</p>
+<p>someone asked to reset the password of your Online Furniture Shop account. Follow this link within an hour to choose a new one:</p>
+<p><a href="{{.Link}}">Reset your password</a></p>
+<p>If that was not you, ignore this email; your password stays as it is.</p>
+<p>Online Furniture Shop</p>
+</body>
+</html>
+`))
+
+func passwordResetEmail(user User, token string) (emailMessage, error) {
+	data := linkEmailData{Name: user.Name, Link: publicBaseURL + "/reset-password?token=" + token}
+	var text, html bytes.Buffer
+	if err := passwordResetText.Execute(&text, data); err != nil {
+		return emailMessage{}, err
+	}
+	if err := passwordResetHTML.Execute(&html, data); err != nil {
+		return emailMessage{}, err
+	}
+	return emailMessage{
+		To:      user.Email,
+		Subject: "Reset your password",
+		Text:    text.String(),
+		HTML:    html.String(),
+	}, nil
+}
+
+// sendPasswordReset issues a reset token for the account with email, if
+// there is one, and mails it. It runs outside the request so the response
+// does not take longer for existing accounts.
+func sendPasswordReset(ctx context.Context, email string) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), time.Minute)
+	defer cancel()
+
+	var user User
+	err := database.Collection(collectionName).FindOne(ctx, bson.M{
+		"email":         email,
+		"deleted_at":    nil,
+		"password_hash": bson.M{"$exists": true},
+	}).Decode(&user)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return
+	}
+	if err != nil {
+		fmt.Println("Error looking up account for password reset:", err)
+		return
+	}
+
+	token, err := newSecretToken()
+	if err != nil {
+		fmt.Println("Error generating password reset token:", err)
+		return
+	}
+	now := time.Now()
+	_, err = database.Collection(passwordResetsCollectionName).InsertOne(ctx, passwordReset{
+		UserID:    user.ID,
+		TokenHash: hashToken(token),
+		ExpiresAt: now.Add(passwordResetTTL),
+		CreatedAt: now,
+	})
+	if err != nil {
+		fmt.Println("Error storing password reset token:", err)
+		return
+	}
+
+	msg, err := passwordResetEmail(user, token)
+	if err != nil {
+		fmt.Println("Error rendering password reset email:", err)
+		return
+	}
+	if err := enqueueEmail(ctx, msg); err != nil {
+		fmt.Println("Error queueing password reset email:", err)
+	}
+}
+
+// handleForgotPassword answers the same way whether or not the email
+// belongs to an account.
+func handleForgotPassword(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Email string `json:"email"`
+	}
+	if !decodeJSON(w, r, &body) {
+		return
+	}
+	if email := strings.ToLower(strings.TrimSpace(body.Email)); email != "" {
+		goBackgroundFor(r.Context(), func(ctx context.Context) { sendPasswordReset(ctx, email) })
+	}
+	writeJSON(w, http.StatusAccepted, map[string]string{
+		"message": "If an account with this email exists, a reset link has been sent to it",
+	})
+}
+
+// handleResetPassword sets a new password with a token from
+// handleForgotPassword. The token is spent in the same update that checks
+// it, and every refresh token and session of the user is revoked afterwards.
+func handleResetPassword(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Token    string `json:"token"`
+		Password string `json:"password"`
+	}
+	if !decodeJSON(w, r, &body) {
+		return
+	}
+	var errs []fieldError
+	if body.Token == "" {
+		errs = append(errs, fieldError{Field: "token", Message: "token is required"})
+	}
+	if message := validatePassword(body.Password); message != "" {
+		errs = append(errs, fieldError{Field: "password", Message: message})
+	}
+	if len(errs) > 0 {
+		writeValidationErrors(w, "Password reset is invalid", errs)
+		return
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(body.Password), bcrypt.DefaultCost)
+	if err != nil {
+		fmt.Println("Error hashing password:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to reset password")
+		return
+	}
+
+	now := time.Now()
+	resets := database.Collection(passwordResetsCollectionName)
+	var reset passwordReset
+	err = resets.FindOneAndUpdate(r.Context(), bson.M{
+		"token_hash": hashToken(body.Token),
+		"used_at":    bson.M{"$exists": false},
+		"expires_at": bson.M{"$gt": now},
+	}, bson.M{"$set": bson.M{"used_at": now}}).Decode(&reset)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		writeJSONError(w, http.StatusBadRequest, "Reset token is invalid or has expired")
+		return
+	}
+	if err != nil {
+		fmt.Println("Error redeeming password reset token:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to reset password")
+		return
+	}
+
+	err = withTransaction(r.Context(), func(ctx context.Context) error {
+		result, err := database.Collection(collectionName).UpdateOne(ctx,
+			activeUserByID(reset.UserID),
+			bson.M{"$set": bson.M{"password_hash": string(hash), "updated_at": now}},
+		)
+		if err != nil {
+			return err
+		}
+		if result.MatchedCount == 0 {
+			return mongo.ErrNoDocuments
+		}
+		// Other links sent before this one must not work either.
+		_, err = resets.UpdateMany(ctx,
+			bson.M{"user_id": reset.UserID, "used_at": bson.M{"$exists": false}},
+			bson.M{"$set": bson.M{"used_at": now}},
+		)
+		if err != nil {
+			return err
+		}
+		if err := revokeUserRefreshTokens(ctx, reset.UserID); err != nil {
+			return err
+		}
+		return deleteUserSessions(ctx, reset.UserID)
+	})
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		writeJSONError(w, http.StatusNotFound, "User not found")
+		return
+	}
+	if err != nil {
+		fmt.Println("Error resetting password:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to reset password")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
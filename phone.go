@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// E.164 numbers are at most 15 digits; the shortest in use, on small
+// islands, have 7.
+const (
+	minPhoneDigits = 7
+	maxPhoneDigits = 15
+)
+
+// phoneCountryCodes holds the assigned ITU country calling codes. No code is
+// the prefix of another, so a number matches at most one.
+var phoneCountryCodes = map[string]bool{}
+
+func init() {
+	for _, code := range strings.Fields(`
+		1 7 20 27 30 31 32 33 34 36 39 40 41 43 44 45 46 47 48 49 51 52 53 54 55
+		56 57 58 60 61 62 63 64 65 66 81 82 84 86 90 91 92 93 94 95 98
+		211 212 213 216 218 220 221 222 223 224 225 226 227 228 229 230 231 232
+		233 234 235 236 237 238 239 240 241 242 243 244 245 246 247 248 249 250
+		251 252 253 254 255 256 257 258 260 261 262 263 264 265 266 267 268 269
+		290 291 297 298 299 350 351 352 353 354 355 356 357 358 359 370 371 372
+		373 374 375 376 377 378 379 380 381 382 383 385 386 387 389 420 421 423
+		500 501 502 503 504 505 506 507 508 509 590 591 592 593 594 595 596 597
+		598 599 670 672 673 674 675 676 677 678 679 680 681 682 683 685 686 687
+		688 689 690 691 692 800 808 850 852 853 855 856 870 878 880 881 882 883
+		886 888 960 961 962 963 964 965 966 967 968 970 971 972 973 974 975 976
+		977 979 992 993 994 995 996 998`) {
+		phoneCountryCodes[code] = true
+	}
+}
+
+var errInvalidPhone = errors.New("phone must be an international number such as +49 30 1234567")
+
+// normalizePhone turns a number written with spaces, dashes, dots or
+// brackets and a leading + or 00 into E.164, as in +49301234567.
+func normalizePhone(raw string) (string, error) {
+	number := strings.TrimSpace(raw)
+	switch {
+	case strings.HasPrefix(number, "+"):
+		number = number[1:]
+	case strings.HasPrefix(number, "00"):
+		number = number[2:]
+	default:
+		return "", errInvalidPhone
+	}
+
+	digits := make([]byte, 0, len(number))
+	for i := 0; i < len(number); i++ {
+		switch c := number[i]; {
+		case c >= '0' && c <= '9':
+			digits = append(digits, c)
+		case c == ' ' || c == '-' || c == '.' || c == '(' || c == ')':
+		default:
+			return "", errInvalidPhone
+		}
+	}
+	if len(digits) < minPhoneDigits || len(digits) > maxPhoneDigits {
+		return "", errInvalidPhone
+	}
+
+	for length := 1; length <= 3; length++ {
+		if phoneCountryCodes[string(digits[:length])] {
+			return "+" + string(digits), nil
+		}
+	}
+	return "", errors.New("phone does not start with a known country code")
+}
+
+func createPhoneIndexes() error {
+	_, err := database.Collection(collectionName).Indexes().CreateOne(context.TODO(), mongo.IndexModel{
+		Keys:    bson.D{{Key: "phone", Value: 1}},
+		Options: options.Index().SetSparse(true),
+	})
+	return err
+}
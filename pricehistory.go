@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type PriceChange struct {
+	ID          primitive.ObjectID  `json:"id" bson:"_id,omitempty"`
+	FurnitureID int                 `json:"furniture_id" bson:"furniture_id"`
+	OldPrice    float64             `json:"old_price" bson:"old_price"`
+	NewPrice    float64             `json:"new_price" bson:"new_price"`
+	ChangedBy   *primitive.ObjectID `json:"changed_by,omitempty" bson:"changed_by,omitempty"`
+	ChangedAt   time.Time           `json:"changed_at" bson:"changed_at"`
+}
+
+func createPriceHistoryIndexes() error {
+	_, err := database.Collection(priceHistoryCollectionName).Indexes().CreateOne(context.TODO(), mongo.IndexModel{
+		Keys: bson.D{{Key: "furniture_id", Value: 1}, {Key: "changed_at", Value: -1}},
+	})
+	return err
+}
+
+func recordPriceChange(ctx context.Context, change PriceChange) error {
+	change.ChangedAt = time.Now()
+	_, err := database.Collection(priceHistoryCollectionName).InsertOne(ctx, change)
+	return err
+}
+
+func getPriceHistory(w http.ResponseWriter, r *http.Request) {
+	id, err := parseFurnitureID(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidID, err.Error())
+		return
+	}
+	page, err := parsePagination(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	filter := bson.M{"furniture_id": id}
+	historyCollection := database.Collection(priceHistoryCollectionName)
+	total, err := historyCollection.CountDocuments(r.Context(), filter)
+	if err != nil {
+		fmt.Println("Error counting price history:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to load price history")
+		return
+	}
+
+	opts := options.Find().
+		SetSort(bson.D{{Key: "changed_at", Value: -1}, {Key: "_id", Value: -1}}).
+		SetSkip(page.skip()).
+		SetLimit(int64(page.Limit))
+	cursor, err := historyCollection.Find(r.Context(), filter, opts)
+	if err != nil {
+		fmt.Println("Error querying price history:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to load price history")
+		return
+	}
+	defer cursor.Close(r.Context())
+
+	changes := []PriceChange{}
+	if err := cursor.All(r.Context(), &changes); err != nil {
+		fmt.Println("Error decoding price history:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to load price history")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, pageResponse{
+		Items:      changes,
+		Total:      total,
+		Page:       page.Page,
+		TotalPages: page.totalPages(total),
+	})
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Promotion discounts every listed item and every item in the listed
+// categories while StartsAt <= now < EndsAt.
+type Promotion struct {
+	ID              primitive.ObjectID   `json:"id" bson:"_id,omitempty"`
+	Name            string               `json:"name" bson:"name"`
+	DiscountPercent float64              `json:"discount_percent" bson:"discount_percent"`
+	CategoryIDs     []primitive.ObjectID `json:"category_ids" bson:"category_ids"`
+	FurnitureIDs    []int                `json:"furniture_ids" bson:"furniture_ids"`
+	StartsAt        time.Time            `json:"starts_at" bson:"starts_at"`
+	EndsAt          time.Time            `json:"ends_at" bson:"ends_at"`
+	CreatedAt       time.Time            `json:"created_at" bson:"created_at"`
+}
+
+func (p *Promotion) validate() error {
+	p.Name = strings.TrimSpace(p.Name)
+	if p.Name == "" {
+		return errors.New("name is required")
+	}
+	if p.DiscountPercent <= 0 || p.DiscountPercent > 100 {
+		return errors.New("discount_percent must be greater than 0 and at most 100")
+	}
+	if len(p.CategoryIDs) == 0 && len(p.FurnitureIDs) == 0 {
+		return errors.New("a promotion needs at least one category_id or furniture_id")
+	}
+	if p.StartsAt.IsZero() || p.EndsAt.IsZero() {
+		return errors.New("starts_at and ends_at are required")
+	}
+	if !p.EndsAt.After(p.StartsAt) {
+		return errors.New("ends_at must be after starts_at")
+	}
+	if p.CategoryIDs == nil {
+		p.CategoryIDs = []primitive.ObjectID{}
+	}
+	if p.FurnitureIDs == nil {
+		p.FurnitureIDs = []int{}
+	}
+	return nil
+}
+
+func (p Promotion) appliesTo(item Furniture) bool {
+	for _, id := range p.FurnitureIDs {
+		if id == item.ID {
+			return true
+		}
+	}
+	if item.CategoryID != nil {
+		for _, id := range p.CategoryIDs {
+			if id == *item.CategoryID {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// discount returns price reduced by the promotion, rounded to whole cents.
+func (p Promotion) discount(price float64) float64 {
+	return math.Round(price*(100-p.DiscountPercent)) / 100
+}
+
+func activePromotions(ctx context.Context, now time.Time) ([]Promotion, error) {
+	cursor, err := database.Collection(promotionsCollectionName).Find(ctx, bson.M{
+		"starts_at": bson.M{"$lte": now},
+		"ends_at":   bson.M{"$gt": now},
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var promotions []Promotion
+	err = cursor.All(ctx, &promotions)
+	return promotions, err
+}
+
+// bestPromotion picks the largest discount among the promotions that apply
+// to item, or nil if none does.
+func bestPromotion(promotions []Promotion, item Furniture) *Promotion {
+	var best *Promotion
+	for i := range promotions {
+		if promotions[i].appliesTo(item) && (best == nil || promotions[i].DiscountPercent > best.DiscountPercent) {
+			best = &promotions[i]
+		}
+	}
+	return best
+}
+
+// applySalePrices fills in SalePrice and PromotionID on items covered by a
+// promotion that is running right now.
+func applySalePrices(ctx context.Context, items []Furniture) error {
+	if len(items) == 0 {
+		return nil
+	}
+	promotions, err := activePromotions(ctx, time.Now())
+	if err != nil {
+		return err
+	}
+	for i := range items {
+		if promotion := bestPromotion(promotions, items[i]); promotion != nil {
+			salePrice := promotion.discount(items[i].Price)
+			items[i].SalePrice = &salePrice
+			items[i].PromotionID = &promotion.ID
+		}
+	}
+	return nil
+}
+
+func handlePromotions(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		listPromotions(w, r)
+	case http.MethodPost:
+		createPromotion(w, r)
+	case http.MethodPut:
+		updatePromotion(w, r)
+	case http.MethodDelete:
+		deletePromotion(w, r)
+	default:
+		writeJSONError(w, http.StatusMethodNotAllowed, "Method not allowed")
+	}
+}
+
+func listPromotions(w http.ResponseWriter, r *http.Request) {
+	filter := bson.M{}
+	if r.URL.Query().Get("active") == "true" {
+		now := time.Now()
+		filter = bson.M{"starts_at": bson.M{"$lte": now}, "ends_at": bson.M{"$gt": now}}
+	}
+
+	opts := options.Find().SetSort(bson.D{{Key: "starts_at", Value: -1}})
+	cursor, err := database.Collection(promotionsCollectionName).Find(r.Context(), filter, opts)
+	if err != nil {
+		fmt.Println("Error querying promotions:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to load promotions")
+		return
+	}
+	defer cursor.Close(r.Context())
+
+	promotions := []Promotion{}
+	if err := cursor.All(r.Context(), &promotions); err != nil {
+		fmt.Println("Error decoding promotions:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to load promotions")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, promotions)
+}
+
+func createPromotion(w http.ResponseWriter, r *http.Request) {
+	var promotion Promotion
+	if !decodeJSON(w, r, &promotion) {
+		return
+	}
+	if err := promotion.validate(); err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	promotion.ID = primitive.NilObjectID
+	promotion.CreatedAt = time.Now()
+
+	result, err := database.Collection(promotionsCollectionName).InsertOne(r.Context(), promotion)
+	if err != nil {
+		fmt.Println("Error inserting promotion:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to create promotion")
+		return
+	}
+	promotion.ID = result.InsertedID.(primitive.ObjectID)
+
+	writeJSON(w, http.StatusCreated, promotion)
+}
+
+func updatePromotion(w http.ResponseWriter, r *http.Request) {
+	id, ok := parseObjectID(w, r)
+	if !ok {
+		return
+	}
+
+	var promotion Promotion
+	if !decodeJSON(w, r, &promotion) {
+		return
+	}
+	if err := promotion.validate(); err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	var updated Promotion
+	err := database.Collection(promotionsCollectionName).FindOneAndUpdate(
+		r.Context(),
+		bson.M{"_id": id},
+		bson.M{"$set": bson.M{
+			"name":             promotion.Name,
+			"discount_percent": promotion.DiscountPercent,
+			"category_ids":     promotion.CategoryIDs,
+			"furniture_ids":    promotion.FurnitureIDs,
+			"starts_at":        promotion.StartsAt,
+			"ends_at":          promotion.EndsAt,
+		}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&updated)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		writeJSONError(w, http.StatusNotFound, "Promotion not found")
+		return
+	}
+	if err != nil {
+		fmt.Println("Error updating promotion:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to update promotion")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, updated)
+}
+
+func deletePromotion(w http.ResponseWriter, r *http.Request) {
+	id, ok := parseObjectID(w, r)
+	if !ok {
+		return
+	}
+
+	result, err := database.Collection(promotionsCollectionName).DeleteOne(r.Context(), bson.M{"_id": id})
+	if err != nil {
+		fmt.Println("Error deleting promotion:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to delete promotion")
+		return
+	}
+	if result.DeletedCount == 0 {
+		writeJSONError(w, http.StatusNotFound, "Promotion not found")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
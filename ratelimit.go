@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const rateLimitSweepInterval = time.Minute
+
+// The route groups with their own limits. Each is set by an environment
+// variable such as RATE_LIMIT_AUTH="10/m": a client may burst up to 10
+// requests and gets them back at 10 a minute. The unit is s, m or h; "off"
+// turns the group's limit off. Config.apply replaces these defaults.
+var (
+	authLimiter      = newRateLimiter(10, time.Minute)
+	orderLimiter     = newRateLimiter(20, time.Minute)
+	catalogueLimiter = newRateLimiter(300, time.Minute)
+
+	rateLimiters = []*rateLimiter{authLimiter, orderLimiter, catalogueLimiter}
+)
+
+// rateLimitConfig is a limit as configured: Requests per Per. The zero value
+// is "off".
+type rateLimitConfig struct {
+	Requests int
+	Per      time.Duration
+}
+
+func (c rateLimitConfig) limiter() *rateLimiter {
+	if c.Requests == 0 {
+		return nil
+	}
+	return newRateLimiter(c.Requests, c.Per)
+}
+
+func (c rateLimitConfig) String() string {
+	switch c.Per {
+	case time.Second:
+		return strconv.Itoa(c.Requests) + "/s"
+	case time.Minute:
+		return strconv.Itoa(c.Requests) + "/m"
+	case time.Hour:
+		return strconv.Itoa(c.Requests) + "/h"
+	}
+	return "off"
+}
+
+// rateLimiter is a token bucket per client IP. A nil limiter allows
+// everything.
+type rateLimiter struct {
+	capacity float64
+	perSec   float64
+
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(requests int, per time.Duration) *rateLimiter {
+	return &rateLimiter{
+		capacity: float64(requests),
+		perSec:   float64(requests) / per.Seconds(),
+		buckets:  map[string]*tokenBucket{},
+	}
+}
+
+// parseRate reads a limit such as "10/m", or "off".
+func parseRate(raw string) (rateLimitConfig, error) {
+	raw = strings.TrimSpace(raw)
+	if raw == "off" {
+		return rateLimitConfig{}, nil
+	}
+	count, unit, ok := strings.Cut(raw, "/")
+	requests, err := strconv.Atoi(count)
+	if !ok || err != nil || requests <= 0 {
+		return rateLimitConfig{}, fmt.Errorf("invalid rate %q", raw)
+	}
+	switch unit {
+	case "s":
+		return rateLimitConfig{requests, time.Second}, nil
+	case "m":
+		return rateLimitConfig{requests, time.Minute}, nil
+	case "h":
+		return rateLimitConfig{requests, time.Hour}, nil
+	}
+	return rateLimitConfig{}, fmt.Errorf("invalid rate %q", raw)
+}
+
+// allow takes a token from key's bucket. When there is none it returns how
+// long until there is.
+func (l *rateLimiter) allow(key string, now time.Time) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	bucket, ok := l.buckets[key]
+	if !ok {
+		bucket = &tokenBucket{tokens: l.capacity, last: now}
+		l.buckets[key] = bucket
+	}
+	bucket.tokens = math.Min(l.capacity, bucket.tokens+now.Sub(bucket.last).Seconds()*l.perSec)
+	bucket.last = now
+	if bucket.tokens < 1 {
+		return false, time.Duration((1 - bucket.tokens) / l.perSec * float64(time.Second))
+	}
+	bucket.tokens--
+	return true, 0
+}
+
+// sweep forgets the clients whose bucket has filled up again; a new bucket
+// for them would be the same.
+func (l *rateLimiter) sweep(now time.Time) {
+	refill := time.Duration(l.capacity / l.perSec * float64(time.Second))
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for key, bucket := range l.buckets {
+		if now.Sub(bucket.last) >= refill {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// sweepRateLimitersPeriodically keeps the buckets of idle clients from
+// piling up until ctx is cancelled.
+func sweepRateLimitersPeriodically(ctx context.Context) {
+	ticker := time.NewTicker(rateLimitSweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			for _, l := range rateLimiters {
+				if l != nil {
+					l.sweep(now)
+				}
+			}
+		}
+	}
+}
+
+// rateLimit answers 429 with Retry-After once the client IP has used up its
+// requests in l.
+func rateLimit(l *rateLimiter, h http.HandlerFunc) http.HandlerFunc {
+	if l == nil {
+		return h
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		ok, wait := l.allow(clientIP(r), time.Now())
+		if !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			writeError(w, http.StatusTooManyRequests, codeRateLimited, "Too many requests, please try again later")
+			return
+		}
+		h(w, r)
+	}
+}
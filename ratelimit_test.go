@@ -0,0 +1,114 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestParseRate(t *testing.T) {
+	tests := []struct {
+		raw  string
+		want rateLimitConfig
+	}{
+		{"10/s", rateLimitConfig{10, time.Second}},
+		{"20/m", rateLimitConfig{20, time.Minute}},
+		{" 300/h ", rateLimitConfig{300, time.Hour}},
+		{"off", rateLimitConfig{}},
+	}
+	for _, tt := range tests {
+		got, err := parseRate(tt.raw)
+		if err != nil || got != tt.want {
+			t.Errorf("parseRate(%q) = %v, %v; want %v", tt.raw, got, err, tt.want)
+		}
+	}
+	for _, raw := range []string{"", "10", "10/d", "0/m", "-1/m", "ten/m", "10/", "/m", "Off"} {
+		if got, err := parseRate(raw); err == nil {
+			t.Errorf("parseRate(%q) = %v, want an error", raw, got)
+		}
+	}
+}
+
+func TestRateLimiterRefills(t *testing.T) {
+	l := newRateLimiter(2, time.Minute)
+	now := time.Now()
+	for i := 0; i < 2; i++ {
+		if ok, _ := l.allow("client", now); !ok {
+			t.Fatalf("request %d refused within the burst", i+1)
+		}
+	}
+	ok, wait := l.allow("client", now)
+	if ok || wait != 30*time.Second {
+		t.Errorf("third request: allowed %v, wait %s; want refused for 30s", ok, wait)
+	}
+	if ok, _ := l.allow("other", now); !ok {
+		t.Error("another client was refused")
+	}
+	if ok, _ := l.allow("client", now.Add(29*time.Second)); ok {
+		t.Error("allowed before a token came back")
+	}
+	if ok, _ := l.allow("client", now.Add(30*time.Second)); !ok {
+		t.Error("refused once a token came back")
+	}
+}
+
+func TestRateLimitAnswersWithRetryAfter(t *testing.T) {
+	var served atomic.Int32
+	h := assignRequestID(rateLimit(newRateLimiter(1, time.Hour), func(w http.ResponseWriter, r *http.Request) {
+		served.Add(1)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	if rec := serveTest(h, http.MethodGet, "/", "", ""); rec.Code != http.StatusNoContent {
+		t.Fatalf("first request = %d, want 204", rec.Code)
+	}
+	rec := serveTest(h, http.MethodGet, "/", "", "")
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("second request = %d, want 429", rec.Code)
+	}
+	retry, err := strconv.Atoi(rec.Header().Get("Retry-After"))
+	if err != nil || retry < 3599 || retry > 3600 {
+		t.Errorf("Retry-After = %q, want about an hour in seconds", rec.Header().Get("Retry-After"))
+	}
+	if apiErr := decodeAPIError(t, rec); apiErr.Code != codeRateLimited {
+		t.Errorf("code = %q, want %q", apiErr.Code, codeRateLimited)
+	}
+	if served.Load() != 1 {
+		t.Errorf("handler ran %d times, want 1", served.Load())
+	}
+
+	other := httptest.NewRequest(http.MethodGet, "/", nil)
+	other.RemoteAddr = "198.51.100.7:1234"
+	if rec := serveRequest(h, other); rec.Code != http.StatusNoContent {
+		t.Errorf("request from another address = %d, want 204", rec.Code)
+	}
+}
+
+func TestRateLimiterSweepForgetsIdleClients(t *testing.T) {
+	l := newRateLimiter(10, time.Minute)
+	now := time.Now()
+	l.allow("idle", now)
+	l.allow("active", now.Add(50*time.Second))
+
+	l.sweep(now.Add(time.Minute))
+	if _, ok := l.buckets["idle"]; ok {
+		t.Error("the bucket of a client idle for a full refill is still there")
+	}
+	if _, ok := l.buckets["active"]; !ok {
+		t.Error("the bucket of a recent client was swept")
+	}
+}
+
+func BenchmarkRateLimiterAllow(b *testing.B) {
+	l := newRateLimiter(1000, time.Second)
+	var clients atomic.Int64
+	b.RunParallel(func(pb *testing.PB) {
+		key := "client-" + strconv.FormatInt(clients.Add(1), 10)
+		for pb.Next() {
+			l.allow(key, time.Now())
+		}
+	})
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// adjustRating adds (or, with negative deltas, removes) approved ratings to
+// an item. The sum, the count and the average derived from them change in
+// one pipeline update, so readers never see them out of step.
+func adjustRating(ctx context.Context, furnitureID, ratingDelta, countDelta int) error {
+	count := bson.M{"$add": bson.A{bson.M{"$ifNull": bson.A{"$rating_count", 0}}, countDelta}}
+	sum := bson.M{"$add": bson.A{bson.M{"$ifNull": bson.A{"$rating_sum", 0}}, ratingDelta}}
+	_, err := database.Collection(furnitureCollectionName).UpdateOne(ctx,
+		bson.M{"_id": furnitureID},
+		mongo.Pipeline{
+			{{Key: "$set", Value: bson.M{"rating_count": count, "rating_sum": sum}}},
+			{{Key: "$set", Value: bson.M{"rating_avg": bson.M{"$cond": bson.A{
+				bson.M{"$gt": bson.A{"$rating_count", 0}},
+				bson.M{"$round": bson.A{bson.M{"$divide": bson.A{"$rating_sum", "$rating_count"}}, 2}},
+				0,
+			}}}}},
+		},
+	)
+	return err
+}
+
+// reviewRatingChange is how much a review moving from one status to another
+// changes its item's rating totals.
+func reviewRatingChange(review Review, from, to string) (ratingDelta, countDelta int) {
+	switch {
+	case from != reviewStatusApproved && to == reviewStatusApproved:
+		return review.Rating, 1
+	case from == reviewStatusApproved && to != reviewStatusApproved:
+		return -review.Rating, -1
+	}
+	return 0, 0
+}
+
+// recomputeRatings rebuilds every item's rating totals from the approved
+// reviews, for when the stored numbers have drifted.
+func recomputeRatings(w http.ResponseWriter, r *http.Request) {
+	cursor, err := database.Collection(reviewsCollectionName).Aggregate(r.Context(), mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"status": reviewStatusApproved}}},
+		{{Key: "$group", Value: bson.M{
+			"_id":   "$furniture_id",
+			"sum":   bson.M{"$sum": "$rating"},
+			"count": bson.M{"$sum": 1},
+		}}},
+	})
+	if err != nil {
+		fmt.Println("Error aggregating ratings:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to recompute ratings")
+		return
+	}
+	defer cursor.Close(r.Context())
+
+	var totals []struct {
+		FurnitureID int `bson:"_id"`
+		Sum         int `bson:"sum"`
+		Count       int `bson:"count"`
+	}
+	if err := cursor.All(r.Context(), &totals); err != nil {
+		fmt.Println("Error decoding ratings:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to recompute ratings")
+		return
+	}
+
+	rated := make([]int, len(totals))
+	models := make([]mongo.WriteModel, 0, len(totals)+1)
+	for i, total := range totals {
+		rated[i] = total.FurnitureID
+		models = append(models, mongo.NewUpdateOneModel().
+			SetFilter(bson.M{"_id": total.FurnitureID}).
+			SetUpdate(bson.M{"$set": bson.M{
+				"rating_sum":   total.Sum,
+				"rating_count": total.Count,
+				"rating_avg":   math.Round(float64(total.Sum)/float64(total.Count)*100) / 100,
+			}}))
+	}
+	models = append(models, mongo.NewUpdateManyModel().
+		SetFilter(bson.M{"_id": bson.M{"$nin": rated}, "rating_count": bson.M{"$exists": true}}).
+		SetUpdate(bson.M{"$unset": bson.M{"rating_sum": "", "rating_count": "", "rating_avg": ""}}))
+
+	result, err := database.Collection(furnitureCollectionName).BulkWrite(r.Context(), models)
+	if err != nil {
+		fmt.Println("Error writing ratings:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to recompute ratings")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]int64{"modified": result.ModifiedCount})
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"runtime/debug"
+)
+
+// recoverPanics turns a panic anywhere below it into a logged stack trace and
+// a 500. It is the outermost middleware, so it covers the other middleware
+// too; the request and trace IDs they set are read back from the response
+// headers for the log line and the error envelope. The panic value is only
+// logged; it may hold internal details.
+func recoverPanics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rw := &statusWriter{ResponseWriter: w}
+		defer func() {
+			recovered := recover()
+			if recovered == nil {
+				return
+			}
+			if recovered == http.ErrAbortHandler {
+				// Deliberate aborts are how handlers drop a connection.
+				panic(recovered)
+			}
+			logger.LogAttrs(r.Context(), slog.LevelError, "panic",
+				slog.String("method", r.Method),
+				slog.String("path", r.URL.Path),
+				slog.String("request_id", w.Header().Get(requestIDHeader)),
+				slog.String("trace_id", w.Header().Get(traceIDHeader)),
+				slog.String("panic", fmt.Sprint(recovered)),
+				slog.String("stack", string(debug.Stack())),
+			)
+			if rw.started() {
+				// Part of the response is out; all that is left is to cut it short.
+				panic(http.ErrAbortHandler)
+			}
+			writeJSONError(w, http.StatusInternalServerError, "Internal server error")
+		}()
+		next.ServeHTTP(rw, r)
+	})
+}
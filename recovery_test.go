@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRecoverPanicsAnswersWithEnvelopeAndKeepsServing(t *testing.T) {
+	mux := newRouter()
+	mux.probeRoute("/panic", func(w http.ResponseWriter, r *http.Request) {
+		panic("boom")
+	}, http.MethodGet)
+	mux.probeRoute("/panic-after-flush", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(`{"partial":`))
+		w.(http.Flusher).Flush()
+		panic("boom")
+	}, http.MethodGet)
+	mux.probeRoute("/ok", handleLiveness, http.MethodGet)
+	srv := httptest.NewServer(withMiddleware(mux))
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/panic")
+	if err != nil {
+		t.Fatalf("GET /panic: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusInternalServerError {
+		t.Fatalf("GET /panic = %d, want 500", resp.StatusCode)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Content-Type = %q, want application/json", ct)
+	}
+	var envelope struct {
+		Error apiError `json:"error"`
+	}
+	if err := json.Unmarshal(body, &envelope); err != nil {
+		t.Fatalf("body %q: %v", body, err)
+	}
+	if envelope.Error.Code != codeInternal || envelope.Error.Message != "Internal server error" {
+		t.Errorf("error = %+v, want %s without the panic value", envelope.Error, codeInternal)
+	}
+	if id := resp.Header.Get(requestIDHeader); id == "" || envelope.Error.RequestID != id {
+		t.Errorf("request_id = %q, want the %s header %q", envelope.Error.RequestID, requestIDHeader, id)
+	}
+
+	// Once part of the response is out, a panic can only cut it short.
+	if resp, err := http.Get(srv.URL + "/panic-after-flush"); err == nil {
+		_, err = io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err == nil {
+			t.Error("GET /panic-after-flush completed, want the response cut short")
+		}
+	}
+
+	for i := 0; i < 3; i++ {
+		resp, err := http.Get(srv.URL + "/ok")
+		if err != nil {
+			t.Fatalf("GET /ok after panics: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("GET /ok after panics = %d, want 200", resp.StatusCode)
+		}
+	}
+}
+
+// A panic in middleware, above any handler, is recovered too, and the IDs
+// set further out still reach the envelope.
+func TestRecoverPanicsCoversMiddleware(t *testing.T) {
+	panicking := func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { panic("middleware boom") })
+	}
+	h := recoverPanics(assignRequestID(traceRequests(panicking(http.NotFoundHandler()))))
+
+	rec := serveTest(h, http.MethodGet, "/", "", "")
+	if rec.Code != http.StatusInternalServerError {
+		t.Fatalf("status = %d, want 500", rec.Code)
+	}
+	apiErr := decodeAPIError(t, rec)
+	if apiErr.Code != codeInternal || apiErr.RequestID == "" || apiErr.RequestID != rec.Header().Get(requestIDHeader) {
+		t.Errorf("error = %+v, want %s with the %s header", apiErr, codeInternal, requestIDHeader)
+	}
+	if apiErr.TraceID == "" || apiErr.TraceID != rec.Header().Get(traceIDHeader) {
+		t.Errorf("trace_id = %q, want the %s header", apiErr.TraceID, traceIDHeader)
+	}
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const refreshTokenTTL = 30 * 24 * time.Hour
+
+// RefreshToken is stored by hash only; the token itself is handed to the
+// client once. Every token issued by rotating another one shares its
+// FamilyID with the token issued at login.
+type RefreshToken struct {
+	ID        primitive.ObjectID `bson:"_id,omitempty"`
+	UserID    primitive.ObjectID `bson:"user_id"`
+	FamilyID  primitive.ObjectID `bson:"family_id"`
+	TokenHash string             `bson:"token_hash"`
+	UserAgent string             `bson:"user_agent,omitempty"`
+	IP        string             `bson:"ip,omitempty"`
+	ExpiresAt time.Time          `bson:"expires_at"`
+	CreatedAt time.Time          `bson:"created_at"`
+	UsedAt    *time.Time         `bson:"used_at,omitempty"`
+	RevokedAt *time.Time         `bson:"revoked_at,omitempty"`
+}
+
+var errRefreshTokenInvalid = errors.New("refresh token is invalid")
+
+func createRefreshTokenIndexes() error {
+	_, err := database.Collection(refreshTokensCollectionName).Indexes().CreateMany(context.TODO(), []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "token_hash", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+		{Keys: bson.D{{Key: "family_id", Value: 1}}},
+		{Keys: bson.D{{Key: "user_id", Value: 1}}},
+		{
+			Keys:    bson.D{{Key: "expires_at", Value: 1}},
+			Options: options.Index().SetExpireAfterSeconds(0),
+		},
+	})
+	return err
+}
+
+// newSecretToken returns 32 random bytes as URL-safe text, for tokens that
+// are sent to a client once and stored only as hashToken.
+func newSecretToken() (string, error) {
+	var raw [32]byte
+	if _, err := rand.Read(raw[:]); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(raw[:]), nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// trustedProxyHops is how many reverse proxies, set in TRUSTED_PROXY_HOPS,
+// stand in front of the server. Each appends the address it got the request
+// from to X-Forwarded-For, so the client is that many entries from the end;
+// anything further left could have been made up by the client. With 0, the
+// default, the header is ignored. TRUSTED_PROXY_HEADER names another header
+// the proxies use the same way, such as X-Real-IP with one hop.
+var (
+	trustedProxyHops   = 0
+	trustedProxyHeader = "X-Forwarded-For"
+)
+
+func clientIP(r *http.Request) string {
+	if trustedProxyHops > 0 {
+		var forwarded []string
+		for _, header := range r.Header.Values(trustedProxyHeader) {
+			for _, entry := range strings.Split(header, ",") {
+				forwarded = append(forwarded, strings.TrimSpace(entry))
+			}
+		}
+		if len(forwarded) >= trustedProxyHops {
+			if ip := net.ParseIP(forwarded[len(forwarded)-trustedProxyHops]); ip != nil {
+				return ip.String()
+			}
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// issueRefreshToken stores a new refresh token in family and returns it.
+func issueRefreshToken(ctx context.Context, r *http.Request, userID, family primitive.ObjectID, now time.Time) (string, error) {
+	token, err := newSecretToken()
+	if err != nil {
+		return "", err
+	}
+	_, err = database.Collection(refreshTokensCollectionName).InsertOne(ctx, RefreshToken{
+		UserID:    userID,
+		FamilyID:  family,
+		TokenHash: hashToken(token),
+		UserAgent: r.UserAgent(),
+		IP:        clientIP(r),
+		ExpiresAt: now.Add(refreshTokenTTL),
+		CreatedAt: now,
+	})
+	return token, err
+}
+
+// issueTokenPair signs an access token and stores a refresh token in family
+// for user, returning the body sent back to the client.
+func issueTokenPair(ctx context.Context, r *http.Request, user User, family primitive.ObjectID) (map[string]interface{}, error) {
+	now := time.Now()
+	accessToken, expiresAt, err := issueAccessToken(user, now)
+	if err != nil {
+		return nil, err
+	}
+	refreshToken, err := issueRefreshToken(ctx, r, user.ID, family, now)
+	if err != nil {
+		return nil, err
+	}
+	response := tokenResponse(accessToken, expiresAt)
+	response["refresh_token"] = refreshToken
+	return response, nil
+}
+
+// rotateRefreshToken marks token used and returns it. A token that was
+// already used or revoked means it leaked, so its whole family is revoked
+// and errRefreshTokenInvalid returned.
+func rotateRefreshToken(ctx context.Context, token string) (RefreshToken, error) {
+	now := time.Now()
+	tokens := database.Collection(refreshTokensCollectionName)
+	hash := hashToken(token)
+
+	var stored RefreshToken
+	err := tokens.FindOneAndUpdate(ctx, bson.M{
+		"token_hash": hash,
+		"used_at":    bson.M{"$exists": false},
+		"revoked_at": bson.M{"$exists": false},
+		"expires_at": bson.M{"$gt": now},
+	}, bson.M{"$set": bson.M{"used_at": now}}).Decode(&stored)
+	if !errors.Is(err, mongo.ErrNoDocuments) {
+		return stored, err
+	}
+
+	err = tokens.FindOne(ctx, bson.M{"token_hash": hash}).Decode(&stored)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return stored, errRefreshTokenInvalid
+	}
+	if err != nil {
+		return stored, err
+	}
+	if stored.UsedAt != nil {
+		fmt.Println("Refresh token reused, revoking family", stored.FamilyID.Hex())
+		if err := revokeRefreshFamily(ctx, stored.FamilyID); err != nil {
+			return stored, err
+		}
+	}
+	return stored, errRefreshTokenInvalid
+}
+
+func revokeRefreshFamily(ctx context.Context, family primitive.ObjectID) error {
+	_, err := database.Collection(refreshTokensCollectionName).UpdateMany(ctx,
+		bson.M{"family_id": family, "revoked_at": bson.M{"$exists": false}},
+		bson.M{"$set": bson.M{"revoked_at": time.Now()}},
+	)
+	return err
+}
+
+// revokeUserRefreshTokens logs userID out everywhere.
+func revokeUserRefreshTokens(ctx context.Context, userID primitive.ObjectID) error {
+	_, err := database.Collection(refreshTokensCollectionName).UpdateMany(ctx,
+		bson.M{"user_id": userID, "revoked_at": bson.M{"$exists": false}},
+		bson.M{"$set": bson.M{"revoked_at": time.Now()}},
+	)
+	return err
+}
+
+func decodeRefreshToken(w http.ResponseWriter, r *http.Request) (string, bool) {
+	var body struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	if !decodeJSON(w, r, &body) {
+		return "", false
+	}
+	if body.RefreshToken == "" {
+		writeValidationErrors(w, "Request is invalid", []fieldError{{Field: "refresh_token", Message: "refresh_token is required"}})
+		return "", false
+	}
+	return body.RefreshToken, true
+}
+
+func handleTokenRefresh(w http.ResponseWriter, r *http.Request) {
+	token, ok := decodeRefreshToken(w, r)
+	if !ok {
+		return
+	}
+
+	stored, err := rotateRefreshToken(r.Context(), token)
+	if errors.Is(err, errRefreshTokenInvalid) {
+		writeUnauthorized(w, "Invalid refresh token")
+		return
+	}
+	if err != nil {
+		fmt.Println("Error rotating refresh token:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to refresh token")
+		return
+	}
+
+	// The user is loaded again so the new access token carries their
+	// current role, and deleted users cannot refresh.
+	var user User
+	err = database.Collection(collectionName).FindOne(r.Context(), activeUserByID(stored.UserID)).Decode(&user)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		writeUnauthorized(w, "Invalid refresh token")
+		return
+	}
+	if err != nil {
+		fmt.Println("Error loading user:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to refresh token")
+		return
+	}
+
+	response, err := issueTokenPair(r.Context(), r, user, stored.FamilyID)
+	if err != nil {
+		fmt.Println("Error issuing tokens:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to refresh token")
+		return
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+// handleLogout ends the cookie session, or otherwise revokes the presented
+// refresh token. Unknown or already revoked tokens are not an error, so
+// logging out twice is harmless.
+func handleLogout(w http.ResponseWriter, r *http.Request) {
+	if ended, err := endSession(w, r); ended {
+		if err != nil {
+			fmt.Println("Error deleting session:", err)
+			writeJSONError(w, http.StatusInternalServerError, "Failed to log out")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	token, ok := decodeRefreshToken(w, r)
+	if !ok {
+		return
+	}
+
+	_, err := database.Collection(refreshTokensCollectionName).UpdateOne(r.Context(),
+		bson.M{"token_hash": hashToken(token), "revoked_at": bson.M{"$exists": false}},
+		bson.M{"$set": bson.M{"revoked_at": time.Now()}},
+	)
+	if err != nil {
+		fmt.Println("Error revoking refresh token:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to log out")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
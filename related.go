@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	maxRelated = 6
+	// minCoPurchases is how many co-purchases the order history must show
+	// before it is trusted over the category.
+	minCoPurchases = 3
+	relatedTTL     = time.Hour
+)
+
+type relatedItem struct {
+	ID      int                 `json:"id" bson:"_id"`
+	Name    string              `json:"name" bson:"name"`
+	Price   float64             `json:"price" bson:"price"`
+	ImageID *primitive.ObjectID `json:"image_id,omitempty" bson:"image_id,omitempty"`
+	Source  string              `json:"source" bson:"-"`
+}
+
+type relatedEntry struct {
+	items     []relatedItem
+	expiresAt time.Time
+}
+
+// relatedCache keeps each item's computed recommendations for relatedTTL.
+type relatedCache struct {
+	mu      sync.Mutex
+	entries map[int]relatedEntry
+}
+
+var related = relatedCache{entries: map[int]relatedEntry{}}
+
+func (c *relatedCache) get(id int) ([]relatedItem, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[id]
+	if !ok || time.Now().After(entry.expiresAt) {
+		delete(c.entries, id)
+		return nil, false
+	}
+	return entry.items, true
+}
+
+func (c *relatedCache) put(id int, items []relatedItem) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[id] = relatedEntry{items: items, expiresAt: time.Now().Add(relatedTTL)}
+}
+
+// sellableFilter matches items that are neither deleted nor out of stock.
+func sellableFilter() bson.M {
+	return bson.M{
+		"deleted_at": bson.M{"$exists": false},
+		"$or": bson.A{
+			bson.M{"stock": bson.M{"$gt": 0}},
+			bson.M{"variants.stock": bson.M{"$gt": 0}},
+		},
+	}
+}
+
+// coPurchased returns the sellable items bought together with id, most often
+// first, and how many co-purchases the history holds in total. Each order
+// counts once per item however many lines it has for it.
+func coPurchased(ctx context.Context, id int) ([]relatedItem, int, error) {
+	cursor, err := database.Collection(ordersCollectionName).Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"items.furniture_id": id, "status": bson.M{"$ne": orderStatusCancelled}}}},
+		{{Key: "$unwind", Value: "$items"}},
+		{{Key: "$match", Value: bson.M{"items.furniture_id": bson.M{"$ne": id}}}},
+		{{Key: "$group", Value: bson.M{"_id": bson.M{"order": "$_id", "furniture_id": "$items.furniture_id"}}}},
+		{{Key: "$group", Value: bson.M{"_id": "$_id.furniture_id", "count": bson.M{"$sum": 1}}}},
+		{{Key: "$sort", Value: bson.D{{Key: "count", Value: -1}, {Key: "_id", Value: 1}}}},
+		{{Key: "$lookup", Value: bson.M{
+			"from":         furnitureCollectionName,
+			"localField":   "_id",
+			"foreignField": "_id",
+			"as":           "furniture",
+		}}},
+		{{Key: "$unwind", Value: "$furniture"}},
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	defer cursor.Close(ctx)
+
+	var rows []struct {
+		Count     int       `bson:"count"`
+		Furniture Furniture `bson:"furniture"`
+	}
+	if err := cursor.All(ctx, &rows); err != nil {
+		return nil, 0, err
+	}
+
+	var items []relatedItem
+	total := 0
+	for _, row := range rows {
+		total += row.Count
+		f := row.Furniture
+		if f.DeletedAt != nil || !f.inStock() || len(items) == maxRelated {
+			continue
+		}
+		items = append(items, relatedItem{ID: f.ID, Name: f.Name, Price: f.Price, ImageID: f.ImageID, Source: "co_purchase"})
+	}
+	return items, total, nil
+}
+
+// sameCategory returns up to limit sellable items from the category of item,
+// best rated first, leaving out the IDs in exclude.
+func sameCategory(ctx context.Context, item Furniture, exclude []int, limit int) ([]relatedItem, error) {
+	if item.CategoryID == nil || limit <= 0 {
+		return nil, nil
+	}
+	filter := sellableFilter()
+	filter["category_id"] = *item.CategoryID
+	filter["_id"] = bson.M{"$nin": append(exclude, item.ID)}
+
+	opts := options.Find().
+		SetSort(bson.D{{Key: "rating_avg", Value: -1}, {Key: "_id", Value: 1}}).
+		SetLimit(int64(limit)).
+		SetProjection(bson.M{"name": 1, "price": 1, "image_id": 1})
+	cursor, err := database.Collection(furnitureCollectionName).Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var items []relatedItem
+	if err := cursor.All(ctx, &items); err != nil {
+		return nil, err
+	}
+	for i := range items {
+		items[i].Source = "category"
+	}
+	return items, nil
+}
+
+func computeRelated(ctx context.Context, item Furniture) ([]relatedItem, error) {
+	items, total, err := coPurchased(ctx, item.ID)
+	if err != nil {
+		return nil, err
+	}
+	if total < minCoPurchases {
+		items = nil
+	}
+
+	exclude := make([]int, len(items))
+	for i, related := range items {
+		exclude[i] = related.ID
+	}
+	fill, err := sameCategory(ctx, item, exclude, maxRelated-len(items))
+	if err != nil {
+		return nil, err
+	}
+	items = append(items, fill...)
+	if items == nil {
+		items = []relatedItem{}
+	}
+	return items, nil
+}
+
+// getRelatedFurniture answers "customers also bought" for ?id=. Results are
+// cached per item, so they can lag new orders and stock changes by up to
+// relatedTTL.
+func getRelatedFurniture(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(idParam(r))
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "id must be an integer")
+		return
+	}
+
+	if items, ok := related.get(id); ok {
+		writeJSON(w, http.StatusOK, items)
+		return
+	}
+
+	var item Furniture
+	err = database.Collection(furnitureCollectionName).FindOne(r.Context(), activeFurnitureByID(id)).Decode(&item)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		writeJSONError(w, http.StatusNotFound, "Furniture not found")
+		return
+	}
+	if err != nil {
+		fmt.Println("Error loading furniture:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to load related furniture")
+		return
+	}
+
+	items, err := computeRelated(r.Context(), item)
+	if err != nil {
+		fmt.Println("Error computing related furniture:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to load related furniture")
+		return
+	}
+	related.put(id, items)
+	writeJSON(w, http.StatusOK, items)
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const reservationHold = 15 * time.Minute
+
+// Reservation holds stock for a checkout in progress. It lapses at ExpiresAt;
+// the TTL index removes it shortly after, but every read also filters on
+// ExpiresAt so an expired hold never blocks stock while it waits for removal.
+type Reservation struct {
+	ID          primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+	CartID      string             `json:"cart_id" bson:"cart_id"`
+	FurnitureID int                `json:"furniture_id" bson:"furniture_id"`
+	VariantID   string             `json:"variant_id,omitempty" bson:"variant_id,omitempty"`
+	Quantity    int                `json:"quantity" bson:"quantity"`
+	ExpiresAt   time.Time          `json:"expires_at" bson:"expires_at"`
+	CreatedAt   time.Time          `json:"created_at" bson:"created_at"`
+}
+
+// stockKey identifies the stock pool of an item or one of its variants.
+type stockKey struct {
+	FurnitureID int    `bson:"furniture_id"`
+	VariantID   string `bson:"variant_id"`
+}
+
+func createReservationIndexes() error {
+	_, err := database.Collection(reservationsCollectionName).Indexes().CreateMany(context.TODO(), []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "expires_at", Value: 1}},
+			Options: options.Index().SetExpireAfterSeconds(0),
+		},
+		{Keys: bson.D{{Key: "cart_id", Value: 1}}},
+		{Keys: bson.D{{Key: "furniture_id", Value: 1}, {Key: "variant_id", Value: 1}}},
+	})
+	return err
+}
+
+// reservedQuantities sums the active holds on the given items, leaving out the
+// holds of excludeCart so a cart never competes with itself.
+func reservedQuantities(ctx context.Context, furnitureIDs []int, excludeCart string) (map[stockKey]int, error) {
+	match := bson.M{
+		"furniture_id": bson.M{"$in": furnitureIDs},
+		"expires_at":   bson.M{"$gt": time.Now()},
+	}
+	if excludeCart != "" {
+		match["cart_id"] = bson.M{"$ne": excludeCart}
+	}
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: match}},
+		{{Key: "$group", Value: bson.M{
+			"_id":      bson.M{"furniture_id": "$furniture_id", "variant_id": bson.M{"$ifNull": bson.A{"$variant_id", ""}}},
+			"quantity": bson.M{"$sum": "$quantity"},
+		}}},
+	}
+
+	cursor, err := database.Collection(reservationsCollectionName).Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var rows []struct {
+		Key      stockKey `bson:"_id"`
+		Quantity int      `bson:"quantity"`
+	}
+	if err := cursor.All(ctx, &rows); err != nil {
+		return nil, err
+	}
+	reserved := make(map[stockKey]int, len(rows))
+	for _, row := range rows {
+		reserved[row.Key] = row.Quantity
+	}
+	return reserved, nil
+}
+
+// checkAvailability reports the lines whose quantity exceeds the stock left
+// after other carts' active reservations.
+func checkAvailability(ctx context.Context, items []OrderItem, catalogue map[int]Furniture, cartID string) ([]stockShortage, error) {
+	ids := make([]int, len(items))
+	for i, item := range items {
+		ids[i] = item.FurnitureID
+	}
+	reserved, err := reservedQuantities(ctx, ids, cartID)
+	if err != nil {
+		return nil, err
+	}
+
+	var shortages []stockShortage
+	for _, item := range items {
+		key := stockKey{FurnitureID: item.FurnitureID, VariantID: item.VariantID}
+		available := catalogue[item.FurnitureID].stockOf(item.VariantID) - reserved[key]
+		if available < 0 {
+			available = 0
+		}
+		if item.Quantity > available {
+			shortages = append(shortages, stockShortage{
+				FurnitureID: item.FurnitureID,
+				VariantID:   item.VariantID,
+				Requested:   item.Quantity,
+				Available:   available,
+			})
+		}
+	}
+	return shortages, nil
+}
+
+// releaseReservations drops every hold of a cart.
+func releaseReservations(ctx context.Context, cartID string) error {
+	_, err := database.Collection(reservationsCollectionName).DeleteMany(ctx, bson.M{"cart_id": cartID})
+	return err
+}
+
+func handleReservations(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPost:
+		createReservation(w, r)
+	case http.MethodDelete:
+		deleteReservation(w, r)
+	default:
+		writeJSONError(w, http.StatusMethodNotAllowed, "Method not allowed")
+	}
+}
+
+// createReservation replaces the holds of the caller's cart, the one in the
+// cart cookie, with the requested items. The holds are written first and availability checked afterwards, so of two
+// carts racing for the last unit at least one sees the other and backs out;
+// stock is never promised twice.
+func createReservation(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Items []OrderItem `json:"items"`
+	}
+	if !decodeJSON(w, r, &body) {
+		return
+	}
+
+	var errs []fieldError
+	if len(body.Items) == 0 {
+		errs = append(errs, fieldError{Field: "items", Message: "at least one item is required"})
+	}
+	ids := make([]int, len(body.Items))
+	for i, item := range body.Items {
+		ids[i] = item.FurnitureID
+	}
+	catalogue, err := loadFurniture(r.Context(), ids)
+	if err != nil {
+		fmt.Println("Error loading furniture for reservation:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to reserve stock")
+		return
+	}
+	for i, item := range body.Items {
+		prefix := "items[" + strconv.Itoa(i) + "]."
+		furniture, ok := catalogue[item.FurnitureID]
+		if !ok || furniture.DeletedAt != nil {
+			errs = append(errs, fieldError{Field: prefix + "furniture_id", Message: fmt.Sprintf("unknown furniture ID %d", item.FurnitureID)})
+		} else if item.VariantID != "" && furniture.variant(item.VariantID) == nil {
+			errs = append(errs, fieldError{Field: prefix + "variant_id", Message: "unknown variant for this furniture"})
+		}
+		if item.Quantity < 1 {
+			errs = append(errs, fieldError{Field: prefix + "quantity", Message: "quantity must be at least 1"})
+		} else if item.Quantity > maxLineQuantity {
+			errs = append(errs, fieldError{Field: prefix + "quantity", Message: fmt.Sprintf("quantity must be at most %d", maxLineQuantity)})
+		}
+	}
+	if len(errs) > 0 {
+		writeValidationErrors(w, "Reservation is invalid", errs)
+		return
+	}
+
+	cart, err := issueCartID(w, r)
+	if err != nil {
+		fmt.Println("Error issuing cart ID:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to reserve stock")
+		return
+	}
+	if err := releaseReservations(r.Context(), cart); err != nil {
+		fmt.Println("Error replacing reservations:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to reserve stock")
+		return
+	}
+
+	now := time.Now()
+	reservations := make([]Reservation, len(body.Items))
+	docs := make([]interface{}, len(body.Items))
+	for i, item := range body.Items {
+		reservations[i] = Reservation{
+			ID:          primitive.NewObjectID(),
+			CartID:      cart,
+			FurnitureID: item.FurnitureID,
+			VariantID:   item.VariantID,
+			Quantity:    item.Quantity,
+			ExpiresAt:   now.Add(reservationHold),
+			CreatedAt:   now,
+		}
+		docs[i] = reservations[i]
+	}
+	if _, err := database.Collection(reservationsCollectionName).InsertMany(r.Context(), docs); err != nil {
+		fmt.Println("Error inserting reservations:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to reserve stock")
+		return
+	}
+
+	shortages, err := checkAvailability(r.Context(), body.Items, catalogue, cart)
+	if err != nil || len(shortages) > 0 {
+		if releaseErr := releaseReservations(r.Context(), cart); releaseErr != nil {
+			fmt.Println("Error releasing rejected reservations:", releaseErr)
+		}
+		if err != nil {
+			fmt.Println("Error checking availability:", err)
+			writeJSONError(w, http.StatusInternalServerError, "Failed to reserve stock")
+			return
+		}
+		writeStockShortage(w, shortages)
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, reservations)
+}
+
+// deleteReservation drops the holds of the caller's cart; a caller without a
+// cart has none.
+func deleteReservation(w http.ResponseWriter, r *http.Request) {
+	if id, ok := cartID(r); ok {
+		if err := releaseReservations(r.Context(), id); err != nil {
+			fmt.Println("Error releasing reservations:", err)
+			writeJSONError(w, http.StatusInternalServerError, "Failed to release reservation")
+			return
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	myCart    = "0123456789abcdef0123456789abcdef"
+	otherCart = "fedcba9876543210fedcba9876543210"
+)
+
+func insertReservation(t *testing.T, cartID string, furnitureID, quantity int, expiresAt time.Time) {
+	t.Helper()
+	hold := Reservation{
+		ID:          primitive.NewObjectID(),
+		CartID:      cartID,
+		FurnitureID: furnitureID,
+		Quantity:    quantity,
+		ExpiresAt:   expiresAt,
+		CreatedAt:   expiresAt.Add(-reservationHold),
+	}
+	if _, err := database.Collection(reservationsCollectionName).InsertOne(context.Background(), hold); err != nil {
+		t.Fatalf("insert reservation: %v", err)
+	}
+}
+
+// serveReservation sends a /reservations request from the cart cartID, or
+// from a caller without a cart when it is empty.
+func serveReservation(h http.Handler, method, cartID, body string) *httptest.ResponseRecorder {
+	req := newTestRequest(method, "/reservations", "", body)
+	if cartID != "" {
+		req.AddCookie(&http.Cookie{Name: cartCookieName, Value: cartID})
+	}
+	return serveRequest(h, req)
+}
+
+func countReservations(t *testing.T, cartID string) int64 {
+	t.Helper()
+	n, err := database.Collection(reservationsCollectionName).CountDocuments(context.Background(), bson.M{"cart_id": cartID})
+	if err != nil {
+		t.Fatalf("count reservations: %v", err)
+	}
+	return n
+}
+
+func insertSofa(t *testing.T, stock int) {
+	t.Helper()
+	if _, err := database.Collection(furnitureCollectionName).InsertOne(context.Background(), Furniture{ID: 1, Name: "Sofa", Price: 500, Stock: stock}); err != nil {
+		t.Fatalf("insert: %v", err)
+	}
+}
+
+// The TTL monitor only runs once a minute, so expired holds are still there
+// when these tests read; they must be ignored anyway.
+func TestExpiredReservationsAreNotCounted(t *testing.T) {
+	h, _ := testServer(t)
+	insertSofa(t, 2)
+	insertReservation(t, otherCart, 1, 2, time.Now().Add(-time.Second))
+
+	reserved, err := reservedQuantities(context.Background(), []int{1}, "")
+	if err != nil {
+		t.Fatalf("reservedQuantities: %v", err)
+	}
+	if n := reserved[stockKey{FurnitureID: 1}]; n != 0 {
+		t.Errorf("reserved = %d, want 0 with only an expired hold", n)
+	}
+
+	rec := serveReservation(h, http.MethodPost, myCart, `{"items":[{"furniture_id":1,"quantity":2}]}`)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("POST /reservations = %d, want 201 past an expired hold: %s", rec.Code, rec.Body)
+	}
+}
+
+func TestActiveReservationsAreCounted(t *testing.T) {
+	h, _ := testServer(t)
+	insertSofa(t, 2)
+	insertReservation(t, otherCart, 1, 1, time.Now().Add(time.Minute))
+
+	rec := serveReservation(h, http.MethodPost, myCart, `{"items":[{"furniture_id":1,"quantity":2}]}`)
+	if rec.Code != http.StatusConflict {
+		t.Fatalf("POST /reservations = %d, want 409 with one of two units held: %s", rec.Code, rec.Body)
+	}
+	if apiErr := decodeAPIError(t, rec); apiErr.Code != "insufficient_stock" {
+		t.Errorf("code = %q, want insufficient_stock", apiErr.Code)
+	}
+}
+
+func TestReservationBelongsToTheCartCookie(t *testing.T) {
+	h, _ := testServer(t)
+	insertSofa(t, 10)
+
+	rec := serveReservation(h, http.MethodPost, "", `{"items":[{"furniture_id":1,"quantity":1}]}`)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("POST /reservations = %d: %s", rec.Code, rec.Body)
+	}
+	var issued string
+	for _, cookie := range rec.Result().Cookies() {
+		if cookie.Name == cartCookieName {
+			issued = cookie.Value
+		}
+	}
+	if issued == "" || countReservations(t, issued) != 1 {
+		t.Errorf("cart cookie %q; want one hold under a newly issued cart", issued)
+	}
+
+	rec = serveReservation(h, http.MethodPost, myCart, `{"cart_id":"`+otherCart+`","items":[{"furniture_id":1,"quantity":1}]}`)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("POST with a cart_id field = %d, want 400", rec.Code)
+	}
+
+	insertReservation(t, otherCart, 1, 1, time.Now().Add(time.Minute))
+	if rec := serveReservation(h, http.MethodDelete, myCart, ""); rec.Code != http.StatusNoContent {
+		t.Fatalf("DELETE /reservations = %d, want 204", rec.Code)
+	}
+	if rec := serveRequest(h, newTestRequest(http.MethodDelete, "/reservations?cart_id="+otherCart, "", "")); rec.Code != http.StatusNoContent {
+		t.Fatalf("DELETE /reservations?cart_id= = %d, want 204", rec.Code)
+	}
+	if n := countReservations(t, otherCart); n != 1 {
+		t.Errorf("other cart has %d holds, want its hold left alone", n)
+	}
+}
+
+func TestReservationQuantityIsCapped(t *testing.T) {
+	h, _ := testServer(t)
+	insertSofa(t, 10*maxLineQuantity)
+
+	body := fmt.Sprintf(`{"items":[{"furniture_id":1,"quantity":%d}]}`, maxLineQuantity+1)
+	rec := serveReservation(h, http.MethodPost, myCart, body)
+	if rec.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("POST /reservations = %d, want 422 above %d units: %s", rec.Code, maxLineQuantity, rec.Body)
+	}
+	if n := countReservations(t, myCart); n != 0 {
+		t.Errorf("cart has %d holds, want none", n)
+	}
+}
+
+func TestReservationsAreRateLimited(t *testing.T) {
+	limiter := orderLimiter
+	orderLimiter = newRateLimiter(1, time.Hour)
+	t.Cleanup(func() { orderLimiter = limiter })
+	h, _ := testServer(t)
+
+	serveReservation(h, http.MethodDelete, myCart, "")
+	if rec := serveReservation(h, http.MethodDelete, myCart, ""); rec.Code != http.StatusTooManyRequests {
+		t.Errorf("second DELETE /reservations = %d, want 429", rec.Code)
+	}
+}
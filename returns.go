@@ -0,0 +1,373 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	returnStatusRequested = "requested"
+	returnStatusApproved  = "approved"
+	returnStatusRefunded  = "refunded"
+	returnStatusRejected  = "rejected"
+)
+
+var returnTransitions = map[string][]string{
+	returnStatusRequested: {returnStatusApproved, returnStatusRejected},
+	returnStatusApproved:  {returnStatusRefunded},
+	returnStatusRefunded:  {},
+	returnStatusRejected:  {},
+}
+
+var errOrderChanged = errors.New("order changed while the return was being recorded")
+
+// Return is a customer's request to send back some or all of a delivered
+// order. Items carry the unit price paid, so the refund does not depend on
+// today's prices.
+type Return struct {
+	ID            primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+	OrderID       primitive.ObjectID `json:"order_id" bson:"order_id"`
+	Items         []OrderItem        `json:"items" bson:"items"`
+	Reason        string             `json:"reason,omitempty" bson:"reason,omitempty"`
+	Status        string             `json:"status" bson:"status"`
+	StatusHistory []StatusChange     `json:"status_history" bson:"status_history"`
+	RefundAmount  float64            `json:"refund_amount" bson:"refund_amount"`
+	// CreditRefund is the part of RefundAmount that was paid with store
+	// credit; it goes back to the customer's balance once refunded.
+	CreditRefund float64   `json:"credit_refund,omitempty" bson:"credit_refund,omitempty"`
+	CreatedAt    time.Time `json:"created_at" bson:"created_at"`
+	UpdatedAt    time.Time `json:"updated_at" bson:"updated_at"`
+}
+
+type returnShortfall struct {
+	FurnitureID int    `json:"furniture_id"`
+	VariantID   string `json:"variant_id,omitempty"`
+	Requested   int    `json:"requested"`
+	Returnable  int    `json:"returnable"`
+}
+
+func createReturnIndexes() error {
+	_, err := database.Collection(returnsCollectionName).Indexes().CreateMany(context.TODO(), []mongo.IndexModel{
+		{Keys: bson.D{{Key: "order_id", Value: 1}}},
+		{Keys: bson.D{{Key: "status", Value: 1}, {Key: "created_at", Value: 1}}},
+	})
+	return err
+}
+
+// returnedQuantities sums what earlier returns of the order, rejected ones
+// aside, already claim.
+func returnedQuantities(ctx context.Context, orderID primitive.ObjectID) (map[stockKey]int, error) {
+	cursor, err := database.Collection(returnsCollectionName).Find(ctx, bson.M{
+		"order_id": orderID,
+		"status":   bson.M{"$ne": returnStatusRejected},
+	})
+	if err != nil {
+		return nil, err
+	}
+	var returns []Return
+	if err := cursor.All(ctx, &returns); err != nil {
+		return nil, err
+	}
+
+	returned := map[stockKey]int{}
+	for _, ret := range returns {
+		for _, item := range ret.Items {
+			returned[stockKey{FurnitureID: item.FurnitureID, VariantID: item.VariantID}] += item.Quantity
+		}
+	}
+	return returned, nil
+}
+
+// refundFor prices the returned items at what was paid for them, sharing any
+// coupon discount on the order out in proportion, and says how much of that
+// was paid with store credit, in the same proportion.
+func refundFor(order Order, items []OrderItem) (amount, credit float64) {
+	for _, item := range items {
+		amount += item.UnitPrice * float64(item.Quantity)
+	}
+	if order.Subtotal <= 0 {
+		return roundCents(amount), 0
+	}
+	paid := order.Subtotal - order.Discount
+	amount *= paid / order.Subtotal
+	if order.StoreCredit > 0 && paid > 0 {
+		credit = math.Min(amount*order.StoreCredit/paid, amount)
+	}
+	return roundCents(amount), roundCents(credit)
+}
+
+// handleOrderReturn records a return request for a delivered order. Lines may
+// be returned in part and over several requests, but never beyond what was
+// bought. The order's returns_version is bumped with the insert, so two
+// requests racing for the same units cannot both be recorded. Only the
+// customer who placed the order, or an admin, may return from it.
+func handleOrderReturn(w http.ResponseWriter, r *http.Request) {
+	orderID, ok := parseObjectID(w, r)
+	if !ok {
+		return
+	}
+
+	var body struct {
+		Items  []OrderItem `json:"items"`
+		Reason string      `json:"reason"`
+	}
+	if !decodeJSON(w, r, &body) {
+		return
+	}
+	if _, ok := findOrder(w, r, bson.M{"_id": orderID}); !ok {
+		return
+	}
+
+	var errs []fieldError
+	if len(body.Items) == 0 {
+		errs = append(errs, fieldError{Field: "items", Message: "at least one item is required"})
+	}
+	for i, item := range body.Items {
+		if item.Quantity < 1 {
+			errs = append(errs, fieldError{Field: "items[" + strconv.Itoa(i) + "].quantity", Message: "quantity must be at least 1"})
+		}
+	}
+	if len(errs) > 0 {
+		writeValidationErrors(w, "Return is invalid", errs)
+		return
+	}
+
+	var ret Return
+	var shortfalls []returnShortfall
+	var order Order
+	err := withTransaction(r.Context(), func(ctx context.Context) error {
+		if err := database.Collection(ordersCollectionName).FindOne(ctx, bson.M{"_id": orderID}).Decode(&order); err != nil {
+			return err
+		}
+		if order.Status != orderStatusDelivered {
+			return errIllegalTransition
+		}
+
+		returned, err := returnedQuantities(ctx, orderID)
+		if err != nil {
+			return err
+		}
+		ordered := map[stockKey]int{}
+		prices := map[stockKey]float64{}
+		for _, item := range order.Items {
+			key := stockKey{FurnitureID: item.FurnitureID, VariantID: item.VariantID}
+			ordered[key] += item.Quantity
+			prices[key] = item.UnitPrice
+		}
+		requested := map[stockKey]int{}
+		for _, item := range body.Items {
+			requested[stockKey{FurnitureID: item.FurnitureID, VariantID: item.VariantID}] += item.Quantity
+		}
+
+		ret = Return{OrderID: orderID, Reason: strings.TrimSpace(body.Reason)}
+		shortfalls = nil
+		for _, item := range body.Items {
+			key := stockKey{FurnitureID: item.FurnitureID, VariantID: item.VariantID}
+			returnable := ordered[key] - returned[key]
+			if requested[key] > returnable {
+				shortfalls = append(shortfalls, returnShortfall{
+					FurnitureID: item.FurnitureID,
+					VariantID:   item.VariantID,
+					Requested:   requested[key],
+					Returnable:  returnable,
+				})
+				continue
+			}
+			ret.Items = append(ret.Items, OrderItem{
+				FurnitureID: item.FurnitureID,
+				VariantID:   item.VariantID,
+				Quantity:    item.Quantity,
+				UnitPrice:   prices[key],
+			})
+		}
+		if len(shortfalls) > 0 {
+			return nil
+		}
+
+		// Orders from before returns existed have no returns_version at all.
+		version := interface{}(order.ReturnsVersion)
+		if order.ReturnsVersion == 0 {
+			version = bson.M{"$in": bson.A{0, nil}}
+		}
+		result, err := database.Collection(ordersCollectionName).UpdateOne(ctx,
+			bson.M{"_id": orderID, "returns_version": version},
+			bson.M{"$set": bson.M{"returns_version": order.ReturnsVersion + 1}},
+		)
+		if err != nil {
+			return err
+		}
+		if result.MatchedCount == 0 {
+			return errOrderChanged
+		}
+
+		now := time.Now()
+		ret.Status = returnStatusRequested
+		ret.StatusHistory = []StatusChange{{Status: ret.Status, ChangedAt: now}}
+		ret.RefundAmount, ret.CreditRefund = refundFor(order, ret.Items)
+		ret.CreatedAt = now
+		ret.UpdatedAt = now
+		insert, err := database.Collection(returnsCollectionName).InsertOne(ctx, ret)
+		if err != nil {
+			return err
+		}
+		ret.ID = insert.InsertedID.(primitive.ObjectID)
+		return nil
+	})
+
+	switch {
+	case errors.Is(err, mongo.ErrNoDocuments):
+		writeJSONError(w, http.StatusNotFound, "Order not found")
+	case errors.Is(err, errIllegalTransition):
+		writeErrorDetails(w, http.StatusConflict, "illegal_transition", "Only delivered orders can be returned",
+			[]map[string]string{{"current_status": order.Status}})
+	case errors.Is(err, errOrderChanged):
+		writeJSONError(w, http.StatusConflict, "Another return for this order was recorded at the same time, please retry")
+	case err != nil:
+		fmt.Println("Error recording return:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to record return")
+	case len(shortfalls) > 0:
+		writeErrorDetails(w, http.StatusUnprocessableEntity, codeValidationFailed, "Cannot return more than was bought", shortfalls)
+	default:
+		writeJSON(w, http.StatusCreated, ret)
+	}
+}
+
+// handleOrderReturns lists the returns of ?id= to whoever may see the order.
+func handleOrderReturns(w http.ResponseWriter, r *http.Request) {
+	orderID, ok := parseObjectID(w, r)
+	if !ok {
+		return
+	}
+	if _, ok := findOrder(w, r, bson.M{"_id": orderID}); !ok {
+		return
+	}
+
+	opts := options.Find().SetSort(bson.D{{Key: "created_at", Value: 1}})
+	cursor, err := database.Collection(returnsCollectionName).Find(r.Context(), bson.M{"order_id": orderID}, opts)
+	if err != nil {
+		fmt.Println("Error querying returns:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to load returns")
+		return
+	}
+	defer cursor.Close(r.Context())
+
+	returns := []Return{}
+	if err := cursor.All(r.Context(), &returns); err != nil {
+		fmt.Println("Error decoding returns:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to load returns")
+		return
+	}
+	writeJSON(w, http.StatusOK, returns)
+}
+
+// transitionReturn moves a return to status if its current status allows it,
+// in one guarded update like transitionOrder.
+func transitionReturn(ctx context.Context, id primitive.ObjectID, status string) (Return, error) {
+	var from []string
+	for current, next := range returnTransitions {
+		for _, s := range next {
+			if s == status {
+				from = append(from, current)
+			}
+		}
+	}
+	if from == nil {
+		from = []string{}
+	}
+
+	now := time.Now()
+	var ret Return
+	returnsCollection := database.Collection(returnsCollectionName)
+	err := returnsCollection.FindOneAndUpdate(ctx,
+		bson.M{"_id": id, "status": bson.M{"$in": from}},
+		bson.M{
+			"$set":  bson.M{"status": status, "updated_at": now},
+			"$push": bson.M{"status_history": StatusChange{Status: status, ChangedAt: now}},
+		},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&ret)
+	if !errors.Is(err, mongo.ErrNoDocuments) {
+		return ret, err
+	}
+	if err := returnsCollection.FindOne(ctx, bson.M{"_id": id}).Decode(&ret); err != nil {
+		return ret, err
+	}
+	return ret, errIllegalTransition
+}
+
+// updateReturnStatus moves a return along requested → approved → refunded
+// (or to rejected). Approving puts the returned units back into stock;
+// refunding gives back the store credit share, as cancelling an order does.
+// It is for admins only.
+func updateReturnStatus(w http.ResponseWriter, r *http.Request) {
+	id, ok := parseObjectID(w, r)
+	if !ok {
+		return
+	}
+
+	var body struct {
+		Status string `json:"status"`
+	}
+	if !decodeJSON(w, r, &body) {
+		return
+	}
+	if _, known := returnTransitions[body.Status]; !known || body.Status == returnStatusRequested {
+		writeJSONError(w, http.StatusBadRequest, "status must be one of approved, refunded, rejected")
+		return
+	}
+
+	var ret Return
+	err := withTransaction(r.Context(), func(ctx context.Context) error {
+		var err error
+		if ret, err = transitionReturn(ctx, id, body.Status); err != nil {
+			return err
+		}
+		switch body.Status {
+		case returnStatusApproved:
+			return releaseStock(ctx, ret.Items)
+		case returnStatusRefunded:
+			return refundReturnCredit(ctx, ret)
+		}
+		return nil
+	})
+	switch {
+	case errors.Is(err, errIllegalTransition):
+		writeErrorDetails(w, http.StatusConflict, "illegal_transition",
+			fmt.Sprintf("Cannot move a return from %s to %s", ret.Status, body.Status),
+			[]map[string]string{{"current_status": ret.Status}})
+	case errors.Is(err, mongo.ErrNoDocuments):
+		writeJSONError(w, http.StatusNotFound, "Return not found")
+	case err != nil:
+		fmt.Println("Error updating return status:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to update return status")
+	default:
+		writeJSON(w, http.StatusOK, ret)
+	}
+}
+
+func refundReturnCredit(ctx context.Context, ret Return) error {
+	if ret.CreditRefund <= 0 {
+		return nil
+	}
+	var order Order
+	opts := options.FindOne().SetProjection(bson.M{"user_id": 1})
+	if err := database.Collection(ordersCollectionName).FindOne(ctx, bson.M{"_id": ret.OrderID}, opts).Decode(&order); err != nil {
+		return err
+	}
+	if order.UserID == nil {
+		return nil
+	}
+	refund := CreditMovement{UserID: *order.UserID, Amount: ret.CreditRefund, Reason: creditReasonReturnRefunded, OrderID: &ret.OrderID}
+	return moveCredit(ctx, refund)
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestRefundFor(t *testing.T) {
+	items := []OrderItem{{FurnitureID: 1, Quantity: 1, UnitPrice: 60}}
+	tests := []struct {
+		name               string
+		order              Order
+		wantAmount, credit float64
+	}{
+		{"full price", Order{Subtotal: 100, Total: 100}, 60, 0},
+		{"coupon", Order{Subtotal: 100, Discount: 20, Total: 80}, 48, 0},
+		{"store credit", Order{Subtotal: 100, StoreCredit: 25, Total: 75}, 60, 15},
+		{"coupon and store credit", Order{Subtotal: 100, Discount: 20, StoreCredit: 40, Total: 40}, 48, 24},
+		{"paid all in credit", Order{Subtotal: 100, Discount: 20, StoreCredit: 80}, 48, 48},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			amount, credit := refundFor(tt.order, items)
+			if amount != tt.wantAmount || credit != tt.credit {
+				t.Errorf("refundFor = %.2f, %.2f credit; want %.2f, %.2f credit", amount, credit, tt.wantAmount, tt.credit)
+			}
+		})
+	}
+}
+
+func TestRefundedReturnGivesBackTheCreditShare(t *testing.T) {
+	h, db := testServer(t)
+	ctx := context.Background()
+	customer := User{ID: primitive.NewObjectID(), Name: "Jane", Email: "jane@example.com"}
+	if _, err := db.Collection(collectionName).InsertOne(ctx, customer); err != nil {
+		t.Fatalf("insert user: %v", err)
+	}
+	if _, err := db.Collection(furnitureCollectionName).InsertOne(ctx, Furniture{ID: 1, Name: "Chair", Price: 50}); err != nil {
+		t.Fatalf("insert furniture: %v", err)
+	}
+	order := Order{
+		ID:          primitive.NewObjectID(),
+		UserID:      &customer.ID,
+		Items:       []OrderItem{{FurnitureID: 1, Quantity: 2, UnitPrice: 50}},
+		Subtotal:    100,
+		StoreCredit: 30,
+		Total:       70,
+		Status:      orderStatusDelivered,
+		CreatedAt:   time.Now(),
+	}
+	if _, err := db.Collection(ordersCollectionName).InsertOne(ctx, order); err != nil {
+		t.Fatalf("insert order: %v", err)
+	}
+
+	rec := serveTest(h, http.MethodPost, "/orders/return?id="+order.ID.Hex(), testToken(t, customer), `{"items":[{"furniture_id":1,"quantity":1}]}`)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("POST /orders/return = %d: %s", rec.Code, rec.Body)
+	}
+	var ret Return
+	if err := json.Unmarshal(rec.Body.Bytes(), &ret); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if ret.RefundAmount != 50 || ret.CreditRefund != 15 {
+		t.Errorf("refund = %.2f with %.2f credit, want 50.00 with 15.00", ret.RefundAmount, ret.CreditRefund)
+	}
+
+	admin := testToken(t, User{ID: primitive.NewObjectID(), Role: roleAdmin})
+	for _, status := range []string{returnStatusApproved, returnStatusRefunded} {
+		rec := serveTest(h, http.MethodPatch, "/admin/returns?id="+ret.ID.Hex(), admin, `{"status":"`+status+`"}`)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("PATCH /admin/returns to %s = %d: %s", status, rec.Code, rec.Body)
+		}
+	}
+
+	balance, err := creditBalance(ctx, customer.ID)
+	if err != nil {
+		t.Fatalf("creditBalance: %v", err)
+	}
+	if balance != 15 {
+		t.Errorf("balance = %.2f after the refund, want 15.00", balance)
+	}
+	var entry CreditMovement
+	if err := db.Collection(creditLedgerCollectionName).FindOne(ctx, bson.M{"user_id": customer.ID}).Decode(&entry); err != nil {
+		t.Fatalf("load ledger entry: %v", err)
+	}
+	if entry.Amount != 15 || entry.Reason != creditReasonReturnRefunded || entry.OrderID == nil || *entry.OrderID != order.ID {
+		t.Errorf("ledger entry = %+v, want 15.00 for the return of the order", entry)
+	}
+}
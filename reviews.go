@@ -0,0 +1,308 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	reviewStatusPending  = "pending"
+	reviewStatusApproved = "approved"
+	reviewStatusRejected = "rejected"
+
+	maxReviewLength = 2000
+)
+
+type Review struct {
+	ID          primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+	FurnitureID int                `json:"furniture_id" bson:"furniture_id"`
+	// UserID is zero once the author has been anonymized.
+	UserID      primitive.ObjectID `json:"user_id" bson:"user_id,omitempty"`
+	Rating      int                `json:"rating" bson:"rating"`
+	Text        string             `json:"text" bson:"text"`
+	Status      string             `json:"status" bson:"status"`
+	CreatedAt   time.Time          `json:"created_at" bson:"created_at"`
+	ModeratedAt *time.Time         `json:"moderated_at,omitempty" bson:"moderated_at,omitempty"`
+}
+
+// reviewInput takes the rating as a float so that 4.5 is reported as not a
+// whole number instead of failing to decode.
+type reviewInput struct {
+	FurnitureID int      `json:"furniture_id"`
+	Rating      *float64 `json:"rating"`
+	Text        string   `json:"text"`
+}
+
+// createReviewIndexes allows one review per user and item. Reviews detached
+// from an anonymized author have no user_id and are left out of that rule.
+func createReviewIndexes() error {
+	indexes := database.Collection(reviewsCollectionName).Indexes()
+	// Superseded by furniture_user_unique.
+	if _, err := indexes.DropOne(context.TODO(), "furniture_id_1_user_id_1"); err != nil && !isIndexNotFound(err) {
+		return err
+	}
+	_, err := indexes.CreateMany(context.TODO(), []mongo.IndexModel{
+		{
+			Keys: bson.D{{Key: "furniture_id", Value: 1}, {Key: "user_id", Value: 1}},
+			Options: options.Index().
+				SetName("furniture_user_unique").
+				SetUnique(true).
+				SetPartialFilterExpression(bson.M{"user_id": bson.M{"$type": "objectId"}}),
+		},
+		{Keys: bson.D{{Key: "furniture_id", Value: 1}, {Key: "status", Value: 1}, {Key: "created_at", Value: -1}}},
+		{Keys: bson.D{{Key: "status", Value: 1}, {Key: "created_at", Value: 1}}},
+	})
+	return err
+}
+
+func (in *reviewInput) validate() (Review, []fieldError) {
+	review := Review{FurnitureID: in.FurnitureID, Text: strings.TrimSpace(in.Text)}
+	var errs []fieldError
+
+	switch {
+	case in.Rating == nil:
+		errs = append(errs, fieldError{Field: "rating", Message: "rating is required"})
+	case *in.Rating != math.Trunc(*in.Rating) || *in.Rating < 1 || *in.Rating > 5:
+		errs = append(errs, fieldError{Field: "rating", Message: "rating must be a whole number from 1 to 5"})
+	default:
+		review.Rating = int(*in.Rating)
+	}
+
+	if utf8.RuneCountInString(review.Text) > maxReviewLength {
+		errs = append(errs, fieldError{Field: "text", Message: fmt.Sprintf("text must be at most %d characters", maxReviewLength)})
+	}
+	return review, errs
+}
+
+func handleReviews(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		listReviews(w, r)
+	case http.MethodPost:
+		requireAuth(createReview)(w, r)
+	default:
+		writeJSONError(w, http.StatusMethodNotAllowed, "Method not allowed")
+	}
+}
+
+// createReview stores a review by the caller for moderation; it is not shown
+// until approved.
+func createReview(w http.ResponseWriter, r *http.Request) {
+	var in reviewInput
+	if !decodeJSON(w, r, &in) {
+		return
+	}
+	review, errs := in.validate()
+	review.UserID, _ = authenticatedUserID(r.Context())
+
+	err := database.Collection(furnitureCollectionName).FindOne(r.Context(), activeFurnitureByID(review.FurnitureID)).Err()
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		errs = append(errs, fieldError{Field: "furniture_id", Message: fmt.Sprintf("unknown furniture ID %d", review.FurnitureID)})
+	} else if err != nil {
+		fmt.Println("Error looking up furniture:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to submit review")
+		return
+	}
+	if len(errs) > 0 {
+		writeValidationErrors(w, "Review is invalid", errs)
+		return
+	}
+
+	review.Status = reviewStatusPending
+	review.CreatedAt = time.Now()
+	result, err := database.Collection(reviewsCollectionName).InsertOne(r.Context(), review)
+	if mongo.IsDuplicateKeyError(err) {
+		writeJSONError(w, http.StatusConflict, "You have already reviewed this item")
+		return
+	}
+	if err != nil {
+		fmt.Println("Error inserting review:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to submit review")
+		return
+	}
+	review.ID = result.InsertedID.(primitive.ObjectID)
+	writeJSON(w, http.StatusCreated, review)
+}
+
+// listReviews pages through the approved reviews of ?furniture_id=, newest
+// first.
+func listReviews(w http.ResponseWriter, r *http.Request) {
+	furnitureID, err := strconv.Atoi(r.URL.Query().Get("furniture_id"))
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "furniture_id must be an integer")
+		return
+	}
+	pageReviews(w, r, bson.M{"furniture_id": furnitureID, "status": reviewStatusApproved}, -1)
+}
+
+func pageReviews(w http.ResponseWriter, r *http.Request, filter bson.M, order int) {
+	page, err := parsePagination(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	reviewsCollection := database.Collection(reviewsCollectionName)
+	total, err := reviewsCollection.CountDocuments(r.Context(), filter)
+	if err != nil {
+		fmt.Println("Error counting reviews:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to load reviews")
+		return
+	}
+
+	opts := options.Find().
+		SetSort(bson.D{{Key: "created_at", Value: order}, {Key: "_id", Value: order}}).
+		SetSkip(page.skip()).
+		SetLimit(int64(page.Limit))
+	cursor, err := reviewsCollection.Find(r.Context(), filter, opts)
+	if err != nil {
+		fmt.Println("Error querying reviews:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to load reviews")
+		return
+	}
+	defer cursor.Close(r.Context())
+
+	reviews := []Review{}
+	if err := cursor.All(r.Context(), &reviews); err != nil {
+		fmt.Println("Error decoding reviews:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to load reviews")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, pageResponse{
+		Items:      reviews,
+		Total:      total,
+		Page:       page.Page,
+		TotalPages: page.totalPages(total),
+	})
+}
+
+// setReviewStatus moves a review to status and updates its item's rating to
+// match. The status write is guarded on the old status, so of two concurrent
+// moderators only one changes the rating.
+func setReviewStatus(ctx context.Context, id primitive.ObjectID, status string) (Review, error) {
+	var review Review
+	err := withTransaction(ctx, func(ctx context.Context) error {
+		reviewsCollection := database.Collection(reviewsCollectionName)
+		var before Review
+		err := reviewsCollection.FindOneAndUpdate(ctx,
+			bson.M{"_id": id, "status": bson.M{"$ne": status}},
+			bson.M{"$set": bson.M{"status": status, "moderated_at": time.Now()}},
+		).Decode(&before)
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			// Either missing or already in that status; the reload tells.
+			return reviewsCollection.FindOne(ctx, bson.M{"_id": id}).Decode(&review)
+		}
+		if err != nil {
+			return err
+		}
+
+		review = before
+		review.Status = status
+		if ratingDelta, countDelta := reviewRatingChange(before, before.Status, status); countDelta != 0 {
+			return adjustRating(ctx, before.FurnitureID, ratingDelta, countDelta)
+		}
+		return nil
+	})
+	return review, err
+}
+
+// deleteReview removes a review, taking it out of the item's rating if it
+// was approved.
+func deleteReview(w http.ResponseWriter, r *http.Request) {
+	id, ok := parseObjectID(w, r)
+	if !ok {
+		return
+	}
+
+	err := withTransaction(r.Context(), func(ctx context.Context) error {
+		var review Review
+		if err := database.Collection(reviewsCollectionName).FindOneAndDelete(ctx, bson.M{"_id": id}).Decode(&review); err != nil {
+			return err
+		}
+		if review.Status == reviewStatusApproved {
+			return adjustRating(ctx, review.FurnitureID, -review.Rating, -1)
+		}
+		return nil
+	})
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		writeJSONError(w, http.StatusNotFound, "Review not found")
+		return
+	}
+	if err != nil {
+		fmt.Println("Error deleting review:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to delete review")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func handleAdminReviews(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		listReviewQueue(w, r)
+	case http.MethodPatch:
+		moderateReview(w, r)
+	case http.MethodDelete:
+		deleteReview(w, r)
+	default:
+		writeJSONError(w, http.StatusMethodNotAllowed, "Method not allowed")
+	}
+}
+
+// listReviewQueue lists reviews by ?status= (pending by default), oldest
+// first so moderators work through them in order.
+func listReviewQueue(w http.ResponseWriter, r *http.Request) {
+	status := r.URL.Query().Get("status")
+	switch status {
+	case "":
+		status = reviewStatusPending
+	case reviewStatusPending, reviewStatusApproved, reviewStatusRejected:
+	default:
+		writeJSONError(w, http.StatusBadRequest, "status must be one of pending, approved, rejected")
+		return
+	}
+	pageReviews(w, r, bson.M{"status": status}, 1)
+}
+
+func moderateReview(w http.ResponseWriter, r *http.Request) {
+	id, ok := parseObjectID(w, r)
+	if !ok {
+		return
+	}
+
+	var body struct {
+		Status string `json:"status"`
+	}
+	if !decodeJSON(w, r, &body) {
+		return
+	}
+	if body.Status != reviewStatusApproved && body.Status != reviewStatusRejected {
+		writeJSONError(w, http.StatusBadRequest, "status must be approved or rejected")
+		return
+	}
+
+	review, err := setReviewStatus(r.Context(), id, body.Status)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		writeJSONError(w, http.StatusNotFound, "Review not found")
+		return
+	}
+	if err != nil {
+		fmt.Println("Error moderating review:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to moderate review")
+		return
+	}
+	writeJSON(w, http.StatusOK, review)
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+const (
+	roleCustomer = "customer"
+	roleAdmin    = "admin"
+)
+
+// role treats users created before roles existed as customers.
+func (u User) role() string {
+	if u.Role == "" {
+		return roleCustomer
+	}
+	return u.Role
+}
+
+// requireAdmin is requireAuth for staff endpoints: authenticated callers
+// without the admin role get 403.
+func requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return requireAuth(func(w http.ResponseWriter, r *http.Request) {
+		if !callerIsAdmin(r.Context()) {
+			writeJSONError(w, http.StatusForbidden, "Admin role required")
+			return
+		}
+		next(w, r)
+	})
+}
+
+// adminWrites leaves reads of next public, though a caller who signs in is
+// known to it; every other method requires an admin or an API key with scope.
+func adminWrites(scope string, next http.HandlerFunc) http.HandlerFunc {
+	admin := requireAdminOrKey(scope, next)
+	read := optionalAuth(next)
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			read(w, r)
+			return
+		}
+		admin(w, r)
+	}
+}
+
+// bootstrapAdmin promotes the account with email, ADMIN_EMAIL, so that the
+// first admin can exist. It does nothing when email is empty.
+func bootstrapAdmin(email string) error {
+	if email == "" {
+		return nil
+	}
+	result, err := database.Collection(collectionName).UpdateMany(context.TODO(),
+		bson.M{"email": email, "deleted_at": nil, "password_hash": bson.M{"$exists": true}},
+		bson.M{"$set": bson.M{"role": roleAdmin, "updated_at": time.Now()}},
+	)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		fmt.Println("ADMIN_EMAIL does not match any account; register it and restart to promote it")
+	}
+	return nil
+}
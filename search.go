@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const furnitureTextIndexName = "furniture_text"
+
+// errCodeIndexNotFound is returned by $text queries when no text index exists.
+const errCodeIndexNotFound = 27
+
+type furnitureSearchResult struct {
+	Furniture `bson:",inline"`
+	Score     float64 `json:"score" bson:"score"`
+}
+
+// createFurnitureTextIndex is safe to call repeatedly: creating an index that
+// already exists with the same definition is a no-op.
+func createFurnitureTextIndex(ctx context.Context) error {
+	_, err := database.Collection(furnitureCollectionName).Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "name", Value: "text"}, {Key: "description", Value: "text"}},
+		Options: options.Index().
+			SetName(furnitureTextIndexName).
+			SetWeights(bson.M{"name": 3, "description": 1}),
+	})
+	return err
+}
+
+func isIndexNotFound(err error) bool {
+	var cmdErr mongo.CommandError
+	if errors.As(err, &cmdErr) {
+		return cmdErr.Code == errCodeIndexNotFound
+	}
+	var serverErr mongo.ServerError
+	return errors.As(err, &serverErr) && serverErr.HasErrorCode(errCodeIndexNotFound)
+}
+
+func searchFurniture(w http.ResponseWriter, r *http.Request) {
+	q := strings.TrimSpace(r.URL.Query().Get("q"))
+	if q == "" {
+		writeJSONError(w, http.StatusBadRequest, "q is required")
+		return
+	}
+	page, err := parsePagination(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	results, err := runFurnitureSearch(r.Context(), q, page)
+	if isIndexNotFound(err) {
+		// The startup index creation may have failed or the collection was
+		// recreated; build the index now and try once more.
+		if err = createFurnitureTextIndex(r.Context()); err == nil {
+			results, err = runFurnitureSearch(r.Context(), q, page)
+		}
+	}
+	if err != nil {
+		fmt.Println("Error searching furniture:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to search furniture")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, results)
+}
+
+func runFurnitureSearch(ctx context.Context, q string, page pagination) ([]furnitureSearchResult, error) {
+	filter := bson.M{
+		"$text":      bson.M{"$search": q},
+		"deleted_at": bson.M{"$exists": false},
+	}
+	score := bson.M{"$meta": "textScore"}
+	opts := options.Find().
+		SetProjection(bson.M{"score": score}).
+		SetSort(bson.D{{Key: "score", Value: score}, {Key: "_id", Value: 1}}).
+		SetSkip(page.skip()).
+		SetLimit(int64(page.Limit))
+
+	cursor, err := database.Collection(furnitureCollectionName).Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	results := []furnitureSearchResult{}
+	if err := cursor.All(ctx, &results); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	sessionCookieName = "session_id"
+	sessionLifetime   = 7 * 24 * time.Hour
+)
+
+// Session backs cookie logins for clients that cannot hold a JWT. The
+// cookie carries a random token; only its hash is stored.
+type Session struct {
+	ID        primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+	UserID    primitive.ObjectID `json:"-" bson:"user_id"`
+	TokenHash string             `json:"-" bson:"token_hash"`
+	UserAgent string             `json:"user_agent,omitempty" bson:"user_agent,omitempty"`
+	IP        string             `json:"ip,omitempty" bson:"ip,omitempty"`
+	CreatedAt time.Time          `json:"created_at" bson:"created_at"`
+	ExpiresAt time.Time          `json:"expires_at" bson:"expires_at"`
+}
+
+var errSessionInvalid = errors.New("session is invalid")
+
+func createSessionIndexes() error {
+	_, err := database.Collection(sessionsCollectionName).Indexes().CreateMany(context.TODO(), []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "token_hash", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+		{Keys: bson.D{{Key: "user_id", Value: 1}}},
+		{
+			Keys:    bson.D{{Key: "expires_at", Value: 1}},
+			Options: options.Index().SetExpireAfterSeconds(0),
+		},
+	})
+	return err
+}
+
+func setSessionCookie(w http.ResponseWriter, token string, maxAge int) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    token,
+		Path:     "/",
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// startSession stores a session for user and sets its cookie.
+func startSession(w http.ResponseWriter, r *http.Request, user User) error {
+	token, err := newSecretToken()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	_, err = database.Collection(sessionsCollectionName).InsertOne(r.Context(), Session{
+		UserID:    user.ID,
+		TokenHash: hashToken(token),
+		UserAgent: r.UserAgent(),
+		IP:        clientIP(r),
+		CreatedAt: now,
+		ExpiresAt: now.Add(sessionLifetime),
+	})
+	if err != nil {
+		return err
+	}
+	setSessionCookie(w, token, int(sessionLifetime/time.Second))
+	return nil
+}
+
+// authenticateSession resolves a session cookie to its caller. The role is
+// read from the user document on every request.
+func authenticateSession(ctx context.Context, token string) (principal, error) {
+	var session Session
+	err := database.Collection(sessionsCollectionName).FindOne(ctx, bson.M{
+		"token_hash": hashToken(token),
+		"expires_at": bson.M{"$gt": time.Now()},
+	}).Decode(&session)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return principal{}, errSessionInvalid
+	}
+	if err != nil {
+		return principal{}, err
+	}
+
+	var user User
+	err = database.Collection(collectionName).FindOne(ctx, activeUserByID(session.UserID)).Decode(&user)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return principal{}, errSessionInvalid
+	}
+	if err != nil {
+		return principal{}, err
+	}
+	return principal{UserID: user.ID, Role: user.role(), SessionID: session.ID}, nil
+}
+
+// endSession deletes the session of the request's cookie, if any, and
+// clears the cookie. ok is false when the request had no session cookie.
+func endSession(w http.ResponseWriter, r *http.Request) (ok bool, err error) {
+	cookie, err := r.Cookie(sessionCookieName)
+	if err != nil {
+		return false, nil
+	}
+	setSessionCookie(w, "", -1)
+	_, err = database.Collection(sessionsCollectionName).DeleteOne(r.Context(), bson.M{"token_hash": hashToken(cookie.Value)})
+	return true, err
+}
+
+func deleteUserSessions(ctx context.Context, userID primitive.ObjectID) error {
+	_, err := database.Collection(sessionsCollectionName).DeleteMany(ctx, bson.M{"user_id": userID})
+	return err
+}
+
+func handleSessions(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		listSessions(w, r)
+	case http.MethodDelete:
+		revokeSession(w, r)
+	default:
+		writeJSONError(w, http.StatusMethodNotAllowed, "Method not allowed")
+	}
+}
+
+type sessionResponse struct {
+	Session
+	Current bool `json:"current"`
+}
+
+func listSessions(w http.ResponseWriter, r *http.Request) {
+	caller, _ := authenticatedCaller(r.Context())
+	cursor, err := database.Collection(sessionsCollectionName).Find(r.Context(),
+		bson.M{"user_id": caller.UserID, "expires_at": bson.M{"$gt": time.Now()}},
+		options.Find().SetSort(bson.D{{Key: "created_at", Value: -1}}),
+	)
+	if err != nil {
+		fmt.Println("Error querying sessions:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to load sessions")
+		return
+	}
+	defer cursor.Close(r.Context())
+
+	var sessions []Session
+	if err := cursor.All(r.Context(), &sessions); err != nil {
+		fmt.Println("Error decoding sessions:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to load sessions")
+		return
+	}
+	response := []sessionResponse{}
+	for _, session := range sessions {
+		response = append(response, sessionResponse{Session: session, Current: session.ID == caller.SessionID})
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+// revokeSession ends one of the caller's own sessions, such as one left
+// open on another device.
+func revokeSession(w http.ResponseWriter, r *http.Request) {
+	id, ok := parseObjectID(w, r)
+	if !ok {
+		return
+	}
+	caller, _ := authenticatedCaller(r.Context())
+
+	result, err := database.Collection(sessionsCollectionName).DeleteOne(r.Context(), bson.M{"_id": id, "user_id": caller.UserID})
+	if err != nil {
+		fmt.Println("Error deleting session:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to revoke session")
+		return
+	}
+	if result.DeletedCount == 0 {
+		writeJSONError(w, http.StatusNotFound, "Session not found")
+		return
+	}
+	if id == caller.SessionID {
+		setSessionCookie(w, "", -1)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// shutdownTimeout is how long requests in flight get to finish after a
+// SIGINT or SIGTERM. It is well above requestTimeout, so normally every
+// request ends on its own. SHUTDOWN_TIMEOUT changes it.
+var shutdownTimeout = 30 * time.Second
+
+// backgroundCtx is cancelled when the server shuts down; backgroundWork
+// counts what still runs in the background. See goBackground.
+var (
+	backgroundCtx, stopBackground = context.WithCancel(context.Background())
+	backgroundWork                sync.WaitGroup
+)
+
+// goBackground runs fn outside any request. On shutdown ctx is cancelled and
+// the server waits for fn to return: long-running workers should stop on
+// ctx, short tasks such as queueing an email may ignore it and finish.
+func goBackground(fn func(ctx context.Context)) {
+	goBackgroundFor(context.Background(), fn)
+}
+
+// goBackgroundFor is goBackground for work a request started: ctx carries
+// the ID and the trace of the request in parent, so logs, emails and
+// webhooks can be traced back to it.
+func goBackgroundFor(parent context.Context, fn func(ctx context.Context)) {
+	ctx := continueTrace(backgroundCtx, parent)
+	if id := requestIDFrom(parent); id != "" {
+		ctx = withRequestID(ctx, id)
+	}
+	backgroundWork.Add(1)
+	go func() {
+		defer backgroundWork.Done()
+		fn(ctx)
+	}()
+}
+
+// serve runs srv until SIGINT or SIGTERM. It then fails readiness for
+// readinessDrainDelay, stops accepting requests and waits up to
+// shutdownTimeout for those in flight and for the background work.
+// Requests still running after that have their context cancelled, so
+// their database calls fail and transactions roll back instead of being
+// cut off half way once the client disconnects. The error is the one that
+// kept srv from listening; a shutdown on a signal returns nil.
+func serve(srv *http.Server) error {
+	requestsCtx, cancelRequests := context.WithCancel(context.Background())
+	defer cancelRequests()
+	srv.BaseContext = func(net.Listener) context.Context { return requestsCtx }
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
+	failed := make(chan error, 1)
+	go func() {
+		failed <- srv.ListenAndServe()
+	}()
+	select {
+	case err := <-failed:
+		fmt.Println("Error starting the server:", err)
+		return err
+	case sig := <-signals:
+		fmt.Println("Received", sig, "- shutting down")
+	}
+
+	// Fail readiness first and keep serving while load balancers catch up;
+	// a second signal skips the wait.
+	shuttingDown.Store(true)
+	select {
+	case <-time.After(readinessDrainDelay):
+	case <-signals:
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		fmt.Println("Error draining requests:", err)
+		cancelRequests()
+	}
+
+	stopBackground()
+	done := make(chan struct{})
+	go func() {
+		backgroundWork.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		fmt.Println("Background work was still running at shutdown")
+	}
+	return nil
+}
+
+// disconnectMongo closes c with a context of its own, since whatever
+// context it was connected with has long expired.
+func disconnectMongo(c *mongo.Client) {
+	if c == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := c.Disconnect(ctx); err != nil && !errors.Is(err, mongo.ErrClientDisconnected) {
+		fmt.Println("Error disconnecting from MongoDB:", err)
+	}
+}
@@ -0,0 +1,473 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"golang.org/x/sync/errgroup"
+)
+
+const (
+	defaultStatsWindow = 30 * 24 * time.Hour
+	maxStatsDays       = 366
+	statsDayFormat     = "2006-01-02"
+)
+
+type dailySales struct {
+	Date    string  `json:"date" bson:"_id"`
+	Orders  int     `json:"orders" bson:"orders"`
+	Revenue float64 `json:"revenue" bson:"revenue"`
+}
+
+// statsRange reads ?from= and ?to= (RFC3339), defaulting to the last 30 days.
+func statsRange(r *http.Request) (from, to time.Time, err error) {
+	to, hasTo, err := timeParam(r, "to")
+	if err != nil {
+		return from, to, err
+	}
+	if !hasTo {
+		to = time.Now()
+	}
+	from, hasFrom, err := timeParam(r, "from")
+	if err != nil {
+		return from, to, err
+	}
+	if !hasFrom {
+		from = to.Add(-defaultStatsWindow)
+	}
+	if from.After(to) {
+		return from, to, badRequestf("from must not be after to")
+	}
+	return from, to, nil
+}
+
+// soldOrdersMatch selects the orders in [from, to] that count as sales.
+func soldOrdersMatch(from, to time.Time) bson.D {
+	return bson.D{{Key: "$match", Value: bson.M{
+		"created_at": bson.M{"$gte": from, "$lte": to},
+		"status":     bson.M{"$ne": orderStatusCancelled},
+	}}}
+}
+
+// handleSalesStats reports order count and revenue per UTC day. Days without
+// orders are filled in with zeros so the series has no holes.
+func handleSalesStats(w http.ResponseWriter, r *http.Request) {
+	from, to, err := statsRange(r)
+	if err != nil {
+		writeQueryError(w, err, "Failed to load sales")
+		return
+	}
+	firstDay := from.UTC().Truncate(24 * time.Hour)
+	lastDay := to.UTC().Truncate(24 * time.Hour)
+	if lastDay.Sub(firstDay) >= maxStatsDays*24*time.Hour {
+		writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("the range may span at most %d days", maxStatsDays))
+		return
+	}
+
+	pipeline := mongo.Pipeline{
+		soldOrdersMatch(from, to),
+		{{Key: "$group", Value: bson.M{
+			"_id":     bson.M{"$dateToString": bson.M{"format": "%Y-%m-%d", "date": "$created_at", "timezone": "UTC"}},
+			"orders":  bson.M{"$sum": 1},
+			"revenue": bson.M{"$sum": "$total"},
+		}}},
+	}
+	cursor, err := database.Collection(ordersCollectionName).Aggregate(r.Context(), pipeline)
+	if err != nil {
+		fmt.Println("Error aggregating sales:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to load sales")
+		return
+	}
+	defer cursor.Close(r.Context())
+
+	var rows []dailySales
+	if err := cursor.All(r.Context(), &rows); err != nil {
+		fmt.Println("Error decoding sales:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to load sales")
+		return
+	}
+	byDay := make(map[string]dailySales, len(rows))
+	for _, row := range rows {
+		byDay[row.Date] = row
+	}
+
+	days := []dailySales{}
+	for day := firstDay; !day.After(lastDay); day = day.AddDate(0, 0, 1) {
+		key := day.Format(statsDayFormat)
+		row, ok := byDay[key]
+		if !ok {
+			row = dailySales{Date: key}
+		}
+		row.Revenue = math.Round(row.Revenue*100) / 100
+		days = append(days, row)
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"from": from,
+		"to":   to,
+		"days": days,
+	})
+}
+
+const (
+	defaultTopProducts = 10
+	maxTopProducts     = 50
+)
+
+// topProduct is one best seller. Deleted is set for items that were removed
+// from the catalogue since; their past sales still count.
+type topProduct struct {
+	FurnitureID  int      `json:"furniture_id" bson:"_id"`
+	Name         string   `json:"name" bson:"name"`
+	CurrentPrice *float64 `json:"current_price" bson:"current_price"`
+	Quantity     int      `json:"quantity" bson:"quantity"`
+	Revenue      float64  `json:"revenue" bson:"revenue"`
+	Deleted      bool     `json:"deleted" bson:"deleted"`
+}
+
+func handleTopProducts(w http.ResponseWriter, r *http.Request) {
+	from, to, err := statsRange(r)
+	if err != nil {
+		writeQueryError(w, err, "Failed to load top products")
+		return
+	}
+	limit := defaultTopProducts
+	if raw := r.URL.Query().Get("limit"); raw != "" {
+		parsed, err := strconv.Atoi(raw)
+		if err != nil || parsed < 1 {
+			writeJSONError(w, http.StatusBadRequest, "limit must be a positive integer")
+			return
+		}
+		limit = parsed
+	}
+	if limit > maxTopProducts {
+		limit = maxTopProducts
+	}
+
+	pipeline := mongo.Pipeline{
+		soldOrdersMatch(from, to),
+		{{Key: "$unwind", Value: "$items"}},
+		{{Key: "$group", Value: bson.M{
+			"_id":      "$items.furniture_id",
+			"quantity": bson.M{"$sum": "$items.quantity"},
+			"revenue":  bson.M{"$sum": bson.M{"$multiply": bson.A{"$items.unit_price", "$items.quantity"}}},
+		}}},
+		{{Key: "$sort", Value: bson.D{{Key: "quantity", Value: -1}, {Key: "revenue", Value: -1}, {Key: "_id", Value: 1}}}},
+		{{Key: "$limit", Value: limit}},
+		{{Key: "$lookup", Value: bson.M{
+			"from":         furnitureCollectionName,
+			"localField":   "_id",
+			"foreignField": "_id",
+			"as":           "furniture",
+		}}},
+		{{Key: "$unwind", Value: bson.M{"path": "$furniture", "preserveNullAndEmptyArrays": true}}},
+		{{Key: "$project", Value: bson.M{
+			"quantity":      1,
+			"revenue":       1,
+			"name":          "$furniture.name",
+			"current_price": "$furniture.price",
+			"deleted": bson.M{"$or": bson.A{
+				bson.M{"$eq": bson.A{bson.M{"$type": "$furniture"}, "missing"}},
+				bson.M{"$ne": bson.A{bson.M{"$type": "$furniture.deleted_at"}, "missing"}},
+			}},
+		}}},
+		{{Key: "$sort", Value: bson.D{{Key: "quantity", Value: -1}, {Key: "revenue", Value: -1}, {Key: "_id", Value: 1}}}},
+	}
+	cursor, err := database.Collection(ordersCollectionName).Aggregate(r.Context(), pipeline)
+	if err != nil {
+		fmt.Println("Error aggregating top products:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to load top products")
+		return
+	}
+	defer cursor.Close(r.Context())
+
+	products := []topProduct{}
+	if err := cursor.All(r.Context(), &products); err != nil {
+		fmt.Println("Error decoding top products:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to load top products")
+		return
+	}
+	for i := range products {
+		products[i].Revenue = math.Round(products[i].Revenue*100) / 100
+	}
+
+	writeJSON(w, http.StatusOK, products)
+}
+
+const overviewTimeout = 5 * time.Second
+
+// overviewMetrics collects the dashboard figures computed concurrently. A
+// metric that fails is left out of values and its error is recorded instead,
+// so one slow or broken query does not take the whole dashboard down.
+type overviewMetrics struct {
+	mu     sync.Mutex
+	values map[string]interface{}
+	errors map[string]string
+}
+
+func (m *overviewMetrics) run(ctx context.Context, g *errgroup.Group, name string, compute func(ctx context.Context) (interface{}, error)) {
+	g.Go(func() error {
+		value, err := compute(ctx)
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		if err != nil {
+			fmt.Printf("Error computing %s: %v\n", name, err)
+			m.errors[name] = "could not be computed"
+			m.values[name] = nil
+			return nil
+		}
+		m.values[name] = value
+		return nil
+	})
+}
+
+func countOf(collection string, filter bson.M) func(ctx context.Context) (interface{}, error) {
+	return func(ctx context.Context) (interface{}, error) {
+		return database.Collection(collection).CountDocuments(ctx, filter)
+	}
+}
+
+func ordersByStatus(ctx context.Context) (interface{}, error) {
+	cursor, err := database.Collection(ordersCollectionName).Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$group", Value: bson.M{"_id": "$status", "count": bson.M{"$sum": 1}}}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var rows []struct {
+		Status string `bson:"_id"`
+		Count  int64  `bson:"count"`
+	}
+	if err := cursor.All(ctx, &rows); err != nil {
+		return nil, err
+	}
+	counts := map[string]int64{}
+	for status := range orderTransitions {
+		counts[status] = 0
+	}
+	for _, row := range rows {
+		counts[row.Status] = row.Count
+	}
+	return counts, nil
+}
+
+func revenueBetween(from, to time.Time) func(ctx context.Context) (interface{}, error) {
+	return func(ctx context.Context) (interface{}, error) {
+		cursor, err := database.Collection(ordersCollectionName).Aggregate(ctx, mongo.Pipeline{
+			{{Key: "$match", Value: bson.M{
+				"created_at": bson.M{"$gte": from, "$lt": to},
+				"status":     bson.M{"$ne": orderStatusCancelled},
+			}}},
+			{{Key: "$group", Value: bson.M{"_id": nil, "revenue": bson.M{"$sum": "$total"}}}},
+		})
+		if err != nil {
+			return nil, err
+		}
+		defer cursor.Close(ctx)
+
+		var rows []struct {
+			Revenue float64 `bson:"revenue"`
+		}
+		if err := cursor.All(ctx, &rows); err != nil {
+			return nil, err
+		}
+		if len(rows) == 0 {
+			return 0.0, nil
+		}
+		return math.Round(rows[0].Revenue*100) / 100, nil
+	}
+}
+
+// handleStatsOverview reports the headline figures of the shop. Weeks start
+// on Monday and months on the 1st, both in UTC.
+func handleStatsOverview(w http.ResponseWriter, r *http.Request) {
+	now := time.Now().UTC()
+	today := now.Truncate(24 * time.Hour)
+	weekStart := today.AddDate(0, 0, -((int(today.Weekday()) + 6) % 7))
+	monthStart := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	lastMonthStart := monthStart.AddDate(0, -1, 0)
+
+	ctx, cancel := context.WithTimeout(r.Context(), overviewTimeout)
+	defer cancel()
+
+	metrics := &overviewMetrics{values: map[string]interface{}{}, errors: map[string]string{}}
+	var g errgroup.Group
+	metrics.run(ctx, &g, "total_users", countOf(collectionName, bson.M{}))
+	metrics.run(ctx, &g, "new_users_this_week", countOf(collectionName, bson.M{"created_at": bson.M{"$gte": weekStart}}))
+	metrics.run(ctx, &g, "total_orders", countOf(ordersCollectionName, bson.M{}))
+	metrics.run(ctx, &g, "orders_by_status", ordersByStatus)
+	metrics.run(ctx, &g, "revenue_this_month", revenueBetween(monthStart, now.Add(time.Second)))
+	metrics.run(ctx, &g, "revenue_last_month", revenueBetween(lastMonthStart, monthStart))
+	metrics.run(ctx, &g, "catalogue_size", countOf(furnitureCollectionName, bson.M{"deleted_at": bson.M{"$exists": false}}))
+	g.Wait()
+
+	response := map[string]interface{}{"metrics": metrics.values}
+	if len(metrics.errors) > 0 {
+		response["errors"] = metrics.errors
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+// ageBoundaries are the lower bounds of the age ranges of handleUserStats;
+// the last one is the upper bound of the oldest range.
+var ageBoundaries = []int{0, 18, 25, 35, 50, 65, 150}
+
+const signupWeeks = 12
+
+type ageBucket struct {
+	Range string `json:"range"`
+	Count int64  `json:"count"`
+}
+
+// usersByAge counts active users per age range. An age of 0 is what users
+// without an age were given, so those users are counted as unknown rather
+// than as under 18.
+func usersByAge(ctx context.Context) (interface{}, error) {
+	cursor, err := database.Collection(collectionName).Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"deleted_at": nil}}},
+		{{Key: "$bucket", Value: bson.M{
+			"groupBy":    bson.M{"$cond": bson.A{bson.M{"$gt": bson.A{"$age", 0}}, "$age", nil}},
+			"boundaries": ageBoundaries,
+			"default":    "unknown",
+			"output":     bson.M{"count": bson.M{"$sum": 1}},
+		}}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var rows []struct {
+		Bucket interface{} `bson:"_id"`
+		Count  int64       `bson:"count"`
+	}
+	if err := cursor.All(ctx, &rows); err != nil {
+		return nil, err
+	}
+	counts := map[string]int64{}
+	for _, row := range rows {
+		counts[fmt.Sprint(row.Bucket)] = row.Count
+	}
+
+	buckets := make([]ageBucket, 0, len(ageBoundaries))
+	for i := 0; i+1 < len(ageBoundaries); i++ {
+		buckets = append(buckets, ageBucket{
+			Range: fmt.Sprintf("%d-%d", ageBoundaries[i], ageBoundaries[i+1]-1),
+			Count: counts[strconv.Itoa(ageBoundaries[i])],
+		})
+	}
+	return append(buckets, ageBucket{Range: "unknown", Count: counts["unknown"]}), nil
+}
+
+type weeklySignups struct {
+	WeekStart string `json:"week_start"`
+	Signups   int64  `json:"signups"`
+}
+
+// signupsPerWeek counts new users in each of the last signupWeeks weeks,
+// the current one included. Weeks start on Monday in UTC.
+func signupsPerWeek(now time.Time) func(ctx context.Context) (interface{}, error) {
+	return func(ctx context.Context) (interface{}, error) {
+		today := now.UTC().Truncate(24 * time.Hour)
+		thisWeek := today.AddDate(0, 0, -((int(today.Weekday()) + 6) % 7))
+		boundaries := make(bson.A, 0, signupWeeks+1)
+		for i := signupWeeks - 1; i >= 0; i-- {
+			boundaries = append(boundaries, thisWeek.AddDate(0, 0, -7*i))
+		}
+		boundaries = append(boundaries, now.Add(time.Second))
+
+		cursor, err := database.Collection(collectionName).Aggregate(ctx, mongo.Pipeline{
+			{{Key: "$match", Value: bson.M{"created_at": bson.M{"$gte": boundaries[0], "$lt": boundaries[signupWeeks]}}}},
+			{{Key: "$bucket", Value: bson.M{
+				"groupBy":    "$created_at",
+				"boundaries": boundaries,
+				"output":     bson.M{"signups": bson.M{"$sum": 1}},
+			}}},
+		})
+		if err != nil {
+			return nil, err
+		}
+		defer cursor.Close(ctx)
+
+		var rows []struct {
+			WeekStart time.Time `bson:"_id"`
+			Signups   int64     `bson:"signups"`
+		}
+		if err := cursor.All(ctx, &rows); err != nil {
+			return nil, err
+		}
+		byWeek := make(map[string]int64, len(rows))
+		for _, row := range rows {
+			byWeek[row.WeekStart.UTC().Format(statsDayFormat)] = row.Signups
+		}
+
+		weeks := make([]weeklySignups, signupWeeks)
+		for i := range weeks {
+			key := boundaries[i].(time.Time).Format(statsDayFormat)
+			weeks[i] = weeklySignups{WeekStart: key, Signups: byWeek[key]}
+		}
+		return weeks, nil
+	}
+}
+
+// usersByVerification counts active users with and without a verified
+// email. Users from before verification existed count as unverified.
+func usersByVerification(ctx context.Context) (interface{}, error) {
+	cursor, err := database.Collection(collectionName).Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"deleted_at": nil}}},
+		{{Key: "$group", Value: bson.M{
+			"_id":   bson.M{"$eq": bson.A{"$email_verified", true}},
+			"count": bson.M{"$sum": 1},
+		}}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var rows []struct {
+		Verified bool  `bson:"_id"`
+		Count    int64 `bson:"count"`
+	}
+	if err := cursor.All(ctx, &rows); err != nil {
+		return nil, err
+	}
+	counts := map[string]int64{"verified": 0, "unverified": 0}
+	for _, row := range rows {
+		if row.Verified {
+			counts["verified"] = row.Count
+		} else {
+			counts["unverified"] = row.Count
+		}
+	}
+	return counts, nil
+}
+
+// handleUserStats reports who the active users are, computed like the
+// overview: concurrently, with failed figures listed under errors.
+func handleUserStats(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), overviewTimeout)
+	defer cancel()
+
+	metrics := &overviewMetrics{values: map[string]interface{}{}, errors: map[string]string{}}
+	var g errgroup.Group
+	metrics.run(ctx, &g, "age_ranges", usersByAge)
+	metrics.run(ctx, &g, "signups_per_week", signupsPerWeek(time.Now()))
+	metrics.run(ctx, &g, "email_verification", usersByVerification)
+	g.Wait()
+
+	response := map[string]interface{}{"metrics": metrics.values}
+	if len(metrics.errors) > 0 {
+		response["errors"] = metrics.errors
+	}
+	writeJSON(w, http.StatusOK, response)
+}
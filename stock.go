@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var (
+	errInsufficientStock = errors.New("insufficient stock")
+	errVariantNotFound   = errors.New("variant not found")
+)
+
+// adjustStock atomically adds delta to the stock of an item, or of one of its
+// variants when variantID is set. A negative delta only applies while enough
+// stock remains, so stock can never drop below zero; in that case
+// errInsufficientStock is returned along with the current item.
+func adjustStock(ctx context.Context, id int, variantID string, delta int) (Furniture, error) {
+	filter := activeFurnitureByID(id)
+	field := "stock"
+	if variantID != "" {
+		match := bson.M{"id": variantID}
+		if delta < 0 {
+			match["stock"] = bson.M{"$gte": -delta}
+		}
+		filter["variants"] = bson.M{"$elemMatch": match}
+		field = "variants.$.stock"
+	} else if delta < 0 {
+		filter["stock"] = bson.M{"$gte": -delta}
+	}
+
+	var item Furniture
+	furnitureCollection := database.Collection(furnitureCollectionName)
+	err := furnitureCollection.FindOneAndUpdate(
+		ctx,
+		filter,
+		bson.M{"$inc": bson.M{field: delta}, "$set": bson.M{"updated_at": time.Now()}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&item)
+	if !errors.Is(err, mongo.ErrNoDocuments) {
+		return item, err
+	}
+
+	// The guarded update matched nothing: the item or variant is missing, or
+	// there is too little stock.
+	if err := furnitureCollection.FindOne(ctx, activeFurnitureByID(id)).Decode(&item); err != nil {
+		return item, err
+	}
+	if variantID != "" && item.variant(variantID) == nil {
+		return item, errVariantNotFound
+	}
+	return item, errInsufficientStock
+}
+
+func handleFurnitureStock(w http.ResponseWriter, r *http.Request) {
+	id, err := parseFurnitureID(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidID, err.Error())
+		return
+	}
+
+	var body struct {
+		Delta int `json:"delta"`
+	}
+	if !decodeJSON(w, r, &body) {
+		return
+	}
+	if body.Delta == 0 {
+		writeJSONError(w, http.StatusBadRequest, "delta must be a non-zero integer")
+		return
+	}
+
+	variantID := r.URL.Query().Get("variant_id")
+	item, err := adjustStock(r.Context(), id, variantID, body.Delta)
+	switch {
+	case errors.Is(err, errInsufficientStock):
+		writeErrorDetails(w, http.StatusConflict, "insufficient_stock", "Not enough stock",
+			[]map[string]int{{"stock": item.stockOf(variantID)}})
+	case errors.Is(err, mongo.ErrNoDocuments):
+		writeJSONError(w, http.StatusNotFound, "Furniture not found")
+	case errors.Is(err, errVariantNotFound):
+		writeJSONError(w, http.StatusNotFound, "Variant not found")
+	case err != nil:
+		fmt.Println("Error adjusting stock:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to update stock")
+	default:
+		writeJSON(w, http.StatusOK, item)
+	}
+}
+
+// stockShortage describes an order line that cannot be filled.
+type stockShortage struct {
+	FurnitureID int    `json:"furniture_id"`
+	VariantID   string `json:"variant_id,omitempty"`
+	Requested   int    `json:"requested"`
+	Available   int    `json:"available"`
+}
+
+type stockShortageError struct {
+	Shortages []stockShortage
+}
+
+func (e *stockShortageError) Error() string {
+	return fmt.Sprintf("insufficient stock for %d order lines", len(e.Shortages))
+}
+
+func writeStockShortage(w http.ResponseWriter, shortages []stockShortage) {
+	writeErrorDetails(w, http.StatusConflict, "insufficient_stock", "Not enough stock for some items", shortages)
+}
+
+// reserveStock takes stock for every line or for none of them. Each line is a
+// guarded decrement, so stock never goes negative even without a
+// transaction. If some lines cannot be filled, the lines already taken are
+// handed back and a *stockShortageError lists every line that fell short.
+func reserveStock(ctx context.Context, items []OrderItem) error {
+	var taken []OrderItem
+	var shortages []stockShortage
+	var failure error
+
+	for _, item := range items {
+		current, err := adjustStock(ctx, item.FurnitureID, item.VariantID, -item.Quantity)
+		if errors.Is(err, errInsufficientStock) || errors.Is(err, mongo.ErrNoDocuments) || errors.Is(err, errVariantNotFound) {
+			shortages = append(shortages, stockShortage{
+				FurnitureID: item.FurnitureID,
+				VariantID:   item.VariantID,
+				Requested:   item.Quantity,
+				Available:   current.stockOf(item.VariantID),
+			})
+			continue
+		}
+		if err != nil {
+			failure = err
+			break
+		}
+		taken = append(taken, item)
+	}
+
+	if failure == nil && len(shortages) == 0 {
+		return nil
+	}
+	if err := releaseStock(ctx, taken); err != nil {
+		fmt.Println("Error handing back reserved stock:", err)
+	}
+	if failure != nil {
+		return failure
+	}
+	return &stockShortageError{Shortages: shortages}
+}
+
+// releaseStock gives stock taken by reserveStock back. Items or variants that
+// have been removed since are skipped.
+func releaseStock(ctx context.Context, items []OrderItem) error {
+	for _, item := range items {
+		_, err := adjustStock(ctx, item.FurnitureID, item.VariantID, item.Quantity)
+		if errors.Is(err, mongo.ErrNoDocuments) || errors.Is(err, errVariantNotFound) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	maxSuggestions          = 10
+	suggestionRefreshPeriod = time.Minute
+)
+
+// suggestionCache holds every active furniture name sorted case-insensitively,
+// so a prefix lookup is a binary search followed by a short scan.
+type suggestionCache struct {
+	mu    sync.RWMutex
+	ready bool
+	lower []string
+	names []string
+}
+
+var suggestions suggestionCache
+
+func (c *suggestionCache) lookup(prefix string) ([]string, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if !c.ready {
+		return nil, false
+	}
+
+	prefix = strings.ToLower(prefix)
+	matches := []string{}
+	for i := sort.SearchStrings(c.lower, prefix); i < len(c.lower) && len(matches) < maxSuggestions; i++ {
+		if !strings.HasPrefix(c.lower[i], prefix) {
+			break
+		}
+		matches = append(matches, c.names[i])
+	}
+	return matches, true
+}
+
+func (c *suggestionCache) refresh(ctx context.Context) error {
+	names, err := database.Collection(furnitureCollectionName).Distinct(ctx, "name", bson.M{"deleted_at": bson.M{"$exists": false}})
+	if err != nil {
+		return err
+	}
+
+	entries := make([]string, 0, len(names))
+	for _, name := range names {
+		if s, ok := name.(string); ok {
+			entries = append(entries, s)
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return strings.ToLower(entries[i]) < strings.ToLower(entries[j])
+	})
+	lower := make([]string, len(entries))
+	for i, name := range entries {
+		lower[i] = strings.ToLower(name)
+	}
+
+	c.mu.Lock()
+	c.names, c.lower, c.ready = entries, lower, true
+	c.mu.Unlock()
+	return nil
+}
+
+// refreshSuggestionsPeriodically keeps the cache warm until ctx is cancelled.
+func refreshSuggestionsPeriodically(ctx context.Context) {
+	ticker := time.NewTicker(suggestionRefreshPeriod)
+	defer ticker.Stop()
+	for {
+		if err := suggestions.refresh(ctx); err != nil {
+			fmt.Println("Error refreshing furniture suggestions:", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func suggestFurniture(w http.ResponseWriter, r *http.Request) {
+	prefix := strings.TrimSpace(r.URL.Query().Get("prefix"))
+	if prefix == "" {
+		writeJSON(w, http.StatusOK, []string{})
+		return
+	}
+
+	if names, ok := suggestions.lookup(prefix); ok {
+		writeJSON(w, http.StatusOK, names)
+		return
+	}
+
+	// The cache has not been filled yet, so ask the database directly.
+	filter := bson.M{
+		"name":       primitive.Regex{Pattern: "^" + regexp.QuoteMeta(prefix), Options: "i"},
+		"deleted_at": bson.M{"$exists": false},
+	}
+	opts := options.Find().
+		SetProjection(bson.M{"name": 1}).
+		SetSort(bson.D{{Key: "name", Value: 1}}).
+		SetLimit(maxSuggestions)
+	cursor, err := database.Collection(furnitureCollectionName).Find(r.Context(), filter, opts)
+	if err != nil {
+		fmt.Println("Error querying furniture suggestions:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to load suggestions")
+		return
+	}
+	defer cursor.Close(r.Context())
+
+	var items []Furniture
+	if err := cursor.All(r.Context(), &items); err != nil {
+		fmt.Println("Error decoding furniture suggestions:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to load suggestions")
+		return
+	}
+
+	names := make([]string, len(items))
+	for i, item := range items {
+		names[i] = item.Name
+	}
+	writeJSON(w, http.StatusOK, names)
+}
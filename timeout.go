@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+)
+
+// requestTimeout bounds the work of one request, database calls included.
+// Exports and imports get exportTimeout instead. Both come from the Config,
+// REQUEST_TIMEOUT and EXPORT_TIMEOUT.
+var (
+	requestTimeout = 5 * time.Second
+	exportTimeout  = 2 * time.Minute
+)
+
+// withTimeout gives h a request context that ends after timeout. A handler
+// that fails because the deadline passed answers 500 like for any database
+// error; the client is told 504 instead, since a retry may well succeed.
+func withTimeout(h http.HandlerFunc, timeout time.Duration) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+		h(&timeoutWriter{ResponseWriter: w, ctx: ctx}, r.WithContext(ctx))
+	}
+}
+
+type timeoutWriter struct {
+	http.ResponseWriter
+	ctx      context.Context
+	timedOut bool
+}
+
+func (tw *timeoutWriter) WriteHeader(status int) {
+	if status >= http.StatusInternalServerError && errors.Is(tw.ctx.Err(), context.DeadlineExceeded) {
+		tw.timedOut = true
+		writeError(tw.ResponseWriter, http.StatusGatewayTimeout, codeTimeout, "The request took too long, please try again")
+		return
+	}
+	tw.ResponseWriter.WriteHeader(status)
+}
+
+// Write drops the body of the replaced 500.
+func (tw *timeoutWriter) Write(b []byte) (int, error) {
+	if tw.timedOut {
+		return len(b), nil
+	}
+	return tw.ResponseWriter.Write(b)
+}
+
+// Flush keeps streaming exports streaming through the wrapper.
+func (tw *timeoutWriter) Flush() {
+	if flusher, ok := tw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (tw *timeoutWriter) Unwrap() http.ResponseWriter {
+	return tw.ResponseWriter
+}
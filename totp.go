@@ -0,0 +1,359 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	totpIssuer = "Online Furniture Shop"
+	totpPeriod = 30 * time.Second
+	totpDigits = 6
+	// totpSkew is how many time steps before and after now a code may come
+	// from, to tolerate clocks that drift apart.
+	totpSkew = 1
+
+	recoveryCodeCount = 10
+
+	twoFactorChallengeTTL = 5 * time.Minute
+	maxTwoFactorAttempts  = 5
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// twoFactorChallenge is the half-finished login between a correct password
+// and a correct code.
+type twoFactorChallenge struct {
+	ID        primitive.ObjectID `bson:"_id,omitempty"`
+	UserID    primitive.ObjectID `bson:"user_id"`
+	TokenHash string             `bson:"token_hash"`
+	Mode      string             `bson:"mode,omitempty"`
+	Attempts  int                `bson:"attempts"`
+	ExpiresAt time.Time          `bson:"expires_at"`
+}
+
+func createTwoFactorIndexes() error {
+	_, err := database.Collection(twoFactorChallengesCollectionName).Indexes().CreateMany(context.TODO(), []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "token_hash", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+		{
+			Keys:    bson.D{{Key: "expires_at", Value: 1}},
+			Options: options.Index().SetExpireAfterSeconds(0),
+		},
+	})
+	return err
+}
+
+// totpCode is the RFC 6238 code of secret for time step step.
+func totpCode(secret []byte, step int64) string {
+	var counter [8]byte
+	binary.BigEndian.PutUint64(counter[:], uint64(step))
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(counter[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	modulus := uint32(1)
+	for i := 0; i < totpDigits; i++ {
+		modulus *= 10
+	}
+	return fmt.Sprintf("%0*d", totpDigits, value%modulus)
+}
+
+// matchTOTP returns the time step code belongs to, within totpSkew steps of
+// now.
+func matchTOTP(encodedSecret, code string, now time.Time) (int64, bool) {
+	secret, err := totpEncoding.DecodeString(encodedSecret)
+	if err != nil || len(code) != totpDigits {
+		return 0, false
+	}
+	current := now.Unix() / int64(totpPeriod/time.Second)
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if subtle.ConstantTimeCompare([]byte(totpCode(secret, step)), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// useTOTP checks code against the user's enabled secret. The step of an
+// accepted code is recorded with a guarded update, so one code cannot be
+// used twice.
+func useTOTP(ctx context.Context, user User, code string) (bool, error) {
+	step, ok := matchTOTP(user.TOTPSecret, code, time.Now())
+	if !ok {
+		return false, nil
+	}
+	result, err := database.Collection(collectionName).UpdateOne(ctx,
+		bson.M{"_id": user.ID, "totp_last_step": bson.M{"$not": bson.M{"$gte": step}}},
+		bson.M{"$set": bson.M{"totp_last_step": step}},
+	)
+	if err != nil {
+		return false, err
+	}
+	return result.ModifiedCount > 0, nil
+}
+
+// useRecoveryCode spends one of the user's recovery codes.
+func useRecoveryCode(ctx context.Context, userID primitive.ObjectID, code string) (bool, error) {
+	hash := hashToken(normalizeRecoveryCode(code))
+	result, err := database.Collection(collectionName).UpdateOne(ctx,
+		bson.M{"_id": userID, "totp_recovery_codes": hash},
+		bson.M{"$pull": bson.M{"totp_recovery_codes": hash}},
+	)
+	if err != nil {
+		return false, err
+	}
+	return result.ModifiedCount > 0, nil
+}
+
+func normalizeRecoveryCode(code string) string {
+	return strings.ToUpper(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+}
+
+// newRecoveryCodes returns codes to show the user, formatted XXXXX-XXXXX,
+// and the hashes to store.
+func newRecoveryCodes() (codes, hashes []string, err error) {
+	for i := 0; i < recoveryCodeCount; i++ {
+		var raw [7]byte
+		if _, err := rand.Read(raw[:]); err != nil {
+			return nil, nil, err
+		}
+		code := totpEncoding.EncodeToString(raw[:])[:10]
+		codes = append(codes, code[:5]+"-"+code[5:])
+		hashes = append(hashes, hashToken(code))
+	}
+	return codes, hashes, nil
+}
+
+// handleTwoFactorSetup starts enrolling the caller: the secret and recovery
+// codes are stored as pending and only take effect once a code generated
+// from the secret is sent to /2fa/confirm.
+func handleTwoFactorSetup(w http.ResponseWriter, r *http.Request) {
+	userID, _ := authenticatedUserID(r.Context())
+
+	var user User
+	err := database.Collection(collectionName).FindOne(r.Context(), activeUserByID(userID)).Decode(&user)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		writeJSONError(w, http.StatusNotFound, "User not found")
+		return
+	}
+	if err != nil {
+		fmt.Println("Error loading user:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to set up two-factor authentication")
+		return
+	}
+	if user.TOTPEnabled {
+		writeJSONError(w, http.StatusConflict, "Two-factor authentication is already enabled")
+		return
+	}
+
+	var raw [20]byte
+	if _, err := rand.Read(raw[:]); err != nil {
+		fmt.Println("Error generating TOTP secret:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to set up two-factor authentication")
+		return
+	}
+	secret := totpEncoding.EncodeToString(raw[:])
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		fmt.Println("Error generating recovery codes:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to set up two-factor authentication")
+		return
+	}
+
+	_, err = database.Collection(collectionName).UpdateOne(r.Context(),
+		bson.M{"_id": userID},
+		bson.M{"$set": bson.M{"totp_pending_secret": secret, "totp_pending_recovery_codes": hashes}},
+	)
+	if err != nil {
+		fmt.Println("Error storing TOTP secret:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to set up two-factor authentication")
+		return
+	}
+
+	label := url.PathEscape(totpIssuer + ":" + user.Email)
+	query := url.Values{
+		"secret":    {secret},
+		"issuer":    {totpIssuer},
+		"algorithm": {"SHA1"},
+		"digits":    {fmt.Sprint(totpDigits)},
+		"period":    {fmt.Sprint(int(totpPeriod / time.Second))},
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"secret":         secret,
+		"otpauth_url":    "otpauth://totp/" + label + "?" + query.Encode(),
+		"recovery_codes": codes,
+	})
+}
+
+func handleTwoFactorConfirm(w http.ResponseWriter, r *http.Request) {
+	userID, _ := authenticatedUserID(r.Context())
+
+	var body struct {
+		Code string `json:"code"`
+	}
+	if !decodeJSON(w, r, &body) {
+		return
+	}
+
+	var user User
+	err := database.Collection(collectionName).FindOne(r.Context(), activeUserByID(userID)).Decode(&user)
+	if err != nil && !errors.Is(err, mongo.ErrNoDocuments) {
+		fmt.Println("Error loading user:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to confirm two-factor authentication")
+		return
+	}
+	if user.TOTPPendingSecret == "" {
+		writeJSONError(w, http.StatusConflict, "Start two-factor setup first")
+		return
+	}
+	step, ok := matchTOTP(user.TOTPPendingSecret, strings.TrimSpace(body.Code), time.Now())
+	if !ok {
+		writeValidationErrors(w, "Code is invalid", []fieldError{{Field: "code", Message: "code does not match the authenticator"}})
+		return
+	}
+
+	// The pending secret in the filter keeps a setup started in parallel
+	// from being confirmed with this code.
+	result, err := database.Collection(collectionName).UpdateOne(r.Context(),
+		bson.M{"_id": userID, "totp_pending_secret": user.TOTPPendingSecret},
+		bson.M{
+			"$set": bson.M{
+				"totp_enabled":        true,
+				"totp_secret":         user.TOTPPendingSecret,
+				"totp_recovery_codes": user.TOTPPendingRecoveryCodes,
+				"totp_last_step":      step,
+				"updated_at":          time.Now(),
+			},
+			"$unset": bson.M{"totp_pending_secret": "", "totp_pending_recovery_codes": ""},
+		},
+	)
+	if err != nil {
+		fmt.Println("Error enabling two-factor authentication:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to confirm two-factor authentication")
+		return
+	}
+	if result.ModifiedCount == 0 {
+		writeJSONError(w, http.StatusConflict, "Two-factor setup was restarted, confirm the newest secret")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"message": "Two-factor authentication enabled"})
+}
+
+// startTwoFactorChallenge answers a correct password on a 2FA account with a
+// challenge token, to be sent to /2fa/verify together with a code.
+func startTwoFactorChallenge(w http.ResponseWriter, r *http.Request, user User, mode string) {
+	token, err := newSecretToken()
+	if err != nil {
+		fmt.Println("Error generating 2FA challenge:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to log in")
+		return
+	}
+	_, err = database.Collection(twoFactorChallengesCollectionName).InsertOne(r.Context(), twoFactorChallenge{
+		UserID:    user.ID,
+		TokenHash: hashToken(token),
+		Mode:      mode,
+		ExpiresAt: time.Now().Add(twoFactorChallengeTTL),
+	})
+	if err != nil {
+		fmt.Println("Error storing 2FA challenge:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to log in")
+		return
+	}
+	writeJSON(w, http.StatusAccepted, map[string]interface{}{
+		"two_factor_required": true,
+		"challenge":           token,
+		"expires_in":          int(twoFactorChallengeTTL / time.Second),
+	})
+}
+
+// handleTwoFactorVerify finishes a login with an authenticator code or a
+// recovery code. Each challenge allows maxTwoFactorAttempts tries.
+func handleTwoFactorVerify(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Challenge    string `json:"challenge"`
+		Code         string `json:"code"`
+		RecoveryCode string `json:"recovery_code"`
+	}
+	if !decodeJSON(w, r, &body) {
+		return
+	}
+
+	challenges := database.Collection(twoFactorChallengesCollectionName)
+	var challenge twoFactorChallenge
+	err := challenges.FindOneAndUpdate(r.Context(), bson.M{
+		"token_hash": hashToken(body.Challenge),
+		"expires_at": bson.M{"$gt": time.Now()},
+		"attempts":   bson.M{"$lt": maxTwoFactorAttempts},
+	}, bson.M{"$inc": bson.M{"attempts": 1}}).Decode(&challenge)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		writeUnauthorized(w, "Login challenge is invalid or has expired, log in again")
+		return
+	}
+	if err != nil {
+		fmt.Println("Error loading 2FA challenge:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to verify code")
+		return
+	}
+
+	var user User
+	err = database.Collection(collectionName).FindOne(r.Context(), activeUserByID(challenge.UserID)).Decode(&user)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		writeUnauthorized(w, "Login challenge is invalid or has expired, log in again")
+		return
+	}
+	if err != nil {
+		fmt.Println("Error loading user:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to verify code")
+		return
+	}
+
+	var valid bool
+	if body.RecoveryCode != "" {
+		valid, err = useRecoveryCode(r.Context(), user.ID, body.RecoveryCode)
+	} else {
+		valid, err = useTOTP(r.Context(), user, strings.TrimSpace(body.Code))
+	}
+	if err != nil {
+		fmt.Println("Error checking 2FA code:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to verify code")
+		return
+	}
+	if !valid {
+		writeUnauthorized(w, "Invalid code")
+		return
+	}
+
+	// Deleting the challenge only succeeds once, so a challenge cannot log
+	// in twice.
+	deleted, err := challenges.DeleteOne(r.Context(), bson.M{"_id": challenge.ID})
+	if err != nil {
+		fmt.Println("Error deleting 2FA challenge:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to verify code")
+		return
+	}
+	if deleted.DeletedCount == 0 {
+		writeUnauthorized(w, "Login challenge is invalid or has expired, log in again")
+		return
+	}
+	completeLogin(w, r, user, challenge.Mode)
+}
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Spans follow the OpenTelemetry data model and are exported as OTLP/HTTP
+// JSON to OTEL_EXPORTER_OTLP_TRACES_ENDPOINT, or to /v1/traces under
+// OTEL_EXPORTER_OTLP_ENDPOINT. With neither set, spans are still created,
+// so trace IDs propagate and show up in errors and logs, but they are not
+// sent anywhere. OTEL_SERVICE_NAME names the service, "shop" by default.
+const (
+	traceParentHeader = "traceparent"
+	traceIDHeader     = "X-Trace-ID"
+
+	spanKindServer = 2
+	spanKindClient = 3
+
+	spanStatusError = 2
+
+	spanBatchSize     = 512
+	spanQueueSize     = 4096
+	spanFlushInterval = 5 * time.Second
+)
+
+// spanExporter is nil, and spans are not exported, unless an OTLP endpoint
+// is configured. serviceName is OTEL_SERVICE_NAME.
+var (
+	spanExporter *otlpExporter
+	serviceName  = "shop"
+)
+
+type spanContext struct {
+	traceID [16]byte
+	spanID  [8]byte
+	sampled bool
+}
+
+func (sc spanContext) valid() bool {
+	return sc.traceID != [16]byte{} && sc.spanID != [8]byte{}
+}
+
+// traceParent renders sc as a W3C traceparent header.
+func (sc spanContext) traceParent() string {
+	flags := "00"
+	if sc.sampled {
+		flags = "01"
+	}
+	return "00-" + hex.EncodeToString(sc.traceID[:]) + "-" + hex.EncodeToString(sc.spanID[:]) + "-" + flags
+}
+
+// parseTraceParent reads a W3C traceparent header. Versions above 00 may
+// append fields, which are ignored.
+func parseTraceParent(header string) (spanContext, bool) {
+	var sc spanContext
+	parts := strings.Split(strings.TrimSpace(header), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || (parts[0] == "00" && len(parts) != 4) {
+		return sc, false
+	}
+	traceID, err1 := hex.DecodeString(parts[1])
+	spanID, err2 := hex.DecodeString(parts[2])
+	flags, err3 := hex.DecodeString(parts[3])
+	if err1 != nil || err2 != nil || err3 != nil || len(traceID) != 16 || len(spanID) != 8 || len(flags) != 1 {
+		return sc, false
+	}
+	copy(sc.traceID[:], traceID)
+	copy(sc.spanID[:], spanID)
+	sc.sampled = flags[0]&1 == 1
+	return sc, sc.valid()
+}
+
+type spanContextKey struct{}
+type currentSpanKey struct{}
+
+func withSpanContext(ctx context.Context, sc spanContext) context.Context {
+	return context.WithValue(ctx, spanContextKey{}, sc)
+}
+
+func spanContextFrom(ctx context.Context) (spanContext, bool) {
+	sc, ok := ctx.Value(spanContextKey{}).(spanContext)
+	return sc, ok && sc.valid()
+}
+
+// currentSpan is the span ctx was started with, if it is still local.
+func currentSpan(ctx context.Context) *span {
+	s, _ := ctx.Value(currentSpanKey{}).(*span)
+	return s
+}
+
+// traceIDFrom is the hex trace ID of ctx, or "".
+func traceIDFrom(ctx context.Context) string {
+	sc, ok := spanContextFrom(ctx)
+	if !ok {
+		return ""
+	}
+	return hex.EncodeToString(sc.traceID[:])
+}
+
+type span struct {
+	sc       spanContext
+	parentID [8]byte
+	name     string
+	kind     int
+	start    time.Time
+	attrs    []otlpAttribute
+	failed   bool
+	message  string
+}
+
+// startSpan starts a span as a child of the span in ctx, or as the root of
+// a new, sampled trace.
+func startSpan(ctx context.Context, name string, kind int) (context.Context, *span) {
+	s := &span{name: name, kind: kind, start: time.Now()}
+	if parent, ok := spanContextFrom(ctx); ok {
+		s.sc.traceID, s.sc.sampled, s.parentID = parent.traceID, parent.sampled, parent.spanID
+	} else {
+		rand.Read(s.sc.traceID[:])
+		s.sc.sampled = true
+	}
+	rand.Read(s.sc.spanID[:])
+	ctx = withSpanContext(ctx, s.sc)
+	return context.WithValue(ctx, currentSpanKey{}, s), s
+}
+
+func (s *span) setAttr(key string, value interface{}) {
+	s.attrs = append(s.attrs, otlpAttr(key, value))
+}
+
+// fail marks the span as failed with message, which is exported as it is:
+// it must not hold secrets.
+func (s *span) fail(message string) {
+	s.failed = true
+	s.message = message
+}
+
+func (s *span) end() {
+	if spanExporter == nil || !s.sc.sampled {
+		return
+	}
+	spanExporter.enqueue(s.toOTLP(time.Now()))
+}
+
+// continueTrace gives the background ctx the trace of parent, so work a
+// request started shows up in its trace.
+func continueTrace(ctx, parent context.Context) context.Context {
+	if sc, ok := spanContextFrom(parent); ok {
+		return withSpanContext(ctx, sc)
+	}
+	return ctx
+}
+
+// injectTraceParent passes the trace of ctx on to an outgoing request.
+func injectTraceParent(ctx context.Context, req *http.Request) {
+	if sc, ok := spanContextFrom(ctx); ok {
+		req.Header.Set(traceParentHeader, sc.traceParent())
+	}
+}
+
+// traceRequests starts the server span of each request, continuing the
+// trace of an incoming traceparent header. instrument names it after the
+// route. The trace ID is sent back in X-Trace-ID and in error responses.
+func traceRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		if sc, ok := parseTraceParent(r.Header.Get(traceParentHeader)); ok {
+			ctx = withSpanContext(ctx, sc)
+		}
+		ctx, s := startSpan(ctx, r.Method, spanKindServer)
+		s.setAttr("http.request.method", r.Method)
+		s.setAttr("url.path", r.URL.Path)
+		s.setAttr("client.address", clientIP(r))
+		s.setAttr("http.request_id", requestIDFrom(ctx))
+		w.Header().Set(traceIDHeader, hex.EncodeToString(s.sc.traceID[:]))
+
+		sw := &statusWriter{ResponseWriter: w}
+		completed := false
+		defer func() {
+			status := sw.status
+			if !completed {
+				status = http.StatusInternalServerError
+			} else if status == 0 {
+				status = http.StatusOK
+			}
+			s.setAttr("http.response.status_code", status)
+			if status >= http.StatusInternalServerError {
+				s.fail(http.StatusText(status))
+			}
+			s.end()
+		}()
+		next.ServeHTTP(sw, r.WithContext(ctx))
+		completed = true
+	})
+}
+
+type otlpAttribute struct {
+	Key   string                 `json:"key"`
+	Value map[string]interface{} `json:"value"`
+}
+
+func otlpAttr(key string, value interface{}) otlpAttribute {
+	var v map[string]interface{}
+	switch value := value.(type) {
+	case string:
+		v = map[string]interface{}{"stringValue": value}
+	case int:
+		v = map[string]interface{}{"intValue": strconv.Itoa(value)}
+	case int64:
+		v = map[string]interface{}{"intValue": strconv.FormatInt(value, 10)}
+	case bool:
+		v = map[string]interface{}{"boolValue": value}
+	case float64:
+		v = map[string]interface{}{"doubleValue": value}
+	default:
+		v = map[string]interface{}{"stringValue": fmt.Sprint(value)}
+	}
+	return otlpAttribute{Key: key, Value: v}
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            *otlpStatus     `json:"status,omitempty"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+func (s *span) toOTLP(end time.Time) otlpSpan {
+	out := otlpSpan{
+		TraceID:           hex.EncodeToString(s.sc.traceID[:]),
+		SpanID:            hex.EncodeToString(s.sc.spanID[:]),
+		Name:              s.name,
+		Kind:              s.kind,
+		StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(end.UnixNano(), 10),
+		Attributes:        s.attrs,
+	}
+	if s.parentID != [8]byte{} {
+		out.ParentSpanID = hex.EncodeToString(s.parentID[:])
+	}
+	if s.failed {
+		out.Status = &otlpStatus{Code: spanStatusError, Message: s.message}
+	}
+	return out
+}
+
+// otlpExporter sends finished spans in batches. A full queue drops spans
+// rather than slow requests down.
+type otlpExporter struct {
+	url    string
+	client *http.Client
+	queue  chan otlpSpan
+}
+
+func newSpanExporter(url string) *otlpExporter {
+	if url == "" {
+		return nil
+	}
+	return &otlpExporter{
+		url:    url,
+		client: &http.Client{Timeout: 10 * time.Second},
+		queue:  make(chan otlpSpan, spanQueueSize),
+	}
+}
+
+func (e *otlpExporter) enqueue(s otlpSpan) {
+	select {
+	case e.queue <- s:
+	default:
+	}
+}
+
+// exportSpansPeriodically sends queued spans until ctx is cancelled, and
+// what is left after that.
+func exportSpansPeriodically(ctx context.Context) {
+	if spanExporter == nil {
+		return
+	}
+	ticker := time.NewTicker(spanFlushInterval)
+	defer ticker.Stop()
+	var batch []otlpSpan
+	for {
+		select {
+		case s := <-spanExporter.queue:
+			batch = append(batch, s)
+			if len(batch) < spanBatchSize {
+				continue
+			}
+		case <-ticker.C:
+		case <-ctx.Done():
+			for len(spanExporter.queue) > 0 {
+				batch = append(batch, <-spanExporter.queue)
+			}
+			spanExporter.send(batch)
+			return
+		}
+		spanExporter.send(batch)
+		batch = batch[:0]
+	}
+}
+
+func (e *otlpExporter) send(batch []otlpSpan) {
+	if len(batch) == 0 {
+		return
+	}
+	body, err := json.Marshal(map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{
+				"attributes": []otlpAttribute{otlpAttr("service.name", serviceName)},
+			},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]string{"name": "shop"},
+				"spans": batch,
+			}},
+		}},
+	})
+	if err != nil {
+		fmt.Println("Error encoding spans:", err)
+		return
+	}
+	resp, err := e.client.Post(e.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		fmt.Println("Error exporting spans:", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		fmt.Println("Error exporting spans: collector answered", resp.StatusCode)
+	}
+}
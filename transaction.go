@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// transactionsSupported is set at startup. Multi-document transactions need
+// a replica set or sharded cluster; a standalone server rejects them.
+var transactionsSupported bool
+
+func detectTransactionSupport() error {
+	var hello struct {
+		SetName string `bson:"setName"`
+		Msg     string `bson:"msg"`
+	}
+	if err := database.RunCommand(context.TODO(), bson.D{{Key: "hello", Value: 1}}).Decode(&hello); err != nil {
+		return err
+	}
+	transactionsSupported = hello.SetName != "" || hello.Msg == "isdbgrid"
+	if !transactionsSupported {
+		fmt.Println("MongoDB is a standalone server: multi-document transactions are disabled")
+	}
+	return nil
+}
+
+// withTransaction runs fn inside a transaction when the server supports one.
+// On a standalone server fn runs directly, so callers must keep their writes
+// guarded (conditional filters, compensating updates) to stay consistent
+// without it.
+func withTransaction(ctx context.Context, fn func(ctx context.Context) error) error {
+	if !transactionsSupported {
+		return fn(ctx)
+	}
+
+	session, err := database.Client().StartSession()
+	if err != nil {
+		return err
+	}
+	defer session.EndSession(ctx)
+
+	_, err = session.WithTransaction(ctx, func(sc mongo.SessionContext) (interface{}, error) {
+		return nil, fn(sc)
+	})
+	return err
+}
+
+// undoSteps runs the compensating steps of a failed unit of work, last
+// first. Only a standalone server needs them; a transaction is rolled back
+// as a whole.
+func undoSteps(what string, undo []func() error) {
+	if transactionsSupported {
+		return
+	}
+	for i := len(undo) - 1; i >= 0; i-- {
+		if err := undo[i](); err != nil {
+			fmt.Printf("Error undoing part of failed %s: %v\n", what, err)
+		}
+	}
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var userExportHeader = []string{"id", "name", "email", "age", "created_at"}
+
+// exportUsers streams every active user as a CSV row, reading the cursor one
+// user at a time like exportOrders.
+func exportUsers(w http.ResponseWriter, r *http.Request) {
+	opts := options.Find().
+		SetSort(bson.D{{Key: "_id", Value: 1}}).
+		SetProjection(bson.M{"name": 1, "email": 1, "age": 1, "created_at": 1}).
+		SetBatchSize(1000)
+	cursor, err := database.Collection(collectionName).Find(r.Context(), bson.M{"deleted_at": nil}, opts)
+	if err != nil {
+		fmt.Println("Error querying users for export:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to export users")
+		return
+	}
+	defer cursor.Close(r.Context())
+
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="users-`+time.Now().UTC().Format("20060102")+`.csv"`)
+
+	flusher, _ := w.(http.Flusher)
+	out := csv.NewWriter(w)
+	out.Write(userExportHeader)
+
+	rows := 0
+	for cursor.Next(r.Context()) {
+		var user User
+		if err := cursor.Decode(&user); err != nil {
+			fmt.Println("Error decoding user for export:", err)
+			break
+		}
+		out.Write([]string{
+			user.ID.Hex(),
+			user.Name,
+			user.Email,
+			strconv.Itoa(user.Age),
+			user.CreatedAt.UTC().Format(time.RFC3339),
+		})
+		rows++
+		if rows%exportFlushEvery == 0 {
+			out.Flush()
+			if flusher != nil {
+				flusher.Flush()
+			}
+			if err := r.Context().Err(); err != nil {
+				fmt.Println("Export stopped:", err)
+				break
+			}
+		}
+	}
+	if err := cursor.Err(); err != nil {
+		fmt.Println("Error reading users for export:", err)
+	}
+
+	out.Flush()
+	if err := out.Error(); err != nil {
+		fmt.Println("Error writing user export:", err)
+	}
+}
+
+// userImportRow is one CSV record of a user import. Name and Age are nil
+// when the column is missing or empty, which leaves an existing user's
+// value alone.
+type userImportRow struct {
+	Line  int
+	Email string
+	Name  *string
+	Age   *int
+	Err   error
+}
+
+type userImportReport struct {
+	Created int             `json:"created"`
+	Updated int             `json:"updated"`
+	Failed  []importFailure `json:"failed"`
+}
+
+// importUsers upserts users from a CSV with an email column and optional
+// name and age columns, matching on email; an id column, as written by
+// exportUsers, is ignored. New users get no password and have to set one
+// through /password/forgot.
+func importUsers(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxImportSize)
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType != "text/csv" {
+		writeJSONError(w, http.StatusUnsupportedMediaType, "Content-Type must be text/csv")
+		return
+	}
+	rows, err := readUserCSVImport(r.Body)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	report := userImportReport{Failed: []importFailure{}}
+	usersCollection := database.Collection(collectionName)
+	for _, row := range rows {
+		if row.Err != nil {
+			report.Failed = append(report.Failed, importFailure{Line: row.Line, Error: row.Err.Error()})
+			continue
+		}
+
+		now := time.Now()
+		set := bson.M{"updated_at": now}
+		if row.Name != nil {
+			set["name"] = *row.Name
+		}
+		if row.Age != nil {
+			set["age"] = *row.Age
+		}
+		var before User
+		err := usersCollection.FindOneAndUpdate(r.Context(),
+			bson.M{"email": row.Email, "deleted_at": nil},
+			bson.M{"$set": set, "$inc": bson.M{"version": 1}},
+		).Decode(&before)
+		if err == nil {
+			after, err := applySet(before, set)
+			if err != nil {
+				fmt.Println("Error applying imported user:", err)
+				writeJSONError(w, http.StatusInternalServerError, "Failed to import users")
+				return
+			}
+			after.Version++
+			recordUserAudit(r, auditUpdate, before.ID, &before, &after)
+			report.Updated++
+			continue
+		}
+		if !errors.Is(err, mongo.ErrNoDocuments) {
+			fmt.Println("Error importing user:", err)
+			writeJSONError(w, http.StatusInternalServerError, "Failed to import users")
+			return
+		}
+		if row.Name == nil {
+			report.Failed = append(report.Failed, importFailure{Line: row.Line, Error: "name is required for a new user"})
+			continue
+		}
+
+		user := User{Name: *row.Name, Email: row.Email, Role: roleCustomer, CreatedAt: now, UpdatedAt: now, Version: 1}
+		if row.Age != nil {
+			user.Age = *row.Age
+		}
+		result, err := usersCollection.InsertOne(r.Context(), user)
+		if mongo.IsDuplicateKeyError(err) {
+			report.Failed = append(report.Failed, importFailure{Line: row.Line, Error: "another user was created with this email at the same time"})
+			continue
+		}
+		if err != nil {
+			fmt.Println("Error importing user:", err)
+			writeJSONError(w, http.StatusInternalServerError, "Failed to import users")
+			return
+		}
+		user.ID = result.InsertedID.(primitive.ObjectID)
+		recordUserAudit(r, auditCreate, user.ID, nil, &user)
+		report.Created++
+	}
+
+	writeJSON(w, http.StatusOK, report)
+}
+
+func readUserCSVImport(body io.Reader) ([]userImportRow, error) {
+	reader := csv.NewReader(body)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, errors.New("CSV must start with a header row")
+	}
+	columns := map[string]int{}
+	for i, name := range header {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	if _, ok := columns["email"]; !ok {
+		return nil, errors.New("CSV header is missing the email column")
+	}
+
+	var rows []userImportRow
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		var row userImportRow
+		if err != nil {
+			var parseErr *csv.ParseError
+			if !errors.As(err, &parseErr) {
+				return nil, errors.New("could not read CSV body")
+			}
+			row.Line = parseErr.StartLine
+			row.Err = errors.New(parseErr.Err.Error())
+			rows = append(rows, row)
+			continue
+		}
+		row.Line, _ = reader.FieldPos(0)
+
+		field := func(name string) string {
+			if i, ok := columns[name]; ok && i < len(record) {
+				return strings.TrimSpace(record[i])
+			}
+			return ""
+		}
+
+		var v validator
+		row.Email = strings.ToLower(field("email"))
+		v.email("email", row.Email)
+		if name := field("name"); name != "" {
+			row.Name = &name
+		}
+		if raw := field("age"); raw != "" {
+			age, err := strconv.Atoi(raw)
+			if v.check(err == nil, "age", ruleType, "age must be a whole number") && v.intRange("age", age, 0, maxUserAge) {
+				row.Age = &age
+			}
+		}
+		row.Err = fieldErrorsErr(v.errs)
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
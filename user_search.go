@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const maxUserSearchResults = 20
+
+// activeUsersOnly selects users that are not soft-deleted in the form the
+// partial indexes on users are defined with, so queries can use them.
+var activeUsersOnly = bson.M{"$type": "null"}
+
+// userDistinctFields are the fields ?field= may list the values of, mapped to
+// their path in the user documents.
+var userDistinctFields = map[string]string{
+	"country":       "addresses.country",
+	"city":          "addresses.city",
+	"role":          "role",
+	"auth_provider": "auth_provider",
+}
+
+// createUserSearchIndexes indexes names case-insensitively for prefix
+// search. Emails and phones already have their own indexes.
+func createUserSearchIndexes() error {
+	_, err := database.Collection(collectionName).Indexes().CreateOne(context.TODO(), mongo.IndexModel{
+		Keys: bson.D{{Key: "name", Value: 1}},
+		Options: options.Index().
+			SetName("name_search").
+			SetCollation(emailCollation).
+			SetPartialFilterExpression(bson.M{"deleted_at": activeUsersOnly}),
+	})
+	return err
+}
+
+type userSearchResult struct {
+	User User `json:"user"`
+	// Matched lists which of name, email and phone matched the query.
+	Matched []string `json:"matched"`
+}
+
+// searchUsers finds active users whose name starts with ?q=, whose email is
+// ?q= or whose phone number is ?q=, ignoring case. Exact email and phone
+// matches come first, then names in alphabetical order.
+func searchUsers(w http.ResponseWriter, r *http.Request) {
+	q := strings.TrimSpace(r.URL.Query().Get("q"))
+	if q == "" {
+		writeJSONError(w, http.StatusBadRequest, "q is required")
+		return
+	}
+
+	// Each field is looked up on its own, so every query can use its index:
+	// the phone index has no collation, the other two do.
+	type lookup struct {
+		field  string
+		filter bson.M
+		opts   *options.FindOptions
+	}
+	var lookups []lookup
+	if strings.Contains(q, "@") {
+		lookups = append(lookups, lookup{"email",
+			bson.M{"email": strings.ToLower(q), "deleted_at": activeUsersOnly},
+			options.Find().SetCollation(emailCollation)})
+	}
+	if phone, err := normalizePhone(q); err == nil {
+		lookups = append(lookups, lookup{"phone",
+			bson.M{"phone": phone, "deleted_at": activeUsersOnly},
+			options.Find()})
+	}
+	// U+FFFF sorts after every other character, so this range holds exactly
+	// the names starting with q.
+	lookups = append(lookups, lookup{"name",
+		bson.M{"name": bson.M{"$gte": q, "$lt": q + "\uffff"}, "deleted_at": activeUsersOnly},
+		options.Find().SetCollation(emailCollation).SetSort(bson.D{{Key: "name", Value: 1}, {Key: "_id", Value: 1}})})
+
+	results := []*userSearchResult{}
+	byID := map[string]*userSearchResult{}
+	for _, l := range lookups {
+		cursor, err := database.Collection(collectionName).Find(r.Context(), l.filter, l.opts.SetLimit(maxUserSearchResults))
+		if err != nil {
+			fmt.Println("Error searching users:", err)
+			writeJSONError(w, http.StatusInternalServerError, "Failed to search users")
+			return
+		}
+		var users []User
+		err = cursor.All(r.Context(), &users)
+		if err != nil {
+			fmt.Println("Error decoding users:", err)
+			writeJSONError(w, http.StatusInternalServerError, "Failed to search users")
+			return
+		}
+		for _, user := range users {
+			if result, ok := byID[user.ID.Hex()]; ok {
+				result.Matched = append(result.Matched, l.field)
+				continue
+			}
+			if len(results) == maxUserSearchResults {
+				continue
+			}
+			result := &userSearchResult{User: user, Matched: []string{l.field}}
+			byID[user.ID.Hex()] = result
+			results = append(results, result)
+		}
+	}
+
+	writeJSON(w, http.StatusOK, results)
+}
+
+// distinctUserValues lists the values ?field= takes across active users,
+// sorted, for filter dropdowns.
+func distinctUserValues(w http.ResponseWriter, r *http.Request) {
+	field := r.URL.Query().Get("field")
+	path, ok := userDistinctFields[field]
+	if !ok {
+		allowed := make([]string, 0, len(userDistinctFields))
+		for name := range userDistinctFields {
+			allowed = append(allowed, name)
+		}
+		sort.Strings(allowed)
+		writeJSONError(w, http.StatusBadRequest, "field must be one of: "+strings.Join(allowed, ", "))
+		return
+	}
+
+	raw, err := database.Collection(collectionName).Distinct(r.Context(), path, bson.M{"deleted_at": activeUsersOnly})
+	if err != nil {
+		fmt.Println("Error listing distinct user values:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to list values")
+		return
+	}
+	values := make([]string, 0, len(raw))
+	for _, value := range raw {
+		if s, ok := value.(string); ok && s != "" {
+			values = append(values, s)
+		}
+	}
+	sort.Strings(values)
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{"field": field, "values": values})
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestUserMarshalJSONShape(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	user := User{
+		ID:                       primitive.NewObjectID(),
+		Name:                     "Jane Doe",
+		Email:                    "jane@example.com",
+		Age:                      31,
+		CreatedAt:                now,
+		UpdatedAt:                now,
+		Version:                  4,
+		StoreCredit:              12.5,
+		PasswordHash:             "$2a$10$secrethash",
+		Role:                     roleAdmin,
+		EmailVerified:            true,
+		VerificationSentAt:       &now,
+		FailedLogins:             3,
+		LockedUntil:              &now,
+		TOTPEnabled:              true,
+		TOTPSecret:               "TOTPSECRETVALUE",
+		TOTPRecoveryCodes:        []string{"recovery-code-1"},
+		TOTPPendingSecret:        "PENDINGSECRETVALUE",
+		TOTPPendingRecoveryCodes: []string{"pending-code-1"},
+		AuthProvider:             authProviderGoogle,
+		GoogleID:                 "google-subject-id",
+		DeletedAt:                &now,
+		Anonymized:               true,
+		AnonymizedAt:             &now,
+		Addresses:                []Address{{}},
+		Phone:                    "+49301234567",
+		Avatar:                   &Avatar{},
+		LastLoginAt:              &now,
+	}
+
+	body, err := json.Marshal(user)
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+
+	want := []string{
+		"id", "name", "email", "age", "phone", "role", "email_verified",
+		"totp_enabled", "auth_provider", "store_credit", "addresses", "avatar",
+		"anonymized", "created_at", "updated_at", "last_login_at",
+		"anonymized_at", "deleted_at",
+	}
+	var got []string
+	for key := range fields {
+		got = append(got, key)
+	}
+	sort.Strings(got)
+	sort.Strings(want)
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("keys = %v, want %v", got, want)
+	}
+
+	for _, secret := range []string{
+		user.PasswordHash, user.TOTPSecret, user.TOTPRecoveryCodes[0],
+		user.TOTPPendingSecret, user.TOTPPendingRecoveryCodes[0], user.GoogleID,
+	} {
+		if strings.Contains(string(body), secret) {
+			t.Errorf("body contains %q: %s", secret, body)
+		}
+	}
+	if id := string(fields["id"]); id != `"`+user.ID.Hex()+`"` {
+		t.Errorf("id = %s, want the hex ID", id)
+	}
+	if created := string(fields["created_at"]); created != `"2024-05-01T12:00:00Z"` {
+		t.Errorf("created_at = %s, want RFC 3339", created)
+	}
+}
+
+func TestUserMarshalJSONOmitsEmptyOptionalFields(t *testing.T) {
+	body, err := json.Marshal(User{ID: primitive.NewObjectID(), Name: "Jane", Email: "jane@example.com"})
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	for _, key := range []string{"password_hash", "failed_logins", "locked_until", "deleted_at", "last_login_at"} {
+		if _, ok := fields[key]; ok {
+			t.Errorf("%s present in %s", key, body)
+		}
+	}
+	if role := string(fields["role"]); role != `"`+roleCustomer+`"` {
+		t.Errorf("role = %s, want %q for a user without one", role, roleCustomer)
+	}
+}
+
+func TestUpdateUnknownUserIsNotFoundAndNotCreated(t *testing.T) {
+	h, db := testServer(t)
+	users := db.Collection(collectionName)
+	deletedAt := time.Now()
+	deleted := User{ID: primitive.NewObjectID(), Name: "Gone", Email: "gone@example.com", Version: 1, DeletedAt: &deletedAt}
+	if _, err := users.InsertOne(context.Background(), deleted); err != nil {
+		t.Fatalf("insert: %v", err)
+	}
+	missing := primitive.NewObjectID()
+
+	tests := []struct {
+		name, method, target string
+		caller               User
+	}{
+		{"admin on /users/{id}", http.MethodPatch, "/users/" + missing.Hex(), User{ID: primitive.NewObjectID(), Role: roleAdmin}},
+		{"owner on /users/{id}", http.MethodPatch, "/users/" + missing.Hex(), User{ID: missing}},
+		{"deprecated /updateUser", http.MethodPatch, "/updateUser?id=" + missing.Hex(), User{ID: missing}},
+		{"soft-deleted user", http.MethodPatch, "/users/" + deleted.ID.Hex(), User{ID: primitive.NewObjectID(), Role: roleAdmin}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := serveTest(h, tt.method, tt.target, testToken(t, tt.caller), `{"name":"New name","version":1}`)
+			if rec.Code != http.StatusNotFound {
+				t.Fatalf("status = %d, want 404: %s", rec.Code, rec.Body)
+			}
+			if apiErr := decodeAPIError(t, rec); apiErr.Code != codeNotFound {
+				t.Errorf("code = %q, want %q", apiErr.Code, codeNotFound)
+			}
+		})
+	}
+
+	if n, err := users.CountDocuments(context.Background(), bson.M{"_id": missing}); err != nil || n != 0 {
+		t.Errorf("found %d users with the unknown ID (err %v), want none upserted", n, err)
+	}
+	var after User
+	if err := users.FindOne(context.Background(), bson.M{"_id": deleted.ID}).Decode(&after); err != nil {
+		t.Fatalf("load deleted user: %v", err)
+	}
+	if after.Name != deleted.Name || after.Version != deleted.Version {
+		t.Errorf("deleted user changed to name %q, version %d", after.Name, after.Version)
+	}
+}
+
+func TestGetUserAnswersJSON(t *testing.T) {
+	h, db := testServer(t)
+	user := User{ID: primitive.NewObjectID(), Name: "Jane", Email: "jane@example.com", Version: 1}
+	if _, err := db.Collection(collectionName).InsertOne(context.Background(), user); err != nil {
+		t.Fatalf("insert: %v", err)
+	}
+	token := testToken(t, user)
+
+	for _, target := range []string{"/users/" + user.ID.Hex(), "/users/" + user.ID.Hex() + "?fields=name,email"} {
+		rec := serveTest(h, http.MethodGet, target, token, "")
+		if rec.Code != http.StatusOK {
+			t.Fatalf("GET %s = %d: %s", target, rec.Code, rec.Body)
+		}
+		if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+			t.Errorf("GET %s: Content-Type = %q, want application/json", target, ct)
+		}
+		var got map[string]interface{}
+		if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil || got["name"] != user.Name {
+			t.Errorf("GET %s: body %s (err %v), want the user", target, rec.Body, err)
+		}
+	}
+}
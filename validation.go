@@ -0,0 +1,86 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/mail"
+	"strings"
+)
+
+// Rules name the check a fieldError failed, so clients can react to it
+// without parsing the message.
+const (
+	ruleRequired  = "required"
+	ruleEmail     = "email"
+	ruleRange     = "range"
+	ruleMin       = "min"
+	ruleMax       = "max"
+	rulePositive  = "positive"
+	ruleFormat    = "format"
+	rulePassword  = "password"
+	ruleType      = "type"
+	ruleReference = "reference"
+	ruleImmutable = "immutable"
+	ruleUnknown   = "unknown"
+)
+
+// validator collects every violation of a payload instead of stopping at
+// the first one.
+type validator struct {
+	errs []fieldError
+}
+
+// check records a violation of rule on field unless ok, and returns ok.
+func (v *validator) check(ok bool, field, rule, message string) bool {
+	if !ok {
+		v.errs = append(v.errs, fieldError{Field: field, Rule: rule, Message: message})
+	}
+	return ok
+}
+
+func (v *validator) required(field, value string) bool {
+	return v.check(value != "", field, ruleRequired, field+" is required")
+}
+
+// email accepts a bare address such as "jane@example.com"; display names
+// and anything mail.ParseAddress would rewrite are refused.
+func (v *validator) email(field, value string) bool {
+	addr, err := mail.ParseAddress(value)
+	ok := err == nil && addr.Address == value && strings.Contains(value[strings.LastIndex(value, "@")+1:], ".")
+	return v.check(ok, field, ruleEmail, field+" must be a valid email address")
+}
+
+// phone returns value in E.164 form, or records why it is not a plausible
+// international number.
+func (v *validator) phone(field, value string) (string, bool) {
+	normalized, err := normalizePhone(value)
+	if err != nil {
+		return "", v.check(false, field, ruleFormat, err.Error())
+	}
+	return normalized, true
+}
+
+func (v *validator) intRange(field string, value, min, max int) bool {
+	return v.check(value >= min && value <= max, field, ruleRange, fmt.Sprintf("%s must be between %d and %d", field, min, max))
+}
+
+func (v *validator) positive(field string, value float64) bool {
+	return v.check(value > 0, field, rulePositive, field+" must be greater than 0")
+}
+
+func (v *validator) nonNegative(field string, value float64) bool {
+	return v.check(value >= 0, field, ruleMin, field+" must not be negative")
+}
+
+// fieldErrorsErr joins errs into one error for callers that report a single
+// message, or returns nil when there are none.
+func fieldErrorsErr(errs []fieldError) error {
+	if len(errs) == 0 {
+		return nil
+	}
+	messages := make([]string, len(errs))
+	for i, e := range errs {
+		messages[i] = e.Message
+	}
+	return errors.New(strings.Join(messages, "; "))
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+type categoryValuation struct {
+	CategoryID *primitive.ObjectID `json:"category_id" bson:"_id"`
+	Name       string              `json:"name" bson:"name"`
+	Value      json.Number         `json:"value" bson:"-"`
+	Items      int                 `json:"items" bson:"items"`
+	Units      int                 `json:"units" bson:"units"`
+	OutOfStock int                 `json:"out_of_stock" bson:"out_of_stock"`
+
+	RawValue primitive.Decimal128 `json:"-" bson:"value"`
+}
+
+func decimalRat(d primitive.Decimal128) (*big.Rat, error) {
+	coefficient, exp, err := d.BigInt()
+	if err != nil {
+		return nil, err
+	}
+	value := new(big.Rat).SetInt(coefficient)
+	for ; exp > 0; exp-- {
+		value.Mul(value, big.NewRat(10, 1))
+	}
+	for ; exp < 0; exp++ {
+		value.Quo(value, big.NewRat(10, 1))
+	}
+	return value, nil
+}
+
+// priceAsOf replaces price with the price the item had at asOf: the newest
+// change made by then, or failing that the old price of the first change
+// after it. Items never repriced keep their current price.
+func priceAsOf(asOf time.Time) []bson.D {
+	return []bson.D{
+		{{Key: "$lookup", Value: bson.M{
+			"from": priceHistoryCollectionName,
+			"let":  bson.M{"id": "$_id"},
+			"pipeline": bson.A{
+				bson.M{"$match": bson.M{"$expr": bson.M{"$and": bson.A{
+					bson.M{"$eq": bson.A{"$furniture_id", "$$id"}},
+					bson.M{"$lte": bson.A{"$changed_at", asOf}},
+				}}}},
+				bson.M{"$sort": bson.M{"changed_at": -1}},
+				bson.M{"$limit": 1},
+			},
+			"as": "before",
+		}}},
+		{{Key: "$lookup", Value: bson.M{
+			"from": priceHistoryCollectionName,
+			"let":  bson.M{"id": "$_id"},
+			"pipeline": bson.A{
+				bson.M{"$match": bson.M{"$expr": bson.M{"$and": bson.A{
+					bson.M{"$eq": bson.A{"$furniture_id", "$$id"}},
+					bson.M{"$gt": bson.A{"$changed_at", asOf}},
+				}}}},
+				bson.M{"$sort": bson.M{"changed_at": 1}},
+				bson.M{"$limit": 1},
+			},
+			"as": "after",
+		}}},
+		{{Key: "$set", Value: bson.M{"price": bson.M{"$ifNull": bson.A{
+			bson.M{"$arrayElemAt": bson.A{"$before.new_price", 0}},
+			bson.M{"$arrayElemAt": bson.A{"$after.old_price", 0}},
+			"$price",
+		}}}}},
+	}
+}
+
+// handleInventoryValue values the stock on hand per category. Sums are taken
+// in Decimal128 so thousands of prices add up without float drift. With
+// ?as_of= the prices are those of that moment, but the stock is today's.
+func handleInventoryValue(w http.ResponseWriter, r *http.Request) {
+	asOf, hasAsOf, err := timeParam(r, "as_of")
+	if err != nil {
+		writeQueryError(w, err, "Failed to value inventory")
+		return
+	}
+
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"deleted_at": bson.M{"$exists": false}}}},
+	}
+	if hasAsOf {
+		pipeline = append(pipeline, priceAsOf(asOf)...)
+	}
+	price := bson.M{"$toDecimal": "$price"}
+	variants := bson.M{"$ifNull": bson.A{"$variants", bson.A{}}}
+	pipeline = append(pipeline,
+		bson.D{{Key: "$project", Value: bson.M{
+			"category_id": 1,
+			"units": bson.M{"$add": bson.A{"$stock", bson.M{"$sum": bson.M{"$map": bson.M{
+				"input": variants, "as": "v", "in": "$$v.stock",
+			}}}}},
+			"value": bson.M{"$add": bson.A{
+				bson.M{"$multiply": bson.A{price, "$stock"}},
+				bson.M{"$sum": bson.M{"$map": bson.M{
+					"input": variants,
+					"as":    "v",
+					"in": bson.M{"$multiply": bson.A{
+						bson.M{"$add": bson.A{price, bson.M{"$toDecimal": "$$v.price_delta"}}},
+						"$$v.stock",
+					}},
+				}}},
+			}},
+		}}},
+		bson.D{{Key: "$group", Value: bson.M{
+			"_id":          "$category_id",
+			"value":        bson.M{"$sum": "$value"},
+			"items":        bson.M{"$sum": 1},
+			"units":        bson.M{"$sum": "$units"},
+			"out_of_stock": bson.M{"$sum": bson.M{"$cond": bson.A{bson.M{"$lte": bson.A{"$units", 0}}, 1, 0}}},
+		}}},
+		bson.D{{Key: "$lookup", Value: bson.M{
+			"from":         categoriesCollectionName,
+			"localField":   "_id",
+			"foreignField": "_id",
+			"as":           "category",
+		}}},
+		bson.D{{Key: "$set", Value: bson.M{
+			"name":  bson.M{"$ifNull": bson.A{bson.M{"$arrayElemAt": bson.A{"$category.name", 0}}, "Uncategorised"}},
+			"value": bson.M{"$toDecimal": "$value"},
+		}}},
+		bson.D{{Key: "$sort", Value: bson.M{"name": 1}}},
+	)
+
+	cursor, err := database.Collection(furnitureCollectionName).Aggregate(r.Context(), pipeline)
+	if err != nil {
+		fmt.Println("Error aggregating inventory value:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to value inventory")
+		return
+	}
+	defer cursor.Close(r.Context())
+
+	categories := []categoryValuation{}
+	if err := cursor.All(r.Context(), &categories); err != nil {
+		fmt.Println("Error decoding inventory value:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to value inventory")
+		return
+	}
+
+	total := new(big.Rat)
+	outOfStock := 0
+	for i := range categories {
+		value, err := decimalRat(categories[i].RawValue)
+		if err != nil {
+			fmt.Println("Error reading inventory value:", err)
+			writeJSONError(w, http.StatusInternalServerError, "Failed to value inventory")
+			return
+		}
+		categories[i].Value = json.Number(value.FloatString(2))
+		total.Add(total, value)
+		outOfStock += categories[i].OutOfStock
+	}
+
+	response := map[string]interface{}{
+		"total_value":  json.Number(total.FloatString(2)),
+		"out_of_stock": outOfStock,
+		"categories":   categories,
+	}
+	if hasAsOf {
+		response["as_of"] = asOf
+	}
+	writeJSON(w, http.StatusOK, response)
+}
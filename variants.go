@@ -0,0 +1,235 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Variant is a purchasable version of a furniture item, e.g. the oak chair.
+// Its price is the item price plus PriceDelta and it keeps its own stock.
+type Variant struct {
+	ID         string            `json:"id" bson:"id"`
+	Attributes map[string]string `json:"attributes" bson:"attributes"`
+	PriceDelta float64           `json:"price_delta" bson:"price_delta"`
+	Stock      int               `json:"stock" bson:"stock"`
+}
+
+// openOrderStatuses are the order states in which line items still need the
+// variant they reference.
+var openOrderStatuses = []string{orderStatusPending, orderStatusConfirmed, orderStatusShipped}
+
+func (f Furniture) variant(id string) *Variant {
+	for i := range f.Variants {
+		if f.Variants[i].ID == id {
+			return &f.Variants[i]
+		}
+	}
+	return nil
+}
+
+// stockOf returns the stock of the given variant, or of the item itself when
+// variantID is empty.
+func (f Furniture) stockOf(variantID string) int {
+	if variantID == "" {
+		return f.Stock
+	}
+	if v := f.variant(variantID); v != nil {
+		return v.Stock
+	}
+	return 0
+}
+
+// inStock reports whether the item itself or any of its variants has stock.
+func (f Furniture) inStock() bool {
+	if f.Stock > 0 {
+		return true
+	}
+	for _, v := range f.Variants {
+		if v.Stock > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+type variantInput struct {
+	Attributes map[string]string `json:"attributes"`
+	PriceDelta float64           `json:"price_delta"`
+	Stock      int               `json:"stock"`
+}
+
+func (in variantInput) validate(basePrice float64) error {
+	if len(in.Attributes) == 0 {
+		return errors.New("attributes must name at least one property")
+	}
+	if basePrice+in.PriceDelta <= 0 {
+		return errors.New("price_delta must leave a positive price")
+	}
+	if in.Stock < 0 {
+		return errors.New("stock must not be negative")
+	}
+	return nil
+}
+
+func handleFurnitureVariants(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPost:
+		addVariant(w, r)
+	case http.MethodPut:
+		updateVariant(w, r)
+	case http.MethodDelete:
+		removeVariant(w, r)
+	default:
+		writeJSONError(w, http.StatusMethodNotAllowed, "Method not allowed")
+	}
+}
+
+// loadVariantTarget reads the furniture ID and variant payload shared by add
+// and update. It writes the error response itself and returns ok=false.
+func loadVariantTarget(w http.ResponseWriter, r *http.Request) (item Furniture, input variantInput, ok bool) {
+	id, err := parseFurnitureID(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidID, err.Error())
+		return item, input, false
+	}
+	if !decodeJSON(w, r, &input) {
+		return item, input, false
+	}
+
+	err = database.Collection(furnitureCollectionName).FindOne(r.Context(), activeFurnitureByID(id)).Decode(&item)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		writeJSONError(w, http.StatusNotFound, "Furniture not found")
+		return item, input, false
+	}
+	if err != nil {
+		fmt.Println("Error looking up furniture:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to load furniture")
+		return item, input, false
+	}
+
+	if err := input.validate(item.Price); err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return item, input, false
+	}
+	return item, input, true
+}
+
+func addVariant(w http.ResponseWriter, r *http.Request) {
+	item, input, ok := loadVariantTarget(w, r)
+	if !ok {
+		return
+	}
+
+	variant := Variant{
+		ID:         primitive.NewObjectID().Hex(),
+		Attributes: input.Attributes,
+		PriceDelta: input.PriceDelta,
+		Stock:      input.Stock,
+	}
+
+	result, err := database.Collection(furnitureCollectionName).UpdateOne(
+		r.Context(),
+		activeFurnitureByID(item.ID),
+		bson.M{"$push": bson.M{"variants": variant}, "$set": bson.M{"updated_at": time.Now()}},
+	)
+	if err != nil {
+		fmt.Println("Error adding variant:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to add variant")
+		return
+	}
+	if result.MatchedCount == 0 {
+		writeJSONError(w, http.StatusNotFound, "Furniture not found")
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, variant)
+}
+
+func updateVariant(w http.ResponseWriter, r *http.Request) {
+	variantID := r.URL.Query().Get("variant_id")
+	item, input, ok := loadVariantTarget(w, r)
+	if !ok {
+		return
+	}
+
+	filter := activeFurnitureByID(item.ID)
+	filter["variants.id"] = variantID
+
+	var updated Furniture
+	err := database.Collection(furnitureCollectionName).FindOneAndUpdate(
+		r.Context(),
+		filter,
+		bson.M{"$set": bson.M{
+			"variants.$.attributes":  input.Attributes,
+			"variants.$.price_delta": input.PriceDelta,
+			"variants.$.stock":       input.Stock,
+			"updated_at":             time.Now(),
+		}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&updated)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		writeJSONError(w, http.StatusNotFound, "Variant not found")
+		return
+	}
+	if err != nil {
+		fmt.Println("Error updating variant:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to update variant")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, updated.variant(variantID))
+}
+
+// removeVariant refuses to drop a variant that an open order still points at.
+func removeVariant(w http.ResponseWriter, r *http.Request) {
+	id, err := parseFurnitureID(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidID, err.Error())
+		return
+	}
+	variantID := r.URL.Query().Get("variant_id")
+	if variantID == "" {
+		writeJSONError(w, http.StatusBadRequest, "variant_id is required")
+		return
+	}
+
+	openOrders, err := database.Collection(ordersCollectionName).CountDocuments(r.Context(), bson.M{
+		"status": bson.M{"$in": openOrderStatuses},
+		"items":  bson.M{"$elemMatch": bson.M{"furniture_id": id, "variant_id": variantID}},
+	})
+	if err != nil {
+		fmt.Println("Error checking orders for variant:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to remove variant")
+		return
+	}
+	if openOrders > 0 {
+		writeJSONError(w, http.StatusConflict, fmt.Sprintf("Variant is referenced by %d open orders", openOrders))
+		return
+	}
+
+	filter := activeFurnitureByID(id)
+	filter["variants.id"] = variantID
+	result, err := database.Collection(furnitureCollectionName).UpdateOne(
+		r.Context(),
+		filter,
+		bson.M{"$pull": bson.M{"variants": bson.M{"id": variantID}}, "$set": bson.M{"updated_at": time.Now()}},
+	)
+	if err != nil {
+		fmt.Println("Error removing variant:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to remove variant")
+		return
+	}
+	if result.MatchedCount == 0 {
+		writeJSONError(w, http.StatusNotFound, "Variant not found")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
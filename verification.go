@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	htmltemplate "html/template"
+	"net/http"
+	"strconv"
+	texttemplate "text/template"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	verificationTTL = 24 * time.Hour
+	// verificationResendInterval is how long an account waits between
+	// verification emails.
+	verificationResendInterval = 5 * time.Minute
+)
+
+type emailVerification struct {
+	ID        primitive.ObjectID `bson:"_id,omitempty"`
+	UserID    primitive.ObjectID `bson:"user_id"`
+	TokenHash string             `bson:"token_hash"`
+	ExpiresAt time.Time          `bson:"expires_at"`
+	CreatedAt time.Time          `bson:"created_at"`
+}
+
+func createVerificationIndexes() error {
+	_, err := database.Collection(emailVerificationsCollectionName).Indexes().CreateMany(context.TODO(), []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "token_hash", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+		{Keys: bson.D{{Key: "user_id", Value: 1}}},
+		{
+			Keys:    bson.D{{Key: "expires_at", Value: 1}},
+			Options: options.Index().SetExpireAfterSeconds(0),
+		},
+	})
+	return err
+}
+
+// needsVerification reports whether u is an account whose email has not
+// been confirmed yet. Users created before registration existed are exempt.
+func (u User) needsVerification() bool {
+	return u.PasswordHash != "" && !u.EmailVerified
+}
+
+var verificationText = texttemplate.Must(texttemplate.New("text").Parse(`Hello {{.Name}},
+
+please confirm your email address for the Online Furniture Shop by following this link within 24 hours:
+
+{{.Link}}
+
+Online Furniture Shop
+`))
+
+var verificationHTML = htmltemplate.Must(htmltemplate.New("html").Parse(`<!DOCTYPE html>
+<html>
+<body>
+<p>Hello {{.Name}},</p>
+<p>please confirm your email address for the Online Furniture Shop by following this link within 24 hours:</p>
+<p><a href="{{.Link}}">Confirm your email address</a></p>
+<p>Online Furniture Shop</p>
+</body>
+</html>
+`))
+
+func verificationEmail(user User, token string) (emailMessage, error) {
+	data := linkEmailData{Name: user.Name, Link: publicBaseURL + "/verify?token=" + token}
+	var text, html bytes.Buffer
+	if err := verificationText.Execute(&text, data); err != nil {
+		return emailMessage{}, err
+	}
+	if err := verificationHTML.Execute(&html, data); err != nil {
+		return emailMessage{}, err
+	}
+	return emailMessage{
+		To:      user.Email,
+		Subject: "Confirm your email address",
+		Text:    text.String(),
+		HTML:    html.String(),
+	}, nil
+}
+
+// sendVerification stores a fresh verification token for user and mails
+// it. It runs outside the request, so it only takes the request ID from ctx
+// and is not cut short by a shutdown.
+func sendVerification(ctx context.Context, user User) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), time.Minute)
+	defer cancel()
+
+	token, err := newSecretToken()
+	if err != nil {
+		fmt.Println("Error generating verification token:", err)
+		return
+	}
+	now := time.Now()
+	_, err = database.Collection(emailVerificationsCollectionName).InsertOne(ctx, emailVerification{
+		UserID:    user.ID,
+		TokenHash: hashToken(token),
+		ExpiresAt: now.Add(verificationTTL),
+		CreatedAt: now,
+	})
+	if err != nil {
+		fmt.Println("Error storing verification token:", err)
+		return
+	}
+
+	msg, err := verificationEmail(user, token)
+	if err != nil {
+		fmt.Println("Error rendering verification email:", err)
+		return
+	}
+	if err := enqueueEmail(ctx, msg); err != nil {
+		fmt.Println("Error queueing verification email:", err)
+	}
+}
+
+// handleVerifyEmail confirms the email of the account a verification link
+// was sent to. Every outstanding token of that account stops working.
+func handleVerifyEmail(w http.ResponseWriter, r *http.Request) {
+	token := r.URL.Query().Get("token")
+	if token == "" {
+		writeJSONError(w, http.StatusBadRequest, "token is required")
+		return
+	}
+
+	verifications := database.Collection(emailVerificationsCollectionName)
+	var verification emailVerification
+	err := verifications.FindOneAndDelete(r.Context(), bson.M{
+		"token_hash": hashToken(token),
+		"expires_at": bson.M{"$gt": time.Now()},
+	}).Decode(&verification)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		writeJSONError(w, http.StatusBadRequest, "Verification link is invalid or has expired")
+		return
+	}
+	if err != nil {
+		fmt.Println("Error redeeming verification token:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to verify email")
+		return
+	}
+
+	result, err := database.Collection(collectionName).UpdateOne(r.Context(),
+		activeUserByID(verification.UserID),
+		bson.M{"$set": bson.M{"email_verified": true, "updated_at": time.Now()}},
+	)
+	if err != nil {
+		fmt.Println("Error marking email verified:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to verify email")
+		return
+	}
+	if result.MatchedCount == 0 {
+		writeJSONError(w, http.StatusNotFound, "User not found")
+		return
+	}
+	if _, err := verifications.DeleteMany(r.Context(), bson.M{"user_id": verification.UserID}); err != nil {
+		fmt.Println("Error removing verification tokens:", err)
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"message": "Email address verified"})
+}
+
+// resendVerification mails the caller a new verification link, at most once
+// per verificationResendInterval. The interval is enforced by the same
+// update that records the send, so concurrent requests cannot both pass.
+func resendVerification(w http.ResponseWriter, r *http.Request) {
+	userID, _ := authenticatedUserID(r.Context())
+
+	now := time.Now()
+	var user User
+	err := database.Collection(collectionName).FindOneAndUpdate(r.Context(), bson.M{
+		"_id":            userID,
+		"deleted_at":     nil,
+		"password_hash":  bson.M{"$exists": true},
+		"email_verified": bson.M{"$ne": true},
+		"$or": bson.A{
+			bson.M{"verification_sent_at": bson.M{"$exists": false}},
+			bson.M{"verification_sent_at": bson.M{"$lte": now.Add(-verificationResendInterval)}},
+		},
+	}, bson.M{"$set": bson.M{"verification_sent_at": now}}).Decode(&user)
+	if err != nil && !errors.Is(err, mongo.ErrNoDocuments) {
+		fmt.Println("Error recording verification resend:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to resend verification email")
+		return
+	}
+	if err == nil {
+		goBackgroundFor(r.Context(), func(ctx context.Context) { sendVerification(ctx, user) })
+		writeJSON(w, http.StatusAccepted, map[string]string{"message": "Verification email sent"})
+		return
+	}
+
+	// Nothing matched: find out whether the account is already verified or
+	// asked too recently.
+	err = database.Collection(collectionName).FindOne(r.Context(), activeUserByID(userID)).Decode(&user)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		writeJSONError(w, http.StatusNotFound, "User not found")
+		return
+	}
+	if err != nil {
+		fmt.Println("Error loading user:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to resend verification email")
+		return
+	}
+	if !user.needsVerification() {
+		writeJSONError(w, http.StatusConflict, "Email address is already verified")
+		return
+	}
+	wait := verificationResendInterval
+	if user.VerificationSentAt != nil {
+		wait = time.Until(user.VerificationSentAt.Add(verificationResendInterval))
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+	writeJSONError(w, http.StatusTooManyRequests, "A verification email was sent recently, try again later")
+}
@@ -0,0 +1,428 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	webhookEventOrderCreated       = "order.created"
+	webhookEventOrderStatusChanged = "order.status_changed"
+
+	deliveryStatusPending   = "pending"
+	deliveryStatusSucceeded = "succeeded"
+	deliveryStatusFailed    = "failed"
+
+	maxWebhookAttempts   = 5
+	webhookInitialDelay  = 2 * time.Second
+	webhookClientTimeout = 10 * time.Second
+	webhookSignature     = "X-Shop-Signature"
+)
+
+var webhookEvents = []string{webhookEventOrderCreated, webhookEventOrderStatusChanged}
+
+var webhookClient = &http.Client{Timeout: webhookClientTimeout}
+
+// Webhook is a subscriber URL. Every delivery body is signed with Secret as
+// hex HMAC-SHA256 in the X-Shop-Signature header ("sha256=<hex>").
+type Webhook struct {
+	ID        primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+	URL       string             `json:"url" bson:"url"`
+	Secret    string             `json:"secret,omitempty" bson:"secret"`
+	Events    []string           `json:"events" bson:"events"`
+	Enabled   bool               `json:"enabled" bson:"enabled"`
+	CreatedAt time.Time          `json:"created_at" bson:"created_at"`
+}
+
+type WebhookDelivery struct {
+	ID           primitive.ObjectID `json:"id" bson:"_id"`
+	WebhookID    primitive.ObjectID `json:"webhook_id" bson:"webhook_id"`
+	Event        string             `json:"event" bson:"event"`
+	Payload      string             `json:"payload" bson:"payload"`
+	Status       string             `json:"status" bson:"status"`
+	Attempts     int                `json:"attempts" bson:"attempts"`
+	ResponseCode int                `json:"response_code,omitempty" bson:"response_code,omitempty"`
+	LastError    string             `json:"last_error,omitempty" bson:"last_error,omitempty"`
+	RequestID    string             `json:"request_id,omitempty" bson:"request_id,omitempty"`
+	CreatedAt    time.Time          `json:"created_at" bson:"created_at"`
+	UpdatedAt    time.Time          `json:"updated_at" bson:"updated_at"`
+}
+
+type webhookPayload struct {
+	Event      string    `json:"event"`
+	OccurredAt time.Time `json:"occurred_at"`
+	Order      Order     `json:"order"`
+}
+
+func createWebhookIndexes() error {
+	_, err := database.Collection(webhookDeliveriesCollectionName).Indexes().CreateMany(context.TODO(), []mongo.IndexModel{
+		{Keys: bson.D{{Key: "created_at", Value: -1}}},
+		{Keys: bson.D{{Key: "webhook_id", Value: 1}, {Key: "created_at", Value: -1}}},
+	})
+	return err
+}
+
+func (h *Webhook) validate() error {
+	h.URL = strings.TrimSpace(h.URL)
+	target, err := url.Parse(h.URL)
+	if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+		return errors.New("url must be an absolute http or https URL")
+	}
+	if len(h.Events) == 0 {
+		return errors.New("events must name at least one event")
+	}
+	for _, event := range h.Events {
+		known := false
+		for _, name := range webhookEvents {
+			known = known || event == name
+		}
+		if !known {
+			return fmt.Errorf("unknown event %q, supported events: %s", event, strings.Join(webhookEvents, ", "))
+		}
+	}
+	return nil
+}
+
+func sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// publishOrderEvent notifies every enabled webhook subscribed to event. It
+// returns at once; lookups and deliveries run in the background and carry
+// the request ID from ctx.
+func publishOrderEvent(ctx context.Context, event string, order Order) {
+	goBackgroundFor(ctx, func(ctx context.Context) {
+		requestID := requestIDFrom(ctx)
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 10*time.Second)
+		defer cancel()
+
+		cursor, err := database.Collection(webhooksCollectionName).Find(ctx, bson.M{"enabled": true, "events": event})
+		if err != nil {
+			fmt.Println("Error loading webhooks:", err)
+			return
+		}
+		var hooks []Webhook
+		if err := cursor.All(ctx, &hooks); err != nil {
+			fmt.Println("Error decoding webhooks:", err)
+			return
+		}
+		if len(hooks) == 0 {
+			return
+		}
+
+		payload, err := json.Marshal(webhookPayload{Event: event, OccurredAt: time.Now(), Order: order})
+		if err != nil {
+			fmt.Println("Error encoding webhook payload:", err)
+			return
+		}
+		for _, hook := range hooks {
+			now := time.Now()
+			delivery := WebhookDelivery{
+				ID:        primitive.NewObjectID(),
+				WebhookID: hook.ID,
+				Event:     event,
+				Payload:   string(payload),
+				Status:    deliveryStatusPending,
+				RequestID: requestID,
+				CreatedAt: now,
+				UpdatedAt: now,
+			}
+			if _, err := database.Collection(webhookDeliveriesCollectionName).InsertOne(ctx, delivery); err != nil {
+				fmt.Println("Error recording webhook delivery:", err)
+				continue
+			}
+			goBackgroundFor(ctx, func(ctx context.Context) { deliverWebhook(ctx, hook, delivery) })
+		}
+	})
+}
+
+// notifyStatusChange publishes an order that has just moved to a new status.
+func notifyStatusChange(ctx context.Context, order Order) {
+	publishOrderEvent(ctx, webhookEventOrderStatusChanged, order)
+}
+
+// deliverWebhook posts the delivery until the receiver answers 2xx, waiting
+// twice as long after each failure, and gives up after maxWebhookAttempts.
+// A shutdown, during a POST or the wait after one, leaves the delivery pending.
+func deliverWebhook(ctx context.Context, hook Webhook, delivery WebhookDelivery) {
+	delay := webhookInitialDelay
+	for attempt := 1; attempt <= maxWebhookAttempts; attempt++ {
+		code, err := postWebhook(ctx, hook, delivery)
+		if err != nil && ctx.Err() != nil {
+			return
+		}
+
+		set := bson.M{"attempts": attempt, "updated_at": time.Now(), "response_code": code}
+		if err == nil {
+			set["status"] = deliveryStatusSucceeded
+		} else {
+			set["last_error"] = err.Error()
+			if attempt == maxWebhookAttempts {
+				set["status"] = deliveryStatusFailed
+			}
+		}
+		updateCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		_, updateErr := database.Collection(webhookDeliveriesCollectionName).UpdateByID(updateCtx, delivery.ID, bson.M{"$set": set})
+		cancel()
+		if updateErr != nil {
+			fmt.Println("Error updating webhook delivery:", updateErr)
+		}
+
+		if err == nil {
+			return
+		}
+		if attempt < maxWebhookAttempts {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(delay):
+			}
+			delay *= 2
+		}
+	}
+}
+
+func postWebhook(ctx context.Context, hook Webhook, delivery WebhookDelivery) (code int, err error) {
+	ctx, s := startSpan(ctx, "POST webhook", spanKindClient)
+	s.setAttr("http.request.method", http.MethodPost)
+	s.setAttr("webhook.event", delivery.Event)
+	s.setAttr("webhook.delivery_id", delivery.ID.Hex())
+	defer func() {
+		s.setAttr("http.response.status_code", code)
+		if err != nil {
+			s.fail(err.Error())
+		}
+		s.end()
+	}()
+
+	body := []byte(delivery.Payload)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, hook.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	injectTraceParent(ctx, req)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Shop-Event", delivery.Event)
+	req.Header.Set("X-Shop-Delivery", delivery.ID.Hex())
+	req.Header.Set(webhookSignature, sign(hook.Secret, body))
+	if delivery.RequestID != "" {
+		req.Header.Set(requestIDHeader, delivery.RequestID)
+	}
+
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("receiver answered %d", resp.StatusCode)
+	}
+	return resp.StatusCode, nil
+}
+
+func handleWebhooks(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		listWebhooks(w, r)
+	case http.MethodPost:
+		createWebhook(w, r)
+	case http.MethodPut:
+		updateWebhook(w, r)
+	case http.MethodDelete:
+		deleteWebhook(w, r)
+	default:
+		writeJSONError(w, http.StatusMethodNotAllowed, "Method not allowed")
+	}
+}
+
+// listWebhooks never returns secrets; they are only shown once, on creation.
+func listWebhooks(w http.ResponseWriter, r *http.Request) {
+	opts := options.Find().SetSort(bson.D{{Key: "created_at", Value: -1}}).SetProjection(bson.M{"secret": 0})
+	cursor, err := database.Collection(webhooksCollectionName).Find(r.Context(), bson.M{}, opts)
+	if err != nil {
+		fmt.Println("Error querying webhooks:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to load webhooks")
+		return
+	}
+	defer cursor.Close(r.Context())
+
+	hooks := []Webhook{}
+	if err := cursor.All(r.Context(), &hooks); err != nil {
+		fmt.Println("Error decoding webhooks:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to load webhooks")
+		return
+	}
+	writeJSON(w, http.StatusOK, hooks)
+}
+
+// createWebhook generates a secret when the request does not bring one.
+func createWebhook(w http.ResponseWriter, r *http.Request) {
+	var hook Webhook
+	if !decodeJSON(w, r, &hook) {
+		return
+	}
+	if err := hook.validate(); err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if hook.Secret == "" {
+		var secret [32]byte
+		if _, err := rand.Read(secret[:]); err != nil {
+			fmt.Println("Error generating webhook secret:", err)
+			writeJSONError(w, http.StatusInternalServerError, "Failed to create webhook")
+			return
+		}
+		hook.Secret = hex.EncodeToString(secret[:])
+	}
+
+	hook.ID = primitive.NilObjectID
+	hook.CreatedAt = time.Now()
+	result, err := database.Collection(webhooksCollectionName).InsertOne(r.Context(), hook)
+	if err != nil {
+		fmt.Println("Error inserting webhook:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to create webhook")
+		return
+	}
+	hook.ID = result.InsertedID.(primitive.ObjectID)
+	writeJSON(w, http.StatusCreated, hook)
+}
+
+// updateWebhook keeps the stored secret unless a new one is sent.
+func updateWebhook(w http.ResponseWriter, r *http.Request) {
+	id, ok := parseObjectID(w, r)
+	if !ok {
+		return
+	}
+
+	var hook Webhook
+	if !decodeJSON(w, r, &hook) {
+		return
+	}
+	if err := hook.validate(); err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	set := bson.M{"url": hook.URL, "events": hook.Events, "enabled": hook.Enabled}
+	if hook.Secret != "" {
+		set["secret"] = hook.Secret
+	}
+	var updated Webhook
+	err := database.Collection(webhooksCollectionName).FindOneAndUpdate(
+		r.Context(),
+		bson.M{"_id": id},
+		bson.M{"$set": set},
+		options.FindOneAndUpdate().SetReturnDocument(options.After).SetProjection(bson.M{"secret": 0}),
+	).Decode(&updated)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		writeJSONError(w, http.StatusNotFound, "Webhook not found")
+		return
+	}
+	if err != nil {
+		fmt.Println("Error updating webhook:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to update webhook")
+		return
+	}
+	writeJSON(w, http.StatusOK, updated)
+}
+
+func deleteWebhook(w http.ResponseWriter, r *http.Request) {
+	id, ok := parseObjectID(w, r)
+	if !ok {
+		return
+	}
+
+	result, err := database.Collection(webhooksCollectionName).DeleteOne(r.Context(), bson.M{"_id": id})
+	if err != nil {
+		fmt.Println("Error deleting webhook:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to delete webhook")
+		return
+	}
+	if result.DeletedCount == 0 {
+		writeJSONError(w, http.StatusNotFound, "Webhook not found")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// listWebhookDeliveries pages through deliveries, newest first, optionally
+// narrowed with ?status= and ?webhook_id=.
+func listWebhookDeliveries(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	filter := bson.M{}
+	switch status := query.Get("status"); status {
+	case "":
+	case deliveryStatusPending, deliveryStatusSucceeded, deliveryStatusFailed:
+		filter["status"] = status
+	default:
+		writeJSONError(w, http.StatusBadRequest, "status must be one of pending, succeeded, failed")
+		return
+	}
+	if raw := query.Get("webhook_id"); raw != "" {
+		id, err := primitive.ObjectIDFromHex(raw)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, codeInvalidID, "webhook_id must be a valid ID")
+			return
+		}
+		filter["webhook_id"] = id
+	}
+	page, err := parsePagination(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	deliveriesCollection := database.Collection(webhookDeliveriesCollectionName)
+	total, err := deliveriesCollection.CountDocuments(r.Context(), filter)
+	if err != nil {
+		fmt.Println("Error counting webhook deliveries:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to load webhook deliveries")
+		return
+	}
+
+	opts := options.Find().
+		SetSort(bson.D{{Key: "created_at", Value: -1}, {Key: "_id", Value: -1}}).
+		SetSkip(page.skip()).
+		SetLimit(int64(page.Limit))
+	cursor, err := deliveriesCollection.Find(r.Context(), filter, opts)
+	if err != nil {
+		fmt.Println("Error querying webhook deliveries:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to load webhook deliveries")
+		return
+	}
+	defer cursor.Close(r.Context())
+
+	deliveries := []WebhookDelivery{}
+	if err := cursor.All(r.Context(), &deliveries); err != nil {
+		fmt.Println("Error decoding webhook deliveries:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to load webhook deliveries")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, pageResponse{
+		Items:      deliveries,
+		Total:      total,
+		Page:       page.Page,
+		TotalPages: page.totalPages(total),
+	})
+}
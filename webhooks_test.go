@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// A shutdown cancels a POST that is still waiting for the receiver, rather
+// than waiting out webhookClientTimeout.
+func TestPostWebhookStopsWhenContextIsCancelled(t *testing.T) {
+	release := make(chan struct{})
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer receiver.Close()
+	defer close(release)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	hook := Webhook{URL: receiver.URL, Secret: "secret"}
+	delivery := WebhookDelivery{ID: primitive.NewObjectID(), Event: webhookEventOrderCreated, Payload: `{}`}
+
+	start := time.Now()
+	_, err := postWebhook(ctx, hook, delivery)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("postWebhook = %v, want %v", err, context.Canceled)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("postWebhook took %s after the cancel, want it to stop right away", elapsed)
+	}
+}
+
+func TestDeliveryCutShortByShutdownStaysPending(t *testing.T) {
+	_, db := testServer(t)
+	release := make(chan struct{})
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer receiver.Close()
+	defer close(release)
+
+	delivery := WebhookDelivery{ID: primitive.NewObjectID(), Event: webhookEventOrderCreated, Payload: `{}`, Status: deliveryStatusPending}
+	deliveries := db.Collection(webhookDeliveriesCollectionName)
+	if _, err := deliveries.InsertOne(context.Background(), delivery); err != nil {
+		t.Fatalf("insert delivery: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	deliverWebhook(ctx, Webhook{URL: receiver.URL, Secret: "secret"}, delivery)
+
+	var after WebhookDelivery
+	if err := deliveries.FindOne(context.Background(), bson.M{"_id": delivery.ID}).Decode(&after); err != nil {
+		t.Fatalf("load delivery: %v", err)
+	}
+	if after.Status != deliveryStatusPending || after.Attempts != 0 {
+		t.Errorf("delivery is %s after %d attempts, want it still pending", after.Status, after.Attempts)
+	}
+}
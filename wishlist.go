@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// wishlistEntry is one saved item; (user_id, furniture_id) is unique.
+type wishlistEntry struct {
+	UserID      primitive.ObjectID `bson:"user_id"`
+	FurnitureID int                `bson:"furniture_id"`
+	AddedAt     time.Time          `bson:"added_at"`
+}
+
+type wishlistItem struct {
+	FurnitureID int       `json:"furniture_id" bson:"furniture_id"`
+	AddedAt     time.Time `json:"added_at" bson:"added_at"`
+	SKU         string    `json:"sku" bson:"sku"`
+	Name        string    `json:"name" bson:"name"`
+	Price       float64   `json:"price" bson:"price"`
+	InStock     bool      `json:"in_stock" bson:"in_stock"`
+}
+
+func createWishlistIndexes() error {
+	_, err := database.Collection(wishlistsCollectionName).Indexes().CreateOne(context.TODO(), mongo.IndexModel{
+		Keys:    bson.D{{Key: "user_id", Value: 1}, {Key: "furniture_id", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	return err
+}
+
+// handleWishlist serves the caller's own wishlist; the routes sit behind
+// requireAuth.
+func handleWishlist(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		getWishlist(w, r)
+	case http.MethodPost:
+		addToWishlist(w, r)
+	case http.MethodDelete:
+		removeFromWishlist(w, r)
+	default:
+		writeJSONError(w, http.StatusMethodNotAllowed, "Method not allowed")
+	}
+}
+
+// getWishlist lists the saved items, newest first, with their current
+// details. Items deleted from the catalogue since are left out.
+func getWishlist(w http.ResponseWriter, r *http.Request) {
+	userID, _ := authenticatedUserID(r.Context())
+
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"user_id": userID}}},
+		{{Key: "$sort", Value: bson.D{{Key: "added_at", Value: -1}, {Key: "furniture_id", Value: 1}}}},
+		{{Key: "$lookup", Value: bson.M{
+			"from":         furnitureCollectionName,
+			"localField":   "furniture_id",
+			"foreignField": "_id",
+			"as":           "furniture",
+		}}},
+		{{Key: "$unwind", Value: "$furniture"}},
+		{{Key: "$match", Value: bson.M{"furniture.deleted_at": bson.M{"$exists": false}}}},
+		{{Key: "$project", Value: bson.M{
+			"_id":          0,
+			"furniture_id": 1,
+			"added_at":     1,
+			"sku":          "$furniture.sku",
+			"name":         "$furniture.name",
+			"price":        "$furniture.price",
+			"in_stock": bson.M{"$or": bson.A{
+				bson.M{"$gt": bson.A{"$furniture.stock", 0}},
+				bson.M{"$gt": bson.A{bson.M{"$max": bson.M{"$ifNull": bson.A{"$furniture.variants.stock", bson.A{}}}}, 0}},
+			}},
+		}}},
+	}
+	cursor, err := database.Collection(wishlistsCollectionName).Aggregate(r.Context(), pipeline)
+	if err != nil {
+		fmt.Println("Error aggregating wishlist:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to load wishlist")
+		return
+	}
+	defer cursor.Close(r.Context())
+
+	items := []wishlistItem{}
+	if err := cursor.All(r.Context(), &items); err != nil {
+		fmt.Println("Error decoding wishlist:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to load wishlist")
+		return
+	}
+	writeJSON(w, http.StatusOK, items)
+}
+
+// addToWishlist saves an item. Saving it again keeps the original added_at.
+func addToWishlist(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		FurnitureID int `json:"furniture_id"`
+	}
+	if !decodeJSON(w, r, &body) {
+		return
+	}
+	userID, _ := authenticatedUserID(r.Context())
+
+	err := database.Collection(furnitureCollectionName).FindOne(r.Context(), activeFurnitureByID(body.FurnitureID)).Err()
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		writeJSONError(w, http.StatusNotFound, "Furniture not found")
+		return
+	}
+	if err != nil {
+		fmt.Println("Error looking up furniture:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to update wishlist")
+		return
+	}
+
+	key := bson.M{"user_id": userID, "furniture_id": body.FurnitureID}
+	_, err = database.Collection(wishlistsCollectionName).UpdateOne(r.Context(), key,
+		bson.M{"$setOnInsert": wishlistEntry{UserID: userID, FurnitureID: body.FurnitureID, AddedAt: time.Now()}},
+		options.Update().SetUpsert(true),
+	)
+	// Two concurrent first saves race on the unique index; either way the
+	// item ends up on the list once.
+	if err != nil && !mongo.IsDuplicateKeyError(err) {
+		fmt.Println("Error updating wishlist:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to update wishlist")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// removeFromWishlist is idempotent: removing an item that is not saved is
+// not an error.
+func removeFromWishlist(w http.ResponseWriter, r *http.Request) {
+	userID, _ := authenticatedUserID(r.Context())
+	furnitureID, err := strconv.Atoi(r.URL.Query().Get("furniture_id"))
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "furniture_id must be an integer")
+		return
+	}
+
+	result, err := database.Collection(wishlistsCollectionName).DeleteOne(r.Context(), bson.M{"user_id": userID, "furniture_id": furnitureID})
+	if err != nil {
+		fmt.Println("Error updating wishlist:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to update wishlist")
+		return
+	}
+	if result.DeletedCount == 0 {
+		writeJSONError(w, http.StatusNotFound, "Furniture is not on the wishlist")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}